@@ -0,0 +1,301 @@
+package bloblang
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/redpanda-data/benthos/v4/public/bloblang"
+	py "github.com/voutilad/gogopython"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+)
+
+// shutdownTimeout bounds how long Stop waits on expressions still running.
+const shutdownTimeout = 10 * time.Second
+
+// maxExpressions bounds how many compiled expressions each evaluator keeps,
+// as mappings may build them dynamically.
+const maxExpressions = 256
+
+// evaluators holds the evaluator for each Python executable and runtime used
+// by mappings. Bloblang plugins have no lifecycle, so they're started on
+// first use and stopped by Stop.
+var (
+	evaluatorsMtx sync.Mutex
+	evaluators    = make(map[evaluatorKey]*evaluator)
+)
+
+type evaluatorKey struct {
+	exe         string
+	runtimeName string
+}
+
+// evaluator evaluates expressions in the main interpreter of a Python
+// executable.
+type evaluator struct {
+	exe         string
+	runtimeName string // Name of the runtime shared with components, if any.
+
+	startMtx sync.Mutex
+	runtime  python.Runtime // Nil until started. Protected by startMtx.
+
+	// Python state, only used with our interpreter's ticket.
+	compile     py.PyObjectPtr
+	expressions map[string]*list.Element
+	order       *list.List // Compiled expressions, most recently used first.
+	serializer  *python.Serializer
+}
+
+// expression is a compiled expression.
+type expression struct {
+	source string
+	fn     py.PyObjectPtr
+}
+
+// evaluatorFor finds or creates the evaluator for exe and runtimeName,
+// without starting it.
+func evaluatorFor(exe, runtimeName string) *evaluator {
+	evaluatorsMtx.Lock()
+	defer evaluatorsMtx.Unlock()
+
+	key := evaluatorKey{exe: exe, runtimeName: runtimeName}
+	if e, ok := evaluators[key]; ok {
+		return e
+	}
+	e := &evaluator{exe: exe, runtimeName: runtimeName}
+	evaluators[key] = e
+	return e
+}
+
+// Stop stops the Python runtimes of mappings. They're started again if a
+// mapping evaluates an expression afterward.
+func Stop(ctx context.Context) error {
+	evaluatorsMtx.Lock()
+	defer evaluatorsMtx.Unlock()
+
+	var errs []error
+	for _, e := range evaluators {
+		errs = append(errs, e.stop(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// start starts our runtime if it's not already running, returning it.
+func (e *evaluator) start(ctx context.Context) (python.Runtime, error) {
+	e.startMtx.Lock()
+	defer e.startMtx.Unlock()
+
+	if e.runtime != nil {
+		return e.runtime, nil
+	}
+
+	// Like components, only look for Python once we're about to use it, so
+	// the process-wide settings they apply are in place.
+	var r python.Runtime
+	r, err := python.NewSingleInterpreterRuntime(e.exe, 1, nil)
+	if err != nil {
+		return nil, err
+	}
+	if e.runtimeName != "" {
+		r, err = python.ShareRuntime(e.runtimeName, e.exe, python.Global, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = r.Start(ctx); err != nil {
+		return nil, err
+	}
+
+	err = r.Map(ctx, func(_ *python.InterpreterTicket) error {
+		rpcn, err := python.LoadRpcnModule()
+		if err != nil {
+			return err
+		}
+		e.compile = py.PyObject_GetAttrString(rpcn, "_expression")
+		if e.compile == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find _expression function in rpcn module")
+		}
+		e.expressions = make(map[string]*list.Element)
+		e.order = list.New()
+
+		e.serializer, err = python.NewSerializer()
+		return err
+	})
+	if err != nil {
+		// Try cleaning up if we had an issue.
+		_ = r.Stop(ctx)
+		return nil, err
+	}
+	e.runtime = r
+	return r, nil
+}
+
+// stop releases our Python state and stops our runtime, if it's running.
+func (e *evaluator) stop(ctx context.Context) error {
+	e.startMtx.Lock()
+	defer e.startMtx.Unlock()
+
+	if e.runtime == nil {
+		return nil
+	}
+	_ = e.runtime.Map(ctx, func(_ *python.InterpreterTicket) error {
+		for elem := e.order.Front(); elem != nil; elem = elem.Next() {
+			py.Py_DecRef(elem.Value.(*expression).fn)
+		}
+		e.expressions, e.order = nil, nil
+		py.Py_DecRef(e.compile)
+		if e.serializer != nil {
+			e.serializer.DecRef()
+		}
+		return nil
+	})
+	err := python.StopWithDeadline(ctx, e.runtime, shutdownTimeout, nil)
+	e.runtime = nil
+	return err
+}
+
+// compiled finds the compiled form of source, compiling it if needed and
+// evicting the least recently used once we have too many.
+//
+// The caller must manage the interpreter state for this to succeed.
+func (e *evaluator) compiled(source string) (py.PyObjectPtr, error) {
+	if elem, ok := e.expressions[source]; ok {
+		e.order.MoveToFront(elem)
+		return elem.Value.(*expression).fn, nil
+	}
+
+	str := py.PyUnicode_FromString(source)
+	if str == py.NullPyObjectPtr {
+		return py.NullPyObjectPtr, errors.New("failed to create python string")
+	}
+	fn := py.PyObject_CallOneArg(e.compile, str)
+	py.Py_DecRef(str)
+	if fn == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return py.NullPyObjectPtr, fmt.Errorf("failed to compile python expression '%s'", source)
+	}
+
+	e.expressions[source] = e.order.PushFront(&expression{source: source, fn: fn})
+	for e.order.Len() > maxExpressions {
+		oldest := e.order.Back()
+		e.order.Remove(oldest)
+		evicted := oldest.Value.(*expression)
+		delete(e.expressions, evicted.source)
+		py.Py_DecRef(evicted.fn)
+	}
+	return fn, nil
+}
+
+// evaluate evaluates expression against value, converting the result back
+// into a Bloblang value.
+func (e *evaluator) evaluate(ctx context.Context, source string, value any) (any, error) {
+	r, err := e.start(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hand over bytes as they are and everything else as JSON.
+	var arg []byte
+	raw, isBytes := value.([]byte)
+	if isBytes {
+		arg = raw
+	} else {
+		if arg, err = json.Marshal(value); err != nil {
+			return nil, err
+		}
+	}
+
+	ticket, err := r.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = r.Release(ticket) }()
+
+	var result any
+	err = r.Apply(ticket, ctx, func() error {
+		fn, err := e.compiled(source)
+		if err != nil {
+			return err
+		}
+
+		var obj py.PyObjectPtr
+		if isBytes {
+			obj = py.PyBytes_FromStringAndSize(unsafe.SliceData(arg), int64(len(arg)))
+		} else {
+			obj = py.PyUnicode_FromString(string(arg))
+		}
+		if obj == py.NullPyObjectPtr {
+			return errors.New("failed to convert value to python")
+		}
+		out := py.PyObject_CallOneArg(fn, obj)
+		py.Py_DecRef(obj)
+		if out == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return fmt.Errorf("python expression '%s' failed", source)
+		}
+		defer py.Py_DecRef(out)
+
+		switch py.BaseType(out) {
+		case py.None:
+			result = nil
+		case py.Bytes:
+			// Copy out of memory managed by Python.
+			data := make([]byte, py.PyBytes_Size(out))
+			copy(data, unsafe.Slice(py.PyBytes_AsString(out), len(data)))
+			result = data
+		case py.String:
+			s, err := python.UnicodeToString(out)
+			if err != nil {
+				return err
+			}
+			result = s
+		default:
+			data, err := e.serializer.JsonBytes(out)
+			if err != nil {
+				return err
+			}
+			return json.Unmarshal(data, &result)
+		}
+		return nil
+	})
+	return result, err
+}
+
+func init() {
+	spec := bloblang.NewPluginSpec().
+		Category("Python").
+		Description("Evaluates a Python expression against the current value, available to it as `this`, as an escape hatch for what's awkward to express in Bloblang. Bytes are passed as `bytes` and other values as their JSON equivalent, while results come back as bytes, strings, or the structure of their JSON. Expressions run in the main interpreter of the Python executable, started on first use, and the most recently used are kept compiled.").
+		Param(bloblang.NewStringParam("expression").Description("Python expression to evaluate.")).
+		Param(bloblang.NewStringParam("exe").Description("Python executable to evaluate with.").Default("python3")).
+		Param(bloblang.NewStringParam("runtime").Description("Name of a runtime in `global` mode to share with components, as their `runtime`. A runtime of its own if empty.").Default("")).
+		Example("", `root.slug = this.title.python("'-'.join(this.lower().split())")`,
+			[2]string{`{"title":"Hello Python World"}`, `{"slug":"hello-python-world"}`})
+
+	err := bloblang.RegisterMethodV2("python", spec, func(args *bloblang.ParsedParams) (bloblang.Method, error) {
+		expression, err := args.GetString("expression")
+		if err != nil {
+			return nil, err
+		}
+		exe, err := args.GetString("exe")
+		if err != nil {
+			return nil, err
+		}
+		runtimeName, err := args.GetString("runtime")
+		if err != nil {
+			return nil, err
+		}
+		e := evaluatorFor(exe, runtimeName)
+		return func(v any) (any, error) {
+			return e.evaluate(context.Background(), expression, v)
+		}, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,57 @@
+package bloblang
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/redpanda-data/benthos/v4/public/bloblang"
+)
+
+func TestPythonMethod(t *testing.T) {
+	exec, err := bloblang.Parse(`
+root.slug = this.title.python("'-'.join(this.lower().split())")
+root.total = this.items.python("sum(i['price'] for i in this)")
+root.raw = this.data.python("this.upper()")
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := exec.Query(map[string]any{
+		"title": "Hello Python World",
+		"data":  []byte("abc"),
+		"items": []any{map[string]any{"price": 1.5}, map[string]any{"price": 2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]any{
+		"slug":  "hello-python-world",
+		"total": 3.5,
+		"raw":   []byte("ABC"),
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("expected %v, got %v", expected, result)
+	}
+}
+
+func TestPythonMethodAfterStop(t *testing.T) {
+	exec, err := bloblang.Parse(`root = this.python("this * 2")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		result, err := exec.Query(21)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != 42.0 {
+			t.Fatalf("expected 42, got %v", result)
+		}
+		if err = Stop(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
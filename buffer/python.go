@@ -0,0 +1,525 @@
+package buffer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+	py "github.com/voutilad/gogopython"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+)
+
+var configSpec = service.NewConfigSpec().
+	Summary("Aggregate windows of messages with Python.").
+	Description("Hands each message to the `add` method of a Python object, defined by the script, and calls its `flush` method when a window closes, emitting what it returns as a batch. Enables tumbling and sliding window aggregations written in Python. Messages are acknowledged once the batch of the window they were added to, or a later one, is.").
+	Field(service.NewStringField("script").
+		Description("Python code defining the window object.")).
+	Fields(python.RuntimeFields()...).
+	Field(service.NewStringField("object").
+		Description("Name of the Python object, defined by the script, with `add(message)` and `flush()` methods. `flush` returns the window's results as a list, each becoming a message: `bytes` and `str` as is and anything else as JSON. Either method may be `async def`.").
+		Default("window")).
+	Field(service.NewBoolField("with_metadata").
+		Description("Pass each message to `add` as a `(content, metadata)` tuple, where metadata is a `dict` of the message's metadata, instead of just its content as `bytes`.").
+		Default(false)).
+	Field(service.NewIntField("count").
+		Description("Flush once this many messages were added since the last flush. Disabled if 0.").
+		Default(0)).
+	Field(service.NewDurationField("period").
+		Description("Flush at this interval, e.g. for tumbling windows over time.").
+		Example("10s").
+		Optional()).
+	Field(service.NewStringEnumField("json_library", python.JSONLibraryAuto, python.JSONLibraryJSON, python.JSONLibraryOrjson, python.JSONLibraryUjson).
+		Description("Library encoding flushed results as JSON. `orjson` is several times faster than the standard `json` module and also handles datetimes and numpy arrays, while `auto` uses `orjson` or `ujson` if installed, falling back to `json`.").
+		Advanced().
+		Default(python.JSONLibraryJSON)).
+	LintRule(`root = python_syntax_error("script", this.script | "", this.exe | "python3")`)
+
+// window is a batch flushed by our Python object, along with the
+// acknowledgements of the messages added before it.
+type window struct {
+	batch service.MessageBatch
+	acks  []service.AckFunc
+}
+
+type pythonBuffer struct {
+	logger          *service.Logger
+	runtime         python.Runtime
+	script          string
+	path            []string
+	environment     map[string]string
+	preload         []string
+	requires        []string
+	objectName      string
+	withMetadata    bool
+	count           int
+	period          time.Duration
+	shutdownTimeout time.Duration
+	jsonLibrary     string
+
+	// Python state, only used with our single interpreter's ticket.
+	add        py.PyObjectPtr
+	flush      py.PyObjectPtr
+	resolve    py.PyObjectPtr
+	listType   py.PyObjectPtr
+	serializer *python.Serializer
+
+	mtx     sync.Mutex
+	added   int               // Messages added since the last flush.
+	pending []service.AckFunc // Acknowledgements awaiting a flush.
+	ready   []window          // Flushed windows awaiting a read.
+	ended   bool              // Whether the input ended.
+	notify  chan struct{}     // Signals a change to ready or ended.
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func init() {
+	err := service.RegisterBatchBuffer("python", configSpec,
+		func(conf *service.ParsedConfig, mgr *service.Resources) (service.BatchBuffer, error) {
+			// Extract our configuration.
+			runtimeConf, err := python.ParseRuntimeConfig(conf, mgr.Logger())
+			if err != nil {
+				return nil, err
+			}
+			script, err := conf.FieldString("script")
+			if err != nil {
+				return nil, err
+			}
+			if err = python.AuditScript(mgr.Logger(), "script", script, runtimeConf.ScriptChecksums); err != nil {
+				return nil, err
+			}
+
+			b, err := newPythonBuffer(runtimeConf.Exe, runtimeConf.Mode, mgr.Metrics(), mgr.Logger())
+			if err != nil {
+				return nil, err
+			}
+			b.script = script
+			b.path = runtimeConf.Path
+			b.environment = runtimeConf.Environment
+			b.preload = runtimeConf.Preload
+			b.requires = runtimeConf.Requires
+			b.shutdownTimeout = runtimeConf.ShutdownTimeout
+			if b.objectName, err = conf.FieldString("object"); err != nil {
+				return nil, err
+			}
+			if b.withMetadata, err = conf.FieldBool("with_metadata"); err != nil {
+				return nil, err
+			}
+			if b.count, err = conf.FieldInt("count"); err != nil {
+				return nil, err
+			}
+			if b.count < 0 {
+				return nil, errors.New("count must not be negative")
+			}
+			if conf.Contains("period") {
+				if b.period, err = conf.FieldDuration("period"); err != nil {
+					return nil, err
+				}
+			}
+			if b.count == 0 && b.period <= 0 {
+				return nil, errors.New("at least one of count or period must be set")
+			}
+			if b.jsonLibrary, err = conf.FieldString("json_library"); err != nil {
+				return nil, err
+			}
+
+			if err = b.start(context.Background()); err != nil {
+				return nil, err
+			}
+			return b, nil
+		})
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+// newPythonBuffer creates a python buffer. It uses a single interpreter of
+// its own, so all messages go through the same window state.
+func newPythonBuffer(exe string, mode python.Mode, metrics *service.Metrics, logger *service.Logger) (*pythonBuffer, error) {
+	var err error
+	var r python.Runtime
+
+	switch mode {
+	case python.IsolatedLegacy:
+		r, err = python.NewMultiInterpreterRuntime(exe, 1, true, logger)
+	case python.Global:
+		r, err = python.NewSingleInterpreterRuntime(exe, 1, logger)
+	case python.Isolated:
+		r, err = python.NewMultiInterpreterRuntime(exe, 1, false, logger)
+	case python.FreeThreaded:
+		r, err = python.NewFreeThreadedRuntime(exe, 1, logger)
+	default:
+		return nil, errors.New("invalid mode")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &pythonBuffer{
+		logger:          logger,
+		runtime:         python.NewMeteredRuntime(r, metrics),
+		shutdownTimeout: 10 * time.Second,
+		notify:          make(chan struct{}, 1),
+		stop:            make(chan struct{}),
+	}, nil
+}
+
+// start starts our runtime, runs our script to find our window object, and
+// starts flushing periodically if configured.
+func (b *pythonBuffer) start(ctx context.Context) error {
+	err := b.runtime.Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = b.runtime.Map(ctx, func(ticket *python.InterpreterTicket) error {
+		code, err := python.Compile(b.script, "__rp_connect_python_buffer__.py")
+		if err != nil {
+			return err
+		}
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+
+		// Provide our rpcn helper module, which we also need for running
+		// async methods.
+		rpcn, err := python.LoadRpcnModule()
+		if err != nil {
+			return err
+		}
+		py.PyDict_SetItemString(globals, "rpcn", rpcn)
+		resolve := py.PyObject_GetAttrString(rpcn, "_resolve")
+		if resolve == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find _resolve function in rpcn module")
+		}
+		b.resolve = resolve
+
+		// Send print() and friends to our logger.
+		if err = python.CaptureOutput(b.logger); err != nil {
+			return err
+		}
+
+		// Apply environment variables before running anything of the user's.
+		if err = python.SetEnvironment(b.environment); err != nil {
+			return err
+		}
+
+		// Make any local helper modules importable.
+		if err = python.ExtendSysPath(b.path); err != nil {
+			return err
+		}
+
+		// Fail fast, saying where we looked, if a dependency is missing.
+		if err = python.RequireModules(b.requires); err != nil {
+			return err
+		}
+
+		// Pay for slow imports now rather than on the first message.
+		if err = python.PreloadModules(b.preload); err != nil {
+			return err
+		}
+
+		// Execute the script to define our window object.
+		result := py.PyEval_EvalCode(code, globals, py.NullPyObjectPtr)
+		if result == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to evaluate buffer script")
+		}
+		py.Py_DecRef(result)
+
+		obj := py.PyDict_GetItemString(globals, b.objectName)
+		if obj == py.NullPyObjectPtr {
+			return fmt.Errorf("failed to find python object '%s'", b.objectName)
+		}
+		b.add = py.PyObject_GetAttrString(obj, "add")
+		if b.add == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return fmt.Errorf("failed to find add method on python object '%s'", b.objectName)
+		}
+		b.flush = py.PyObject_GetAttrString(obj, "flush")
+		if b.flush == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return fmt.Errorf("failed to find flush method on python object '%s'", b.objectName)
+		}
+
+		// We need the list type for collecting what flush returns.
+		builtins := py.PyImport_ImportModule("builtins")
+		if builtins == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to import builtins module")
+		}
+		defer py.Py_DecRef(builtins)
+		b.listType = py.PyObject_GetAttrString(builtins, "list")
+		if b.listType == py.NullPyObjectPtr {
+			return errors.New("failed to find list type")
+		}
+
+		b.serializer, err = python.NewSerializer()
+		if err != nil || b.jsonLibrary == "" {
+			return err
+		}
+		library, err := b.serializer.SetJSONLibrary(b.jsonLibrary)
+		if err != nil {
+			return err
+		}
+		b.logger.Debugf("Encoding JSON with %s.", library)
+		return nil
+	})
+	if err != nil {
+		// Try cleaning up if we had an issue.
+		_ = b.runtime.Stop(ctx)
+		return err
+	}
+
+	if b.period > 0 {
+		go b.flushPeriodically()
+	}
+	return nil
+}
+
+// flushPeriodically flushes every period until we're closed.
+func (b *pythonBuffer) flushPeriodically() {
+	ticker := time.NewTicker(b.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.flushWindow(context.Background()); err != nil {
+				b.logger.Errorf("Failed to flush window: %s", err)
+			}
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// apply calls f with our interpreter's state managed.
+func (b *pythonBuffer) apply(ctx context.Context, f func() error) error {
+	ticket, err := b.runtime.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = b.runtime.Release(ticket) }()
+	return b.runtime.Apply(ticket, ctx, f)
+}
+
+// call calls fn with any arg, whose reference is stolen, running its result
+// to completion if it's awaitable. Returns a new reference to the result.
+//
+// The caller must manage the interpreter state for this to succeed.
+func (b *pythonBuffer) call(fn py.PyObjectPtr, name string, arg py.PyObjectPtr) (py.PyObjectPtr, error) {
+	var result py.PyObjectPtr
+	if arg == py.NullPyObjectPtr {
+		result = py.PyObject_CallNoArgs(fn)
+	} else {
+		result = py.PyObject_CallOneArg(fn, arg)
+		py.Py_DecRef(arg)
+	}
+	if result != py.NullPyObjectPtr {
+		defer py.Py_DecRef(result)
+		result = py.PyObject_CallOneArg(b.resolve, result)
+	}
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return py.NullPyObjectPtr, fmt.Errorf("python method '%s.%s' failed", b.objectName, name)
+	}
+	return result, nil
+}
+
+func (b *pythonBuffer) WriteBatch(ctx context.Context, batch service.MessageBatch, ack service.AckFunc) error {
+	err := b.apply(ctx, func() error {
+		for _, m := range batch {
+			data, err := m.AsBytes()
+			if err != nil {
+				return err
+			}
+			obj := py.PyBytes_FromStringAndSize(unsafe.SliceData(data), int64(len(data)))
+			if obj == py.NullPyObjectPtr {
+				return errors.New("failed to create python bytes")
+			}
+			if b.withMetadata {
+				if obj, err = python.WithMetadata(obj, m); err != nil {
+					return err
+				}
+			}
+			result, err := b.call(b.add, "add", obj)
+			if err != nil {
+				return err
+			}
+			py.Py_DecRef(result)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Hold on to the acknowledgement until a window including the batch is
+	// acknowledged.
+	b.mtx.Lock()
+	b.pending = append(b.pending, ack)
+	b.added += len(batch)
+	full := b.count > 0 && b.added >= b.count
+	b.mtx.Unlock()
+
+	if full {
+		return b.flushWindow(ctx)
+	}
+	return nil
+}
+
+// flushWindow flushes our window object, queueing its results to be read.
+func (b *pythonBuffer) flushWindow(ctx context.Context) error {
+	var batch service.MessageBatch
+	err := b.apply(ctx, func() error {
+		result, err := b.call(b.flush, "flush", py.NullPyObjectPtr)
+		if err != nil {
+			return err
+		}
+		defer py.Py_DecRef(result)
+		if py.BaseType(result) == py.None {
+			return nil
+		}
+
+		list := py.PyObject_CallOneArg(b.listType, result)
+		if list == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return fmt.Errorf("python method '%s.flush' didn't return a list", b.objectName)
+		}
+		defer py.Py_DecRef(list)
+
+		for idx := int64(0); idx < py.PyList_Size(list); idx++ {
+			item := py.PyList_GetItem(list, idx)
+			switch py.BaseType(item) {
+			case py.None:
+				continue
+			case py.Bytes:
+				// Copy out of memory managed by Python.
+				data := make([]byte, py.PyBytes_Size(item))
+				copy(data, unsafe.Slice(py.PyBytes_AsString(item), len(data)))
+				batch = append(batch, service.NewMessage(data))
+			case py.String:
+				data, err := python.UnicodeToBytes(item)
+				if err != nil {
+					return err
+				}
+				batch = append(batch, service.NewMessage(data))
+			default:
+				data, err := b.serializer.JsonBytes(item)
+				if err != nil {
+					return err
+				}
+				batch = append(batch, service.NewMessage(data))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	b.mtx.Lock()
+	acks := b.pending
+	b.pending = nil
+	b.added = 0
+	if len(batch) > 0 {
+		b.ready = append(b.ready, window{batch: batch, acks: acks})
+		b.signal()
+	}
+	b.mtx.Unlock()
+
+	if len(batch) == 0 {
+		// Nothing to wait on downstream.
+		for _, ack := range acks {
+			_ = ack(ctx, nil)
+		}
+	}
+	return nil
+}
+
+// signal wakes up a reader waiting on a window. Must be called with mtx
+// locked.
+func (b *pythonBuffer) signal() {
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (b *pythonBuffer) ReadBatch(ctx context.Context) (service.MessageBatch, service.AckFunc, error) {
+	for {
+		b.mtx.Lock()
+		if len(b.ready) > 0 {
+			w := b.ready[0]
+			b.ready = b.ready[1:]
+			if len(b.ready) > 0 || b.ended {
+				// Let the next reader through, too.
+				b.signal()
+			}
+			b.mtx.Unlock()
+			return w.batch, func(ctx context.Context, err error) error {
+				for _, ack := range w.acks {
+					_ = ack(ctx, err)
+				}
+				return nil
+			}, nil
+		}
+		ended := b.ended
+		b.mtx.Unlock()
+
+		if ended {
+			return nil, nil, service.ErrEndOfBuffer
+		}
+		select {
+		case <-b.notify:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+func (b *pythonBuffer) EndOfInput() {
+	b.mtx.Lock()
+	ended := b.ended
+	b.mtx.Unlock()
+	if ended {
+		return
+	}
+
+	// Flush what's left of the last window.
+	if err := b.flushWindow(context.Background()); err != nil {
+		b.logger.Errorf("Failed to flush window: %s", err)
+	}
+
+	b.mtx.Lock()
+	b.ended = true
+	b.signal()
+	b.mtx.Unlock()
+}
+
+func (b *pythonBuffer) Close(ctx context.Context) error {
+	var err error
+	b.closeOnce.Do(func() {
+		close(b.stop)
+
+		// Anything not flushed yet needs delivering again.
+		b.mtx.Lock()
+		acks := b.pending
+		b.pending = nil
+		b.mtx.Unlock()
+		for _, ack := range acks {
+			_ = ack(ctx, errors.New("buffer closed before flushing"))
+		}
+
+		err = python.StopWithDeadline(ctx, b.runtime, b.shutdownTimeout, b.logger)
+	})
+	return err
+}
@@ -0,0 +1,71 @@
+package buffer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+	"golang.org/x/net/context"
+)
+
+func TestWindowsFlushOnCount(t *testing.T) {
+	b, err := newPythonBuffer("python3", python.Global, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.script = `
+class Sum:
+    def __init__(self):
+        self.total = 0
+    def add(self, message):
+        self.total += int(message)
+    def flush(self):
+        total, self.total = self.total, 0
+        return [{"sum": total}]
+window = Sum()
+`
+	b.objectName = "window"
+	b.count = 2
+	ctx := context.Background()
+	if err = b.start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = b.Close(ctx) }()
+
+	acked := 0
+	ack := func(context.Context, error) error {
+		acked++
+		return nil
+	}
+	for _, n := range []string{"1", "2", "3"} {
+		if err = b.WriteBatch(ctx, service.MessageBatch{service.NewMessage([]byte(n))}, ack); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if acked != 0 {
+		t.Fatal("expected acknowledgements to wait on the window")
+	}
+	b.EndOfInput()
+
+	for _, expected := range []string{`{"sum": 3}`, `{"sum": 3}`} {
+		batch, windowAck, err := b.ReadBatch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := batch[0].AsBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Fatalf("expected '%s', got '%s'", expected, data)
+		}
+		_ = windowAck(ctx, nil)
+	}
+	if acked != 3 {
+		t.Fatalf("expected 3 acknowledgements, got %d", acked)
+	}
+	if _, _, err = b.ReadBatch(ctx); !errors.Is(err, service.ErrEndOfBuffer) {
+		t.Fatalf("expected end of buffer, got %v", err)
+	}
+}
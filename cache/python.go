@@ -0,0 +1,473 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+	py "github.com/voutilad/gogopython"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+)
+
+var configSpec = service.NewConfigSpec().
+	Summary("Back a cache with Python.").
+	Description("Calls Python functions, defined by the script, to get, set, add, and delete keys, so any Python client (DynamoDB, a REST API, an in-house store) can back a cache. Functions may be `async def`.").
+	Field(service.NewStringField("script").
+		Description("Python code defining the cache's functions.")).
+	Fields(python.RuntimeFields()...).
+	Field(python.SharedRuntimeField()).
+	Field(service.NewIntField("interpreters").
+		Description("Number of interpreters to call the functions from concurrently. Each has its own globals, so clients are created per interpreter. Most useful with the isolated modes.").
+		Default(1)).
+	Field(service.NewStringField("get_function").
+		Description("Name of a Python function called as `get_function(key)`, returning the value as `bytes` or `str`, or `None` if the key doesn't exist.").
+		Default("get")).
+	Field(service.NewStringField("set_function").
+		Description("Name of a Python function called as `set_function(key, value, ttl)`, where `value` is `bytes` and `ttl` is the number of seconds the key should live for, or `None` for no expiry.").
+		Default("set")).
+	Field(service.NewStringField("add_function").
+		Description("Name of a Python function called as `add_function(key, value, ttl)`, like `set_function` but only if the key doesn't exist, returning whether it was added. If not set, adding checks with `get_function` before calling `set_function`, which isn't atomic.").
+		Example("add").
+		Optional()).
+	Field(service.NewStringField("delete_function").
+		Description("Name of a Python function called as `delete_function(key)`.").
+		Default("delete")).
+	Field(service.NewDurationField("default_ttl").
+		Description("TTL passed to `set_function` and `add_function` when the caller doesn't specify one. No expiry if not set.").
+		Example("5m").
+		Optional()).
+	LintRule(`root = python_syntax_error("script", this.script | "", this.exe | "python3")`)
+
+type pythonCache struct {
+	logger          *service.Logger
+	runtime         python.Runtime
+	script          string
+	path            []string
+	environment     map[string]string
+	preload         []string
+	requires        []string
+	getFn           string
+	setFn           string
+	addFn           string
+	deleteFn        string
+	defaultTTL      *time.Duration
+	shutdownTimeout time.Duration
+	interpreters    map[int64]*interpreter // Protected by mtx.
+	mtx             sync.RWMutex
+}
+
+// interpreter holds our functions in a particular interpreter.
+type interpreter struct {
+	get      py.PyObjectPtr
+	set      py.PyObjectPtr
+	add      py.PyObjectPtr
+	del      py.PyObjectPtr
+	resolve  py.PyObjectPtr
+	classify py.PyObjectPtr // Describes exceptions raised by our functions.
+}
+
+func init() {
+	err := service.RegisterCache("python", configSpec,
+		func(conf *service.ParsedConfig, mgr *service.Resources) (service.Cache, error) {
+			// Extract our configuration.
+			runtimeConf, err := python.ParseRuntimeConfig(conf, mgr.Logger())
+			if err != nil {
+				return nil, err
+			}
+			runtimeName, err := conf.FieldString("runtime")
+			if err != nil {
+				return nil, err
+			}
+			script, err := conf.FieldString("script")
+			if err != nil {
+				return nil, err
+			}
+			if err = python.AuditScript(mgr.Logger(), "script", script, runtimeConf.ScriptChecksums); err != nil {
+				return nil, err
+			}
+			interpreters, err := conf.FieldInt("interpreters")
+			if err != nil {
+				return nil, err
+			}
+			if interpreters < 1 {
+				return nil, errors.New("interpreters must be at least 1")
+			}
+
+			c, err := newPythonCache(runtimeConf.Exe, runtimeConf.Mode, runtimeName, interpreters, mgr.Metrics(), mgr.Logger())
+			if err != nil {
+				return nil, err
+			}
+			c.script = script
+			c.path = runtimeConf.Path
+			c.environment = runtimeConf.Environment
+			c.preload = runtimeConf.Preload
+			c.requires = runtimeConf.Requires
+			c.shutdownTimeout = runtimeConf.ShutdownTimeout
+			if c.getFn, err = conf.FieldString("get_function"); err != nil {
+				return nil, err
+			}
+			if c.setFn, err = conf.FieldString("set_function"); err != nil {
+				return nil, err
+			}
+			if conf.Contains("add_function") {
+				if c.addFn, err = conf.FieldString("add_function"); err != nil {
+					return nil, err
+				}
+			}
+			if c.deleteFn, err = conf.FieldString("delete_function"); err != nil {
+				return nil, err
+			}
+			if conf.Contains("default_ttl") {
+				ttl, err := conf.FieldDuration("default_ttl")
+				if err != nil {
+					return nil, err
+				}
+				c.defaultTTL = &ttl
+			}
+
+			// Start now, as caches are used without connecting.
+			if err = c.start(context.Background()); err != nil {
+				return nil, err
+			}
+			return c, nil
+		})
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+// newPythonCache creates a python cache using up to cnt interpreters.
+func newPythonCache(exe string, mode python.Mode, runtimeName string, cnt int, metrics *service.Metrics, logger *service.Logger) (*pythonCache, error) {
+	var err error
+	var r python.Runtime
+
+	switch mode {
+	case python.IsolatedLegacy:
+		r, err = python.NewMultiInterpreterRuntime(exe, cnt, true, logger)
+	case python.Global:
+		r, err = python.NewSingleInterpreterRuntime(exe, cnt, logger)
+	case python.Isolated:
+		r, err = python.NewMultiInterpreterRuntime(exe, cnt, false, logger)
+	case python.FreeThreaded:
+		r, err = python.NewFreeThreadedRuntime(exe, cnt, logger)
+	default:
+		return nil, errors.New("invalid mode")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if runtimeName != "" {
+		r, err = python.ShareRuntime(runtimeName, exe, mode, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r = python.NewMeteredRuntime(r, metrics)
+
+	return &pythonCache{
+		logger:          logger,
+		runtime:         r,
+		shutdownTimeout: 10 * time.Second,
+		interpreters:    make(map[int64]*interpreter),
+	}, nil
+}
+
+// start starts our runtime and runs our script in every interpreter to
+// define our functions.
+func (c *pythonCache) start(ctx context.Context) error {
+	err := c.runtime.Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = c.runtime.Map(ctx, func(ticket *python.InterpreterTicket) error {
+		code, err := python.Compile(c.script, "__rp_connect_python_cache__.py")
+		if err != nil {
+			return err
+		}
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+
+		// Provide our rpcn helper module, which we also need for running
+		// async functions.
+		rpcn, err := python.LoadRpcnModule()
+		if err != nil {
+			return err
+		}
+		py.PyDict_SetItemString(globals, "rpcn", rpcn)
+		resolve := py.PyObject_GetAttrString(rpcn, "_resolve")
+		if resolve == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find _resolve function in rpcn module")
+		}
+		classify := py.PyObject_GetAttrString(rpcn, "_classify")
+		if classify == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			py.Py_DecRef(resolve)
+			return errors.New("failed to find _classify function in rpcn module")
+		}
+		i := &interpreter{resolve: resolve, classify: classify}
+
+		// Send print() and friends to our logger.
+		if err = python.CaptureOutput(c.logger); err != nil {
+			return err
+		}
+
+		// Apply environment variables before running anything of the user's.
+		if err = python.SetEnvironment(c.environment); err != nil {
+			return err
+		}
+
+		// Make any local helper modules importable.
+		if err = python.ExtendSysPath(c.path); err != nil {
+			return err
+		}
+
+		// Fail fast, saying where we looked, if a dependency is missing.
+		if err = python.RequireModules(c.requires); err != nil {
+			return err
+		}
+
+		// Pay for slow imports now rather than on the first call.
+		if err = python.PreloadModules(c.preload); err != nil {
+			return err
+		}
+
+		// Execute the script to define our functions.
+		result := py.PyEval_EvalCode(code, globals, py.NullPyObjectPtr)
+		if result == py.NullPyObjectPtr {
+			return i.failed("failed to evaluate cache script")
+		}
+		py.Py_DecRef(result)
+
+		if i.get, err = lookupFunction(globals, c.getFn); err != nil {
+			return err
+		}
+		if i.set, err = lookupFunction(globals, c.setFn); err != nil {
+			return err
+		}
+		if c.addFn != "" {
+			if i.add, err = lookupFunction(globals, c.addFn); err != nil {
+				return err
+			}
+		}
+		if i.del, err = lookupFunction(globals, c.deleteFn); err != nil {
+			return err
+		}
+
+		c.mtx.Lock()
+		c.interpreters[ticket.Id()] = i
+		c.mtx.Unlock()
+		return nil
+	})
+	if err != nil {
+		// Try cleaning up if we had an issue.
+		_ = c.runtime.Stop(ctx)
+		return err
+	}
+	return nil
+}
+
+// lookupFunction finds a function defined by our script, returning a
+// borrowed reference.
+func lookupFunction(globals py.PyObjectPtr, name string) (py.PyObjectPtr, error) {
+	fn := py.PyDict_GetItemString(globals, name)
+	if fn == py.NullPyObjectPtr {
+		return py.NullPyObjectPtr, fmt.Errorf("failed to find python function '%s'", name)
+	}
+	if py.BaseType(fn) != py.Function {
+		return py.NullPyObjectPtr, fmt.Errorf("python object '%s' is not a function", name)
+	}
+	return fn, nil
+}
+
+// apply calls f with the state of an interpreter, managing its state.
+func (c *pythonCache) apply(ctx context.Context, f func(i *interpreter) error) error {
+	// Once closed, our runtime holds on to its interpreters, so don't wait on
+	// one.
+	c.mtx.RLock()
+	closed := c.interpreters == nil
+	c.mtx.RUnlock()
+	if closed {
+		return errors.New("python cache is closed")
+	}
+
+	ticket, err := c.runtime.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.runtime.Release(ticket) }()
+
+	c.mtx.RLock()
+	i, ok := c.interpreters[ticket.Id()]
+	c.mtx.RUnlock()
+	if !ok {
+		return errors.New("python cache is closed")
+	}
+	return c.runtime.Apply(ticket, ctx, func() error { return f(i) })
+}
+
+// call calls fn with args, whose references are stolen, running its result
+// to completion if it's awaitable. Returns a new reference to the result.
+//
+// The caller must manage the interpreter state for this to succeed.
+func (i *interpreter) call(fn py.PyObjectPtr, name string, args ...py.PyObjectPtr) (py.PyObjectPtr, error) {
+	tuple := py.PyTuple_New(int64(len(args)))
+	if tuple == py.NullPyObjectPtr {
+		for _, arg := range args {
+			py.Py_DecRef(arg)
+		}
+		return py.NullPyObjectPtr, errors.New("failed to create python tuple")
+	}
+	defer py.Py_DecRef(tuple)
+	for idx, arg := range args {
+		py.PyTuple_SetItem(tuple, int64(idx), arg)
+	}
+
+	result := py.PyObject_Call(fn, tuple, py.NullPyObjectPtr)
+	if result != py.NullPyObjectPtr {
+		defer py.Py_DecRef(result)
+		result = py.PyObject_CallOneArg(i.resolve, result)
+	}
+	if result == py.NullPyObjectPtr {
+		return py.NullPyObjectPtr, i.failed(fmt.Sprintf("python function '%s' failed", name))
+	}
+	return result, nil
+}
+
+// failed converts the exception Python raised into an error starting with
+// msg, describing it like the python processor does.
+//
+// The caller must manage the interpreter state for this to succeed.
+func (i *interpreter) failed(msg string) error {
+	python.StashException()
+	if _, exc := python.ClassifyException(i.classify, ""); exc != nil {
+		return fmt.Errorf("%s: %w", msg, exc)
+	}
+	return errors.New(msg)
+}
+
+// toBytes creates a new Python bytes object from data.
+func toBytes(data []byte) py.PyObjectPtr {
+	return py.PyBytes_FromStringAndSize(unsafe.SliceData(data), int64(len(data)))
+}
+
+// ttlFor is the TTL to hand to Python in seconds, or None for no expiry.
+func (c *pythonCache) ttlFor(ttl *time.Duration) py.PyObjectPtr {
+	if ttl == nil {
+		ttl = c.defaultTTL
+	}
+	if ttl == nil {
+		return python.NewNone()
+	}
+	return py.PyFloat_FromDouble(ttl.Seconds())
+}
+
+func (c *pythonCache) Get(ctx context.Context, key string) ([]byte, error) {
+	var value []byte
+	err := c.apply(ctx, func(i *interpreter) error {
+		result, err := i.call(i.get, c.getFn, py.PyUnicode_FromString(key))
+		if err != nil {
+			return err
+		}
+		defer py.Py_DecRef(result)
+
+		switch t := py.BaseType(result); t {
+		case py.None:
+			return service.ErrKeyNotFound
+		case py.Bytes:
+			// Copy out of memory managed by Python.
+			value = make([]byte, py.PyBytes_Size(result))
+			copy(value, unsafe.Slice(py.PyBytes_AsString(result), len(value)))
+		case py.String:
+			s, err := python.UnicodeToString(result)
+			if err != nil {
+				return err
+			}
+			value = []byte(s)
+		default:
+			return fmt.Errorf("python function '%s' returned %s instead of bytes or str", c.getFn, t)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (c *pythonCache) Set(ctx context.Context, key string, value []byte, ttl *time.Duration) error {
+	return c.apply(ctx, func(i *interpreter) error {
+		result, err := i.call(i.set, c.setFn, py.PyUnicode_FromString(key), toBytes(value), c.ttlFor(ttl))
+		if err != nil {
+			return err
+		}
+		py.Py_DecRef(result)
+		return nil
+	})
+}
+
+func (c *pythonCache) Add(ctx context.Context, key string, value []byte, ttl *time.Duration) error {
+	if c.addFn == "" {
+		// Fall back on checking first, which isn't atomic.
+		_, err := c.Get(ctx, key)
+		if err == nil {
+			return service.ErrKeyAlreadyExists
+		}
+		if !errors.Is(err, service.ErrKeyNotFound) {
+			return err
+		}
+		return c.Set(ctx, key, value, ttl)
+	}
+
+	return c.apply(ctx, func(i *interpreter) error {
+		result, err := i.call(i.add, c.addFn, py.PyUnicode_FromString(key), toBytes(value), c.ttlFor(ttl))
+		if err != nil {
+			return err
+		}
+		defer py.Py_DecRef(result)
+
+		added, err := python.IsTrue(result)
+		if err != nil {
+			return err
+		}
+		if !added {
+			return service.ErrKeyAlreadyExists
+		}
+		return nil
+	})
+}
+
+func (c *pythonCache) Delete(ctx context.Context, key string) error {
+	return c.apply(ctx, func(i *interpreter) error {
+		result, err := i.call(i.del, c.deleteFn, py.PyUnicode_FromString(key))
+		if err != nil {
+			return err
+		}
+		py.Py_DecRef(result)
+		return nil
+	})
+}
+
+func (c *pythonCache) Close(ctx context.Context) error {
+	// Forget our functions first, so calls racing us find the cache closed.
+	c.mtx.Lock()
+	interpreters := c.interpreters
+	c.interpreters = nil
+	c.mtx.Unlock()
+
+	_ = c.runtime.Map(ctx, func(ticket *python.InterpreterTicket) error {
+		// Our functions are borrowed from the globals, but not the rpcn
+		// module's helpers.
+		if i, ok := interpreters[ticket.Id()]; ok {
+			py.Py_DecRef(i.resolve)
+			py.Py_DecRef(i.classify)
+		}
+		return nil
+	})
+	return python.StopWithDeadline(ctx, c.runtime, c.shutdownTimeout, c.logger)
+}
@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+)
+
+func TestCacheCallsPythonFunctions(t *testing.T) {
+	c, err := newPythonCache("python3", python.Global, "", 1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.script = `
+store = {}
+def get(key):
+    return store.get(key)
+def set(key, value, ttl):
+    store[key] = value + str(ttl).encode()
+def add(key, value, ttl):
+    if key in store:
+        return False
+    store[key] = value
+    return True
+async def delete(key):
+    store.pop(key, None)
+`
+	c.getFn, c.setFn, c.addFn, c.deleteFn = "get", "set", "add", "delete"
+	ctx := context.Background()
+	if err = c.start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = c.Get(ctx, "missing"); !errors.Is(err, service.ErrKeyNotFound) {
+		t.Fatalf("expected key not found, got %v", err)
+	}
+
+	ttl := 90 * time.Second
+	if err = c.Set(ctx, "a", []byte("x"), &ttl); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set(ctx, "b", []byte("y"), nil); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{"a": "x90.0", "b": "yNone"} {
+		value, err := c.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != expected {
+			t.Fatalf("expected '%s', got '%s'", expected, value)
+		}
+	}
+
+	if err = c.Add(ctx, "a", []byte("z"), nil); !errors.Is(err, service.ErrKeyAlreadyExists) {
+		t.Fatalf("expected key already exists, got %v", err)
+	}
+	if err = c.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Add(ctx, "a", []byte("z"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Get(ctx, "a"); err == nil || err.Error() != "python cache is closed" {
+		t.Fatalf("expected the cache to be closed, got %v", err)
+	}
+}
+
+func TestCacheDescribesExceptions(t *testing.T) {
+	c, err := newPythonCache("python3", python.Global, "", 1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.script = `
+def get(key):
+    raise ValueError(f"no {key}")
+def set(key, value, ttl):
+    pass
+def delete(key):
+    pass
+`
+	c.getFn, c.setFn, c.deleteFn = "get", "set", "delete"
+	ctx := context.Background()
+	if err = c.start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close(ctx) }()
+
+	_, err = c.Get(ctx, "a")
+	var exc *python.Exception
+	if !errors.As(err, &exc) || exc.Type != "ValueError" || exc.Message != "no a" {
+		t.Fatalf("expected the ValueError raised, got %v", err)
+	}
+}
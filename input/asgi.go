@@ -0,0 +1,488 @@
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+	py "github.com/voutilad/gogopython"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+)
+
+var asgiConfigSpec = service.NewConfigSpec().
+	Summary("Receive messages from a Python web application.").
+	Description("Serves an ASGI application, like FastAPI or Starlette, or a WSGI application, like Flask, defined by the script. Each request is handled by the application and a successful (2xx) response body becomes a message, with the request's method, path, query, and headers as metadata, so existing Python HTTP handlers can validate and shape what enters the pipeline. Other responses are returned to the client as they are. Clients get the application's response once the message is delivered, or the pipeline's with `sync_response`.").
+	Field(service.NewStringField("script").
+		Description("Python code defining the application.")).
+	Fields(python.RuntimeFields()...).
+	Field(python.SharedRuntimeField()).
+	Field(service.NewIntField("interpreters").
+		Description("Number of interpreters handling requests concurrently. Each runs the script, so each has its own app. Most useful with the isolated modes.").
+		Default(1)).
+	Field(service.NewStringField("app").
+		Description("Name of the application object defined by the script.").
+		Default("app")).
+	Field(service.NewStringEnumField("interface", "auto", "asgi", "wsgi").
+		Description("Interface the application implements. `auto` treats applications that are coroutine functions, or have one as `__call__`, as ASGI and others as WSGI.").
+		Default("auto")).
+	Field(service.NewStringField("address").
+		Description("Address to listen on. Plugins can't mount handlers on the service-wide HTTP server, so the application gets a server of its own.").
+		Default("0.0.0.0:8000")).
+	Field(service.NewDurationField("timeout").
+		Description("How long to wait for the application to respond and the message to be delivered before responding with a timeout.").
+		Default("5s")).
+	Field(service.NewBoolField("sync_response").
+		Description("Respond with the first message of the pipeline's synchronous response, set with a `sync_response` output, instead of the application's response.").
+		Default(false)).
+	LintRule(`root = python_syntax_error("script", this.script | "", this.exe | "python3")`)
+
+// asgiRequest is a message made from a request, awaiting delivery.
+type asgiRequest struct {
+	batch service.MessageBatch
+	ack   chan error
+}
+
+// asgiApp is our application in a particular interpreter.
+type asgiApp struct {
+	app   py.PyObjectPtr
+	rpcn  py.PyObjectPtr // Our reference to the rpcn module.
+	serve py.PyObjectPtr
+}
+
+type pythonAsgiInput struct {
+	logger          *service.Logger
+	runtime         python.Runtime
+	script          string
+	path            []string
+	environment     map[string]string
+	preload         []string
+	requires        []string
+	appName         string
+	iface           string
+	address         string
+	timeout         time.Duration
+	syncResponse    bool
+	shutdownTimeout time.Duration
+
+	apps     map[int64]*asgiApp // Keyed by interpreter ticket id.
+	requests chan asgiRequest
+
+	mtx    sync.Mutex
+	server *http.Server // Running while connected.
+}
+
+func init() {
+	err := service.RegisterBatchInput("python_asgi", asgiConfigSpec,
+		func(conf *service.ParsedConfig, mgr *service.Resources) (service.BatchInput, error) {
+			// Extract our configuration.
+			runtimeConf, err := python.ParseRuntimeConfig(conf, mgr.Logger())
+			if err != nil {
+				return nil, err
+			}
+			runtimeName, err := conf.FieldString("runtime")
+			if err != nil {
+				return nil, err
+			}
+			script, err := conf.FieldString("script")
+			if err != nil {
+				return nil, err
+			}
+			if err = python.AuditScript(mgr.Logger(), "script", script, runtimeConf.ScriptChecksums); err != nil {
+				return nil, err
+			}
+			interpreters, err := conf.FieldInt("interpreters")
+			if err != nil {
+				return nil, err
+			}
+			if interpreters < 1 {
+				return nil, errors.New("interpreters must be at least 1")
+			}
+
+			i, err := newPythonAsgiInput(runtimeConf.Exe, runtimeConf.Mode, runtimeName, interpreters, mgr.Metrics(), mgr.Logger())
+			if err != nil {
+				return nil, err
+			}
+			i.script = script
+			i.path = runtimeConf.Path
+			i.environment = runtimeConf.Environment
+			i.preload = runtimeConf.Preload
+			i.requires = runtimeConf.Requires
+			i.shutdownTimeout = runtimeConf.ShutdownTimeout
+			if i.appName, err = conf.FieldString("app"); err != nil {
+				return nil, err
+			}
+			if i.iface, err = conf.FieldString("interface"); err != nil {
+				return nil, err
+			}
+			if i.address, err = conf.FieldString("address"); err != nil {
+				return nil, err
+			}
+			if i.timeout, err = conf.FieldDuration("timeout"); err != nil {
+				return nil, err
+			}
+			if i.syncResponse, err = conf.FieldBool("sync_response"); err != nil {
+				return nil, err
+			}
+			return i, nil
+		})
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+// newPythonAsgiInput creates a python_asgi input using up to cnt interpreters
+// to handle requests.
+func newPythonAsgiInput(exe string, mode python.Mode, runtimeName string, cnt int, metrics *service.Metrics, logger *service.Logger) (*pythonAsgiInput, error) {
+	var err error
+	var r python.Runtime
+
+	switch mode {
+	case python.IsolatedLegacy:
+		r, err = python.NewMultiInterpreterRuntime(exe, cnt, true, logger)
+	case python.Global:
+		r, err = python.NewSingleInterpreterRuntime(exe, cnt, logger)
+	case python.Isolated:
+		r, err = python.NewMultiInterpreterRuntime(exe, cnt, false, logger)
+	case python.FreeThreaded:
+		r, err = python.NewFreeThreadedRuntime(exe, cnt, logger)
+	default:
+		return nil, errors.New("invalid mode")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if runtimeName != "" {
+		r, err = python.ShareRuntime(runtimeName, exe, mode, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r = python.NewMeteredRuntime(r, metrics)
+
+	return &pythonAsgiInput{
+		logger:          logger,
+		runtime:         r,
+		iface:           "auto",
+		address:         "0.0.0.0:8000",
+		timeout:         5 * time.Second,
+		shutdownTimeout: 10 * time.Second,
+		apps:            make(map[int64]*asgiApp),
+		requests:        make(chan asgiRequest),
+	}, nil
+}
+
+func (i *pythonAsgiInput) Connect(ctx context.Context) error {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	if i.server != nil {
+		return nil
+	}
+
+	err := i.runtime.Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = i.runtime.Map(ctx, func(ticket *python.InterpreterTicket) error {
+		code, err := python.Compile(i.script, "__rp_connect_python_asgi__.py")
+		if err != nil {
+			return err
+		}
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+
+		// Provide our rpcn helper module, which also runs the application
+		// for each request.
+		rpcn, err := python.LoadRpcnModule()
+		if err != nil {
+			return err
+		}
+		py.PyDict_SetItemString(globals, "rpcn", rpcn)
+		serve := py.PyObject_GetAttrString(rpcn, "_serve_http")
+		if serve == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find _serve_http function in rpcn module")
+		}
+		// Hold on to the module while we serve from it, as globals may be
+		// shared and outlive us.
+		py.Py_IncRef(rpcn)
+		state := &asgiApp{rpcn: rpcn, serve: serve}
+		i.apps[ticket.Id()] = state
+
+		// Send print() and friends to our logger.
+		if err = python.CaptureOutput(i.logger); err != nil {
+			return err
+		}
+
+		// Apply environment variables before running anything of the user's.
+		if err = python.SetEnvironment(i.environment); err != nil {
+			return err
+		}
+
+		// Make any local helper modules importable.
+		if err = python.ExtendSysPath(i.path); err != nil {
+			return err
+		}
+
+		// Fail fast, saying where we looked, if a dependency is missing.
+		if err = python.RequireModules(i.requires); err != nil {
+			return err
+		}
+
+		// Pay for slow imports now rather than on the first request.
+		if err = python.PreloadModules(i.preload); err != nil {
+			return err
+		}
+
+		// Execute the script to define our application.
+		result := py.PyEval_EvalCode(code, globals, py.NullPyObjectPtr)
+		if result == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to evaluate asgi input script")
+		}
+		py.Py_DecRef(result)
+
+		app := py.PyDict_GetItemString(globals, i.appName)
+		if app == py.NullPyObjectPtr {
+			return fmt.Errorf("failed to find python application '%s'", i.appName)
+		}
+		state.app = app
+		return nil
+	})
+	if err != nil {
+		// Try cleaning up if we had an issue.
+		i.release(ctx)
+		_ = i.runtime.Stop(ctx)
+		return err
+	}
+
+	listener, err := net.Listen("tcp", i.address)
+	if err != nil {
+		i.release(ctx)
+		_ = i.runtime.Stop(ctx)
+		return err
+	}
+	i.server = &http.Server{Handler: http.HandlerFunc(i.handle)}
+	go func(server *http.Server) {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			i.logger.Errorf("Python application server failed: %s", err)
+		}
+	}(i.server)
+	i.logger.Infof("Serving python application on %s", listener.Addr())
+	return nil
+}
+
+// handle runs a request through our application, turning a successful
+// response into a message and responding once it's delivered.
+func (i *pythonAsgiInput) handle(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), i.timeout)
+	defer cancel()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	status, headers, content, err := i.serve(ctx, r, body)
+	if err != nil {
+		i.logger.Errorf("Python application failed: %s", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if status < 200 || status > 299 {
+		// Nothing for the pipeline, e.g. the request wasn't valid.
+		writeResponse(w, status, headers, content)
+		return
+	}
+
+	m := service.NewMessage(content)
+	m.MetaSetMut("http_method", r.Method)
+	m.MetaSetMut("http_path", r.URL.Path)
+	m.MetaSetMut("http_query", r.URL.RawQuery)
+	for k, v := range r.Header {
+		if len(v) > 0 {
+			m.MetaSetMut(k, v[0])
+		}
+	}
+	var store *service.SyncResponseStore
+	if i.syncResponse {
+		m, store = m.WithSyncResponseStore()
+	}
+
+	req := asgiRequest{batch: service.MessageBatch{m}, ack: make(chan error, 1)}
+	select {
+	case i.requests <- req:
+	case <-ctx.Done():
+		http.Error(w, "Request Timeout", http.StatusRequestTimeout)
+		return
+	}
+	select {
+	case err = <-req.ack:
+	case <-ctx.Done():
+		http.Error(w, "Request Timeout", http.StatusRequestTimeout)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to deliver message", http.StatusBadGateway)
+		return
+	}
+
+	if store != nil {
+		for _, batch := range store.Read() {
+			for _, res := range batch {
+				data, err := res.AsBytes()
+				if err != nil {
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+				writeResponse(w, http.StatusOK, nil, data)
+				return
+			}
+		}
+	}
+	writeResponse(w, status, headers, content)
+}
+
+// serve calls our application with r and its body, returning its response.
+func (i *pythonAsgiInput) serve(ctx context.Context, r *http.Request, body []byte) (int, [][2]string, []byte, error) {
+	headers := make([][2]string, 0, len(r.Header))
+	for k, vs := range r.Header {
+		for _, v := range vs {
+			headers = append(headers, [2]string{k, v})
+		}
+	}
+	request, err := json.Marshal(map[string]any{
+		"method":  r.Method,
+		"path":    r.URL.Path,
+		"query":   r.URL.RawQuery,
+		"headers": headers,
+		"client":  hostPort(r.RemoteAddr),
+		"server":  hostPort(r.Host),
+	})
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	ticket, err := i.runtime.Acquire(ctx)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer func() { _ = i.runtime.Release(ticket) }()
+
+	var status int
+	var responseHeaders [][2]string
+	var content []byte
+	err = i.runtime.Apply(ticket, ctx, func() error {
+		app := i.apps[ticket.Id()]
+
+		args := py.PyTuple_New(4)
+		if args == py.NullPyObjectPtr {
+			return errors.New("failed to create python tuple")
+		}
+		defer py.Py_DecRef(args)
+		// Tuples steal our references.
+		py.Py_IncRef(app.app)
+		py.PyTuple_SetItem(args, 0, app.app)
+		py.PyTuple_SetItem(args, 1, py.PyUnicode_FromString(i.iface))
+		py.PyTuple_SetItem(args, 2, py.PyUnicode_FromString(string(request)))
+		py.PyTuple_SetItem(args, 3, py.PyBytes_FromStringAndSize(unsafe.SliceData(body), int64(len(body))))
+
+		result := py.PyObject_Call(app.serve, args, py.NullPyObjectPtr)
+		if result == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return fmt.Errorf("python application '%s' failed", i.appName)
+		}
+		defer py.Py_DecRef(result)
+
+		status = int(py.PyLong_AsLong(py.PyTuple_GetItem(result, 0)))
+		encoded, err := py.UnicodeToString(py.PyTuple_GetItem(result, 1))
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal([]byte(encoded), &responseHeaders); err != nil {
+			return err
+		}
+		// Copy out of memory managed by Python.
+		data := py.PyTuple_GetItem(result, 2)
+		content = make([]byte, py.PyBytes_Size(data))
+		copy(content, unsafe.Slice(py.PyBytes_AsString(data), len(content)))
+		return nil
+	})
+	return status, responseHeaders, content, err
+}
+
+// hostPort splits an address into a host and port pair for the application.
+func hostPort(addr string) []any {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return []any{addr, 0}
+	}
+	p, _ := strconv.Atoi(port)
+	return []any{host, p}
+}
+
+// writeResponse writes a response with the given status, headers, and body.
+func writeResponse(w http.ResponseWriter, status int, headers [][2]string, body []byte) {
+	for _, h := range headers {
+		w.Header().Add(h[0], h[1])
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+func (i *pythonAsgiInput) ReadBatch(ctx context.Context) (service.MessageBatch, service.AckFunc, error) {
+	select {
+	case req := <-i.requests:
+		return req.batch, func(ctx context.Context, err error) error {
+			req.ack <- err
+			return nil
+		}, nil
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
+
+func (i *pythonAsgiInput) Close(ctx context.Context) error {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	if i.server == nil {
+		// Never connected, or already torn down.
+		return nil
+	}
+
+	// Let requests in flight finish before stopping the application.
+	if err := i.server.Shutdown(ctx); err != nil {
+		i.logger.Warnf("Failed to shut down python application server: %s", err)
+	}
+	i.server = nil
+
+	i.release(ctx)
+	return python.StopWithDeadline(ctx, i.runtime, i.shutdownTimeout, i.logger)
+}
+
+// release drops the references our apps hold in each interpreter.
+func (i *pythonAsgiInput) release(ctx context.Context) {
+	_ = i.runtime.Map(ctx, func(ticket *python.InterpreterTicket) error {
+		app, ok := i.apps[ticket.Id()]
+		if !ok {
+			return nil
+		}
+		delete(i.apps, ticket.Id())
+		py.Py_DecRef(app.serve)
+		py.Py_DecRef(app.rpcn)
+		return nil
+	})
+}
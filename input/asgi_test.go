@@ -0,0 +1,146 @@
+package input
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+)
+
+// Applications uppercasing the request body, rejecting requests for /bad.
+const (
+	asgiApplication = `
+async def app(scope, receive, send):
+    event = await receive()
+    status = 422 if scope["path"] == "/bad" else 201
+    await send({"type": "http.response.start", "status": status, "headers": [(b"x-app", b"asgi")]})
+    await send({"type": "http.response.body", "body": event["body"].upper()})
+`
+	wsgiApplication = `
+def app(environ, start_response):
+    body = environ["wsgi.input"].read()
+    status = "422 Unprocessable Entity" if environ["PATH_INFO"] == "/bad" else "201 Created"
+    start_response(status, [("X-App", "wsgi")])
+    return [body.upper()]
+`
+)
+
+// newTestAsgiInput connects a python_asgi input serving the app defined by
+// script. Messages it reads are passed to respond, if not nil, before being
+// acknowledged, and then sent on the returned channel.
+func newTestAsgiInput(t *testing.T, script string, syncResponse bool, respond func(*service.Message)) (*pythonAsgiInput, <-chan *service.Message) {
+	t.Helper()
+	i, err := newPythonAsgiInput("python3", python.Global, "", 1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.script = script
+	i.address = "127.0.0.1:0"
+	i.syncResponse = syncResponse
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err = i.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		if err := i.Close(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+
+	msgs := make(chan *service.Message, 16)
+	go func() {
+		for {
+			batch, ack, err := i.ReadBatch(ctx)
+			if err != nil {
+				return
+			}
+			for _, m := range batch {
+				if respond != nil {
+					respond(m)
+				}
+				msgs <- m
+			}
+			_ = ack(ctx, nil)
+		}
+	}()
+	return i, msgs
+}
+
+// Test that successful responses of ASGI and WSGI applications become
+// messages, while others are passed straight back to the client.
+func TestAsgiInputServesApplications(t *testing.T) {
+	for _, app := range []struct{ iface, script string }{
+		{"asgi", asgiApplication},
+		{"wsgi", wsgiApplication},
+	} {
+		t.Run(app.iface, func(t *testing.T) {
+			i, msgs := newTestAsgiInput(t, app.script, false, nil)
+
+			w := httptest.NewRecorder()
+			i.handle(w, httptest.NewRequest("POST", "/ok?x=1", strings.NewReader("hello")))
+			if w.Code != 201 {
+				t.Fatalf("expected status 201, got %d", w.Code)
+			}
+			if w.Body.String() != "HELLO" {
+				t.Fatalf("expected body 'HELLO', got '%s'", w.Body.String())
+			}
+			if w.Header().Get("X-App") != app.iface {
+				t.Fatalf("expected header X-App '%s', got '%s'", app.iface, w.Header().Get("X-App"))
+			}
+
+			m := <-msgs
+			data, err := m.AsBytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "HELLO" {
+				t.Fatalf("expected message 'HELLO', got '%s'", data)
+			}
+			for key, expected := range map[string]string{"http_method": "POST", "http_path": "/ok", "http_query": "x=1"} {
+				if value, _ := m.MetaGet(key); value != expected {
+					t.Fatalf("expected %s '%s', got '%s'", key, expected, value)
+				}
+			}
+
+			w = httptest.NewRecorder()
+			i.handle(w, httptest.NewRequest("POST", "/bad", strings.NewReader("nope")))
+			if w.Code != 422 {
+				t.Fatalf("expected status 422, got %d", w.Code)
+			}
+			if w.Body.String() != "NOPE" {
+				t.Fatalf("expected body 'NOPE', got '%s'", w.Body.String())
+			}
+			select {
+			case m = <-msgs:
+				t.Fatal("expected no message for a rejected request")
+			default:
+			}
+		})
+	}
+}
+
+// Test that sync_response responds with what the pipeline made of the
+// message rather than the application's response.
+func TestAsgiInputSyncResponse(t *testing.T) {
+	i, msgs := newTestAsgiInput(t, asgiApplication, true, func(m *service.Message) {
+		m.SetBytes([]byte("from the pipeline"))
+		if err := m.AddSyncResponse(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	w := httptest.NewRecorder()
+	i.handle(w, httptest.NewRequest("POST", "/ok", strings.NewReader("hello")))
+	if w.Code != 200 {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if w.Body.String() != "from the pipeline" {
+		t.Fatalf("expected body 'from the pipeline', got '%s'", w.Body.String())
+	}
+	<-msgs
+}
@@ -8,6 +8,10 @@ import (
 	"github.com/redpanda-data/benthos/v4/public/service"
 	py "github.com/voutilad/gogopython"
 	"github.com/voutilad/rp-connect-python/internal/impl/python"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
+	"time"
 	"unsafe"
 )
 
@@ -21,47 +25,194 @@ const (
 	Object                    // A single Python Object.
 )
 
+// What the ack function is given for each acknowledged item.
+const (
+	ackWithIDs      = "ids"      // Items counted from 0 in the order generated.
+	ackWithPayloads = "payloads" // Objects if not serialized, else message bytes.
+)
+
 type pythonInput struct {
-	logger    *service.Logger
-	runtime   python.Runtime
-	generator py.PyObjectPtr
-	mode      inputMode
-	globals   py.PyObjectPtr
-	code      py.PyCodeObjectPtr
-
-	serializer     *python.Serializer
+	logger         *service.Logger
+	runtime        python.Runtime
 	serializerMode python.SerializerMode
+	csv            python.CSVOptions // Options of the csv serializer.
+	jsonLibrary    string            // Library encoding JSON, if not json.
+	compression    string            // Codec compressing payloads, if any.
+	messageDicts   bool              // Whether to unpack message dicts.
 
-	args          py.PyObjectPtr
-	kwargs        py.PyObjectPtr
 	script        string
+	path          []string
+	scriptDir     string // Directory of a multi-file project, if any.
+	entryModule   string // Module of scriptDir to import.
+	environment   map[string]string
+	preload       []string
+	requires      []string
+	readyFn       string
+	ackFn         string
+	ackWith       string // One of the ackWith values.
+	shutdown      time.Duration
 	generatorName string
-	idx           int64
 	batchSize     int
-	boundsHint    int64
+	shard         int // Share of the work we take, of totalShards.
+	totalShards   int
+	identity      python.Identity
+	connected     bool // Whether our runtime is started and initialized.
+
+	mtx          sync.RWMutex
+	interpreters map[int64]*interpreter // Protected by mtx.
+	queue        []pending              // Batches read ahead of being asked for. Protected by mtx.
+	nextID       int64                  // Id of the next message read. Protected by mtx.
+
+	ackMtx sync.Mutex
+	acked  acked // Items acknowledged since the ack function was last called.
+
+	tracer         trace.Tracer
+	spanAttributes []attribute.KeyValue
+}
+
+// prefetch is how many batches a read pulls from the generator at once, so
+// fast generators don't pay for acquiring an interpreter on every batch.
+const prefetch = 4
+
+// pending is a batch read ahead of being asked for.
+type pending struct {
+	batch service.MessageBatch
+	objs  []py.PyObjectPtr // Objects the batch references, if not serialized.
+	first int64            // Id of the first message in the batch.
+}
+
+// acked holds the acknowledged items awaiting our ack function.
+type acked struct {
+	ids      []int64
+	payloads [][]byte
+	objs     []py.PyObjectPtr // Objects we hold references to.
+}
+
+// interpreter holds the state for our script in a particular interpreter.
+// Each interpreter runs the script, so each has a generator of its own.
+type interpreter struct {
+	globals    py.PyObjectPtr
+	code       py.PyCodeObjectPtr
+	generator  py.PyObjectPtr
+	mode       inputMode
+	serializer *python.Serializer
+	idx        int64
+	boundsHint int64
+	exhausted  bool // Whether the generator has nothing more to give. Protected by pythonInput.mtx.
+
+	// Resolved once on connecting, rather than on every read.
+	next    func() (obj py.PyObjectPtr, owned, ok bool)
+	pack    func(batch service.MessageBatch, obj py.PyObjectPtr) (service.MessageBatch, error)
+	readyFn py.PyObjectPtr // Our ready function, if any.
+	ackFn   py.PyObjectPtr // Our ack function, if any.
+	control py.PyObjectPtr // Describes control messages, like tombstones.
+
+	listType py.PyObjectPtr // For building lists to give our ack function.
 }
 
 var configSpec = service.NewConfigSpec().
 	Summary("Generate data with Python.").
 	Field(service.NewStringField("script").
-		Description("Python code to execute.")).
-	Field(service.NewStringField("exe").
-		Description("Path to a Python executable.").
-		Default("python3")).
+		Description("Python code to execute. Optional if `script_dir` is set.").
+		Default("")).
+	Fields(python.RuntimeFields()...).
+	Field(python.SharedRuntimeField()).
+	Field(service.NewObjectField("debug",
+		service.NewStringField("address").
+			Description("Host and port for debugpy to listen on, e.g. `localhost:5678`. Disabled if empty.").
+			Default(""),
+		service.NewBoolField("wait").
+			Description("Whether to wait for a debugger to attach before running any scripts.").
+			Default(false)).
+		Description("Start [debugpy](https://github.com/microsoft/debugpy) in the main interpreter so a debugger can attach and stop at breakpoints, e.g. `breakpoint()` calls, in scripts while they handle real traffic. Requires the `debugpy` module and `global` mode. As the debugger is process-wide, all components must agree on its address.").
+		Advanced()).
+	Field(service.NewObjectField("schema_registry",
+		service.NewStringField("url").
+			Description("Base URL of the schema registry. Disabled if empty.").
+			Example("http://localhost:8081").
+			Default(""),
+		service.NewStringField("username").
+			Description("Username for basic authentication, if required.").
+			Default(""),
+		service.NewStringField("password").
+			Description("Password for basic authentication, if required.").
+			Secret().
+			Default("")).
+		Description("Bind `rpcn.schema_registry` to a Confluent-compatible schema registry, for framing Avro, Protobuf, and JSON schema payloads in its wire format from scripts. As interpreters may be shared, all components must agree on the registry.").
+		Advanced()).
+	Field(service.NewStringField("script_dir").
+		Description("Directory of a multi-file Python project backing the input. It's made importable and its `entry_module` imported, like `from main import *`, before `script` runs, so the object named by `name` may be defined by the project instead. If the directory has an `__init__.py`, the entry module is imported from it as a package so relative imports work.").
+		Example("./my_source").
+		Default("")).
+	Field(service.NewStringField("entry_module").
+		Description("Module of `script_dir` to import.").
+		Default("main")).
+	Field(service.NewObjectField("identity",
+		service.NewStringField("stream").
+			Description("Name of the stream, e.g. in streams mode, made available to scripts as `identity.stream`.").
+			Example("${STREAM_NAME}").
+			Default(""),
+		service.NewStringField("pipeline_id").
+			Description("Id of the pipeline, e.g. per deployment, made available to scripts as `identity.pipeline`.").
+			Default("")).
+		Description("Identity of the deployment made available to the script as `identity`, along with the component's `label` as `identity.label`, so logs, metrics, and external checkpoints written from Python can be namespaced per deployment.").
+		Advanced()).
 	Field(service.NewStringField("name").
 		Description("Name of python function to call or object to read for generating data.").
 		Default("read")).
+	Field(service.NewStringField("ready_function").
+		Description("Name of a Python function, defined by the script, called with no arguments after the script runs until it returns a true value, e.g. once a model loading in the background is available. The input isn't connected, and so the pipeline isn't ready, until then.").
+		Example("ready").
+		Optional()).
+	Field(service.NewStringField("ack_function").
+		Description("Name of a Python function, defined by the script, called with a list of the items acknowledged since it was last called, e.g. to commit offsets upstream. Acknowledgements are coalesced and handed over when the input next reads from the generator or closes, so busy sources make one call per read rather than one per message.").
+		Example("acked").
+		Optional()).
+	Field(service.NewStringEnumField("ack_with", ackWithIDs, ackWithPayloads).
+		Description("What the ack function is given for each acknowledged item: `ids`, counting messages from 0 in the order they were generated, or `payloads`, the objects generated if the serializer is `none` and the bytes of the messages otherwise.").
+		Advanced().
+		Default(ackWithIDs)).
 	Field(service.NewIntField("batch_size").
-		Description("Size of batches to generate.").
+		Description("Size of batches to generate. A few batches are read from the generator at a time, so it may be called ahead of the pipeline asking for more.").
+		Default(1)).
+	Field(service.NewIntField("shard").
+		Description("Which of `total_shards` shares of the work this instance takes, counting from 0, made available to the script as `shard`. When running several replicas, e.g. in streams mode, sources can use it to split their work deterministically, say with `${SHARD}` from the environment.").
+		Default(0)).
+	Field(service.NewIntField("total_shards").
+		Description("How many instances share the work, made available to the script as `total_shards`.").
+		Default(1)).
+	Field(service.NewIntField("interpreters").
+		Description("Number of interpreters to read from. Each runs the script, so each generates its own messages, which are read in turn. Most useful with the isolated modes.").
 		Default(1)).
-	Field(service.NewStringField("mode").
-		Description("Toggle different Python runtime modes.").
-		Examples(string(python.Global), string(python.Isolated), string(python.IsolatedLegacy)).
-		Default(string(python.Global))).
 	Field(service.NewStringField("serializer").
 		Description("Serialization mode to use on results.").
-		Examples(string(python.None), string(python.Pickle), string(python.Bloblang)).
-		Default(string(python.Bloblang)))
+		Examples(string(python.None), string(python.Pickle), string(python.Bloblang), string(python.CSV), string(python.CBOR), string(python.BSON)).
+		Default(string(python.Bloblang))).
+	Field(service.NewObjectField("csv",
+		service.NewStringListField("columns").
+			Description("Names of the columns, in order. Inferred from the keys of the first dict if empty.").
+			Default([]string{}),
+		service.NewStringField("delimiter").
+			Description("Character separating fields.").
+			Default(","),
+		service.NewStringEnumField("header", python.CSVHeaderNone, python.CSVHeaderFirst, python.CSVHeaderEvery).
+			Description("Whether to put a line of column names before the first row, before every row, or not at all.").
+			Default(python.CSVHeaderFirst)).
+		Description("How the `csv` serializer writes rows, converting each dict, tuple, or list yielded to a CSV line for legacy consumers.").
+		Advanced()).
+	Field(service.NewStringEnumField("compression", python.CompressionNone, python.CompressionGzip, python.CompressionZstd).
+		Description("Compress the payload of each message, e.g. large generated blobs, naming the codec in the `content_encoding` metadata. `zstd` requires Python 3.14 or the `zstandard` module.").
+		Advanced().
+		Default(python.CompressionNone)).
+	Field(service.NewBoolField("message_dicts").
+		Description("Treat a dict of the form `{\"content\": ..., \"meta\": {...}, \"key\": ...}`, where only `content` is required, as the payload, metadata, and key of a message. The key is set in the `key` metadata.").
+		Advanced().
+		Default(false)).
+	Field(service.NewStringEnumField("json_library", python.JSONLibraryAuto, python.JSONLibraryJSON, python.JSONLibraryOrjson, python.JSONLibraryUjson).
+		Description("Library encoding dicts, lists, and tuples as JSON. `orjson` is several times faster than the standard `json` module and also handles datetimes and numpy arrays, while `auto` uses `orjson` or `ujson` if installed, falling back to `json`.").
+		Advanced().
+		Default(python.JSONLibraryJSON)).
+	LintRule(`root = python_syntax_error("script", this.script | "", this.exe | "python3")`)
 
 func noOpAckFn(_ context.Context, _ error) error { return nil }
 
@@ -69,18 +220,62 @@ func init() {
 	err := service.RegisterBatchInput("python", configSpec,
 		func(conf *service.ParsedConfig, mgr *service.Resources) (service.BatchInput, error) {
 			// Extract our configuration.
-			exe, err := conf.FieldString("exe")
+			runtimeConf, err := python.ParseRuntimeConfig(conf, mgr.Logger())
 			if err != nil {
-				panic(err)
+				return nil, err
+			}
+			scriptDir, err := conf.FieldString("script_dir")
+			if err != nil {
+				return nil, err
+			}
+			entryModule, err := conf.FieldString("entry_module")
+			if err != nil {
+				return nil, err
+			}
+			identity, err := python.ParseIdentity(conf, mgr)
+			if err != nil {
+				return nil, err
+			}
+			runtimeName, err := conf.FieldString("runtime")
+			if err != nil {
+				return nil, err
 			}
 			script, err := conf.FieldString("script")
 			if err != nil {
 				return nil, err
 			}
-			mode, err := conf.FieldString("mode")
+			if err = python.AuditScript(mgr.Logger(), "script", script, runtimeConf.ScriptChecksums); err != nil {
+				return nil, err
+			}
+			if script == "" && scriptDir == "" {
+				return nil, errors.New("either script or script_dir is required")
+			}
+			debugAddress, err := conf.FieldString("debug", "address")
+			if err != nil {
+				return nil, err
+			}
+			debugWait, err := conf.FieldBool("debug", "wait")
+			if err != nil {
+				return nil, err
+			}
+			if err = python.SetDebugger(debugAddress, debugWait, runtimeConf.Mode); err != nil {
+				return nil, err
+			}
+			registryURL, err := conf.FieldString("schema_registry", "url")
 			if err != nil {
 				return nil, err
 			}
+			registryUsername, err := conf.FieldString("schema_registry", "username")
+			if err != nil {
+				return nil, err
+			}
+			registryPassword, err := conf.FieldString("schema_registry", "password")
+			if err != nil {
+				return nil, err
+			}
+			if err = python.SetSchemaRegistry(registryURL, registryUsername, registryPassword); err != nil {
+				return nil, err
+			}
 			name, err := conf.FieldString("name")
 			if err != nil {
 				return nil, err
@@ -89,12 +284,70 @@ func init() {
 			if err != nil {
 				return nil, err
 			}
+			shard, err := conf.FieldInt("shard")
+			if err != nil {
+				return nil, err
+			}
+			totalShards, err := conf.FieldInt("total_shards")
+			if err != nil {
+				return nil, err
+			}
+			if totalShards < 1 || shard < 0 || shard >= totalShards {
+				return nil, fmt.Errorf("shard must be between 0 and total_shards (%d), got %d", totalShards, shard)
+			}
+			interpreters, err := conf.FieldInt("interpreters")
+			if err != nil {
+				return nil, err
+			}
+			if interpreters < 1 {
+				return nil, errors.New("interpreters must be at least 1")
+			}
+			readyFn := ""
+			if conf.Contains("ready_function") {
+				readyFn, err = conf.FieldString("ready_function")
+				if err != nil {
+					return nil, err
+				}
+			}
+			ackFn := ""
+			if conf.Contains("ack_function") {
+				ackFn, err = conf.FieldString("ack_function")
+				if err != nil {
+					return nil, err
+				}
+			}
+			ackWith, err := conf.FieldString("ack_with")
+			if err != nil {
+				return nil, err
+			}
 			serializerMode, err := conf.FieldString("serializer")
 			if err != nil {
 				return nil, err
 			}
+			var csv python.CSVOptions
+			if csv.Columns, err = conf.FieldStringList("csv", "columns"); err != nil {
+				return nil, err
+			}
+			if csv.Delimiter, err = conf.FieldString("csv", "delimiter"); err != nil {
+				return nil, err
+			}
+			if csv.Header, err = conf.FieldString("csv", "header"); err != nil {
+				return nil, err
+			}
+			jsonLibrary, err := conf.FieldString("json_library")
+			if err != nil {
+				return nil, err
+			}
+			compression, err := conf.FieldString("compression")
+			if err != nil {
+				return nil, err
+			}
+			messageDicts, err := conf.FieldBool("message_dicts")
+			if err != nil {
+				return nil, err
+			}
 
-			return newPythonInput(exe, script, name, batchSize, python.StringAsMode(mode), python.StringAsSerializerMode(serializerMode), mgr.Logger())
+			return newPythonInput(runtimeConf.Exe, script, runtimeConf.Path, scriptDir, entryModule, runtimeConf.Environment, runtimeConf.Preload, runtimeConf.Requires, readyFn, ackFn, ackWith, name, batchSize, shard, totalShards, identity, runtimeConf.Mode, runtimeName, interpreters, runtimeConf.ShutdownTimeout, python.StringAsSerializerMode(serializerMode), csv, jsonLibrary, compression, messageDicts, mgr.Metrics(), mgr.OtelTracer(), mgr.Logger())
 		})
 
 	if err != nil {
@@ -102,40 +355,74 @@ func init() {
 	}
 }
 
-func newPythonInput(exe, script, name string, batchSize int, mode python.Mode, serializer python.SerializerMode, logger *service.Logger) (service.BatchInput, error) {
+func newPythonInput(exe, script string, path []string, scriptDir, entryModule string, environment map[string]string, preload, requires []string, readyFn, ackFn, ackWith string, name string, batchSize, shard, totalShards int, identity python.Identity, mode python.Mode, runtimeName string, cnt int, shutdownTimeout time.Duration, serializer python.SerializerMode, csv python.CSVOptions, jsonLibrary, compression string, messageDicts bool, metrics *service.Metrics, tracer trace.TracerProvider, logger *service.Logger) (service.BatchInput, error) {
 	var err error
 	var r python.Runtime
 
 	// XXX for now, enforce that we only support non-serializing modes when
-	// using a global interpreter mode.
-	if serializer == python.None && mode != python.Global {
+	// using the main interpreter.
+	if serializer == python.None && mode != python.Global && mode != python.FreeThreaded {
 		return nil,
 			errors.New("isolated interpreters require bloblang or pickle serialization")
 	}
+	if serializer == python.Avro {
+		return nil, errors.New("avro serialization is only supported by the python processor")
+	}
+	if serializer == python.None && compression != "" && compression != python.CompressionNone {
+		return nil, errors.New("compression requires serialization")
+	}
 
 	switch mode {
 	case python.IsolatedLegacy:
-		r, err = python.NewMultiInterpreterRuntime(exe, 1, true, logger)
+		r, err = python.NewMultiInterpreterRuntime(exe, cnt, true, logger)
 	case python.Global:
-		r, err = python.NewSingleInterpreterRuntime(exe, 1, logger)
+		r, err = python.NewSingleInterpreterRuntime(exe, cnt, logger)
 	case python.Isolated:
-		r, err = python.NewMultiInterpreterRuntime(exe, 1, false, logger)
+		r, err = python.NewMultiInterpreterRuntime(exe, cnt, false, logger)
+	case python.FreeThreaded:
+		r, err = python.NewFreeThreadedRuntime(exe, cnt, logger)
 	default:
 		return nil, errors.New("invalid mode")
 	}
 	if err != nil {
 		return nil, err
 	}
+	if runtimeName != "" {
+		r, err = python.ShareRuntime(runtimeName, exe, mode, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r = python.NewMeteredRuntime(r, metrics)
 
 	// TODO: do we want nacks?
 	return &pythonInput{
 		logger:         logger,
 		runtime:        r,
 		script:         script,
+		path:           path,
+		scriptDir:      scriptDir,
+		entryModule:    entryModule,
+		environment:    environment,
+		preload:        preload,
+		requires:       requires,
+		readyFn:        readyFn,
+		ackFn:          ackFn,
+		ackWith:        ackWith,
+		shutdown:       shutdownTimeout,
 		generatorName:  name,
 		batchSize:      batchSize,
-		boundsHint:     -1,
+		shard:          shard,
+		totalShards:    totalShards,
+		identity:       identity,
 		serializerMode: serializer,
+		csv:            csv,
+		jsonLibrary:    jsonLibrary,
+		compression:    compression,
+		messageDicts:   messageDicts,
+		interpreters:   make(map[int64]*interpreter),
+		tracer:         tracer.Tracer(python.TracerName),
+		spanAttributes: python.SpanAttributes(mode, script),
 	}, nil
 }
 
@@ -145,39 +432,68 @@ func (p *pythonInput) Connect(ctx context.Context) error {
 		return err
 	}
 
-	err = p.runtime.Map(ctx, func(_ *python.InterpreterTicket) error {
+	err = p.runtime.Map(ctx, func(ticket *python.InterpreterTicket) error {
 		// Compile our script early to detect syntax errors.
-		code := py.Py_CompileString(p.script, "__rp_connect_python_input__.py", py.PyFileInput)
-		if code == py.NullPyCodeObjectPtr {
-			py.PyErr_Print()
-			return errors.New("failed to compile python script")
+		code, err := python.Compile(p.script, "__rp_connect_python_input__.py")
+		if err != nil {
+			return err
 		}
-		p.code = code
 
-		main := py.PyImport_AddModule("__main__")
-		if main == py.NullPyObjectPtr {
-			return errors.New("failed to add __main__ module")
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
 		}
-		globals := py.PyModule_GetDict(main)
-		if globals == py.NullPyObjectPtr {
-			return errors.New("failed to create globals")
+
+		i := &interpreter{
+			globals:    globals,
+			code:       code,
+			boundsHint: -1,
 		}
 
-		kwargs := py.PyDict_New()
-		if kwargs == py.NullPyObjectPtr {
-			return errors.New("failed to create new state dict")
+		// Send print() and friends to our logger.
+		if err = python.CaptureOutput(p.logger); err != nil {
+			return err
+		}
+
+		// Apply environment variables before running anything of the user's.
+		if err = python.SetEnvironment(p.environment); err != nil {
+			return err
 		}
-		args := py.PyTuple_New(0)
-		if args == py.NullPyObjectPtr {
-			return errors.New("failed to create new tuple")
+
+		// Make any local helper modules importable.
+		if err = python.ExtendSysPath(p.path); err != nil {
+			return err
 		}
 
-		p.globals = globals
-		p.args = args
-		p.kwargs = kwargs
+		// Fail fast, saying where we looked, if a dependency is missing.
+		if err = python.RequireModules(p.requires); err != nil {
+			return err
+		}
+
+		// Pay for slow imports now rather than on the first read.
+		if err = python.PreloadModules(p.preload); err != nil {
+			return err
+		}
+
+		// Bring in the project backing us, if any.
+		if err = python.ImportPackage(p.scriptDir, p.entryModule, i.globals); err != nil {
+			return err
+		}
+
+		// Tell the script which share of the work is ours.
+		for name, value := range map[string]int{"shard": p.shard, "total_shards": p.totalShards} {
+			obj := py.PyLong_FromLong(int64(value))
+			py.PyDict_SetItemString(i.globals, name, obj)
+			py.Py_DecRef(obj)
+		}
+
+		// Tell the script who we are.
+		if err = python.SetIdentity(i.globals, p.identity); err != nil {
+			return err
+		}
 
 		// Execute the script to establish our data generating object.
-		result := py.PyEval_EvalCode(code, p.globals, py.NullPyObjectPtr)
+		result := py.PyEval_EvalCode(code, i.globals, py.NullPyObjectPtr)
 		if result == py.NullPyObjectPtr {
 			py.PyErr_Print()
 			return errors.New("failed to evaluate input script")
@@ -185,195 +501,472 @@ func (p *pythonInput) Connect(ctx context.Context) error {
 		defer py.Py_DecRef(result)
 
 		// Find our data generator.
-		obj := py.PyDict_GetItemString(p.globals, p.generatorName)
+		obj := py.PyDict_GetItemString(i.globals, p.generatorName)
 		if obj == py.NullPyObjectPtr {
 			return errors.New(fmt.Sprintf("failed to find python data generator object '%s'", p.generatorName))
 		}
 
 		switch t := py.BaseType(obj); t {
 		case py.Generator:
-			p.mode = Iterable
+			i.mode = Iterable
 			p.logger.Debug("generating data from an iterable")
 		case py.List:
-			p.mode = List
-			p.boundsHint = py.PyList_Size(obj)
+			i.mode = List
+			i.boundsHint = py.PyList_Size(obj)
 			p.logger.Debug("generating data from list")
 		case py.Tuple:
-			p.mode = Tuple
-			p.boundsHint = py.PyTuple_Size(obj)
+			i.mode = Tuple
+			i.boundsHint = py.PyTuple_Size(obj)
 			p.logger.Debug("generating data from a tuple")
 		case py.Function:
-			p.mode = Callable
+			i.mode = Callable
 			p.logger.Debug("generating data from a callable")
 		default:
-			p.mode = Object
-			p.boundsHint = 1
+			i.mode = Object
+			i.boundsHint = 1
 			p.logger.Debug("generating data from a single object")
 		}
-		p.generator = obj
+		i.generator = obj
+		i.next = i.reader()
+
+		if p.readyFn != "" {
+			i.readyFn = py.PyDict_GetItemString(i.globals, p.readyFn)
+			if i.readyFn == py.NullPyObjectPtr {
+				return fmt.Errorf("failed to find python function '%s'", p.readyFn)
+			}
+		}
+		if p.ackFn != "" {
+			i.ackFn = py.PyDict_GetItemString(i.globals, p.ackFn)
+			if i.ackFn == py.NullPyObjectPtr {
+				return fmt.Errorf("failed to find python function '%s'", p.ackFn)
+			}
+
+			// We need the list type for handing over acknowledged items.
+			builtins := py.PyImport_ImportModule("builtins")
+			if builtins == py.NullPyObjectPtr {
+				py.PyErr_Print()
+				return errors.New("failed to import builtins module")
+			}
+			i.listType = py.PyObject_GetAttrString(builtins, "list")
+			py.Py_DecRef(builtins)
+			if i.listType == py.NullPyObjectPtr {
+				return errors.New("failed to find list type")
+			}
+		}
 
 		serializer, err := python.NewSerializer()
 		if err != nil {
 			return err
 		}
-		p.serializer = serializer
+		if p.serializerMode == python.CSV {
+			if err = serializer.SetCSV(p.csv); err != nil {
+				return err
+			}
+		}
+		if p.serializerMode == python.CBOR {
+			if err = serializer.SetCBOR(); err != nil {
+				return err
+			}
+		}
+		if p.serializerMode == python.BSON {
+			if err = serializer.SetBSON(); err != nil {
+				return err
+			}
+		}
+		if p.compression != "" {
+			if err = serializer.SetCompression(p.compression); err != nil {
+				return err
+			}
+		}
+		if p.jsonLibrary != "" {
+			library, err := serializer.SetJSONLibrary(p.jsonLibrary)
+			if err != nil {
+				return err
+			}
+			p.logger.Debugf("Encoding JSON with %s.", library)
+		}
+		i.serializer = serializer
+		i.pack = p.packer(serializer)
+		if p.messageDicts {
+			i.pack = unpackMessageDicts(i.pack, serializer)
+		}
+		if i.control, err = python.LoadControl(); err != nil {
+			return err
+		}
+		i.pack = unpackControl(i.pack, i.control, serializer)
 
+		p.mtx.Lock()
+		p.interpreters[ticket.Id()] = i
+		p.mtx.Unlock()
 		return nil
 	})
 
+	// Hold off until the script says it's ready.
+	if err == nil && p.readyFn != "" {
+		err = python.WaitUntilReady(ctx, p.runtime, p.ready, p.logger)
+	}
+
 	if err != nil {
 		// Try cleaning up if we had an issue.
 		_ = p.runtime.Stop(ctx)
+		return err
 	}
-	return err
+	p.connected = true
+	return nil
+}
+
+// ready calls our ready function, reporting whether it returned a true value.
+//
+// The caller must manage the interpreter state for this to succeed.
+func (p *pythonInput) ready(ticket *python.InterpreterTicket) (bool, error) {
+	i, ok := p.stateFor(ticket)
+	if !ok {
+		return false, service.ErrNotConnected
+	}
+	result := py.PyObject_CallNoArgs(i.readyFn)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return false, fmt.Errorf("python function '%s' failed", p.readyFn)
+	}
+	defer py.Py_DecRef(result)
+	return python.IsTrue(result)
 }
 
 func (p *pythonInput) ReadBatch(ctx context.Context) (service.MessageBatch, service.AckFunc, error) {
-	ticket, err := p.runtime.Acquire(ctx)
+	// Reading from an interpreter with nothing more to give marks it
+	// exhausted, so this ends once all are.
+	for {
+		if batch, ackFn, ok := p.pop(); ok {
+			return batch, ackFn, nil
+		}
+		if err := p.readAhead(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// stateFor looks up the state of the ticket's interpreter, which is missing
+// if we're not connected.
+func (p *pythonInput) stateFor(ticket *python.InterpreterTicket) (*interpreter, bool) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	i, ok := p.interpreters[ticket.Id()]
+	return i, ok
+}
+
+// remaining counts the interpreters whose generators may have more to give.
+func (p *pythonInput) remaining() int {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	remaining := 0
+	for _, i := range p.interpreters {
+		if !i.exhausted {
+			remaining++
+		}
+	}
+	return remaining
+}
+
+// acquire acquires an interpreter whose generator may have more to give,
+// returning service.ErrEndOfInput once all are exhausted. Exhausted ones are
+// held on to while looking, so they aren't handed to us again.
+func (p *pythonInput) acquire(ctx context.Context) (*python.InterpreterTicket, *interpreter, error) {
+	var exhausted []*python.InterpreterTicket
+	defer func() {
+		for _, ticket := range exhausted {
+			_ = p.runtime.Release(ticket)
+		}
+	}()
+
+	for {
+		if p.remaining() == 0 {
+			return nil, nil, service.ErrEndOfInput
+		}
+
+		ticket, err := p.runtime.Acquire(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Look up our previously initialized interpreter state. It's gone if
+		// we were torn down while waiting.
+		i, ok := p.stateFor(ticket)
+		if !ok {
+			_ = p.runtime.Release(ticket)
+			return nil, nil, service.ErrNotConnected
+		}
+		p.mtx.RLock()
+		done := i.exhausted
+		p.mtx.RUnlock()
+		if !done {
+			return ticket, i, nil
+		}
+		exhausted = append(exhausted, ticket)
+	}
+}
+
+// readAhead reads a few batches from one of our interpreters into our queue,
+// leaving it empty and marking the interpreter exhausted if it had nothing.
+func (p *pythonInput) readAhead(ctx context.Context) error {
+	ticket, i, err := p.acquire(ctx)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer func() { _ = p.runtime.Release(ticket) }()
 
-	batch := service.MessageBatch{}
-	var objs []py.PyObjectPtr
+	var queue []pending
 
+	_, span := p.tracer.Start(ctx, "python.read", trace.WithAttributes(p.spanAttributes...))
 	err = p.runtime.Apply(ticket, ctx, func() error {
 		// Abort if we're cancelling execution.
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
 
-		next := py.NullPyObjectPtr
+		// Hand over acknowledgements while we hold the interpreter.
+		p.deliverAcks(i)
 
-		// TODO: add a flush timeout? Right now we fill a batch.
-		for idx := 0; idx < p.batchSize; idx++ {
-			needsDecref := false
+		// Read ahead a few batches while we hold the interpreter.
+		for range prefetch {
+			read := pending{batch: service.MessageBatch{}}
+			done := false
 
-			// Extract the next object to feed into the pipeline.
-			switch p.mode {
-			case Object:
-				if p.idx >= p.boundsHint {
-					return nil
+			// TODO: add a flush timeout? Right now we fill a batch.
+			for idx := 0; idx < p.batchSize; idx++ {
+				// Extract the next object to feed into the pipeline.
+				next, owned, ok := i.next()
+				if !ok {
+					done = true
+					break
 				}
-				next = p.generator
-				p.idx++
 
-			case Iterable:
-				next = py.PyIter_Next(p.generator)
-				if next == py.NullPyObjectPtr {
-					return nil
+				if p.serializerMode == python.None {
+					// Track our object and bump a reference as it's now part
+					// of the Global interpreter and must outlive this input
+					// loop until it is processed by an output.
+					read.objs = append(read.objs, next)
+					py.Py_IncRef(next)
 				}
-				needsDecref = true
 
-			case List:
-				if p.idx >= p.boundsHint {
-					return nil
-				}
-				next = py.PyList_GetItem(p.generator, p.idx)
-				p.idx++
-				if next == py.NullPyObjectPtr {
-					py.PyErr_Clear()
-					panic("out of bounds Python list index")
-				}
-
-			case Tuple:
-				if p.idx >= p.boundsHint {
-					return nil
-				}
-				next = py.PyTuple_GetItem(p.generator, p.idx)
-				p.idx++
-				if next == py.NullPyObjectPtr {
-					py.PyErr_Clear()
-					panic("out of bounds Python tuple index")
-				}
-
-			case Callable:
-				py.PyErr_Clear()
-				next = py.PyObject_Call(p.generator, p.args, p.kwargs)
-				if next == py.NullPyObjectPtr {
-					py.PyErr_Print()
-					panic("null result from calling python input function")
+				// Package up the object based on our serializer mode. One
+				// we can't convert becomes an errored message, rather than
+				// costing us what we read around it.
+				var packErr error
+				read.batch, packErr = i.pack(read.batch, next)
+				if owned {
+					// Drop any local references we took in the loop.
+					py.Py_DecRef(next)
 				}
-				if py.BaseType(next) == py.None {
-					// No more work.
-					return nil
+				if packErr != nil {
+					m := service.NewMessage(nil)
+					m.SetError(fmt.Errorf("failed to convert python object: %w", packErr))
+					read.batch = append(read.batch, m)
 				}
-				needsDecref = true
-
-			default:
-				panic("unhandled input mode")
-			}
-
-			// Based on serializer mode, determine how we package up the object
-			// before sending our batch.
-			var m *service.Message
-			switch p.serializerMode {
-			case python.None:
-				m = service.NewMessage(nil)
-				m.SetStructured(next)
-
-				// Track our object and bump a reference as it's now part of
-				// the Global interpreter and must outlive this input loop
-				// until it is processed by an output.
-				objs = append(objs, next)
-				py.Py_IncRef(next)
-			case python.Bloblang:
-				m, err = toBloblang(next, p.serializer)
-			case python.Pickle:
-				m, err = toPickle(next, p.serializer)
 			}
-			if err != nil {
-				// TODO: drop this message?
-				panic(err)
-			}
-
-			if m != nil {
-				// Tag the message with information on how it was serialized.
-				m.MetaSetMut(python.SerializerMetaKey, p.serializerMode)
 
-				// Add it to our batch.
-				batch = append(batch, m)
+			if len(read.batch) > 0 {
+				queue = append(queue, read)
 			}
-
-			if needsDecref {
-				// Drop any local references we took in the loop.
-				py.Py_DecRef(next)
+			if done {
+				break
 			}
 		}
 
 		return nil
 	})
+	_ = p.runtime.Release(ticket)
+	python.EndSpan(span, "", err)
 
-	if len(batch) == 0 || err != nil {
-		return nil, nil, service.ErrEndOfInput
+	// Parent the spans of our messages by the read, so their traces start
+	// with it.
+	if span.SpanContext().IsValid() {
+		parent := trace.ContextWithSpan(context.Background(), span)
+		for _, read := range queue {
+			for idx, m := range read.batch {
+				read.batch[idx] = m.WithContext(parent)
+			}
+		}
+	}
+
+	if errors.Is(err, python.ErrInterpreterUnusable) {
+		// Tear down our runtime so it's rebuilt when we're reconnected.
+		p.logger.Errorf("Disconnecting after Python failure: %s", err)
+		_ = p.Close(ctx)
+		return service.ErrNotConnected
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		p.logger.Errorf("Failed to read from python: %s", err)
+		return service.ErrEndOfInput
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if len(queue) == 0 {
+		// Other interpreters may still have data, so only end once all are
+		// exhausted.
+		i.exhausted = true
+		return nil
 	}
 
 	// TODO: should we return service.ErrEndOfInput here, too, if we know
 	//       that we're finished?
-	return batch, func(ctx context.Context, err error) error {
+	for idx := range queue {
+		queue[idx].first = p.nextID
+		p.nextID += int64(len(queue[idx].batch))
+	}
+	p.queue = append(p.queue, queue...)
+	return nil
+}
+
+// pop returns the next batch we read ahead, if any.
+func (p *pythonInput) pop() (service.MessageBatch, service.AckFunc, bool) {
+	p.mtx.Lock()
+	if len(p.queue) == 0 {
+		p.mtx.Unlock()
+		return nil, nil, false
+	}
+	read := p.queue[0]
+	p.queue = p.queue[1:]
+	p.mtx.Unlock()
+
+	return read.batch, func(ctx context.Context, err error) error {
 		if err != nil {
 			// XXX ??? What happens here?
 			p.logger.Errorf("XXX?!?! %v\n", err)
 			return err
 		}
-		return python.DropGlobalReferences(objs, ctx)
-	}, nil
+		if p.ackFn != "" {
+			return p.ack(read, ctx)
+		}
+		return python.DropGlobalReferences(read.objs, ctx)
+	}, true
+}
+
+// ack records the items of an acknowledged batch for our ack function.
+func (p *pythonInput) ack(read pending, ctx context.Context) error {
+	if p.ackWith == ackWithPayloads && p.serializerMode == python.None {
+		// Our ack function takes over the references to the objects.
+		p.ackMtx.Lock()
+		p.acked.objs = append(p.acked.objs, read.objs...)
+		p.ackMtx.Unlock()
+		return nil
+	}
+
+	var payloads [][]byte
+	if p.ackWith == ackWithPayloads {
+		for _, m := range read.batch {
+			data, err := m.AsBytes()
+			if err != nil {
+				return err
+			}
+			payloads = append(payloads, data)
+		}
+	}
+
+	p.ackMtx.Lock()
+	if p.ackWith == ackWithIDs {
+		for idx := range int64(len(read.batch)) {
+			p.acked.ids = append(p.acked.ids, read.first+idx)
+		}
+	}
+	p.acked.payloads = append(p.acked.payloads, payloads...)
+	p.ackMtx.Unlock()
+	return python.DropGlobalReferences(read.objs, ctx)
+}
+
+// deliverAcks calls our ack function, if any, with the items acknowledged
+// since it was last called. Failures are logged, as the items can't be
+// acknowledged again.
+//
+// The caller must manage the interpreter state for this to succeed.
+func (p *pythonInput) deliverAcks(i *interpreter) {
+	if i.ackFn == py.NullPyObjectPtr {
+		return
+	}
+	p.ackMtx.Lock()
+	items := p.acked
+	p.acked = acked{}
+	p.ackMtx.Unlock()
+	if len(items.ids)+len(items.payloads)+len(items.objs) == 0 {
+		return
+	}
+
+	list := py.PyObject_CallNoArgs(i.listType)
+	if list == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		for _, obj := range items.objs {
+			py.Py_DecRef(obj)
+		}
+		p.logger.Error("Failed to create python list of acknowledged items.")
+		return
+	}
+	defer py.Py_DecRef(list)
+
+	// Lists take their own reference, so we drop ours as we go.
+	for _, id := range items.ids {
+		obj := py.PyLong_FromLongLong(id)
+		py.PyList_Append(list, obj)
+		py.Py_DecRef(obj)
+	}
+	for _, payload := range items.payloads {
+		obj := py.PyBytes_FromStringAndSize(unsafe.SliceData(payload), int64(len(payload)))
+		py.PyList_Append(list, obj)
+		py.Py_DecRef(obj)
+	}
+	for _, obj := range items.objs {
+		py.PyList_Append(list, obj)
+		py.Py_DecRef(obj)
+	}
+
+	result := py.PyObject_CallOneArg(i.ackFn, list)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		p.logger.Errorf("Python function '%s' failed.", p.ackFn)
+		return
+	}
+	py.Py_DecRef(result)
 }
 
 func (p *pythonInput) Close(ctx context.Context) error {
+	if !p.connected {
+		// Already torn down.
+		return nil
+	}
+	p.connected = false
+
 	_ = p.runtime.Map(ctx, func(ticket *python.InterpreterTicket) error {
+		p.mtx.Lock()
+		i, ok := p.interpreters[ticket.Id()]
+		delete(p.interpreters, ticket.Id())
+		queue := p.queue
+		p.queue = nil
+		p.mtx.Unlock()
+		if !ok {
+			return nil
+		}
+
+		// Hand over what was acknowledged before we go.
+		p.deliverAcks(i)
+		py.Py_DecRef(i.listType)
+
+		// Batches we read ahead won't be processed, so drop their objects.
+		for _, read := range queue {
+			for _, obj := range read.objs {
+				py.Py_DecRef(obj)
+			}
+		}
+
 		// Even if one of these are null, Py_DecRef is fine being passed NULL.
-		py.Py_DecRef(p.generator)
-		py.Py_DecRef(p.globals)
-		py.Py_DecRef(p.args)
-		py.Py_DecRef(p.kwargs)
-		p.serializer.DecRef()
+		py.Py_DecRef(i.generator)
+		py.Py_DecRef(i.control)
+		py.Py_DecRef(i.globals)
+		i.serializer.DecRef()
 
 		return nil
 	})
 
-	return p.runtime.Stop(ctx)
+	return python.StopWithDeadline(ctx, p.runtime, p.shutdown, p.logger)
 }
 
 func toBloblang(obj py.PyObjectPtr, serializer *python.Serializer) (*service.Message, error) {
@@ -394,11 +987,11 @@ func toBloblang(obj py.PyObjectPtr, serializer *python.Serializer) (*service.Mes
 		m.SetStructured(float)
 
 	case py.String:
-		s, decodeErr := py.UnicodeToString(obj)
-		if decodeErr != nil {
-			panic("failed to decode python input string")
+		data, err := python.UnicodeToBytes(obj)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode python input string: %w", err)
 		}
-		m = service.NewMessage([]byte(s))
+		m = service.NewMessage(data)
 
 	case py.Bytes:
 		// Copy out the bytes.
@@ -409,11 +1002,23 @@ func toBloblang(obj py.PyObjectPtr, serializer *python.Serializer) (*service.Mes
 		m = service.NewMessage(buffer)
 
 	case py.Tuple, py.List, py.Dict, py.Unknown:
+		// Protobuf messages are sent as their bytes.
+		if py.BaseType(obj) == py.Unknown {
+			data, typeURL, ok, err := serializer.Protobuf(obj)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				m = service.NewMessage(data)
+				m.MetaSetMut(python.ProtobufTypeMetaKey, typeURL)
+				return m, nil
+			}
+		}
+
 		// Use the serializer.
 		buffer, err := serializer.JsonBytes(obj)
-
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 		m = service.NewMessage(buffer)
 	}
@@ -421,6 +1026,259 @@ func toBloblang(obj py.PyObjectPtr, serializer *python.Serializer) (*service.Mes
 	return m, nil
 }
 
+// reader returns a function producing the next object from our generator,
+// based on our input mode. owned reports whether the caller must drop the
+// reference it was given, while ok is false once there's no more work.
+func (i *interpreter) reader() func() (obj py.PyObjectPtr, owned, ok bool) {
+	switch i.mode {
+	case Object:
+		return func() (py.PyObjectPtr, bool, bool) {
+			if i.idx >= i.boundsHint {
+				return py.NullPyObjectPtr, false, false
+			}
+			i.idx++
+			return i.generator, false, true
+		}
+
+	case Iterable:
+		return func() (py.PyObjectPtr, bool, bool) {
+			next := py.PyIter_Next(i.generator)
+			return next, true, next != py.NullPyObjectPtr
+		}
+
+	case List:
+		return func() (py.PyObjectPtr, bool, bool) {
+			if i.idx >= i.boundsHint {
+				return py.NullPyObjectPtr, false, false
+			}
+			next := py.PyList_GetItem(i.generator, i.idx)
+			i.idx++
+			if next == py.NullPyObjectPtr {
+				py.PyErr_Clear()
+				panic("out of bounds Python list index")
+			}
+			return next, false, true
+		}
+
+	case Tuple:
+		return func() (py.PyObjectPtr, bool, bool) {
+			if i.idx >= i.boundsHint {
+				return py.NullPyObjectPtr, false, false
+			}
+			next := py.PyTuple_GetItem(i.generator, i.idx)
+			i.idx++
+			if next == py.NullPyObjectPtr {
+				py.PyErr_Clear()
+				panic("out of bounds Python tuple index")
+			}
+			return next, false, true
+		}
+
+	case Callable:
+		return func() (py.PyObjectPtr, bool, bool) {
+			// Calling without arguments takes the vectorcall fast path,
+			// so there are no argument tuple or dict to build.
+			py.PyErr_Clear()
+			next := py.PyObject_CallNoArgs(i.generator)
+			if next == py.NullPyObjectPtr {
+				py.PyErr_Print()
+				panic("null result from calling python input function")
+			}
+			if py.BaseType(next) == py.None {
+				// No more work.
+				py.Py_DecRef(next)
+				return py.NullPyObjectPtr, false, false
+			}
+			return next, true, true
+		}
+	}
+	panic("unhandled input mode")
+}
+
+// packer returns a function appending the messages made from an object to a
+// batch, based on our serializer mode, compressing and tagging them.
+func (p *pythonInput) packer(serializer *python.Serializer) func(service.MessageBatch, py.PyObjectPtr) (service.MessageBatch, error) {
+	// tag finishes a message, tagging it with how it was serialized.
+	tag := func(batch service.MessageBatch, m *service.Message) service.MessageBatch {
+		if m == nil {
+			return batch
+		}
+		if p.serializerMode != python.None {
+			if err := p.compress(m, serializer); err != nil {
+				m.SetError(err)
+			}
+		}
+		m.MetaSetMut(python.SerializerMetaKey, p.serializerMode)
+		return append(batch, m)
+	}
+
+	var toMessage func(py.PyObjectPtr, *python.Serializer) (*service.Message, error)
+	switch p.serializerMode {
+	case python.None:
+		return func(batch service.MessageBatch, obj py.PyObjectPtr) (service.MessageBatch, error) {
+			m := service.NewMessage(nil)
+			m.SetStructured(obj)
+			return tag(batch, m), nil
+		}
+	case python.Bloblang:
+		return func(batch service.MessageBatch, obj py.PyObjectPtr) (service.MessageBatch, error) {
+			// Arrow tables, like Parquet row groups, become a message per
+			// row.
+			rows, ok, err := toArrowRows(obj, serializer)
+			if err != nil {
+				return batch, err
+			}
+			if ok {
+				for _, row := range rows {
+					batch = tag(batch, row)
+				}
+				return batch, nil
+			}
+			m, err := toBloblang(obj, serializer)
+			return tag(batch, m), err
+		}
+	case python.Pickle:
+		toMessage = toPickle
+	case python.CSV:
+		toMessage = toCSV
+	case python.CBOR:
+		toMessage = toCBOR
+	case python.BSON:
+		toMessage = toBSON
+	default:
+		panic("unhandled serializer mode")
+	}
+	return func(batch service.MessageBatch, obj py.PyObjectPtr) (service.MessageBatch, error) {
+		m, err := toMessage(obj, serializer)
+		if err != nil {
+			return batch, err
+		}
+		return tag(batch, m), nil
+	}
+}
+
+// unpackMessageDicts wraps a packer so message dicts become messages of their
+// content, with their metadata and key.
+func unpackMessageDicts(pack func(service.MessageBatch, py.PyObjectPtr) (service.MessageBatch, error), serializer *python.Serializer) func(service.MessageBatch, py.PyObjectPtr) (service.MessageBatch, error) {
+	return func(batch service.MessageBatch, obj py.PyObjectPtr) (service.MessageBatch, error) {
+		content, ok := python.MessageDictContent(obj)
+		if !ok {
+			return pack(batch, obj)
+		}
+		n := len(batch)
+		batch, err := pack(batch, content)
+		if err != nil {
+			return batch, err
+		}
+		for _, m := range batch[n:] {
+			if err = python.SetMessageDictMetadata(obj, m, serializer); err != nil {
+				m.SetError(err)
+			}
+		}
+		return batch, nil
+	}
+}
+
+// unpackControl wraps a packer so control messages, like rpcn.Tombstone,
+// become messages of their own, bypassing serialization and compression so
+// tombstones keep their null payload.
+func unpackControl(pack func(service.MessageBatch, py.PyObjectPtr) (service.MessageBatch, error), control py.PyObjectPtr, serializer *python.Serializer) func(service.MessageBatch, py.PyObjectPtr) (service.MessageBatch, error) {
+	return func(batch service.MessageBatch, obj py.PyObjectPtr) (service.MessageBatch, error) {
+		m, ok, err := python.ControlMessage(control, obj, serializer)
+		if err != nil {
+			m = service.NewMessage(nil)
+			m.SetError(err)
+			return append(batch, m), nil
+		}
+		if !ok {
+			return pack(batch, obj)
+		}
+		return append(batch, m), nil
+	}
+}
+
+// compress compresses the payload of a message with our codec, if any,
+// naming it in the python.CompressionMetaKey metadata.
+func (p *pythonInput) compress(m *service.Message, serializer *python.Serializer) error {
+	if p.compression == "" || p.compression == python.CompressionNone {
+		return nil
+	}
+	data, err := m.AsBytes()
+	if err != nil {
+		return err
+	}
+	compressed, err := serializer.Compress(data)
+	if err != nil {
+		return err
+	}
+	m.SetBytes(compressed)
+	m.MetaSetMut(python.CompressionMetaKey, p.compression)
+	return nil
+}
+
+// toArrowRows converts an Arrow table or record batch to a message per row,
+// holding the row as JSON. If obj isn't an Arrow table, ok is false.
+func toArrowRows(obj py.PyObjectPtr, serializer *python.Serializer) (batch service.MessageBatch, ok bool, err error) {
+	if py.BaseType(obj) != py.Unknown {
+		return nil, false, nil
+	}
+	rows, ok, err := serializer.ArrowRows(obj)
+	if !ok || err != nil {
+		return nil, false, err
+	}
+	batch = make(service.MessageBatch, len(rows))
+	for idx, row := range rows {
+		batch[idx] = service.NewMessage(row)
+	}
+	return batch, true, nil
+}
+
+// toCSV converts a row to a message holding its CSV line, preceded by a
+// header line if due. None is skipped, while rows that can't be encoded,
+// e.g. with fields that aren't columns, become errored messages.
+func toCSV(obj py.PyObjectPtr, serializer *python.Serializer) (*service.Message, error) {
+	if py.BaseType(obj) == py.None {
+		return nil, nil
+	}
+	line, err := serializer.CSV(obj)
+	if err != nil {
+		m := service.NewMessage(nil)
+		m.SetError(err)
+		return m, nil
+	}
+	return service.NewMessage(line), nil
+}
+
+// toCBOR converts an object to a message holding its CBOR encoding. None is
+// skipped, while objects that can't be encoded become errored messages.
+func toCBOR(obj py.PyObjectPtr, serializer *python.Serializer) (*service.Message, error) {
+	if py.BaseType(obj) == py.None {
+		return nil, nil
+	}
+	encoded, err := serializer.CBOR(obj)
+	if err != nil {
+		m := service.NewMessage(nil)
+		m.SetError(err)
+		return m, nil
+	}
+	return service.NewMessage(encoded), nil
+}
+
+// toBSON converts a dict to a message holding its BSON document. None is
+// skipped, while objects that aren't documents become errored messages.
+func toBSON(obj py.PyObjectPtr, serializer *python.Serializer) (*service.Message, error) {
+	if py.BaseType(obj) == py.None {
+		return nil, nil
+	}
+	encoded, err := serializer.BSON(obj)
+	if err != nil {
+		m := service.NewMessage(nil)
+		m.SetError(err)
+		return m, nil
+	}
+	return service.NewMessage(encoded), nil
+}
+
 func toPickle(obj py.PyObjectPtr, serializer *python.Serializer) (*service.Message, error) {
 	pickled, err := serializer.Pickle(obj)
 	if err != nil {
@@ -0,0 +1,353 @@
+package input
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// prelude gives test scripts a record() function appending a line to the
+// file named by the LOG environment variable, so tests can see what Python
+// was called with.
+const prelude = `
+import os
+
+def record(*args):
+    with open(os.environ["LOG"], "a") as f:
+        f.write(" ".join(str(a) for a in args) + "\n")
+
+`
+
+// newTestInput creates a python input reading the object named read, defined
+// by script, a message per batch. Tests adjust its fields before connecting.
+func newTestInput(t *testing.T, script string, mode python.Mode, runtimeName string) *pythonInput {
+	t.Helper()
+	in, err := newPythonInput("python3", script, nil, "", "main", nil, nil, nil,
+		"", "", ackWithIDs, "read", 1, 0, 1, python.Identity{}, mode, runtimeName, 1,
+		5*time.Second, python.Bloblang, python.CSVOptions{}, "", "", false, nil,
+		noop.NewTracerProvider(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return in.(*pythonInput)
+}
+
+// withLog points the record() function of the prelude at a file of its own,
+// returning its path.
+func withLog(t *testing.T, p *pythonInput) string {
+	t.Helper()
+	log := filepath.Join(t.TempDir(), "log")
+	p.environment = map[string]string{"LOG": log}
+	return log
+}
+
+// readLog returns the lines record() appended to log.
+func readLog(t *testing.T, log string) []string {
+	t.Helper()
+	data, err := os.ReadFile(log)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// readAll connects p and reads it until the end of input, acknowledging every
+// batch. Returns the messages read.
+func readAll(t *testing.T, p *pythonInput) []*service.Message {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := p.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var msgs []*service.Message
+	for {
+		batch, ack, err := p.ReadBatch(ctx)
+		if errors.Is(err, service.ErrEndOfInput) {
+			return msgs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, batch...)
+		if err = ack(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Test that every interpreter of a shared runtime is read from, and that an
+// object which can't be converted becomes an errored message without losing
+// the batches read ahead around it.
+func TestReadFromEveryInterpreter(t *testing.T) {
+	r, err := python.NewMultiInterpreterRuntime("python3", 2, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = python.ShareRuntime("test-input-interpreters", "python3", python.Isolated, r); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestInput(t, `
+import uuid
+
+me = uuid.uuid4().hex
+
+def generate():
+    for n in range(6):
+        if n == 2:
+            yield {"bad": object()}
+        else:
+            yield f"{me}:{n}"
+
+read = generate()
+`, python.Isolated, "test-input-interpreters")
+	msgs := readAll(t, p)
+	if err = p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(msgs) != 12 {
+		t.Fatalf("expected 12 messages, got %d", len(msgs))
+	}
+	failed := 0
+	seen := make(map[string][]string)
+	for _, m := range msgs {
+		if err := m.GetError(); err != nil {
+			if !strings.Contains(err.Error(), "failed to convert python object") {
+				t.Fatalf("expected a conversion error, got %s", err)
+			}
+			failed++
+			continue
+		}
+		data, err := m.AsBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		interpreter, n, _ := strings.Cut(string(data), ":")
+		seen[interpreter] = append(seen[interpreter], n)
+	}
+	if failed != 2 {
+		t.Fatalf("expected 2 errored messages, got %d", failed)
+	}
+	if len(seen) != 2 {
+		t.Fatalf("expected messages from 2 interpreters, got %d", len(seen))
+	}
+	for interpreter, ns := range seen {
+		if !slices.Equal(ns, []string{"0", "1", "3", "4", "5"}) {
+			t.Fatalf("expected items 0, 1, 3, 4, 5 from %s, got %v", interpreter, ns)
+		}
+	}
+}
+
+// Test that each kind of object the script may name is read from.
+func TestReadModes(t *testing.T) {
+	for _, c := range []struct {
+		name, script string
+		expected     []string
+	}{
+		{"generator", `read = (f"item {n}" for n in range(3))`, []string{"item 0", "item 1", "item 2"}},
+		{"list", `read = ["a", "b", "c"]`, []string{"a", "b", "c"}},
+		{"tuple", `read = ("a", "b")`, []string{"a", "b"}},
+		{"object", `read = "only"`, []string{"only"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			p := newTestInput(t, c.script, python.Global, "")
+			p.batchSize = 2
+			msgs := readAll(t, p)
+			if err := p.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			var payloads []string
+			for _, m := range msgs {
+				data, err := m.AsBytes()
+				if err != nil {
+					t.Fatal(err)
+				}
+				payloads = append(payloads, string(data))
+			}
+			if !slices.Equal(payloads, c.expected) {
+				t.Fatalf("expected %v, got %v", c.expected, payloads)
+			}
+		})
+	}
+}
+
+// Test that a function is called without arguments until it returns None.
+func TestReadFromFunction(t *testing.T) {
+	p := newTestInput(t, prelude+`
+count = 0
+
+def read(*args):
+    global count
+    count += 1
+    record(len(args))
+    return None if count > 3 else f"item {count}"
+`, python.Global, "")
+	log := withLog(t, p)
+	msgs := readAll(t, p)
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(msgs))
+	}
+	for idx, m := range msgs {
+		data, err := m.AsBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := fmt.Sprintf("item %d", idx+1); string(data) != expected {
+			t.Fatalf("expected '%s', got '%s'", expected, data)
+		}
+	}
+	calls := readLog(t, log)
+	if len(calls) < 4 {
+		t.Fatalf("expected at least 4 calls, got %d", len(calls))
+	}
+	for _, args := range calls {
+		if args != "0" {
+			t.Fatalf("expected no arguments, got %s", args)
+		}
+	}
+}
+
+// Test that a read pulls several batches from the generator at once, and
+// that they're handed out before it's read from again.
+func TestReadAhead(t *testing.T) {
+	p := newTestInput(t, prelude+`
+def generate():
+    for n in range(10):
+        record(n)
+        yield f"item {n}"
+
+read = generate()
+`, python.Global, "")
+	p.batchSize = 2
+	log := withLog(t, p)
+
+	ctx := context.Background()
+	if err := p.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = p.Close(ctx) }()
+
+	var payloads []string
+	for idx := range prefetch + 1 {
+		batch, ack, err := p.ReadBatch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range batch {
+			data, err := m.AsBytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			payloads = append(payloads, string(data))
+		}
+		if err = ack(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		// The first read fills our queue, so the generator isn't touched
+		// again until it's empty.
+		expected := prefetch * p.batchSize
+		if idx == prefetch {
+			expected = 10
+		}
+		if generated := len(readLog(t, log)); generated != expected {
+			t.Fatalf("expected %d items generated after %d reads, got %d", expected, idx+1, generated)
+		}
+	}
+	if len(payloads) != 10 || payloads[0] != "item 0" || payloads[9] != "item 9" {
+		t.Fatalf("expected items 0 to 9 in order, got %v", payloads)
+	}
+}
+
+// Test that acknowledgements are coalesced into a call of the ack function
+// per read, given ids or payloads. Payloads not serialized are the objects
+// generated, whose references are handed over.
+func TestAckFunction(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		ackWith    string
+		serializer python.SerializerMode
+		expected   []string
+	}{
+		{"ids", ackWithIDs, python.Bloblang, []string{
+			"[0, 1, 2, 3]",
+			"[4, 5]",
+		}},
+		{"payloads", ackWithPayloads, python.Bloblang, []string{
+			`[b'{"n": 0}', b'{"n": 1}', b'{"n": 2}', b'{"n": 3}']`,
+			`[b'{"n": 4}', b'{"n": 5}']`,
+		}},
+		{"objects", ackWithPayloads, python.None, []string{
+			"[{'n': 0}, {'n': 1}, {'n': 2}, {'n': 3}]",
+			"[{'n': 4}, {'n': 5}]",
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			p := newTestInput(t, prelude+`
+read = ({"n": n} for n in range(6))
+
+def acked(items):
+    record(items)
+`, python.Global, "")
+			p.ackFn = "acked"
+			p.ackWith = c.ackWith
+			p.serializerMode = c.serializer
+			log := withLog(t, p)
+
+			// Acknowledgements are handed over when the generator is next
+			// read, so the second read of it gets the first prefetch.
+			if msgs := readAll(t, p); len(msgs) != 6 {
+				t.Fatalf("expected 6 messages, got %d", len(msgs))
+			}
+			if err := p.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if calls := readLog(t, log); !slices.Equal(calls, c.expected) {
+				t.Fatalf("expected calls %v, got %v", c.expected, calls)
+			}
+		})
+	}
+}
+
+// Test that the script is told which share of the work is its own.
+func TestShards(t *testing.T) {
+	p := newTestInput(t, `read = [f"{shard} of {total_shards}"]`, python.Global, "")
+	p.shard = 2
+	p.totalShards = 3
+	msgs := readAll(t, p)
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	data, err := msgs[0].AsBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "2 of 3" {
+		t.Fatalf("expected '2 of 3', got '%s'", data)
+	}
+}
@@ -0,0 +1,500 @@
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/Jeffail/checkpoint"
+	"github.com/redpanda-data/benthos/v4/public/service"
+	py "github.com/voutilad/gogopython"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+)
+
+var sqlConfigSpec = service.NewConfigSpec().
+	Summary("Read rows from a database with a Python DB-API driver.").
+	Description("Executes a query through a connection made by a Python function, defined by the script, using any [DB-API](https://peps.python.org/pep-0249/) driver, and streams the rows as JSON objects. Covers databases Redpanda Connect has no native driver for. With a `cursor_column`, the query is given the last position read as its only parameter, and positions are checkpointed once acknowledged, so reading resumes where it left off.").
+	Field(service.NewStringField("script").
+		Description("Python code defining the connect function.")).
+	Fields(python.RuntimeFields()...).
+	Field(service.NewStringField("connect_function").
+		Description("Name of a Python function, defined by the script, called with no arguments and returning a DB-API connection. For SQLAlchemy, return `engine.raw_connection()`.").
+		Default("connect")).
+	Field(service.NewStringField("query").
+		Description("Query to execute. With a `cursor_column`, it takes the last position as its only parameter, using the driver's parameter style, and should order rows by the column.").
+		Example("SELECT * FROM events WHERE id > ? ORDER BY id")).
+	Field(service.NewStringField("cursor_column").
+		Description("Column of the query's results tracking progress, like an incrementing id or an updated-at timestamp.").
+		Example("id").
+		Optional()).
+	Field(service.NewAnyField("initial_cursor").
+		Description("Position to start from when there's no checkpoint. Without one, the query is executed without a parameter until a row is read, so the query must cope with that, or set this.").
+		Example(0).
+		Optional()).
+	Field(service.NewIntField("batch_size").
+		Description("Most rows to fetch and emit as a batch at once.").
+		Default(100)).
+	Field(service.NewDurationField("poll_interval").
+		Description("Execute the query again this long after reading all of its rows, continuing from the last position. The input ends after the first execution if not set.").
+		Example("5s").
+		Optional()).
+	Field(service.NewStringField("checkpoint_cache").
+		Description("Name of a cache resource to store the last acknowledged position in, and read it from on startup.").
+		Optional()).
+	Field(service.NewStringField("checkpoint_key").
+		Description("Key of the position in the `checkpoint_cache`.").
+		Default("python_sql")).
+	LintRule(`root = python_syntax_error("script", this.script | "", this.exe | "python3")`)
+
+type pythonSqlInput struct {
+	logger          *service.Logger
+	mgr             *service.Resources
+	runtime         python.Runtime
+	script          string
+	path            []string
+	environment     map[string]string
+	preload         []string
+	requires        []string
+	connectFn       string
+	query           string
+	cursorColumn    string
+	initialCursor   string // JSON encoded, or empty for none.
+	batchSize       int
+	pollInterval    time.Duration
+	checkpointCache string
+	checkpointKey   string
+	shutdownTimeout time.Duration
+
+	// Python state, only used with our single interpreter's ticket.
+	reader  py.PyObjectPtr
+	execute py.PyObjectPtr
+	fetchFn py.PyObjectPtr
+
+	mtx       sync.Mutex
+	connected bool
+	executing bool   // Whether the query has rows left to fetch.
+	position  string // JSON encoded position of the last row read.
+
+	trackerMtx sync.Mutex
+	tracker    *checkpoint.Uncapped[string]
+}
+
+func init() {
+	err := service.RegisterBatchInput("python_sql", sqlConfigSpec,
+		func(conf *service.ParsedConfig, mgr *service.Resources) (service.BatchInput, error) {
+			// Extract our configuration.
+			runtimeConf, err := python.ParseRuntimeConfig(conf, mgr.Logger())
+			if err != nil {
+				return nil, err
+			}
+			script, err := conf.FieldString("script")
+			if err != nil {
+				return nil, err
+			}
+			if err = python.AuditScript(mgr.Logger(), "script", script, runtimeConf.ScriptChecksums); err != nil {
+				return nil, err
+			}
+
+			i, err := newPythonSqlInput(runtimeConf.Exe, runtimeConf.Mode, mgr.Metrics(), mgr.Logger())
+			if err != nil {
+				return nil, err
+			}
+			i.mgr = mgr
+			i.script = script
+			i.path = runtimeConf.Path
+			i.environment = runtimeConf.Environment
+			i.preload = runtimeConf.Preload
+			i.requires = runtimeConf.Requires
+			i.shutdownTimeout = runtimeConf.ShutdownTimeout
+			if i.connectFn, err = conf.FieldString("connect_function"); err != nil {
+				return nil, err
+			}
+			if i.query, err = conf.FieldString("query"); err != nil {
+				return nil, err
+			}
+			if conf.Contains("cursor_column") {
+				if i.cursorColumn, err = conf.FieldString("cursor_column"); err != nil {
+					return nil, err
+				}
+			}
+			if conf.Contains("initial_cursor") {
+				initial, err := conf.FieldAny("initial_cursor")
+				if err != nil {
+					return nil, err
+				}
+				data, err := json.Marshal(initial)
+				if err != nil {
+					return nil, err
+				}
+				i.initialCursor = string(data)
+			}
+			if i.batchSize, err = conf.FieldInt("batch_size"); err != nil {
+				return nil, err
+			}
+			if i.batchSize < 1 {
+				return nil, errors.New("batch_size must be at least 1")
+			}
+			if conf.Contains("poll_interval") {
+				if i.pollInterval, err = conf.FieldDuration("poll_interval"); err != nil {
+					return nil, err
+				}
+			}
+			if conf.Contains("checkpoint_cache") {
+				if i.checkpointCache, err = conf.FieldString("checkpoint_cache"); err != nil {
+					return nil, err
+				}
+				if !mgr.HasCache(i.checkpointCache) {
+					return nil, fmt.Errorf("cache resource '%s' was not found", i.checkpointCache)
+				}
+			}
+			if i.checkpointKey, err = conf.FieldString("checkpoint_key"); err != nil {
+				return nil, err
+			}
+			if i.cursorColumn == "" && (i.initialCursor != "" || i.checkpointCache != "") {
+				return nil, errors.New("initial_cursor and checkpoint_cache require a cursor_column")
+			}
+
+			// Only acknowledged positions are checkpointed, so retry the
+			// rest.
+			return service.AutoRetryNacksBatched(i), nil
+		})
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+// newPythonSqlInput creates a python_sql input. It uses a single interpreter
+// of its own, holding our database connection.
+func newPythonSqlInput(exe string, mode python.Mode, metrics *service.Metrics, logger *service.Logger) (*pythonSqlInput, error) {
+	var err error
+	var r python.Runtime
+
+	switch mode {
+	case python.IsolatedLegacy:
+		r, err = python.NewMultiInterpreterRuntime(exe, 1, true, logger)
+	case python.Global:
+		r, err = python.NewSingleInterpreterRuntime(exe, 1, logger)
+	case python.Isolated:
+		r, err = python.NewMultiInterpreterRuntime(exe, 1, false, logger)
+	case python.FreeThreaded:
+		r, err = python.NewFreeThreadedRuntime(exe, 1, logger)
+	default:
+		return nil, errors.New("invalid mode")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &pythonSqlInput{
+		logger:          logger,
+		runtime:         python.NewMeteredRuntime(r, metrics),
+		connectFn:       "connect",
+		batchSize:       100,
+		checkpointKey:   "python_sql",
+		shutdownTimeout: 10 * time.Second,
+		tracker:         checkpoint.NewUncapped[string](),
+	}, nil
+}
+
+func (i *pythonSqlInput) Connect(ctx context.Context) error {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	if i.connected {
+		return nil
+	}
+
+	// Resume from our checkpoint, if there is one.
+	i.position = i.initialCursor
+	if i.checkpointCache != "" {
+		var cacheErr error
+		err := i.mgr.AccessCache(ctx, i.checkpointCache, func(c service.Cache) {
+			var data []byte
+			data, cacheErr = c.Get(ctx, i.checkpointKey)
+			if cacheErr == nil {
+				i.position = string(data)
+			} else if errors.Is(cacheErr, service.ErrKeyNotFound) {
+				cacheErr = nil
+			}
+		})
+		if err == nil {
+			err = cacheErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read checkpoint: %w", err)
+		}
+	}
+
+	err := i.runtime.Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = i.runtime.Map(ctx, func(ticket *python.InterpreterTicket) error {
+		code, err := python.Compile(i.script, "__rp_connect_python_sql__.py")
+		if err != nil {
+			return err
+		}
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+
+		// Provide our rpcn helper module, which also reads the query's rows.
+		rpcn, err := python.LoadRpcnModule()
+		if err != nil {
+			return err
+		}
+		py.PyDict_SetItemString(globals, "rpcn", rpcn)
+
+		// Send print() and friends to our logger.
+		if err = python.CaptureOutput(i.logger); err != nil {
+			return err
+		}
+
+		// Apply environment variables before running anything of the user's.
+		if err = python.SetEnvironment(i.environment); err != nil {
+			return err
+		}
+
+		// Make any local helper modules importable.
+		if err = python.ExtendSysPath(i.path); err != nil {
+			return err
+		}
+
+		// Fail fast, saying where we looked, if a dependency is missing.
+		if err = python.RequireModules(i.requires); err != nil {
+			return err
+		}
+
+		// Pay for slow imports now rather than on the first read.
+		if err = python.PreloadModules(i.preload); err != nil {
+			return err
+		}
+
+		// Execute the script to define our connect function.
+		result := py.PyEval_EvalCode(code, globals, py.NullPyObjectPtr)
+		if result == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to evaluate sql input script")
+		}
+		py.Py_DecRef(result)
+
+		connect := py.PyDict_GetItemString(globals, i.connectFn)
+		if connect == py.NullPyObjectPtr {
+			return fmt.Errorf("failed to find python function '%s'", i.connectFn)
+		}
+		connection := py.PyObject_CallNoArgs(connect)
+		if connection == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return fmt.Errorf("python function '%s' failed", i.connectFn)
+		}
+		defer py.Py_DecRef(connection)
+
+		readerType := py.PyObject_GetAttrString(rpcn, "_SqlReader")
+		if readerType == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find _SqlReader class in rpcn module")
+		}
+		defer py.Py_DecRef(readerType)
+
+		args := py.PyTuple_New(2)
+		if args == py.NullPyObjectPtr {
+			return errors.New("failed to create python tuple")
+		}
+		defer py.Py_DecRef(args)
+		// Tuples steal our references.
+		py.Py_IncRef(connection)
+		py.PyTuple_SetItem(args, 0, connection)
+		py.PyTuple_SetItem(args, 1, py.PyUnicode_FromString(i.cursorColumn))
+
+		i.reader = py.PyObject_Call(readerType, args, py.NullPyObjectPtr)
+		if i.reader == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to create sql reader")
+		}
+		i.execute = py.PyObject_GetAttrString(i.reader, "execute")
+		i.fetchFn = py.PyObject_GetAttrString(i.reader, "fetch")
+		if i.execute == py.NullPyObjectPtr || i.fetchFn == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find sql reader methods")
+		}
+		return nil
+	})
+	if err != nil {
+		// Try cleaning up if we had an issue.
+		_ = i.runtime.Stop(ctx)
+		return err
+	}
+	i.executing = false
+	i.connected = true
+	return nil
+}
+
+// row is a row read from the database.
+type row struct {
+	data     []byte
+	position string // JSON encoded, or empty if there's no cursor column.
+}
+
+// fetch executes our query if needed and fetches the next rows, if any.
+func (i *pythonSqlInput) fetch(ctx context.Context) ([]row, error) {
+	ticket, err := i.runtime.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = i.runtime.Release(ticket) }()
+
+	var rows []row
+	err = i.runtime.Apply(ticket, ctx, func() error {
+		if !i.executing {
+			var position py.PyObjectPtr
+			if i.position == "" {
+				position = python.NewNone()
+			} else {
+				position = py.PyUnicode_FromString(i.position)
+			}
+			args := py.PyTuple_New(2)
+			if args == py.NullPyObjectPtr {
+				py.Py_DecRef(position)
+				return errors.New("failed to create python tuple")
+			}
+			// Tuples steal our references.
+			py.PyTuple_SetItem(args, 0, py.PyUnicode_FromString(i.query))
+			py.PyTuple_SetItem(args, 1, position)
+			result := py.PyObject_Call(i.execute, args, py.NullPyObjectPtr)
+			py.Py_DecRef(args)
+			if result == py.NullPyObjectPtr {
+				py.PyErr_Print()
+				return errors.New("failed to execute query")
+			}
+			py.Py_DecRef(result)
+			i.executing = true
+		}
+
+		size := py.PyLong_FromLong(int64(i.batchSize))
+		result := py.PyObject_CallOneArg(i.fetchFn, size)
+		py.Py_DecRef(size)
+		if result == py.NullPyObjectPtr {
+			i.executing = false
+			py.PyErr_Print()
+			return errors.New("failed to fetch rows")
+		}
+		defer py.Py_DecRef(result)
+
+		for idx := int64(0); idx < py.PyList_Size(result); idx++ {
+			item := py.PyList_GetItem(result, idx)
+
+			// Copy out of memory managed by Python.
+			data := py.PyTuple_GetItem(item, 0)
+			r := row{data: make([]byte, py.PyBytes_Size(data))}
+			copy(r.data, unsafe.Slice(py.PyBytes_AsString(data), len(r.data)))
+
+			if position := py.PyTuple_GetItem(item, 1); py.BaseType(position) == py.String {
+				if r.position, err = py.UnicodeToString(position); err != nil {
+					return err
+				}
+			}
+			rows = append(rows, r)
+		}
+		if len(rows) == 0 {
+			i.executing = false
+		}
+		return nil
+	})
+	return rows, err
+}
+
+func (i *pythonSqlInput) ReadBatch(ctx context.Context) (service.MessageBatch, service.AckFunc, error) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	if !i.connected {
+		return nil, nil, service.ErrNotConnected
+	}
+
+	for {
+		rows, err := i.fetch(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rows) == 0 {
+			if i.pollInterval <= 0 {
+				return nil, nil, service.ErrEndOfInput
+			}
+			// Wait for more rows to turn up.
+			select {
+			case <-time.After(i.pollInterval):
+				continue
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+		}
+
+		batch := make(service.MessageBatch, 0, len(rows))
+		for _, r := range rows {
+			batch = append(batch, service.NewMessage(r.data))
+		}
+		if i.cursorColumn == "" {
+			return batch, func(context.Context, error) error { return nil }, nil
+		}
+
+		i.position = rows[len(rows)-1].position
+		i.trackerMtx.Lock()
+		release := i.tracker.Track(i.position, int64(len(batch)))
+		i.trackerMtx.Unlock()
+		return batch, func(ctx context.Context, err error) error {
+			i.trackerMtx.Lock()
+			highest := release()
+			i.trackerMtx.Unlock()
+			if highest == nil || i.checkpointCache == "" {
+				return nil
+			}
+			return i.checkpoint(ctx, *highest)
+		}, nil
+	}
+}
+
+// checkpoint stores position in our checkpoint cache.
+func (i *pythonSqlInput) checkpoint(ctx context.Context, position string) error {
+	var cacheErr error
+	err := i.mgr.AccessCache(ctx, i.checkpointCache, func(c service.Cache) {
+		cacheErr = c.Set(ctx, i.checkpointKey, []byte(position), nil)
+	})
+	if err == nil {
+		err = cacheErr
+	}
+	if err != nil {
+		i.logger.Errorf("Failed to store checkpoint: %s", err)
+	}
+	return err
+}
+
+func (i *pythonSqlInput) Close(ctx context.Context) error {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	if !i.connected {
+		return nil
+	}
+	i.connected = false
+
+	_ = i.runtime.Map(ctx, func(_ *python.InterpreterTicket) error {
+		closeFn := py.PyObject_GetAttrString(i.reader, "close")
+		if closeFn != py.NullPyObjectPtr {
+			result := py.PyObject_CallNoArgs(closeFn)
+			if result == py.NullPyObjectPtr {
+				py.PyErr_Print()
+			}
+			py.Py_DecRef(result)
+			py.Py_DecRef(closeFn)
+		}
+		py.Py_DecRef(i.execute)
+		py.Py_DecRef(i.fetchFn)
+		py.Py_DecRef(i.reader)
+		return nil
+	})
+	return python.StopWithDeadline(ctx, i.runtime, i.shutdownTimeout, i.logger)
+}
@@ -0,0 +1,151 @@
+package input
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+)
+
+// newTestSqlInput creates a python_sql input reading events by id through the
+// connect function defined by script.
+func newTestSqlInput(t *testing.T, script string) *pythonSqlInput {
+	t.Helper()
+	i, err := newPythonSqlInput("python3", python.Global, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.script = script
+	i.query = "SELECT * FROM events WHERE id > ? ORDER BY id"
+	i.cursorColumn = "id"
+	i.initialCursor = "0"
+	return i
+}
+
+// readRows reads a batch from i, returning its payloads and acknowledging it.
+func readRows(t *testing.T, ctx context.Context, i *pythonSqlInput) []string {
+	t.Helper()
+	batch, ack, err := i.ReadBatch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows []string
+	for _, m := range batch {
+		data, err := m.AsBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, string(data))
+	}
+	if err = ack(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+// Test that reconnecting resumes after the last acknowledged position.
+func TestSqlInputResumesFromCheckpoint(t *testing.T) {
+	i := newTestSqlInput(t, `
+import sqlite3
+
+def connect():
+    connection = sqlite3.connect(":memory:")
+    connection.execute("CREATE TABLE events (id INTEGER PRIMARY KEY, name TEXT)")
+    connection.executemany("INSERT INTO events VALUES (?, ?)", [(n, f"event {n}") for n in range(1, 6)])
+    connection.commit()
+    return connection
+`)
+	i.batchSize = 2
+	i.checkpointCache = "checkpoints"
+	i.mgr = service.MockResources(service.MockResourcesOptAddCache("checkpoints"))
+
+	ctx := context.Background()
+	if err := i.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rows := readRows(t, ctx, i)
+	if len(rows) != 2 || rows[0] != `{"id": 1, "name": "event 1"}` || rows[1] != `{"id": 2, "name": "event 2"}` {
+		t.Fatalf("expected events 1 and 2, got %v", rows)
+	}
+	if err := i.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := i.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = i.Close(ctx) }()
+	rows = append(readRows(t, ctx, i), readRows(t, ctx, i)...)
+	if len(rows) != 3 || rows[0] != `{"id": 3, "name": "event 3"}` || rows[2] != `{"id": 5, "name": "event 5"}` {
+		t.Fatalf("expected events 3 to 5, got %v", rows)
+	}
+	if _, _, err := i.ReadBatch(ctx); !errors.Is(err, service.ErrEndOfInput) {
+		t.Fatalf("expected end of input, got %v", err)
+	}
+
+	var checkpoint []byte
+	var cacheErr error
+	err := i.mgr.AccessCache(ctx, "checkpoints", func(c service.Cache) {
+		checkpoint, cacheErr = c.Get(ctx, "python_sql")
+	})
+	if err == nil {
+		err = cacheErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(checkpoint) != "5" {
+		t.Fatalf("expected checkpoint '5', got '%s'", checkpoint)
+	}
+}
+
+// Test that with a poll_interval, the query is executed again from the last
+// position instead of ending.
+func TestSqlInputPolls(t *testing.T) {
+	i := newTestSqlInput(t, `
+import sqlite3
+
+class Growing:
+    """Adds an event each time the query is executed."""
+    def __init__(self):
+        self.connection = sqlite3.connect(":memory:")
+        self.connection.execute("CREATE TABLE events (id INTEGER PRIMARY KEY, name TEXT)")
+        self.count = 0
+
+    def cursor(self):
+        self.count += 1
+        self.connection.execute("INSERT INTO events VALUES (?, ?)", (self.count, f"event {self.count}"))
+        self.connection.commit()
+        return self.connection.cursor()
+
+    def rollback(self):
+        self.connection.rollback()
+
+    def close(self):
+        self.connection.close()
+
+def connect():
+    return Growing()
+`)
+	i.pollInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := i.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = i.Close(ctx) }()
+	for _, expected := range []string{
+		`{"id": 1, "name": "event 1"}`,
+		`{"id": 2, "name": "event 2"}`,
+		`{"id": 3, "name": "event 3"}`,
+	} {
+		rows := readRows(t, ctx, i)
+		if len(rows) != 1 || rows[0] != expected {
+			t.Fatalf("expected [%s], got %v", expected, rows)
+		}
+	}
+}
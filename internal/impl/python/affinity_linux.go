@@ -0,0 +1,38 @@
+package python
+
+import "golang.org/x/sys/unix"
+
+const affinitySupported = true
+
+// processAffinity is the CPUs available to the process when we started.
+var processAffinity unix.CPUSet
+
+func init() {
+	if err := unix.SchedGetaffinity(0, &processAffinity); err != nil {
+		// Assume everything's available and let the kernel decide.
+		processAffinity.Zero()
+		for cpu := 0; cpu < len(processAffinity)*64; cpu++ {
+			processAffinity.Set(cpu)
+		}
+	}
+}
+
+// allowedCPU reports whether the process may run on cpu.
+func allowedCPU(cpu int) bool {
+	return cpu >= 0 && processAffinity.IsSet(cpu)
+}
+
+// setThreadAffinity restricts the calling OS thread to cpus.
+func setThreadAffinity(cpus []int) error {
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	return unix.SchedSetaffinity(0, &set)
+}
+
+// resetThreadAffinity lets the calling OS thread run on any of the CPUs
+// available to the process again.
+func resetThreadAffinity() error {
+	return unix.SchedSetaffinity(0, &processAffinity)
+}
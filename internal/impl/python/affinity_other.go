@@ -0,0 +1,17 @@
+//go:build !linux
+
+package python
+
+import "errors"
+
+const affinitySupported = false
+
+func allowedCPU(_ int) bool { return false }
+
+func setThreadAffinity(_ []int) error {
+	return errors.New("not supported")
+}
+
+func resetThreadAffinity() error {
+	return errors.New("not supported")
+}
@@ -0,0 +1,76 @@
+package python
+
+import (
+	"context"
+	"testing"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// Test that interpreter threads are pinned to the configured CPUs.
+func TestCPUAffinityPinsInterpreters(t *testing.T) {
+	if !affinitySupported {
+		t.Skip("cpu affinity not supported")
+	}
+	if err := SetCPUAffinity([]int{-1}); err == nil {
+		t.Fatal("expected an invalid cpu to be rejected")
+	}
+
+	cpu := -1
+	for c := 0; c < 1024; c++ {
+		if allowedCPU(c) {
+			cpu = c
+			break
+		}
+	}
+	if err := SetCPUAffinity([]int{cpu}); err != nil {
+		t.Fatal(err)
+	}
+	defer cpuAffinity.Store(nil)
+
+	r, err := NewMultiInterpreterRuntime("python3", 1, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Stop(ctx) }()
+
+	ticket, err := r.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Release(ticket) }()
+
+	var pinned int64
+	err = r.Apply(ticket, ctx, func() error {
+		code, err := Compile(`
+import os
+pinned = int(os.sched_getaffinity(0) == {cpu})
+`, "__affinity_test__.py")
+		if err != nil {
+			return err
+		}
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+		py.PyDict_SetItemString(globals, "cpu", py.PyLong_FromLong(int64(cpu)))
+		result := py.PyEval_EvalCode(code, globals, globals)
+		if result == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			t.Fatal("failed to evaluate script")
+		}
+		py.Py_DecRef(result)
+		pinned = py.PyLong_AsLong(py.PyDict_GetItemString(globals, "pinned"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pinned != 1 {
+		t.Fatalf("expected the interpreter thread to be pinned to cpu %d", cpu)
+	}
+}
@@ -0,0 +1,123 @@
+package python
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"github.com/ebitengine/purego"
+	py "github.com/voutilad/gogopython"
+)
+
+// Python C API functions for marshalling code objects, looked up once the
+// Python library is loaded.
+var (
+	pyMarshalReadObjectFromString func(data *byte, size int64) py.PyObjectPtr
+	pyMarshalWriteObjectToString  func(obj py.PyObjectPtr, version int32) py.PyObjectPtr
+	pyImportGetMagicNumber        func() int64
+)
+
+// marshalVersion is the current marshal format, Py_MARSHAL_VERSION.
+const marshalVersion = 4
+
+// bytecodeDir optionally names a directory for caching compiled scripts on
+// disk, so they needn't be compiled again after a restart.
+//
+// Protected by codeMtx.
+var bytecodeDir = ""
+
+// SetBytecodeCache enables caching compiled scripts in dir. As all components
+// share compiled code, they must agree on the directory.
+func SetBytecodeCache(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("invalid bytecode cache: %w", err)
+	}
+
+	codeMtx.Lock()
+	defer codeMtx.Unlock()
+
+	if bytecodeDir != "" && bytecodeDir != dir {
+		return fmt.Errorf("bytecode cache already set to '%s'", bytecodeDir)
+	}
+	bytecodeDir = dir
+	return nil
+}
+
+// loadMarshalFuncs looks up the functions for marshalling code objects.
+//
+// Must be called with globalMtx locked and after loading the Python library.
+func loadMarshalFuncs() {
+	globalMtx.AssertLocked()
+
+	lib := uintptr(library)
+	purego.RegisterLibFunc(&pyMarshalReadObjectFromString, lib, "PyMarshal_ReadObjectFromString")
+	purego.RegisterLibFunc(&pyMarshalWriteObjectToString, lib, "PyMarshal_WriteObjectToString")
+	purego.RegisterLibFunc(&pyImportGetMagicNumber, lib, "PyImport_GetMagicNumber")
+}
+
+// bytecodePath is where a script's bytecode is cached in dir. Bytecode is
+// specific to a Python version, so its magic number is part of the key.
+func bytecodePath(dir, script, filename string) string {
+	hash := sha256.New()
+	_ = binary.Write(hash, binary.LittleEndian, pyImportGetMagicNumber())
+	hash.Write([]byte(filename))
+	hash.Write([]byte{0})
+	hash.Write([]byte(script))
+	return filepath.Join(dir, hex.EncodeToString(hash.Sum(nil))+".pyc")
+}
+
+// compileCached compiles a script, re-using bytecode cached on disk in dir
+// by a previous run if possible. Failing to read or write the cache isn't
+// fatal, as we can always compile the script.
+//
+// The caller must manage the interpreter state for this to succeed.
+func compileCached(dir, script, filename string) py.PyCodeObjectPtr {
+	path := bytecodePath(dir, script, filename)
+
+	data, err := os.ReadFile(path)
+	if err == nil && len(data) > 0 {
+		code := pyMarshalReadObjectFromString(unsafe.SliceData(data), int64(len(data)))
+		if code != py.NullPyObjectPtr {
+			return py.PyCodeObjectPtr(code)
+		}
+		// Corrupt, so compile and overwrite it.
+		py.PyErr_Clear()
+	}
+
+	code := py.Py_CompileString(script, filename, py.PyFileInput)
+	if code == py.NullPyCodeObjectPtr {
+		return code
+	}
+
+	bytes := pyMarshalWriteObjectToString(py.PyObjectPtr(code), marshalVersion)
+	if bytes == py.NullPyObjectPtr {
+		py.PyErr_Clear()
+		return code
+	}
+	defer py.Py_DecRef(bytes)
+	data = unsafe.Slice(py.PyBytes_AsString(bytes), py.PyBytes_Size(bytes))
+
+	// Write atomically, as other processes may be reading it.
+	tmp, err := os.CreateTemp(dir, "*.tmp")
+	if err != nil {
+		return code
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return code
+}
@@ -2,6 +2,7 @@ package python
 
 import (
 	"errors"
+	"sync"
 	"unsafe"
 
 	"github.com/ebitengine/purego"
@@ -16,16 +17,29 @@ type Callback struct {
 	Object     py.PyObjectPtr
 }
 
+// definitions keeps the method definitions of callbacks reachable, as Python
+// holds on to them for as long as the functions live, which may outlast the
+// component that created them.
+var (
+	definitionsMtx sync.Mutex
+	definitions    []*py.PyMethodDef
+)
+
 func NewCallback(name string, f callbackFunc) (*Callback, error) {
 	// TODO: push this into gogopython
-	def := py.PyMethodDef{
-		Name:   unsafe.StringData(name),
+	def := &py.PyMethodDef{
+		// Python expects a NUL-terminated name.
+		Name:   unsafe.StringData(name + "\x00"),
 		Flags:  py.MethodVarArgs,
 		Method: purego.NewCallback(f),
 	}
-	fn := py.PyCFunction_NewEx(&def, py.NullPyObjectPtr, py.NullPyObjectPtr)
+	fn := py.PyCFunction_NewEx(def, py.NullPyObjectPtr, py.NullPyObjectPtr)
 	if fn == py.NullPyObjectPtr {
 		return nil, errors.New("failed to create python function")
 	}
-	return &Callback{Name: name, Definition: &def, Object: fn}, nil
+
+	definitionsMtx.Lock()
+	definitions = append(definitions, def)
+	definitionsMtx.Unlock()
+	return &Callback{Name: name, Definition: def, Object: fn}, nil
 }
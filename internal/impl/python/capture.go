@@ -0,0 +1,140 @@
+package python
+
+import (
+	"errors"
+	"sync"
+	"unsafe"
+
+	"github.com/ebitengine/purego"
+	"github.com/redpanda-data/benthos/v4/public/service"
+	py "github.com/voutilad/gogopython"
+)
+
+// Loggers receiving captured output, identified to Python by their index.
+var (
+	loggersMtx sync.Mutex
+	loggers    []*service.Logger
+)
+
+// Python function writing captured output, shared by all interpreters as
+// purego can only create a limited number of callbacks.
+var (
+	logDefOnce sync.Once
+	logDef     py.PyMethodDef
+	logName    = []byte("__log\x00")
+)
+
+// loggerId finds or assigns the identifier for logger.
+func loggerId(logger *service.Logger) int64 {
+	loggersMtx.Lock()
+	defer loggersMtx.Unlock()
+
+	for idx, l := range loggers {
+		if l == logger {
+			return int64(idx)
+		}
+	}
+	loggers = append(loggers, logger)
+	return int64(len(loggers) - 1)
+}
+
+// logCallback is called from Python with a line of captured output. It has a
+// Python function definition like:
+//
+// def __log(logger: int, level: str, line: str, *fields: str) -> int
+//
+// where logger identifies a service.Logger, level is "info" or "warn", and
+// fields are optional key and value pairs to log with the line.
+func logCallback(_, tuple py.PyObjectPtr) py.PyObjectPtr {
+	if py.BaseType(tuple) != py.Tuple {
+		panic("argument should be a Python tuple")
+	}
+
+	id := py.PyLong_AsLong(py.PyTuple_GetItem(tuple, 0))
+	level, err := py.UnicodeToString(py.PyTuple_GetItem(tuple, 1))
+	if err != nil {
+		panic(err)
+	}
+	line, err := py.UnicodeToString(py.PyTuple_GetItem(tuple, 2))
+	if err != nil {
+		panic(err)
+	}
+
+	loggersMtx.Lock()
+	logger := loggers[id]
+	loggersMtx.Unlock()
+
+	if size := py.PyTuple_Size(tuple); size > 3 {
+		fields := make([]any, 0, size-3)
+		for idx := int64(3); idx < size; idx++ {
+			field, err := py.UnicodeToString(py.PyTuple_GetItem(tuple, idx))
+			if err != nil {
+				panic(err)
+			}
+			fields = append(fields, field)
+		}
+		logger = logger.With(fields...)
+	}
+
+	switch level {
+	case "warn":
+		logger.Warn(line)
+	default:
+		logger.Info(line)
+	}
+	return py.PyLong_FromLong(int64(len(line)))
+}
+
+// CaptureOutput redirects sys.stdout and sys.stderr of the current
+// interpreter to logger, line by line, at info and warn levels respectively.
+// Warnings are logged at warn level along with their category and location.
+// Interpreters shared by components keep the logger of the first.
+//
+// The caller must manage the interpreter state for this to succeed.
+func CaptureOutput(logger *service.Logger) error {
+	if logger == nil {
+		return nil
+	}
+
+	module, err := LoadRpcnModule()
+	if err != nil {
+		return err
+	}
+	capture := py.PyObject_GetAttrString(module, "_capture_output")
+	if capture == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to find _capture_output function in rpcn module")
+	}
+	defer py.Py_DecRef(capture)
+
+	logDefOnce.Do(func() {
+		logDef = py.PyMethodDef{
+			Name:   unsafe.SliceData(logName),
+			Flags:  py.MethodVarArgs,
+			Method: purego.NewCallback(logCallback),
+		}
+	})
+	emit := py.PyCFunction_NewEx(&logDef, py.NullPyObjectPtr, py.NullPyObjectPtr)
+	if emit == py.NullPyObjectPtr {
+		return errors.New("failed to create python function")
+	}
+	defer py.Py_DecRef(emit)
+
+	args := py.PyTuple_New(2)
+	if args == py.NullPyObjectPtr {
+		return errors.New("failed to create python tuple")
+	}
+	defer py.Py_DecRef(args)
+	// Tuples steal our references.
+	py.Py_IncRef(emit)
+	py.PyTuple_SetItem(args, 0, emit)
+	py.PyTuple_SetItem(args, 1, py.PyLong_FromLong(loggerId(logger)))
+
+	result := py.PyObject_Call(capture, args, py.NullPyObjectPtr)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to capture output")
+	}
+	py.Py_DecRef(result)
+	return nil
+}
@@ -0,0 +1,72 @@
+package python
+
+import (
+	"context"
+	"testing"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// Test that captured output is split into lines at the right levels and that
+// warnings, including deprecations, carry their category and location.
+func TestCaptureOutput(t *testing.T) {
+	r, err := NewMultiInterpreterRuntime("python3", 1, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Stop(ctx) }()
+
+	ticket, err := r.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Release(ticket) }()
+
+	var lines string
+	err = r.Apply(ticket, ctx, func() error {
+		if _, err := LoadRpcnModule(); err != nil {
+			return err
+		}
+		code, err := Compile(`
+import sys
+import warnings
+import rpcn
+captured = []
+rpcn._capture_output(lambda *args: captured.append(":".join(map(str, args))), 7)
+print("hello", "world")
+print("partial", end="")
+sys.stderr.write("oops\n\n")
+sys.stdout.flush()
+warnings.warn("old", DeprecationWarning)
+lines = "|".join(captured)
+`, "__capture_test__.py")
+		if err != nil {
+			return err
+		}
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+		result := py.PyEval_EvalCode(code, globals, globals)
+		if result == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			t.Fatal("failed to evaluate script")
+		}
+		py.Py_DecRef(result)
+		lines, err = py.UnicodeToString(py.PyDict_GetItemString(globals, "lines"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "7:info:hello world|7:warn:oops|7:info:partial|" +
+		"7:warn:old:category:DeprecationWarning:location:__capture_test__.py:11"
+	if lines != expected {
+		t.Fatalf("expected '%s', got '%s'", expected, lines)
+	}
+}
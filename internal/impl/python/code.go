@@ -0,0 +1,92 @@
+package python
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sync"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// codeKey identifies a compiled script within a particular interpreter.
+type codeKey struct {
+	interpreter int64
+	filename    string
+	hash        [sha256.Size]byte
+}
+
+// codeMtx guards codeCache.
+var codeMtx sync.Mutex
+
+// codeCache holds compiled code objects so identical scripts sharing an
+// interpreter are only compiled once. Code objects can't be shared between
+// interpreters, so entries are keyed by interpreter id.
+var codeCache = make(map[codeKey]py.PyCodeObjectPtr)
+
+// Compile a Python script into a code object, re-using a previously compiled
+// code object for the same script and filename in the current interpreter, or
+// bytecode from the on-disk cache if enabled.
+//
+// The caller must manage the interpreter state for this to succeed.
+func Compile(script, filename string) (py.PyCodeObjectPtr, error) {
+	return compileHashed(script, filename, sha256.Sum256([]byte(script)))
+}
+
+// compileHashed is Compile for a script whose hash is already known, like our
+// embedded helpers, sparing hashing them again on every compile.
+//
+// The caller must manage the interpreter state for this to succeed.
+func compileHashed(script, filename string, hash [sha256.Size]byte) (py.PyCodeObjectPtr, error) {
+	key := codeKey{
+		interpreter: py.PyInterpreterState_GetID(py.PyInterpreterState_Get()),
+		filename:    filename,
+		hash:        hash,
+	}
+
+	codeMtx.Lock()
+	code, ok := codeCache[key]
+	dir := bytecodeDir
+	codeMtx.Unlock()
+	if ok {
+		return code, nil
+	}
+
+	// We don't hold the lock while compiling. Only the caller can be using
+	// this interpreter, so nobody else can race us for this key.
+	if dir != "" {
+		code = compileCached(dir, script, filename)
+	} else {
+		code = py.Py_CompileString(script, filename, py.PyFileInput)
+	}
+	if code == py.NullPyCodeObjectPtr {
+		py.PyErr_Print()
+		return py.NullPyCodeObjectPtr, errors.New("failed to compile python script")
+	}
+
+	codeMtx.Lock()
+	codeCache[key] = code
+	codeMtx.Unlock()
+	return code, nil
+}
+
+// forgetCode drops any cached code objects for the given interpreter. Must be
+// called before the interpreter is torn down as ids may be re-used.
+func forgetCode(interpreter int64) {
+	codeMtx.Lock()
+	defer codeMtx.Unlock()
+
+	for key := range codeCache {
+		if key.interpreter == interpreter {
+			delete(codeCache, key)
+		}
+	}
+}
+
+// forgetAllCode drops all cached code objects. Must be called before the
+// main interpreter is finalized.
+func forgetAllCode() {
+	codeMtx.Lock()
+	defer codeMtx.Unlock()
+
+	clear(codeCache)
+}
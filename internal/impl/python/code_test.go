@@ -0,0 +1,117 @@
+package python
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// Test that compiling the same script twice in an interpreter re-uses the
+// code object.
+func TestCompileReusesCodeObjects(t *testing.T) {
+	r, err := NewSingleInterpreterRuntime("python3", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	err = r.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Stop(ctx) }()
+
+	err = r.Map(ctx, func(_ *InterpreterTicket) error {
+		first, err := Compile("x = 1", "test.py")
+		if err != nil {
+			return err
+		}
+		second, err := Compile("x = 1", "test.py")
+		if err != nil {
+			return err
+		}
+		if first != second {
+			t.Error("expected the same code object")
+		}
+		other, err := Compile("x = 2", "test.py")
+		if err != nil {
+			return err
+		}
+		if first == other {
+			t.Error("expected a different code object for a different script")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test that compiled scripts are cached on disk and survive a corrupt cache.
+func TestCompileCachesBytecode(t *testing.T) {
+	dir := t.TempDir()
+	if err := SetBytecodeCache(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		codeMtx.Lock()
+		bytecodeDir = ""
+		codeMtx.Unlock()
+	}()
+
+	var path string
+	compile := func() {
+		r, err := NewMultiInterpreterRuntime("python3", 1, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		if err = r.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = r.Stop(ctx) }()
+
+		var answer int64
+		err = r.Map(ctx, func(ticket *InterpreterTicket) error {
+			path = bytecodePath(dir, "answer = 41 + 1", "cached.py")
+			code, err := Compile("answer = 41 + 1", "cached.py")
+			if err != nil {
+				return err
+			}
+			globals, err := ticket.Globals()
+			if err != nil {
+				return err
+			}
+			result := py.PyEval_EvalCode(code, globals, globals)
+			if result == py.NullPyObjectPtr {
+				return errors.New("failed to evaluate cached code")
+			}
+			py.Py_DecRef(result)
+			answer = py.PyLong_AsLong(py.PyDict_GetItemString(globals, "answer"))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if answer != 42 {
+			t.Fatalf("expected 42, got %d", answer)
+		}
+	}
+
+	compile()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected cached bytecode: %s", err)
+	}
+
+	// Loaded from the cache.
+	compile()
+
+	// Recompiled over a corrupt cache.
+	if err := os.WriteFile(path, []byte("junk"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	compile()
+}
@@ -10,6 +10,7 @@ const (
 	Isolated       Mode = "isolated"
 	Global         Mode = "global"
 	IsolatedLegacy Mode = "isolated_legacy"
+	FreeThreaded   Mode = "free_threaded"
 	InvalidMode    Mode = "invalid"
 )
 
@@ -21,6 +22,8 @@ func StringAsMode(s string) Mode {
 		return Global
 	case string(IsolatedLegacy):
 		return IsolatedLegacy
+	case string(FreeThreaded):
+		return FreeThreaded
 	default:
 		return InvalidMode
 	}
@@ -35,6 +38,19 @@ const (
 	// Bloblang SerializerMode will approximate JSON serialization used by Bloblang.
 	Bloblang SerializerMode = "bloblang"
 
+	// Avro SerializerMode will encode Python results as Avro binary with a
+	// configured schema.
+	Avro SerializerMode = "avro"
+
+	// CSV SerializerMode will encode Python results as CSV lines.
+	CSV SerializerMode = "csv"
+
+	// CBOR SerializerMode will encode Python results as CBOR.
+	CBOR SerializerMode = "cbor"
+
+	// BSON SerializerMode will encode Python dict results as BSON documents.
+	BSON SerializerMode = "bson"
+
 	// None SerializerMode will not attempt serialization and simply pass Python object pointers.
 	None SerializerMode = "none"
 
@@ -47,6 +63,14 @@ func StringAsSerializerMode(s string) SerializerMode {
 		return Pickle
 	case string(Bloblang):
 		return Bloblang
+	case string(Avro):
+		return Avro
+	case string(CSV):
+		return CSV
+	case string(CBOR):
+		return CBOR
+	case string(BSON):
+		return BSON
 	case string(None):
 		return None
 	default:
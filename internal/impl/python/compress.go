@@ -0,0 +1,88 @@
+package python
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"unsafe"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// Compression codecs applied to payloads produced by Python.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// CompressionMetaKey is the metadata key naming the codec a payload was
+// compressed with.
+const CompressionMetaKey = "content_encoding"
+
+const zstdCompressor = "zstd_compressor"
+
+// SetCompression prepares compressing payloads with the given codec, one of
+// the Compression values. Go's standard library lacks Zstandard, so zstd
+// uses Python's compression.zstd module or the zstandard package.
+func (s *Serializer) SetCompression(codec string) error {
+	switch codec {
+	case CompressionNone, CompressionGzip:
+	case CompressionZstd:
+		newCompressor := py.PyObject_GetAttrString(s.module, zstdCompressor)
+		if newCompressor == py.NullPyObjectPtr {
+			return fmt.Errorf("failed to find %s in serializer module", zstdCompressor)
+		}
+		defer py.Py_DecRef(newCompressor)
+
+		compressor := py.PyObject_CallNoArgs(newCompressor)
+		if compressor == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to load zstd compressor, is zstandard installed?")
+		}
+		if s.zstd != null {
+			py.Py_DecRef(s.zstd)
+		}
+		s.zstd = compressor
+	default:
+		return fmt.Errorf("invalid compression '%s'", codec)
+	}
+	s.compression = codec
+	return nil
+}
+
+// Compress compresses data with the codec set by SetCompression, returning
+// it as is if there's none.
+func (s *Serializer) Compress(data []byte) ([]byte, error) {
+	switch s.compression {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+
+	case CompressionZstd:
+		obj := py.PyBytes_FromStringAndSize(unsafe.SliceData(data), int64(len(data)))
+		if obj == py.NullPyObjectPtr {
+			return nil, errors.New("failed to create python bytes")
+		}
+		defer py.Py_DecRef(obj)
+		result, err := s.call(s.zstd, obj)
+		if err != nil {
+			return nil, err
+		}
+		defer py.Py_DecRef(result)
+
+		sz := py.PyBytes_Size(result)
+		compressed := make([]byte, sz)
+		copy(compressed, unsafe.Slice(py.PyBytes_AsString(result), sz))
+		return compressed, nil
+	}
+	return data, nil
+}
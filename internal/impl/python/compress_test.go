@@ -0,0 +1,81 @@
+package python
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"testing"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// Test that payloads are compressed with the chosen codec.
+func TestCompress(t *testing.T) {
+	r, err := NewSingleInterpreterRuntime("python3", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Stop(ctx) }()
+
+	data := []byte("hello hello hello")
+	err = r.Map(ctx, func(_ *InterpreterTicket) error {
+		serializer, err := NewSerializer()
+		if err != nil {
+			return err
+		}
+		defer serializer.DecRef()
+
+		if err = serializer.SetCompression("lz4"); err == nil {
+			t.Error("expected an unknown codec to be rejected")
+		}
+
+		if err = serializer.SetCompression(CompressionNone); err != nil {
+			return err
+		}
+		if out, err := serializer.Compress(data); err != nil || !bytes.Equal(out, data) {
+			t.Errorf("expected data as is, got %q (%v)", out, err)
+		}
+
+		if err = serializer.SetCompression(CompressionGzip); err != nil {
+			return err
+		}
+		out, err := serializer.Compress(data)
+		if err != nil {
+			return err
+		}
+		reader, err := gzip.NewReader(bytes.NewReader(out))
+		if err != nil {
+			return err
+		}
+		if decompressed, err := io.ReadAll(reader); err != nil || !bytes.Equal(decompressed, data) {
+			t.Errorf("expected gzip to round trip, got %q (%v)", decompressed, err)
+		}
+
+		// Stand in for the zstandard package, dropping it again afterwards.
+		py.PyRun_SimpleString(`
+import sys, types
+zstandard = types.ModuleType("zstandard")
+class ZstdCompressor:
+    def compress(self, data):
+        return b"zstd:" + data
+zstandard.ZstdCompressor = ZstdCompressor
+sys.modules["zstandard"] = zstandard
+`)
+		defer py.PyRun_SimpleString("import sys; del sys.modules['zstandard']")
+		if err = serializer.SetCompression(CompressionZstd); err != nil {
+			return err
+		}
+		if out, err = serializer.Compress(data); err != nil || string(out) != "zstd:"+string(data) {
+			t.Errorf("expected zstd to compress, got %q (%v)", out, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,43 @@
+package python
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// condaEnv describes a conda environment, which unlike a virtual environment
+// is a Python installation of its own.
+type condaEnv struct {
+	prefix     string // Root of the conda environment.
+	executable string // Python executable within the conda environment.
+}
+
+const condaHelper string = "import sys; print(sys.base_prefix); print(sys.executable)"
+
+// findCondaEnv uses the provided Python executable to detect whether it
+// belongs to a conda environment, or a virtual environment based on one,
+// returning nil if it doesn't.
+func findCondaEnv(exe string) (*condaEnv, error) {
+	out, err := exec.Command(exe, "-c", condaHelper).Output()
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 {
+		return nil, nil
+	}
+
+	// Conda marks its environments, including the base one, with a
+	// conda-meta directory in their root.
+	info, err := os.Stat(filepath.Join(lines[0], "conda-meta"))
+	if err != nil || !info.IsDir() {
+		return nil, nil
+	}
+
+	return &condaEnv{
+		prefix:     lines[0],
+		executable: lines[1],
+	}, nil
+}
@@ -0,0 +1,55 @@
+package python
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakePython writes an executable answering condaHelper as if it were the
+// Python of prefix.
+func fakePython(t *testing.T, prefix string) string {
+	t.Helper()
+	exe := filepath.Join(t.TempDir(), "python")
+	script := fmt.Sprintf("#!/bin/sh\necho '%s'\necho '%s'\n", prefix, exe)
+	if err := os.WriteFile(exe, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return exe
+}
+
+// Test that conda environments are recognized by their conda-meta directory,
+// along with where they keep the Python library.
+func TestFindCondaEnv(t *testing.T) {
+	prefix := t.TempDir()
+	exe := fakePython(t, prefix)
+	conda, err := findCondaEnv(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conda != nil {
+		t.Fatal("expected no conda environment without conda-meta")
+	}
+
+	if err = os.Mkdir(filepath.Join(prefix, "conda-meta"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	conda, err = findCondaEnv(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conda == nil {
+		t.Fatal("expected a conda environment")
+	}
+	if conda.prefix != prefix || conda.executable != exe {
+		t.Errorf("expected prefix %s and executable %s, got %s and %s", prefix, exe, conda.prefix, conda.executable)
+	}
+	if lib := condaLibrary(prefix, "3.13t"); lib != filepath.Join(prefix, "lib", libraryName("3.13t")) {
+		t.Errorf("expected the library in the lib directory, got %s", lib)
+	}
+	if name := libraryName("3.13t"); !strings.Contains(name, "3.13t") {
+		t.Errorf("expected the library named after the version, got %s", name)
+	}
+}
@@ -0,0 +1,235 @@
+package python
+
+import (
+	"time"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+)
+
+// RuntimeConfig is the configuration every python component has for finding,
+// preparing, and starting Python.
+type RuntimeConfig struct {
+	Exe             string            // Python executable, after bootstrapping and installing dependencies.
+	Mode            Mode              // Runtime mode.
+	ShutdownTimeout time.Duration     // How long closing waits for Python code.
+	ScriptChecksums []string          // Checksums scripts must match, if any.
+	Environment     map[string]string // Variables to set in os.environ.
+	Path            []string          // Directories to append to sys.path.
+	Preload         []string          // Modules to import on startup.
+	Requires        []string          // Modules that must be importable.
+}
+
+// RuntimeFields returns the config fields every python component has, parsed
+// by ParseRuntimeConfig.
+func RuntimeFields() []*service.ConfigField {
+	return []*service.ConfigField{
+		service.NewStringListField("script_checksums").
+			Description("SHA-256 checksums, hex encoded, that the component's scripts must match, for supply-chain-conscious deployments. A script matching none of them is rejected. The checksum of every script is logged on startup either way. Not checked if empty.").
+			Example([]string{"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"}).
+			Advanced().
+			Default([]string{}),
+		service.NewStringField("exe").
+			Description("Path to a Python executable.").
+			Default("python3"),
+		service.NewStringField("library").
+			Description("Path to the Python dynamic library (libpython) to load, instead of deriving it from `exe`. Useful for unusual layouts like conda, pyenv, or distributions that split it into a separate package.").
+			Example("/opt/conda/lib/libpython3.12.so.1.0").
+			Advanced().
+			Default(""),
+		service.NewStringField("faulthandler").
+			Description("Enable Python's faulthandler on startup, dumping a Python traceback of every thread on a fatal error like a crash in an extension module. Either `stderr`, a file descriptor number, or a file path to append to. Disabled if empty.").
+			Examples("stderr", "/var/log/rpcn-python-faults.log").
+			Advanced().
+			Default(""),
+		service.NewIntListField("cpu_affinity").
+			Description("CPUs to pin the OS threads running Python code to, improving cache locality and reducing jitter for latency-sensitive workloads. Interpreters are spread across them round-robin, while `global` mode runs everything on the first thread, pinned to all of them. Only supported on Linux. Disabled if empty.").
+			Example([]int{2, 3}).
+			Advanced().
+			Default([]int{}),
+		service.NewBoolField("dedicated_threads").
+			Description("Run each interpreter of `isolated` and `free_threaded` modes on an OS thread of its own, named `rpcn-py-<n>` after the interpreter, so profilers like `py-spy` and `perf` attribute samples to stable, legible threads. The thread running the main interpreter is always named `rpcn-py-main`. As threads are process-wide, enabling it for any component enables it for all.").
+			Advanced().
+			Default(false),
+		service.NewBoolField("isolated").
+			Description("Start Python isolated from the host, like `python -I`, whatever the `mode`: `PYTHON*` environment variables, the working directory, and the site-packages of the user and of the Python installation are left off `sys.path`, so only the standard library, the virtual or conda environment of `exe`, `dependencies`, and `path` are importable. As the main interpreter is process-wide, all components setting it must agree, and it can't be enabled once Python is running without it.").
+			Advanced().
+			Optional(),
+		service.NewStringField("bytecode_cache").
+			Description("Directory for caching compiled scripts on disk, keyed by their contents and the Python version, so restarts and pipelines with many components skip compiling them again. Disabled if empty.").
+			Example("/var/cache/rpcn-python").
+			Advanced().
+			Default(""),
+		service.NewObjectField("standalone",
+			service.NewBoolField("enabled").
+				Description("Download a standalone CPython build on first start if `exe` can't be found.").
+				Default(false),
+			service.NewStringField("version").
+				Description("CPython version to download.").
+				Default("3.12.7"),
+			service.NewStringField("release").
+				Description("python-build-standalone release to download from.").
+				Default("20241016"),
+			service.NewStringField("url").
+				Description("URL of an `install_only` archive to download instead, e.g. from a mirror.").
+				Default(""),
+			service.NewStringField("sha256").
+				Description("Expected SHA-256 checksum of the archive.").
+				Default("")).
+			Description("Bootstrap a pinned [python-build-standalone](https://github.com/indygreg/python-build-standalone) CPython when no Python is installed.").
+			Advanced(),
+		service.NewStringListField("dependencies").
+			Description("Requirement specifiers to install with pip into a managed environment, based on `exe`, before starting.").
+			Example([]string{"requests>=2.32", "pydantic"}).
+			Default([]string{}),
+		service.NewStringField("requirements").
+			Description("Path to a requirements file to install with pip into a managed environment, based on `exe`, before starting.").
+			Example("./requirements.txt").
+			Default(""),
+		service.NewStringEnumField("installer", string(Pip), string(Uv)).
+			Description("Tool used to create the managed environment for `dependencies` and `requirements`. `uv` also supports provisioning `python_version`.").
+			Default(string(Pip)),
+		service.NewStringField("python_version").
+			Description("Python version to create the managed environment with, fetched by `uv` if needed. Requires the `uv` installer.").
+			Example("3.12").
+			Default(""),
+		service.NewStringMapField("environment").
+			Description("Environment variables set in `os.environ` of every interpreter before the script runs, e.g. for SDK credentials only Python needs.").
+			Example(map[string]any{"AWS_REGION": "us-east-1"}).
+			Default(map[string]any{}),
+		service.NewStringListField("path").
+			Description("Directories appended to `sys.path` in every interpreter, making local helper modules importable by the script. Relative paths are resolved against the working directory.").
+			Example([]string{"./lib"}).
+			Default([]string{}),
+		service.NewStringListField("preload_modules").
+			Description("Modules imported in every interpreter on startup, after applying `environment` and `path`, so slow imports like `torch` happen before the pipeline is ready rather than on the first message, and a missing module fails fast.").
+			Example([]string{"numpy", "pandas"}).
+			Default([]string{}),
+		service.NewStringListField("requires").
+			Description("Modules that must be importable, checked in every interpreter on startup without importing them, so a missing dependency fails with an error naming the module, the Python executable, and the `sys.path` searched rather than with a traceback on the first message.").
+			Example([]string{"numpy", "requests"}).
+			Default([]string{}),
+		service.NewStringField("mode").
+			Description("Toggle different Python runtime modes. The `isolated` modes run sub-interpreters isolated from each other, unrelated to the `isolated` field, which isolates Python from the host.").
+			Examples(string(Global), string(Isolated), string(IsolatedLegacy), string(FreeThreaded)).
+			Default(string(Global)),
+		service.NewDurationField("shutdown_timeout").
+			Description("How long closing waits for running Python code to finish before interrupting it by raising `KeyboardInterrupt`. If it still hasn't stopped after a short grace period, the interpreter is abandoned without finalizing so shutdown can complete.").
+			Advanced().
+			Default("10s"),
+	}
+}
+
+// SharedRuntimeField returns the config field naming a runtime to share, for
+// components that support sharing one.
+func SharedRuntimeField() *service.ConfigField {
+	return service.NewStringField("runtime").
+		Description("Name of a runtime to share with other python components using the same name, instead of starting one of their own. The first component using a name defines its `exe`, `mode`, and pool size, and the others must agree on `exe` and `mode`. Components sharing a runtime share interpreter globals, like in `global` mode.").
+		Example("shared").
+		Default("")
+}
+
+// ParseRuntimeConfig extracts the fields of RuntimeFields from a component's
+// config. It applies the process-wide settings, which must agree across
+// components, and bootstraps Python and installs dependencies as configured.
+func ParseRuntimeConfig(conf *service.ParsedConfig, logger *service.Logger) (RuntimeConfig, error) {
+	c := RuntimeConfig{}
+	exe, err := conf.FieldString("exe")
+	if err != nil {
+		return c, err
+	}
+	library, err := conf.FieldString("library")
+	if err != nil {
+		return c, err
+	}
+	if err = SetLibrary(library); err != nil {
+		return c, err
+	}
+	faultHandler, err := conf.FieldString("faulthandler")
+	if err != nil {
+		return c, err
+	}
+	if err = SetFaultHandler(faultHandler); err != nil {
+		return c, err
+	}
+	bytecodeCache, err := conf.FieldString("bytecode_cache")
+	if err != nil {
+		return c, err
+	}
+	if err = SetBytecodeCache(bytecodeCache); err != nil {
+		return c, err
+	}
+	cpuAffinity, err := conf.FieldIntList("cpu_affinity")
+	if err != nil {
+		return c, err
+	}
+	if err = SetCPUAffinity(cpuAffinity); err != nil {
+		return c, err
+	}
+	dedicatedThreads, err := conf.FieldBool("dedicated_threads")
+	if err != nil {
+		return c, err
+	}
+	SetDedicatedThreads(dedicatedThreads)
+	if conf.Contains("isolated") {
+		isolated, err := conf.FieldBool("isolated")
+		if err != nil {
+			return c, err
+		}
+		if err = SetIsolated(isolated); err != nil {
+			return c, err
+		}
+	}
+
+	// Find or bootstrap Python, then install dependencies on top of it.
+	standalone, err := ParseStandalone(conf)
+	if err != nil {
+		return c, err
+	}
+	exe, err = EnsureStandalone(exe, standalone, logger)
+	if err != nil {
+		return c, err
+	}
+	env := Environment{Exe: exe}
+	if env.Dependencies, err = conf.FieldStringList("dependencies"); err != nil {
+		return c, err
+	}
+	if env.Requirements, err = conf.FieldString("requirements"); err != nil {
+		return c, err
+	}
+	installer, err := conf.FieldString("installer")
+	if err != nil {
+		return c, err
+	}
+	env.Installer = Installer(installer)
+	if env.PythonVersion, err = conf.FieldString("python_version"); err != nil {
+		return c, err
+	}
+	if c.Exe, err = EnsureEnvironment(env, logger); err != nil {
+		return c, err
+	}
+
+	mode, err := conf.FieldString("mode")
+	if err != nil {
+		return c, err
+	}
+	c.Mode = StringAsMode(mode)
+	if c.ShutdownTimeout, err = conf.FieldDuration("shutdown_timeout"); err != nil {
+		return c, err
+	}
+	if c.ScriptChecksums, err = conf.FieldStringList("script_checksums"); err != nil {
+		return c, err
+	}
+	if c.Environment, err = conf.FieldStringMap("environment"); err != nil {
+		return c, err
+	}
+	if c.Path, err = conf.FieldStringList("path"); err != nil {
+		return c, err
+	}
+	if c.Preload, err = conf.FieldStringList("preload_modules"); err != nil {
+		return c, err
+	}
+	if c.Requires, err = conf.FieldStringList("requires"); err != nil {
+		return c, err
+	}
+	return c, nil
+}
@@ -0,0 +1,77 @@
+package python
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+	py "github.com/voutilad/gogopython"
+)
+
+// ControlMetaKey is the metadata key naming the kind of a control message.
+const ControlMetaKey = "control"
+
+// Kinds of control messages scripts can emit with the rpcn module.
+const (
+	ControlTombstone = "tombstone" // A null payload deleting a key.
+	ControlHeartbeat = "heartbeat" // An empty keep-alive marker.
+)
+
+// LoadControl finds the rpcn module's _control function, describing the
+// control messages scripts return, like rpcn.Tombstone. Returns a new
+// reference.
+//
+// The caller must manage the interpreter state for this to succeed.
+func LoadControl() (py.PyObjectPtr, error) {
+	module, err := LoadRpcnModule()
+	if err != nil {
+		return py.NullPyObjectPtr, err
+	}
+	control := py.PyObject_GetAttrString(module, "_control")
+	if control == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return py.NullPyObjectPtr, errors.New("failed to find _control function in rpcn module")
+	}
+	return control, nil
+}
+
+// ControlMessage converts obj to a message if it's a control message, using
+// the _control function found by LoadControl. Tombstones have a nil payload
+// and their key in the KeyMetaKey metadata, while heartbeats are empty. Both
+// name their kind in the ControlMetaKey metadata. If obj isn't a control
+// message, ok is false.
+//
+// The caller must manage the interpreter state for this to succeed.
+func ControlMessage(control, obj py.PyObjectPtr, serializer *Serializer) (m *service.Message, ok bool, err error) {
+	// Control messages are instances of our own classes, so don't bother
+	// asking about builtin types.
+	if py.BaseType(obj) != py.Unknown {
+		return nil, false, nil
+	}
+	result := py.PyObject_CallOneArg(control, obj)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return nil, false, errors.New("failed to inspect python object for control messages")
+	}
+	defer py.Py_DecRef(result)
+	if py.BaseType(result) == py.None {
+		return nil, false, nil
+	}
+
+	// Tuple items are borrowed.
+	kind, err := UnicodeToString(py.PyTuple_GetItem(result, 0))
+	if err != nil {
+		return nil, false, err
+	}
+	m = service.NewMessage(nil)
+	m.MetaSetMut(ControlMetaKey, kind)
+	if err = setKey(py.PyTuple_GetItem(result, 1), m); err != nil {
+		return nil, false, fmt.Errorf("invalid %s: %w", kind, err)
+	}
+	if meta := py.PyTuple_GetItem(result, 2); py.BaseType(meta) != py.None {
+		if err = SetMetadata(meta, m, serializer); err != nil {
+			return nil, false, fmt.Errorf("invalid %s: %w", kind, err)
+		}
+	}
+	return m, true, nil
+}
@@ -0,0 +1,84 @@
+package python
+
+import (
+	"context"
+	"testing"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// Test that tombstones and heartbeats become control messages, while other
+// objects are left alone.
+func TestControlMessage(t *testing.T) {
+	r, err := NewSingleInterpreterRuntime("python3", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Stop(ctx) }()
+
+	err = r.Map(ctx, func(ticket *InterpreterTicket) error {
+		code, err := Compile(`import rpcn
+objs = [rpcn.Tombstone(b"a", {"topic": "t"}), rpcn.Heartbeat(), object(), rpcn.Tombstone(1)]`, "__control_test__.py")
+		if err != nil {
+			return err
+		}
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+		out := py.PyEval_EvalCode(code, globals, globals)
+		if out == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			t.Fatal("failed to evaluate script")
+		}
+		py.Py_DecRef(out)
+		objs := py.PyDict_GetItemString(globals, "objs")
+
+		control, err := LoadControl()
+		if err != nil {
+			return err
+		}
+		defer py.Py_DecRef(control)
+		serializer, err := NewSerializer()
+		if err != nil {
+			return err
+		}
+		defer serializer.DecRef()
+
+		m, ok, err := ControlMessage(control, py.PyList_GetItem(objs, 0), serializer)
+		if err != nil || !ok {
+			t.Fatalf("expected a tombstone, got ok=%v err=%v", ok, err)
+		}
+		if data, _ := m.AsBytes(); data != nil {
+			t.Errorf("expected a null payload, got %q", data)
+		}
+		for key, expected := range map[string]string{ControlMetaKey: ControlTombstone, KeyMetaKey: "a", "topic": "t"} {
+			if value, _ := m.MetaGet(key); value != expected {
+				t.Errorf("expected %s metadata %q, got %q", key, expected, value)
+			}
+		}
+
+		m, ok, err = ControlMessage(control, py.PyList_GetItem(objs, 1), serializer)
+		if err != nil || !ok {
+			t.Fatalf("expected a heartbeat, got ok=%v err=%v", ok, err)
+		}
+		if value, _ := m.MetaGet(ControlMetaKey); value != ControlHeartbeat {
+			t.Errorf("expected a heartbeat, got %q", value)
+		}
+
+		if _, ok, err = ControlMessage(control, py.PyList_GetItem(objs, 2), serializer); ok || err != nil {
+			t.Errorf("expected no control message, got ok=%v err=%v", ok, err)
+		}
+		if _, _, err = ControlMessage(control, py.PyList_GetItem(objs, 3), serializer); err == nil {
+			t.Error("expected an error for an int key")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
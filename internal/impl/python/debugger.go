@@ -0,0 +1,103 @@
+package python
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// debugger optionally starts debugpy in the main interpreter.
+type debugger struct {
+	address string // Host and port to listen on, disabled if empty.
+	wait    bool   // Whether to wait for a client before running scripts.
+}
+
+// debug is the debugger to start with the main interpreter.
+//
+// Protected by globalMtx.
+var debug debugger
+
+// SetDebugger starts debugpy listening on address once Python starts, so
+// developers can attach and stop at breakpoints in scripts, optionally
+// waiting for them to attach first. As the debugger is process-wide, all
+// components must agree on its address.
+//
+// Only scripts run in the main interpreter can be debugged, so mode must be
+// the global mode.
+func SetDebugger(address string, wait bool, mode Mode) error {
+	if address == "" {
+		return nil
+	}
+	if mode != Global {
+		return fmt.Errorf("debugging requires %s mode, not %s", Global, mode)
+	}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid debug address: %w", err)
+	}
+	if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid debug port '%s'", port)
+	}
+
+	_ = globalMtx.Lock()
+	defer globalMtx.Unlock()
+
+	if debug.address != "" && debug.address != address {
+		return fmt.Errorf("debugger already set to listen on '%s'", debug.address)
+	}
+	debug.address = address
+	debug.wait = debug.wait || wait
+	return nil
+}
+
+// enableDebugger starts debugpy, spawning its adapter with exe as the
+// embedding process isn't Python.
+//
+// The caller must manage the interpreter state for this to succeed.
+func enableDebugger(d debugger, exe string) error {
+	host, port, err := net.SplitHostPort(d.address)
+	if err != nil {
+		return err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return err
+	}
+
+	module, err := LoadRpcnModule()
+	if err != nil {
+		return err
+	}
+	enable := py.PyObject_GetAttrString(module, "_enable_debugger")
+	if enable == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to find _enable_debugger function in rpcn module")
+	}
+	defer py.Py_DecRef(enable)
+
+	wait := int64(0)
+	if d.wait {
+		wait = 1
+	}
+	args := py.PyTuple_New(4)
+	if args == py.NullPyObjectPtr {
+		return errors.New("failed to create python tuple")
+	}
+	defer py.Py_DecRef(args)
+	// Tuples steal our references.
+	py.PyTuple_SetItem(args, 0, py.PyUnicode_FromString(exe))
+	py.PyTuple_SetItem(args, 1, py.PyUnicode_FromString(host))
+	py.PyTuple_SetItem(args, 2, py.PyLong_FromLong(int64(portNum)))
+	py.PyTuple_SetItem(args, 3, py.PyBool_FromLong(wait))
+
+	result := py.PyObject_Call(enable, args, py.NullPyObjectPtr)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return fmt.Errorf("failed to start debugger on '%s'", d.address)
+	}
+	py.Py_DecRef(result)
+	return nil
+}
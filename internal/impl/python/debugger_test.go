@@ -0,0 +1,31 @@
+package python
+
+import "testing"
+
+// Test that the debugger is only set for the global mode and one address.
+func TestSetDebugger(t *testing.T) {
+	defer func() {
+		_ = globalMtx.Lock()
+		debug = debugger{}
+		globalMtx.Unlock()
+	}()
+
+	if err := SetDebugger("localhost:5678", false, Isolated); err == nil {
+		t.Error("expected isolated mode to be rejected")
+	}
+	if err := SetDebugger("localhost", false, Global); err == nil {
+		t.Error("expected an address without a port to be rejected")
+	}
+	if err := SetDebugger("localhost:5678", false, Global); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetDebugger("localhost:5678", true, Global); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetDebugger("localhost:5679", false, Global); err == nil {
+		t.Error("expected a second address to be rejected")
+	}
+	if !debug.wait {
+		t.Error("expected to wait if any component asked to")
+	}
+}
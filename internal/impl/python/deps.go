@@ -0,0 +1,151 @@
+package python
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+)
+
+// envMtx serializes creating managed environments, as multiple components
+// may ask for the same one.
+var envMtx sync.Mutex
+
+// completeMarker is written into a managed environment once all its
+// dependencies are installed.
+const completeMarker = ".rpcn-complete"
+
+// Installer used for managed environments.
+type Installer string
+
+const (
+	Pip Installer = "pip"
+	Uv  Installer = "uv"
+)
+
+// Environment describes a managed virtual environment.
+type Environment struct {
+	Exe           string    // Python executable to base the environment on.
+	PythonVersion string    // Python version to base the environment on instead, requires Uv.
+	Dependencies  []string  // Requirement specifiers to install.
+	Requirements  string    // Path to a requirements file to install.
+	Installer     Installer // Tool used for creating the environment.
+}
+
+// EnsureEnvironment installs the environment's requirement specifiers, and
+// any in its requirements file, into a managed virtual environment, returning
+// the environment's Python executable.
+//
+// Environments are keyed by their inputs and reused across runs. If there's
+// nothing to install or provision, the configured exe is returned as is.
+func EnsureEnvironment(env Environment, logger *service.Logger) (string, error) {
+	exe, dependencies, requirements := env.Exe, env.Dependencies, env.Requirements
+	switch env.Installer {
+	case Pip:
+		if env.PythonVersion != "" {
+			return "", fmt.Errorf("python_version requires the %s installer", Uv)
+		}
+	case Uv:
+		if _, err := exec.LookPath("uv"); err != nil {
+			return "", fmt.Errorf("the %s installer requires uv on the PATH: %w", Uv, err)
+		}
+	default:
+		return "", fmt.Errorf("invalid installer '%s'", env.Installer)
+	}
+	if len(dependencies) == 0 && requirements == "" && env.PythonVersion == "" {
+		return exe, nil
+	}
+
+	// Key our environment by everything that goes into it.
+	hash := sha256.New()
+	hash.Write([]byte(env.Installer))
+	hash.Write([]byte{0})
+	hash.Write([]byte(exe))
+	hash.Write([]byte{0})
+	hash.Write([]byte(env.PythonVersion))
+	for _, dep := range dependencies {
+		hash.Write([]byte{0})
+		hash.Write([]byte(dep))
+	}
+	if requirements != "" {
+		data, err := os.ReadFile(requirements)
+		if err != nil {
+			return "", fmt.Errorf("failed to read requirements file: %w", err)
+		}
+		hash.Write([]byte{0})
+		hash.Write(data)
+	}
+
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		cache = os.TempDir()
+	}
+	dir := filepath.Join(cache, "rp-connect-python", "envs", hex.EncodeToString(hash.Sum(nil))[:16])
+	python := venvExecutable(dir)
+
+	envMtx.Lock()
+	defer envMtx.Unlock()
+
+	if _, err := os.Stat(filepath.Join(dir, completeMarker)); err == nil {
+		logger.Debugf("Using existing Python environment %s.", dir)
+		return python, nil
+	}
+
+	// Start from scratch in case a previous attempt failed part way.
+	logger.Infof("Creating Python environment %s.", dir)
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	var args []string
+	if env.Installer == Uv {
+		// uv fetches the requested Python version if it's not around and
+		// caches packages on its own.
+		base := exe
+		if env.PythonVersion != "" {
+			base = env.PythonVersion
+		}
+		if err := run("uv", "venv", "--quiet", "--python", base, dir); err != nil {
+			return "", fmt.Errorf("failed to create python environment: %w", err)
+		}
+		args = []string{"pip", "install", "--quiet", "--python", python}
+	} else {
+		if err := run(exe, "-m", "venv", dir); err != nil {
+			return "", fmt.Errorf("failed to create python environment: %w", err)
+		}
+		args = []string{"-m", "pip", "install", "--disable-pip-version-check", "--quiet"}
+	}
+
+	if len(dependencies) > 0 || requirements != "" {
+		args = append(args, dependencies...)
+		if requirements != "" {
+			args = append(args, "-r", requirements)
+		}
+		name := python
+		if env.Installer == Uv {
+			name = "uv"
+		}
+		if err := run(name, args...); err != nil {
+			return "", fmt.Errorf("failed to install python dependencies: %w", err)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, completeMarker), nil, 0o644); err != nil {
+		return "", err
+	}
+	logger.Infof("Installed Python dependencies into %s.", dir)
+	return python, nil
+}
+
+// run a command, including its output in any error.
+func run(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package python
+
+import (
+	"archive/zip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// buildWheel writes a wheel of a package named demo_dep into dir, so
+// dependencies can be installed without an index. Returns its path.
+func buildWheel(t *testing.T, dir string) string {
+	t.Helper()
+	path := filepath.Join(dir, "demo_dep-1.0-py3-none-any.whl")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	w := zip.NewWriter(f)
+	files := []struct{ name, content string }{
+		{"demo_dep.py", "answer = 42\n"},
+		{"demo_dep-1.0.dist-info/METADATA", "Metadata-Version: 2.1\nName: demo-dep\nVersion: 1.0\n"},
+		{"demo_dep-1.0.dist-info/WHEEL", "Wheel-Version: 1.0\nGenerator: test\nRoot-Is-Purelib: true\nTag: py3-none-any\n"},
+		{"demo_dep-1.0.dist-info/RECORD", "demo_dep.py,,\ndemo_dep-1.0.dist-info/METADATA,,\n" +
+			"demo_dep-1.0.dist-info/WHEEL,,\ndemo_dep-1.0.dist-info/RECORD,,\n"},
+	}
+	for _, file := range files {
+		fw, err := w.Create(file.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = fw.Write([]byte(file.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// isolateCache points the user's cache directory, where managed environments
+// live, at a temporary directory.
+func isolateCache(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("LocalAppData", dir)
+}
+
+// Test that dependencies are installed into a managed environment, which is
+// reused while they stay the same.
+func TestEnsureEnvironment(t *testing.T) {
+	isolateCache(t)
+	wheel := buildWheel(t, t.TempDir())
+	env := Environment{
+		Exe:          "python3",
+		Dependencies: []string{wheel},
+		Installer:    Pip,
+	}
+
+	exe, err := EnsureEnvironment(env, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exe == "python3" {
+		t.Fatal("expected a managed environment")
+	}
+	if out, err := exec.Command(exe, "-c", "import demo_dep; print(demo_dep.answer)").Output(); err != nil || strings.TrimSpace(string(out)) != "42" {
+		t.Fatalf("expected the dependency to be importable, got %q (%v)", out, err)
+	}
+
+	again, err := EnsureEnvironment(env, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != exe {
+		t.Fatalf("expected the environment %s to be reused, got %s", exe, again)
+	}
+
+	// Nothing to install leaves exe alone.
+	if exe, err = EnsureEnvironment(Environment{Exe: "python3", Installer: Pip}, nil); err != nil || exe != "python3" {
+		t.Fatalf("expected python3, got %s (%v)", exe, err)
+	}
+
+	// Failing to install is an error naming what failed.
+	env.Dependencies = []string{filepath.Join(t.TempDir(), "missing-1.0-py3-none-any.whl")}
+	if _, err = EnsureEnvironment(env, nil); err == nil || !strings.Contains(err.Error(), "failed to install python dependencies") {
+		t.Fatalf("expected failing to install to be an error, got %v", err)
+	}
+}
+
+// Test that uv provisions managed environments, and that pip can't provision
+// Python versions.
+func TestEnsureEnvironmentWithUv(t *testing.T) {
+	isolateCache(t)
+	if _, err := EnsureEnvironment(Environment{Exe: "python3", PythonVersion: "3.12", Installer: Pip}, nil); err == nil {
+		t.Fatal("expected python_version to require uv")
+	}
+	if _, err := exec.LookPath("uv"); err != nil {
+		t.Skip("requires uv")
+	}
+
+	wheel := buildWheel(t, t.TempDir())
+	exe, err := EnsureEnvironment(Environment{
+		Exe:          "python3",
+		Dependencies: []string{wheel},
+		Installer:    Uv,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command(exe, "-c", "import demo_dep; print(demo_dep.answer)").Output(); err != nil || strings.TrimSpace(string(out)) != "42" {
+		t.Fatalf("expected the dependency to be importable, got %q (%v)", out, err)
+	}
+	if _, err = os.Stat(filepath.Join(filepath.Dir(filepath.Dir(exe)), completeMarker)); err != nil {
+		t.Fatalf("expected the environment to be marked complete: %s", err)
+	}
+}
@@ -0,0 +1,65 @@
+package python
+
+import (
+	"fmt"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+	py "github.com/voutilad/gogopython"
+)
+
+// Metadata keys describing the exception a message failed with.
+const (
+	ExceptionTypeMetaKey    = "python_exception_type"
+	ExceptionMessageMetaKey = "python_exception_message"
+	TracebackMetaKey        = "python_traceback"
+)
+
+// Exception describes an exception raised by Python code.
+type Exception struct {
+	Type      string // Name of the exception's class.
+	Message   string
+	Traceback string // Formatted like Python prints it.
+}
+
+func (e *Exception) Error() string {
+	return fmt.Sprintf("%s: %s", e.Type, e.Message)
+}
+
+// SetMetadata describes the exception in the metadata of m.
+func (e *Exception) SetMetadata(m *service.Message) {
+	m.MetaSetMut(ExceptionTypeMetaKey, e.Type)
+	m.MetaSetMut(ExceptionMessageMetaKey, e.Message)
+	m.MetaSetMut(TracebackMetaKey, e.Traceback)
+}
+
+// ClassifyException classifies the exception last stashed by StashException
+// using the rpcn module's _classify function, returning the classification
+// and a description of the exception. The description is nil if the
+// classifier failed.
+//
+// The caller must manage the interpreter state for this to succeed.
+func ClassifyException(classify py.PyObjectPtr, retryOn string) (string, *Exception) {
+	arg := py.PyUnicode_FromString(retryOn)
+	if arg == py.NullPyObjectPtr {
+		py.PyErr_Clear()
+		return "", nil
+	}
+	defer py.Py_DecRef(arg)
+
+	result := py.PyObject_CallOneArg(classify, arg)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return "", nil
+	}
+	defer py.Py_DecRef(result)
+
+	var fields [4]string
+	for idx := range fields {
+		field, err := py.UnicodeToString(py.PyTuple_GetItem(result, int64(idx)))
+		if err != nil {
+			return "", nil
+		}
+		fields[idx] = field
+	}
+	return fields[0], &Exception{Type: fields[1], Message: fields[2], Traceback: fields[3]}
+}
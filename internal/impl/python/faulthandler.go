@@ -0,0 +1,67 @@
+package python
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// faultHandler optionally enables Python's faulthandler, naming where it
+// writes tracebacks: "stderr", a file descriptor number, or a file path.
+//
+// Protected by globalMtx.
+var faultHandler = ""
+
+// SetFaultHandler enables Python's faulthandler once Python starts, so fatal
+// errors like a crash in an extension module leave a Python traceback behind.
+// As the handler is process-wide, all components must agree on its target.
+func SetFaultHandler(target string) error {
+	if target == "" {
+		return nil
+	}
+	if _, err := strconv.Atoi(target); err != nil && target != "stderr" {
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return fmt.Errorf("invalid faulthandler file: %w", err)
+		}
+		_ = f.Close()
+	}
+
+	_ = globalMtx.Lock()
+	defer globalMtx.Unlock()
+
+	if faultHandler != "" && faultHandler != target {
+		return fmt.Errorf("faulthandler already set to '%s'", faultHandler)
+	}
+	faultHandler = target
+	return nil
+}
+
+// enableFaultHandler enables Python's faulthandler for target.
+//
+// The caller must manage the interpreter state for this to succeed.
+func enableFaultHandler(target string) error {
+	module, err := LoadRpcnModule()
+	if err != nil {
+		return err
+	}
+	enable := py.PyObject_GetAttrString(module, "_enable_faulthandler")
+	if enable == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to find _enable_faulthandler function in rpcn module")
+	}
+	defer py.Py_DecRef(enable)
+
+	arg := py.PyUnicode_FromString(target)
+	defer py.Py_DecRef(arg)
+	result := py.PyObject_CallOneArg(enable, arg)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return fmt.Errorf("failed to enable faulthandler for '%s'", target)
+	}
+	py.Py_DecRef(result)
+	return nil
+}
@@ -0,0 +1,58 @@
+package python
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// Test that faulthandler is enabled in the main interpreter when configured.
+func TestFaultHandlerEnabledOnStart(t *testing.T) {
+	if err := SetFaultHandler(filepath.Join(t.TempDir(), "faults.log")); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = globalMtx.Lock()
+		faultHandler = ""
+		globalMtx.Unlock()
+	}()
+
+	r, err := NewSingleInterpreterRuntime("python3", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Stop(ctx) }()
+
+	ticket, err := r.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Release(ticket) }()
+
+	var enabled int64
+	err = r.Apply(ticket, ctx, func() error {
+		module := py.PyImport_ImportModule("faulthandler")
+		if module == py.NullPyObjectPtr {
+			t.Fatal("failed to import faulthandler")
+		}
+		defer py.Py_DecRef(module)
+		fn := py.PyObject_GetAttrString(module, "is_enabled")
+		defer py.Py_DecRef(fn)
+		result := py.PyObject_CallNoArgs(fn)
+		defer py.Py_DecRef(result)
+		enabled = py.PyLong_AsLong(result)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enabled != 1 {
+		t.Fatal("expected faulthandler to be enabled")
+	}
+}
@@ -0,0 +1,331 @@
+package python
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+	py "github.com/voutilad/gogopython"
+)
+
+// FreeThreadedRuntime provides an implementation for using the main Python
+// interpreter of a free-threaded (no-GIL) build, running multiple threads in
+// it concurrently instead of relying on sub-interpreters.
+type FreeThreadedRuntime struct {
+	exe     string
+	home    string
+	program string
+	paths   []string
+
+	threads []py.PyThreadStatePtr   // Thread state per ticket.
+	globals []py.PyObjectPtr        // Globals per ticket.
+	tickets chan *InterpreterTicket // Tickets for our threads.
+	pinned  pinnedTickets           // Hands out particular tickets.
+
+	workers []*worker // Dedicated threads per ticket, if enabled.
+
+	replyChan chan error // Replies from the main go routine.
+	started   bool       // protected by globalMtx in runtime.go
+	logger    *service.Logger
+}
+
+// configVersion is the only Python version we know how to configure, as
+// gogopython only binds the PyConfig struct of Python 3.12. Other versions lay
+// it out differently, so initializing them with it corrupts memory.
+const configVersion = "3.12"
+
+const freeThreadedHelper string = "import sys, sysconfig; " +
+	"print(f'{sys.version_info[0]}.{sys.version_info[1]}'); " +
+	"print(sysconfig.get_config_var('Py_GIL_DISABLED') or 0)"
+
+// IsFreeThreaded reports whether the given Python executable is a
+// free-threaded build, i.e. was built with Py_GIL_DISABLED, along with its
+// version, like "3.13".
+func IsFreeThreaded(exe string) (bool, string, error) {
+	out, err := exec.Command(exe, "-c", freeThreadedHelper).Output()
+	if err != nil {
+		return false, "", err
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 {
+		return false, "", fmt.Errorf("failed to query python executable '%s'", exe)
+	}
+	return lines[1] == "1", lines[0], nil
+}
+
+// NewFreeThreadedRuntime creates a runtime of cnt threads in the main
+// interpreter of a free-threaded build of Python.
+//
+// XXX Free-threaded builds start at Python 3.13, which we can't configure
+// until gogopython binds its PyConfig, so for now this always fails.
+func NewFreeThreadedRuntime(exe string, cnt int, logger *service.Logger) (*FreeThreadedRuntime, error) {
+	freeThreaded, version, err := IsFreeThreaded(exe)
+	if err != nil {
+		return nil, err
+	}
+	if !freeThreaded {
+		return nil, fmt.Errorf("python executable '%s' is not a free-threaded build", exe)
+	}
+	if version != configVersion {
+		return nil, fmt.Errorf("free_threaded mode isn't supported yet: python executable '%s' is Python %s, "+
+			"but only Python %s can be configured", exe, version, configVersion)
+	}
+
+	home, program, paths, err := findHomeAndPaths(exe)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FreeThreadedRuntime{
+		exe:       exe,
+		home:      home,
+		program:   program,
+		paths:     paths,
+		threads:   make([]py.PyThreadStatePtr, cnt),
+		globals:   make([]py.PyObjectPtr, cnt),
+		tickets:   make(chan *InterpreterTicket, cnt),
+		replyChan: make(chan error),
+		logger:    logger,
+	}, nil
+}
+
+func (r *FreeThreadedRuntime) Start(ctx context.Context) error {
+	err := globalMtx.LockWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer globalMtx.Unlock()
+
+	if r.started {
+		// Already running.
+		return nil
+	}
+
+	err = loadPython(r.exe, r.home, r.program, r.paths, ctx)
+	if err != nil {
+		return err
+	}
+	if !inMainEnvironment(r.paths) {
+		_ = unloadPython(ctx)
+		return errEnvironment(r.exe)
+	}
+	r.logger.Debug("Python interpreter started.")
+
+	// Create a thread state, and globals, for each ticket in the main
+	// interpreter. This needs to happen from the main go routine, unless
+	// tickets have dedicated threads: then each thread state is created on
+	// its own thread, so Python (and py-spy) can tell them apart.
+	r.workers = startWorkers(len(r.threads))
+	var state py.PyInterpreterStatePtr
+	err = Evaluate(func() error {
+		state = py.PyInterpreterState_Get()
+		for idx := range len(r.threads) {
+			if r.workers == nil {
+				ts := py.PyThreadState_New(state)
+				if ts == py.NullThreadState {
+					return errors.New("failed to create new thread state")
+				}
+				r.threads[idx] = ts
+			}
+
+			globals := py.PyDict_New()
+			if globals == py.NullPyObjectPtr {
+				return errors.New("failed to create globals")
+			}
+			name := py.PyUnicode_FromString("__main__")
+			py.PyDict_SetItemString(globals, "__name__", name)
+			py.Py_DecRef(name)
+			r.globals[idx] = globals
+		}
+		return nil
+	}, r.replyChan, ctx)
+	for idx, w := range r.workers {
+		if err != nil {
+			break
+		}
+		err = w.call(func() error {
+			ts := py.PyThreadState_New(state)
+			if ts == py.NullThreadState {
+				return errors.New("failed to create new thread state")
+			}
+			r.threads[idx] = ts
+			return nil
+		})
+	}
+	if err != nil {
+		stopWorkers(r.workers)
+		r.workers = nil
+		return err
+	}
+
+	for idx := range len(r.threads) {
+		r.tickets <- &InterpreterTicket{idx: idx, id: int64(idx), globals: r.globals[idx]}
+	}
+
+	r.started = true
+	r.logger.Debugf("Python free-threaded runtime started with %d threads.", len(r.threads))
+
+	return nil
+}
+
+func (r *FreeThreadedRuntime) Stop(ctx context.Context) error {
+	err := globalMtx.LockWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer globalMtx.Unlock()
+
+	if !r.started {
+		return errors.New("not started")
+	}
+
+	// Collect all the tickets so nobody else can get them, waiting for any
+	// in use.
+	tickets := make([]*InterpreterTicket, cap(r.tickets))
+	for idx := range tickets {
+		ticket, err := r.Acquire(ctx)
+		if err != nil {
+			// Give them back so we can try again.
+			for _, ticket := range tickets[:idx] {
+				_ = r.Release(ticket)
+			}
+			return err
+		}
+		tickets[idx] = ticket
+	}
+
+	// Tear down our thread states from the main go routine.
+	err = Evaluate(func() error {
+		for idx, ts := range r.threads {
+			py.PyThreadState_Clear(ts)
+			py.PyThreadState_Delete(ts)
+			py.Py_DecRef(r.globals[idx])
+		}
+		return nil
+	}, r.replyChan, ctx)
+	if err != nil {
+		return err
+	}
+	stopWorkers(r.workers)
+	r.workers = nil
+
+	err = unloadPython(ctx)
+	if err != nil {
+		return err
+	}
+	r.started = false
+
+	r.logger.Debug("Python free-threaded runtime stopped.")
+	return nil
+}
+
+func (r *FreeThreadedRuntime) Acquire(ctx context.Context) (*InterpreterTicket, error) {
+	// Take a ticket from the pool.
+	select {
+	case ticket := <-r.tickets:
+		return ticket, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (r *FreeThreadedRuntime) Release(ticket *InterpreterTicket) error {
+	// Double-check the token is valid.
+	if ticket.idx < 0 || ticket.idx >= len(r.threads) {
+		return errors.New("invalid ticket: bad index")
+	}
+
+	// Return the ticket to the pool, or whoever is waiting on it. This should
+	// not block as the channel is buffered.
+	r.pinned.release(r.tickets, ticket)
+
+	return nil
+}
+
+// AcquireFor acquires ownership of the thread key maps to, and the globals
+// that go with it, waiting until it's available.
+func (r *FreeThreadedRuntime) AcquireFor(ctx context.Context, key uint64) (*InterpreterTicket, error) {
+	return r.pinned.acquire(ctx, r.tickets, key)
+}
+
+func (r *FreeThreadedRuntime) Apply(ticket *InterpreterTicket, _ context.Context, f func() error) error {
+	// Double-check the token is valid.
+	if ticket.idx < 0 || ticket.idx >= len(r.threads) {
+		return errors.New("invalid ticket: bad index")
+	}
+
+	return r.onThread(ticket.idx, func() error {
+		// Pin our go routine & attach our thread state. Without a GIL, other
+		// tickets may be running at the same time.
+		runtime.LockOSThread()
+		unpin := pinThread(ticket.idx)
+		py.PyEval_RestoreThread(r.threads[ticket.idx])
+
+		err := callSafely(f)
+
+		// Detach our thread state and unpin thread.
+		py.PyEval_SaveThread()
+		unpin()
+		runtime.UnlockOSThread()
+
+		return err
+	})
+}
+
+// onThread calls fn on the dedicated thread of the ticket with index idx, if
+// we have one, otherwise on the calling go routine.
+func (r *FreeThreadedRuntime) onThread(idx int, fn func() error) error {
+	if r.workers == nil {
+		return fn()
+	}
+	return r.workers[idx].call(fn)
+}
+
+// Map a function fn over all the threads, one at a time. Each ticket has its
+// own globals, so this is useful for initializing them all to a given state.
+func (r *FreeThreadedRuntime) Map(ctx context.Context, f func(t *InterpreterTicket) error) error {
+	// Acquire all tickets so we have sole control of the interpreter.
+	tickets := make([]*InterpreterTicket, cap(r.tickets))
+	defer func() {
+		for _, token := range tickets {
+			if token != nil {
+				_ = r.Release(token)
+			}
+		}
+	}()
+	for idx := range tickets {
+		ticket, err := r.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		tickets[idx] = ticket
+	}
+
+	for _, ticket := range tickets {
+		err := r.onThread(ticket.idx, func() error {
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			unpin := pinThread(ticket.idx)
+			py.PyEval_RestoreThread(r.threads[ticket.idx])
+			err := callSafely(func() error { return f(ticket) })
+			py.PyEval_SaveThread()
+			unpin()
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Interrupt isn't supported, as Python can't tell our threads apart: they're
+// all created by the main go routine.
+func (r *FreeThreadedRuntime) Interrupt(_ context.Context) error {
+	return errors.New("interrupting python code is not supported in free-threaded mode")
+}
@@ -0,0 +1,38 @@
+package python
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Test that free-threaded mode is refused for executables that aren't
+// free-threaded, and for versions we can't configure.
+func TestNewFreeThreadedRuntimeChecksExecutable(t *testing.T) {
+	tests := []struct {
+		version  string
+		disabled string
+		err      string
+	}{
+		{version: "3.12", disabled: "0", err: "not a free-threaded build"},
+		{version: "3.13", disabled: "0", err: "not a free-threaded build"},
+		{version: "3.13", disabled: "1", err: "isn't supported yet"},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s/%s", test.version, test.disabled), func(t *testing.T) {
+			// Answer freeThreadedHelper like the given build would.
+			exe := filepath.Join(t.TempDir(), "python")
+			script := fmt.Sprintf("#!/bin/sh\necho '%s'\necho '%s'\n", test.version, test.disabled)
+			if err := os.WriteFile(exe, []byte(script), 0o755); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := NewFreeThreadedRuntime(exe, 1, nil)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected an error containing '%s', got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package python
+
+import (
+	"errors"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+	py "github.com/voutilad/gogopython"
+)
+
+// Identity names the deployment and component a script runs in, so logs,
+// metrics, and checkpoints written from Python can be namespaced.
+type Identity struct {
+	Stream   string // Name of the stream, e.g. in streams mode.
+	Label    string // Label of the component, if any.
+	Pipeline string // Id of the pipeline, e.g. per deployment.
+}
+
+// ParseIdentity extracts the identity of a component from its identity field
+// and label.
+func ParseIdentity(conf *service.ParsedConfig, mgr *service.Resources) (Identity, error) {
+	id := Identity{Label: mgr.Label()}
+	var err error
+	if id.Stream, err = conf.FieldString("identity", "stream"); err != nil {
+		return id, err
+	}
+	if id.Pipeline, err = conf.FieldString("identity", "pipeline_id"); err != nil {
+		return id, err
+	}
+	return id, nil
+}
+
+// SetIdentity sets `identity` in the given namespace, e.g. globals, to an
+// object with the stream, label, and pipeline of the component.
+//
+// The caller must manage the interpreter state for this to succeed.
+func SetIdentity(namespace py.PyObjectPtr, id Identity) error {
+	module, err := LoadRpcnModule()
+	if err != nil {
+		return err
+	}
+	newIdentity := py.PyObject_GetAttrString(module, "_identity")
+	if newIdentity == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to find _identity function in rpcn module")
+	}
+	defer py.Py_DecRef(newIdentity)
+
+	args := py.PyTuple_New(3)
+	if args == py.NullPyObjectPtr {
+		return errors.New("failed to create python tuple")
+	}
+	defer py.Py_DecRef(args)
+	// Tuples steal our references.
+	py.PyTuple_SetItem(args, 0, py.PyUnicode_FromString(id.Stream))
+	py.PyTuple_SetItem(args, 1, py.PyUnicode_FromString(id.Label))
+	py.PyTuple_SetItem(args, 2, py.PyUnicode_FromString(id.Pipeline))
+
+	identity := py.PyObject_Call(newIdentity, args, py.NullPyObjectPtr)
+	if identity == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to create identity")
+	}
+	defer py.Py_DecRef(identity)
+	if py.PyDict_SetItemString(namespace, "identity", identity) != 0 {
+		py.PyErr_Print()
+		return errors.New("failed to set identity")
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package python
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/ebitengine/purego"
+	"github.com/redpanda-data/benthos/v4/public/service"
+	py "github.com/voutilad/gogopython"
+)
+
+// Python C API functions gogopython doesn't provide, looked up once the
+// Python library is loaded.
+var (
+	pyThreadGetThreadIdent   func() uint64
+	pyThreadStateSetAsyncExc func(id uint64, exc py.PyObjectPtr) int32
+)
+
+// mainThreadIdent identifies the OS thread of our main go routine. Python
+// records the creating thread in each thread state, and we create all of
+// ours from the main go routine, so this is how Python knows them no matter
+// which thread they're later used on.
+//
+// Set when starting the main interpreter.
+var mainThreadIdent uint64
+
+// interruptGrace is how long interrupted Python code has to unwind.
+const interruptGrace = 5 * time.Second
+
+// loadInterruptFuncs looks up the functions for interrupting Python code.
+//
+// Must be called with globalMtx locked and after loading the Python library.
+func loadInterruptFuncs() {
+	globalMtx.AssertLocked()
+
+	lib := uintptr(library)
+	purego.RegisterLibFunc(&pyThreadGetThreadIdent, lib, "PyThread_get_thread_ident")
+	purego.RegisterLibFunc(&pyThreadStateSetAsyncExc, lib, "PyThreadState_SetAsyncExc")
+}
+
+// enter marks the ticket as running Python code in the current interpreter.
+//
+// The caller must manage the interpreter state for this to succeed.
+func (i *InterpreterTicket) enter() {
+	i.mtx.Lock()
+	i.running = py.PyInterpreterState_Get()
+	i.since = time.Now()
+	i.mtx.Unlock()
+}
+
+// exit marks the ticket as no longer running Python code. It must be called
+// before giving up the interpreter state.
+func (i *InterpreterTicket) exit() {
+	i.mtx.Lock()
+	i.running = py.NullInterpreterState
+	i.mtx.Unlock()
+}
+
+// interrupt raises KeyboardInterrupt in the Python code the ticket is
+// running, if any.
+func (i *InterpreterTicket) interrupt() {
+	i.whileRunning(raiseInterrupt)
+}
+
+// whileRunning calls f holding the GIL of the interpreter running Python code
+// for the ticket, if it's still running by the time we have it. This blocks
+// until we can take the GIL, which running code gives up between bytecodes or
+// in blocking calls.
+func (i *InterpreterTicket) whileRunning(f func()) {
+	i.mtx.Lock()
+	state := i.running
+	i.mtx.Unlock()
+	if state == py.NullInterpreterState {
+		return
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	ts := py.PyThreadState_New(state)
+	if ts == py.NullThreadState {
+		return
+	}
+	py.PyEval_RestoreThread(ts)
+
+	// The running code can't move on while we hold the GIL, so it's safe to
+	// check once.
+	i.mtx.Lock()
+	running := i.running == state
+	i.mtx.Unlock()
+	if running {
+		f()
+	}
+
+	py.PyThreadState_Clear(ts)
+	py.PyThreadState_DeleteCurrent()
+}
+
+// raiseInterrupt raises KeyboardInterrupt in the code running on the thread
+// states we created in the current interpreter.
+//
+// The caller must manage the interpreter state for this to succeed.
+func raiseInterrupt() {
+	builtins := py.PyImport_ImportModule("builtins")
+	if builtins == py.NullPyObjectPtr {
+		py.PyErr_Clear()
+		return
+	}
+	defer py.Py_DecRef(builtins)
+
+	exc := py.PyObject_GetAttrString(builtins, "KeyboardInterrupt")
+	if exc == py.NullPyObjectPtr {
+		py.PyErr_Clear()
+		return
+	}
+	pyThreadStateSetAsyncExc(mainThreadIdent, exc)
+	py.Py_DecRef(exc)
+}
+
+// interruptAll interrupts the Python code running for any of the tickets,
+// waiting until it's done or ctx is done.
+func interruptAll(ctx context.Context, tickets []*InterpreterTicket) error {
+	done := make(chan struct{})
+	go func() {
+		wg := sync.WaitGroup{}
+		for _, ticket := range tickets {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ticket.interrupt()
+			}()
+		}
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StopWithDeadline stops the runtime, waiting up to timeout for Python code
+// that's still running. After that, it's interrupted and given a short grace
+// period to unwind before trying again. If it still won't stop, the runtime
+// is abandoned instead of finalized, as tearing down an interpreter that's
+// running code would crash the process.
+func StopWithDeadline(ctx context.Context, r Runtime, timeout time.Duration, logger *service.Logger) error {
+	stopCtx, cancel := context.WithTimeout(ctx, timeout)
+	err := r.Stop(stopCtx)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	logger.Warnf("Python code still running after %s, interrupting it.", timeout)
+	graceCtx, cancel := context.WithTimeout(ctx, interruptGrace)
+	defer cancel()
+	err = r.Interrupt(graceCtx)
+	if err == nil {
+		err = r.Stop(graceCtx)
+	}
+	if err != nil {
+		logger.Errorf("Abandoning Python runtime that failed to stop: %s", err)
+	}
+	return err
+}
@@ -0,0 +1,63 @@
+package python
+
+import (
+	"errors"
+	"fmt"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// isolated makes the main interpreter, and the sub-interpreters spawned from
+// it, ignore the host's PYTHON* environment variables, working directory, and
+// site-packages, like running python with -I.
+//
+// Protected by globalMtx.
+var (
+	isolated    = false
+	isolatedSet = false // Whether a component chose a value for isolated.
+)
+
+// SetIsolated chooses whether Python starts isolated from the host, leaving
+// only the standard library, the environment of the executable, and explicit
+// additions importable. As the main interpreter is process-wide, all
+// components choosing it must agree, and it can't be enabled once Python is
+// running without it.
+func SetIsolated(enabled bool) error {
+	_ = globalMtx.Lock()
+	defer globalMtx.Unlock()
+
+	if isolatedSet && isolated != enabled {
+		return fmt.Errorf("python already set to isolate site-packages: %v", isolated)
+	}
+	if enabled && consumersCnt > 0 && !isolated {
+		return errors.New("python is already running without isolation")
+	}
+	isolated = enabled
+	isolatedSet = true
+	return nil
+}
+
+// isolate strips sys.path of the current interpreter of the working
+// directory and the site-packages of the user and the Python installation.
+//
+// The caller must manage the interpreter state for this to succeed.
+func isolate() error {
+	module, err := LoadRpcnModule()
+	if err != nil {
+		return err
+	}
+	fn := py.PyObject_GetAttrString(module, "_isolate")
+	if fn == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to find _isolate function in rpcn module")
+	}
+	defer py.Py_DecRef(fn)
+
+	result := py.PyObject_CallNoArgs(fn)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to isolate sys.path")
+	}
+	py.Py_DecRef(result)
+	return nil
+}
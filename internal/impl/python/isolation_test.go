@@ -0,0 +1,78 @@
+package python
+
+import (
+	"context"
+	"testing"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// Test that components can't disagree on isolating Python.
+func TestSetIsolatedConflict(t *testing.T) {
+	defer func() {
+		_ = globalMtx.Lock()
+		isolated, isolatedSet = false, false
+		globalMtx.Unlock()
+	}()
+
+	if err := SetIsolated(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetIsolated(false); err != nil {
+		t.Errorf("expected agreeing values to be accepted: %s", err)
+	}
+	if err := SetIsolated(true); err == nil {
+		t.Error("expected an error enabling isolation after it was disabled")
+	}
+}
+
+// Test that isolating leaves the working directory off sys.path, and that
+// isolation can't be enabled once Python is running without it.
+func TestIsolate(t *testing.T) {
+	r, err := NewSingleInterpreterRuntime("python3", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Stop(ctx) }()
+
+	if err = SetIsolated(true); err == nil {
+		t.Error("expected an error enabling isolation while running without it")
+	}
+
+	err = r.Map(ctx, func(ticket *InterpreterTicket) error {
+		if err := isolate(); err != nil {
+			return err
+		}
+		code, err := Compile(`import os, sys
+cwd = os.getcwd() in [os.path.abspath(p) for p in sys.path]`, "__isolate_test__.py")
+		if err != nil {
+			return err
+		}
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+		result := py.PyEval_EvalCode(code, globals, globals)
+		if result == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			t.Fatal("failed to evaluate script")
+		}
+		py.Py_DecRef(result)
+
+		cwd, err := IsTrue(py.PyDict_GetItemString(globals, "cwd"))
+		if err != nil {
+			return err
+		}
+		if cwd {
+			t.Error("expected the working directory to be left off sys.path")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
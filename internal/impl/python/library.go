@@ -0,0 +1,125 @@
+package python
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/ebitengine/purego"
+	py "github.com/voutilad/gogopython"
+)
+
+// libraryPath optionally overrides the Python dynamic library otherwise
+// derived from the Python executable.
+//
+// Protected by globalMtx.
+var libraryPath = ""
+
+// library is the handle of the Python dynamic library we loaded.
+//
+// Protected by globalMtx.
+var library py.PythonLibraryPtr
+
+// SetLibrary overrides the path to the Python dynamic library (libpython) to
+// load, instead of deriving it from the Python executable. As only one Python
+// can be embedded in a process, all components must agree on it.
+func SetLibrary(path string) error {
+	if path == "" {
+		return nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("invalid python library: %w", err)
+	}
+
+	_ = globalMtx.Lock()
+	defer globalMtx.Unlock()
+
+	if libraryPath != "" && libraryPath != path {
+		return fmt.Errorf("python library already set to '%s'", libraryPath)
+	}
+	libraryPath = path
+	return nil
+}
+
+// loadLibrary loads the Python dynamic library for exe, or our override.
+//
+// Must be called with globalMtx locked.
+func loadLibrary(exe string) error {
+	globalMtx.AssertLocked()
+
+	if libraryPath != "" {
+		return loadLibraryFrom(libraryPath)
+	}
+
+	candidates := libraryCandidates(exe)
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			return loadLibraryFrom(candidate)
+		}
+	}
+	return fmt.Errorf("failed to find python library for '%s' (tried %s), set library to its path",
+		exe, strings.Join(candidates, ", "))
+}
+
+// loadLibraryFrom loads the Python dynamic library at path, keeping its handle
+// for the functions we look up ourselves.
+//
+// Must be called with globalMtx locked.
+func loadLibraryFrom(path string) error {
+	globalMtx.AssertLocked()
+
+	lib, err := py.LoadLibraryFromPath(path)
+	if err != nil {
+		return fmt.Errorf("failed to load python library '%s': %w", path, err)
+	}
+	library = lib
+	return nil
+}
+
+const libraryHelper string = "import sys, sysconfig; " +
+	"print(sysconfig.get_config_var('LIBDIR')); print(sysconfig.get_config_var('LDLIBRARY')); " +
+	"print(sysconfig.get_config_var('PYTHONFRAMEWORKPREFIX') or ''); " +
+	"print(f'{sys.version_info[0]}.{sys.version_info[1]}{getattr(sys, \"abiflags\", \"\")}')"
+
+// librarySymbol looks up the address of the symbol name in the Python dynamic
+// library lib.
+func librarySymbol(lib py.PythonLibraryPtr, name string) (uintptr, error) {
+	return purego.Dlsym(uintptr(lib), name)
+}
+
+// libraryCandidates lists where we'd expect to find the Python dynamic library
+// for exe, most likely first.
+func libraryCandidates(exe string) []string {
+	out, err := exec.Command(exe, "-c", libraryHelper).Output()
+	if err != nil {
+		return []string{"<none, failed to run " + exe + ">"}
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 4 {
+		return []string{"<none, failed to query " + exe + ">"}
+	}
+	libDir, ldLibrary, framework, version := lines[0], lines[1], lines[2], lines[3]
+
+	var candidates []string
+
+	// Conda environments don't necessarily have setuptools, which gogopython
+	// relies on to find the library on Linux, but we know where conda keeps
+	// it.
+	if conda, _ := findCondaEnv(exe); conda != nil {
+		candidates = append(candidates, condaLibrary(conda.prefix, version))
+	}
+
+	candidates = append(candidates, filepath.Join(libDir, libraryName(version)))
+	if ldLibrary != "None" && ldLibrary != libraryName(version) {
+		candidates = append(candidates, filepath.Join(libDir, ldLibrary))
+	}
+
+	// Framework builds on macOS name the library after the framework, e.g.
+	// Python.framework/Versions/3.12/Python, relative to its prefix.
+	if framework != "" && ldLibrary != "None" {
+		candidates = append(candidates, filepath.Join(framework, ldLibrary))
+	}
+	return candidates
+}
@@ -0,0 +1,34 @@
+package python
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Test that the library of exe is among the candidates we'd try, and that we
+// tell users what we tried when loading fails.
+func TestLibraryCandidates(t *testing.T) {
+	candidates := libraryCandidates("python3")
+	if len(candidates) == 0 || strings.HasPrefix(candidates[0], "<none") {
+		t.Fatalf("expected candidates, got %q", candidates)
+	}
+	for _, candidate := range candidates {
+		if !filepath.IsAbs(candidate) {
+			t.Errorf("expected an absolute path, got %s", candidate)
+		}
+	}
+
+	missing := "no-such-python"
+	if candidates = libraryCandidates(missing); !slices.Equal(candidates, []string{"<none, failed to run no-such-python>"}) {
+		t.Fatalf("expected no candidates, got %q", candidates)
+	}
+
+	_ = globalMtx.Lock()
+	defer globalMtx.Unlock()
+	err := loadLibrary(missing)
+	if err == nil || !strings.Contains(err.Error(), "tried <none, failed to run no-such-python>") {
+		t.Fatalf("expected the error to list what was tried, got %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package python
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/redpanda-data/benthos/v4/public/bloblang"
+)
+
+// lintTimeout bounds how long checking a script's syntax may take.
+const lintTimeout = 10 * time.Second
+
+// Compiles a script read from stdin, printing any syntax error.
+const lintHelper string = `
+import sys
+try:
+    compile(sys.stdin.buffer.read(), "<script>", "exec")
+except SyntaxError as e:
+    print(f"line {e.lineno}: {e.msg}")
+`
+
+// SyntaxError compiles source with the Python executable exe without running
+// it, describing any syntax error found or returning "" if there's none. As
+// it's meant for linting, failing to run exe isn't considered an error; the
+// component will report that when it starts.
+func SyntaxError(exe, source string) string {
+	if strings.TrimSpace(source) == "" {
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lintTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, exe, "-c", lintHelper)
+	cmd.Stdin = strings.NewReader(source)
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return string(bytes.TrimSpace(out))
+}
+
+func init() {
+	spec := bloblang.NewPluginSpec().
+		Category("Python").
+		Description("Checks the syntax of a python component's script using the given Python executable, returning a description of any syntax error or an empty string. Used for linting configs.").
+		Param(bloblang.NewStringParam("field").Description("Name of the field holding the script.")).
+		Param(bloblang.NewStringParam("source").Description("Python source code to check.")).
+		Param(bloblang.NewStringParam("exe").Description("Python executable to compile with.").Default("python3"))
+
+	err := bloblang.RegisterFunctionV2("python_syntax_error", spec, func(args *bloblang.ParsedParams) (bloblang.Function, error) {
+		field, err := args.GetString("field")
+		if err != nil {
+			return nil, err
+		}
+		source, err := args.GetString("source")
+		if err != nil {
+			return nil, err
+		}
+		exe, err := args.GetString("exe")
+		if err != nil {
+			return nil, err
+		}
+		return func() (any, error) {
+			if msg := SyntaxError(exe, source); msg != "" {
+				return fmt.Sprintf("syntax error in %s at %s", field, msg), nil
+			}
+			return "", nil
+		}, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,38 @@
+package python
+
+import (
+	"errors"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// AllocatedBlocks reports the number of memory blocks currently allocated by
+// Python's object allocator in the current interpreter. Only isolated
+// sub-interpreters have an allocator of their own; the others share that of
+// the main interpreter.
+//
+// The caller must manage the interpreter state for this to succeed.
+func AllocatedBlocks() (int64, error) {
+	sys := py.PyImport_ImportModule("sys")
+	if sys == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return 0, errors.New("failed to import sys module")
+	}
+	defer py.Py_DecRef(sys)
+
+	fn := py.PyObject_GetAttrString(sys, "getallocatedblocks")
+	if fn == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return 0, errors.New("failed to find getallocatedblocks function in sys module")
+	}
+	defer py.Py_DecRef(fn)
+
+	result := py.PyObject_CallNoArgs(fn)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return 0, errors.New("failed to get allocated blocks")
+	}
+	defer py.Py_DecRef(result)
+
+	return py.PyLong_AsLong(result), nil
+}
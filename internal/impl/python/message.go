@@ -0,0 +1,216 @@
+package python
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+	py "github.com/voutilad/gogopython"
+)
+
+// WithMetadata pairs the content with a dict of the message's metadata in a
+// new tuple, stealing the reference to content.
+//
+// The caller must manage the interpreter state for this to succeed.
+func WithMetadata(content py.PyObjectPtr, m *service.Message) (py.PyObjectPtr, error) {
+	meta := py.PyDict_New()
+	if meta == py.NullPyObjectPtr {
+		py.Py_DecRef(content)
+		return py.NullPyObjectPtr, errors.New("failed to create metadata dict")
+	}
+
+	err := m.MetaWalk(func(key, value string) error {
+		if key == SerializerMetaKey {
+			// Internal bookkeeping, not metadata.
+			return nil
+		}
+		str := py.PyUnicode_FromString(value)
+		if str == py.NullPyObjectPtr {
+			py.PyErr_Clear()
+			return fmt.Errorf("failed to convert metadata value for key '%s'", key)
+		}
+		defer py.Py_DecRef(str)
+		if py.PyDict_SetItemString(meta, key, str) != 0 {
+			py.PyErr_Print()
+			return fmt.Errorf("failed to set metadata key '%s'", key)
+		}
+		return nil
+	})
+	if err != nil {
+		py.Py_DecRef(content)
+		py.Py_DecRef(meta)
+		return py.NullPyObjectPtr, err
+	}
+
+	tuple := py.PyTuple_New(2)
+	if tuple == py.NullPyObjectPtr {
+		py.Py_DecRef(content)
+		py.Py_DecRef(meta)
+		return py.NullPyObjectPtr, errors.New("failed to create python tuple")
+	}
+	// Tuples steal our references.
+	py.PyTuple_SetItem(tuple, 0, content)
+	py.PyTuple_SetItem(tuple, 1, meta)
+	return tuple, nil
+}
+
+// SetMetadata applies a dict of metadata updates to a message, deleting keys
+// set to None.
+//
+// It's far from efficient for container values (lists, tuples, dicts) as it
+// relies on the Python side serializing to JSON and the Go side
+// deserializing from JSON.
+func SetMetadata(meta py.PyObjectPtr, m *service.Message, serializer *Serializer) error {
+	if py.BaseType(meta) != py.Dict {
+		return errors.New("meta python type is not a dictionary")
+	}
+
+	keys := py.PyDict_Keys(meta)
+	if keys == py.NullPyObjectPtr {
+		return errors.New("failed to get keys from metadata dictionary")
+	}
+	defer py.Py_DecRef(keys)
+	if py.BaseType(keys) != py.List {
+		// This should not happen. If it does, something is horribly wrong.
+		panic("keys wasn't a Python list?!")
+	}
+
+	for idx := int64(0); idx < py.PyList_Size(keys); idx++ {
+		key := py.PyList_GetItem(keys, idx)
+		if key == py.NullPyObjectPtr {
+			// Shouldn't happen...
+			panic("metadata dictionary key was null")
+		}
+		keyString, err := UnicodeToString(key)
+		if err != nil {
+			panic("could not decode dictionary key")
+		}
+		val := py.PyDict_GetItem(meta, key)
+		if val == py.NullPyObjectPtr {
+			// We shouldn't get null pointers. Something is wrong.
+			panic(fmt.Sprintf("metadata dictionary value was null for key %s", keyString))
+		}
+
+		switch py.BaseType(val) {
+		case py.None:
+			// Remove our dictionary item.
+			m.MetaDelete(keyString)
+
+		case py.String:
+			valString, err := UnicodeToString(val)
+			if err != nil {
+				panic("could not decode Python string used as metadata value")
+			}
+			m.MetaSetMut(keyString, valString)
+
+		case py.Bytes:
+			p := py.PyBytes_AsString(val)
+			sz := py.PyBytes_Size(val)
+			m.MetaSetMut(keyString, unsafe.Slice(p, sz))
+
+		case py.Long:
+			long := py.PyLong_AsLong(val)
+			m.MetaSetMut(keyString, long)
+
+		case py.Float:
+			float := py.PyFloat_AsDouble(val)
+			m.MetaSetMut(keyString, float)
+
+		case py.Tuple, py.List, py.Dict:
+			// Convert to a JSON string
+			str, err := serializer.JsonString(val)
+			if err != nil {
+				panic(err)
+			}
+
+			// XXX unmarshal the JSON back into Go objects using the json
+			// module. This handles nested structures nicely and saves on
+			// writing a bunch of recursive extraction code.
+			var _map map[string]any
+			err = json.Unmarshal([]byte(str), &_map)
+			if err != nil {
+				panic(fmt.Sprintf("%s: %s", "failed to unmarshal json", err))
+			}
+			m.MetaSetMut(keyString, _map)
+
+		default:
+			// Datetimes, e.g. for a timestamp, become times.
+			ts, ok, err := serializer.Timestamp(val)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return errors.New("unhandled metadata dictionary value")
+			}
+			m.MetaSetMut(keyString, ts)
+		}
+	}
+	return nil
+}
+
+// KeyMetaKey is the metadata key holding the key of a message dict.
+const KeyMetaKey = "key"
+
+// MessageDictContent returns the content of obj if it's a message dict, i.e.
+// a dict with a "content" item and, optionally, "meta" and "key" items but
+// nothing else. Returns a borrowed reference.
+//
+// The caller must manage the interpreter state for this to succeed.
+func MessageDictContent(obj py.PyObjectPtr) (py.PyObjectPtr, bool) {
+	if py.BaseType(obj) != py.Dict {
+		return py.NullPyObjectPtr, false
+	}
+	content := py.PyDict_GetItemString(obj, "content")
+	if content == py.NullPyObjectPtr {
+		return py.NullPyObjectPtr, false
+	}
+	size := int64(1)
+	for _, key := range []string{"meta", "key"} {
+		if py.PyDict_GetItemString(obj, key) != py.NullPyObjectPtr {
+			size++
+		}
+	}
+	if py.PyDict_Size(obj) != size {
+		return py.NullPyObjectPtr, false
+	}
+	return content, true
+}
+
+// SetMessageDictMetadata sets the metadata of a message dict on a message, and
+// its key, if any, in the KeyMetaKey metadata.
+//
+// The caller must manage the interpreter state for this to succeed.
+func SetMessageDictMetadata(obj py.PyObjectPtr, m *service.Message, serializer *Serializer) error {
+	if meta := py.PyDict_GetItemString(obj, "meta"); meta != py.NullPyObjectPtr && py.BaseType(meta) != py.None {
+		if err := SetMetadata(meta, m, serializer); err != nil {
+			return err
+		}
+	}
+
+	return setKey(py.PyDict_GetItemString(obj, "key"), m)
+}
+
+// setKey sets a str or bytes key, if not None, in the KeyMetaKey metadata of
+// a message.
+//
+// The caller must manage the interpreter state for this to succeed.
+func setKey(key py.PyObjectPtr, m *service.Message) error {
+	switch py.BaseType(key) {
+	case py.Unknown, py.None:
+		// No key.
+	case py.String:
+		str, err := UnicodeToString(key)
+		if err != nil {
+			return err
+		}
+		m.MetaSetMut(KeyMetaKey, str)
+	case py.Bytes:
+		data := unsafe.Slice(py.PyBytes_AsString(key), py.PyBytes_Size(key))
+		m.MetaSetMut(KeyMetaKey, string(data))
+	default:
+		return errors.New("message key must be a str or bytes")
+	}
+	return nil
+}
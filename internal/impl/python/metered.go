@@ -0,0 +1,121 @@
+package python
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+)
+
+// MeteredRuntime is a component's handle on a runtime, recording how long it
+// waits to acquire interpreters, how long it holds them, and how many it has
+// in use. Comparing these tells whether Python execution or contention for
+// interpreters is the bottleneck.
+type MeteredRuntime struct {
+	runtime Runtime
+
+	wait   *service.MetricTimer
+	hold   *service.MetricTimer
+	inUse  *service.MetricGauge
+	used   atomic.Int64
+	waited atomic.Int64 // Total nanoseconds spent waiting, see Waited.
+}
+
+// NewMeteredRuntime wraps r, recording metrics with the given provider, which
+// may be nil.
+func NewMeteredRuntime(r Runtime, metrics *service.Metrics) *MeteredRuntime {
+	return &MeteredRuntime{
+		runtime: r,
+		wait:    metrics.NewTimer("python_interpreter_wait_ns"),
+		hold:    metrics.NewTimer("python_interpreter_hold_ns"),
+		inUse:   metrics.NewGauge("python_interpreters_in_use"),
+	}
+}
+
+func (m *MeteredRuntime) Start(ctx context.Context) error {
+	return m.runtime.Start(ctx)
+}
+
+func (m *MeteredRuntime) Stop(ctx context.Context) error {
+	return m.runtime.Stop(ctx)
+}
+
+func (m *MeteredRuntime) Acquire(ctx context.Context) (*InterpreterTicket, error) {
+	start := time.Now()
+	ticket, err := m.runtime.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.acquired(ticket, start)
+	return ticket, nil
+}
+
+func (m *MeteredRuntime) AcquireFor(ctx context.Context, key uint64) (*InterpreterTicket, error) {
+	pinner, ok := m.runtime.(Pinner)
+	if !ok {
+		return nil, errors.New("runtime can't pin interpreters")
+	}
+	start := time.Now()
+	ticket, err := pinner.AcquireFor(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	m.acquired(ticket, start)
+	return ticket, nil
+}
+
+func (m *MeteredRuntime) Release(ticket *InterpreterTicket) error {
+	m.released(ticket)
+	return m.runtime.Release(ticket)
+}
+
+func (m *MeteredRuntime) Apply(ticket *InterpreterTicket, ctx context.Context, f func() error) error {
+	start := time.Now()
+	return m.runtime.Apply(ticket, ctx, func() error {
+		m.waited.Add(time.Since(start).Nanoseconds())
+		return f()
+	})
+}
+
+func (m *MeteredRuntime) Map(ctx context.Context, f func(ticket *InterpreterTicket) error) error {
+	return m.runtime.Map(ctx, f)
+}
+
+func (m *MeteredRuntime) Interrupt(ctx context.Context) error {
+	return m.runtime.Interrupt(ctx)
+}
+
+func (m *MeteredRuntime) Recycle(ticket *InterpreterTicket, ctx context.Context) error {
+	recycler, ok := m.runtime.(Recycler)
+	if !ok {
+		_ = m.Release(ticket)
+		return errors.New("runtime can't recycle interpreters")
+	}
+	m.released(ticket)
+	return recycler.Recycle(ticket, ctx)
+}
+
+// Waited is the total time spent waiting on interpreters: to acquire them, and
+// then for them to run our code. In the global mode, the latter is waiting on
+// the GIL.
+func (m *MeteredRuntime) Waited() time.Duration {
+	return time.Duration(m.waited.Load())
+}
+
+// acquired records the ticket being taken from the pool, after waiting for it
+// since start.
+func (m *MeteredRuntime) acquired(ticket *InterpreterTicket, start time.Time) {
+	ticket.acquired = time.Now()
+	wait := ticket.acquired.Sub(start).Nanoseconds()
+	m.wait.Timing(wait)
+	m.waited.Add(wait)
+	m.inUse.Set(m.used.Add(1))
+}
+
+// released records the ticket going back to the pool.
+func (m *MeteredRuntime) released(ticket *InterpreterTicket) {
+	m.hold.Timing(time.Since(ticket.acquired).Nanoseconds())
+	m.inUse.Set(m.used.Add(-1))
+}
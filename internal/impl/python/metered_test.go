@@ -0,0 +1,81 @@
+package python
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Test that a metered runtime tracks the interpreters in use.
+func TestMeteredRuntimeInUse(t *testing.T) {
+	r, err := NewMultiInterpreterRuntime("python3", 2, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMeteredRuntime(r, nil)
+
+	ctx := context.Background()
+	if err = m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = m.Stop(ctx) }()
+
+	first, err := m.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := m.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used := m.used.Load(); used != 2 {
+		t.Fatalf("expected 2 interpreters in use, got %d", used)
+	}
+
+	if err = m.Release(first); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Release(second); err != nil {
+		t.Fatal(err)
+	}
+	if used := m.used.Load(); used != 0 {
+		t.Fatalf("expected no interpreters in use, got %d", used)
+	}
+}
+
+// Test that a metered runtime tracks how long it waits on interpreters.
+func TestMeteredRuntimeWaited(t *testing.T) {
+	r, err := NewSingleInterpreterRuntime("python3", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMeteredRuntime(r, nil)
+
+	ctx := context.Background()
+	if err = m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = m.Stop(ctx) }()
+
+	ticket, err := m.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = m.Release(ticket)
+	}()
+
+	ticket, err = m.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Apply(ticket, ctx, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Release(ticket)
+
+	if waited := m.Waited(); waited < 50*time.Millisecond {
+		t.Fatalf("expected to wait at least 50ms, waited %s", waited)
+	}
+}
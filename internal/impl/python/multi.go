@@ -3,7 +3,10 @@ package python
 import (
 	"context"
 	"errors"
+	"os/exec"
 	"runtime"
+	"slices"
+	"sync"
 
 	"github.com/redpanda-data/benthos/v4/public/service"
 	py "github.com/voutilad/gogopython"
@@ -11,21 +14,33 @@ import (
 
 // MultiInterpreterRuntime creates and manages multiple Python sub-interpreters.
 type MultiInterpreterRuntime struct {
-	exe   string   // Python exe (binary).
-	home  string   // Python home.
-	paths []string // Python package paths.
+	exe     string   // Python exe (binary).
+	home    string   // Python home.
+	program string   // Python program name, if in a virtual environment.
+	paths   []string // Python package paths.
 
 	interpreters []*subInterpreter       // Sub-interpreters.
 	tickets      chan *InterpreterTicket // Tickets for sub-interpreters.
+	all          []*InterpreterTicket    // All tickets, whether in use or not. Protected by allMtx.
+	allMtx       sync.Mutex
+	pinned       pinnedTickets // Hands out particular tickets.
 
 	mtx        *ContextAwareMutex // Mutex to write protect the runtime state.
 	started    bool
 	legacyMode bool            // Running in legacy mode?
+	ownEnv     bool            // Using a different environment than the main interpreter?
+	isolated   bool            // Isolating Python from the host?
 	logger     *service.Logger // Redpanda Connect logger service.
+
+	workers []*worker // Dedicated threads per interpreter, if enabled.
+
+	watchdog  Watchdog      // Optional watchdog for stuck interpreters.
+	watchStop chan struct{} // Closed to stop the watchdog.
+	watchDone chan struct{} // Closed once the watchdog stopped.
 }
 
 func NewMultiInterpreterRuntime(exe string, cnt int, legacyMode bool, logger *service.Logger) (*MultiInterpreterRuntime, error) {
-	home, paths, err := py.FindPythonHomeAndPaths(exe)
+	home, program, paths, err := findHomeAndPaths(exe)
 	if err != nil {
 		return nil, err
 	}
@@ -33,15 +48,23 @@ func NewMultiInterpreterRuntime(exe string, cnt int, legacyMode bool, logger *se
 	return &MultiInterpreterRuntime{
 		exe:          exe,
 		home:         home,
+		program:      program,
 		paths:        paths,
 		mtx:          NewContextAwareMutex(),
 		interpreters: make([]*subInterpreter, cnt),
 		tickets:      make(chan *InterpreterTicket, cnt),
+		all:          make([]*InterpreterTicket, cnt),
 		legacyMode:   legacyMode,
 		logger:       logger,
 	}, nil
 }
 
+// SetWatchdog configures a watchdog replacing interpreters stuck running a
+// single call for too long. Must be set before starting the runtime.
+func (r *MultiInterpreterRuntime) SetWatchdog(w Watchdog) {
+	r.watchdog = w
+}
+
 // Start the Python runtime. A MultiInterpreterRuntime centralizes modification
 // of the main interpreter in a go routine.
 func (r *MultiInterpreterRuntime) Start(ctx context.Context) error {
@@ -57,23 +80,38 @@ func (r *MultiInterpreterRuntime) Start(ctx context.Context) error {
 		return nil
 	}
 
-	loadPython(r.exe, r.home, r.paths, ctx)
+	err = loadPython(r.exe, r.home, r.program, r.paths, ctx)
+	if err != nil {
+		return err
+	}
+	r.ownEnv = !inMainEnvironment(r.paths)
+	r.isolated = isolated
 	r.logger.Debug("Python interpreter started.")
+	r.workers = startWorkers(len(r.interpreters))
 
 	// Start up sub-interpreters.
 	for idx := range len(r.interpreters) {
-		sub, err := Spawn(r.legacyMode, ctx)
+		sub, err := r.spawn(ctx)
 		if err != nil {
 			r.logger.Error("Failed to create new sub-interpreter.")
+			stopWorkers(r.workers)
+			r.workers = nil
 			return err
 		}
 
 		// Populate our ticket booth and interpreter list.
 		r.interpreters[idx] = sub
-		r.tickets <- &InterpreterTicket{idx: idx, id: sub.id}
+		r.all[idx] = &InterpreterTicket{idx: idx, id: sub.id}
+		r.tickets <- r.all[idx]
 		r.logger.Tracef("Initialized sub-interpreter %d.\n", sub.id)
 	}
 
+	if r.watchdog.Timeout > 0 {
+		r.watchStop = make(chan struct{})
+		r.watchDone = make(chan struct{})
+		go r.watch(r.watchStop, r.watchDone)
+	}
+
 	r.started = true
 	r.logger.Debugf("Started %d sub-interpreters.", len(r.tickets))
 
@@ -92,12 +130,24 @@ func (r *MultiInterpreterRuntime) Stop(ctx context.Context) error {
 		return errors.New("not started")
 	}
 
-	// Collect all the tickets before stopping the sub-interpreters.
-	tickets := make([]*InterpreterTicket, len(r.tickets))
+	// Stop the watchdog first so it's not replacing interpreters under us.
+	if r.watchStop != nil {
+		close(r.watchStop)
+		<-r.watchDone
+		r.watchStop = nil
+	}
+
+	// Collect all the tickets before stopping the sub-interpreters, waiting
+	// for any in use.
+	tickets := make([]*InterpreterTicket, cap(r.tickets))
 	for idx := range tickets {
 		ticket, err := r.Acquire(ctx)
 		if err != nil {
-			panic("cannot acquire ticket while stopping")
+			// Give them back so we can try again.
+			for _, ticket := range tickets[:idx] {
+				_ = r.Release(ticket)
+			}
+			return err
 		}
 		tickets[idx] = ticket
 	}
@@ -112,6 +162,9 @@ func (r *MultiInterpreterRuntime) Stop(ctx context.Context) error {
 		r.logger.Tracef("Stopped sub-interpreter %d.\n", sub.id)
 	}
 
+	stopWorkers(r.workers)
+	r.workers = nil
+
 	// Tear down the runtime.
 	// runtime.LockOSThread()
 	// defer runtime.UnlockOSThread()
@@ -137,17 +190,28 @@ func (r *MultiInterpreterRuntime) Acquire(ctx context.Context) (*InterpreterTick
 
 func (r *MultiInterpreterRuntime) Release(ticket *InterpreterTicket) error {
 	// Double-check the token is valid.
-	if ticket.idx < 0 || ticket.idx > len(r.tickets) {
+	if ticket.idx < 0 || ticket.idx >= cap(r.tickets) {
 		return errors.New("invalid ticket: bad index")
 	}
 
-	// Return the ticket to the pool. This should not block as the channel is
-	// buffered.
-	r.tickets <- ticket
+	// Our watchdog already replaced its interpreter.
+	if ticket.isAbandoned() {
+		return nil
+	}
+
+	// Return the ticket to the pool, or whoever is waiting on it. This should
+	// not block as the channel is buffered.
+	r.pinned.release(r.tickets, ticket)
 
 	return nil
 }
 
+// AcquireFor acquires ownership of the interpreter key maps to, waiting until
+// it's available.
+func (r *MultiInterpreterRuntime) AcquireFor(ctx context.Context, key uint64) (*InterpreterTicket, error) {
+	return r.pinned.acquire(ctx, r.tickets, key)
+}
+
 func (r *MultiInterpreterRuntime) Apply(ticket *InterpreterTicket, _ context.Context, f func() error) error {
 	// Double-check the token is valid.
 	if ticket.idx < 0 || ticket.idx > len(r.interpreters) {
@@ -159,17 +223,34 @@ func (r *MultiInterpreterRuntime) Apply(ticket *InterpreterTicket, _ context.Con
 		return errors.New("invalid ticket: bad interpreter id")
 	}
 
-	// Pin our go routine & enter the context of the interpreter thread state.
-	runtime.LockOSThread()
-	py.PyEval_RestoreThread(interpreter.thread)
+	return r.onThread(ticket.idx, func() error {
+		// Pin our go routine & enter the context of the interpreter thread state.
+		runtime.LockOSThread()
+		unpin := pinThread(ticket.idx)
+		py.PyEval_RestoreThread(interpreter.thread)
 
-	err := f()
+		// Track the call so it can be interrupted, or caught by our watchdog.
+		// Map isn't tracked, as initialization may legitimately take a while.
+		ticket.enter()
+		err := callSafely(f)
+		ticket.exit()
 
-	// Release our thread state and unpin thread.
-	py.PyEval_SaveThread()
-	runtime.UnlockOSThread()
+		// Release our thread state and unpin thread.
+		py.PyEval_SaveThread()
+		unpin()
+		runtime.UnlockOSThread()
 
-	return err
+		return err
+	})
+}
+
+// onThread calls fn on the dedicated thread of the interpreter with index
+// idx, if we have one, otherwise on the calling go routine.
+func (r *MultiInterpreterRuntime) onThread(idx int, fn func() error) error {
+	if r.workers == nil {
+		return fn()
+	}
+	return r.workers[idx].call(fn)
 }
 
 // Map a function fn over all the interpreters, one at a time. Useful for
@@ -177,7 +258,7 @@ func (r *MultiInterpreterRuntime) Apply(ticket *InterpreterTicket, _ context.Con
 func (r *MultiInterpreterRuntime) Map(ctx context.Context, f func(t *InterpreterTicket) error) error {
 	// Acquire all tickets so we have sole control of the interpreter. Makes it
 	// easier to know if we applied the function to all sub-interpreters.
-	tickets := make([]*InterpreterTicket, len(r.tickets))
+	tickets := make([]*InterpreterTicket, cap(r.tickets))
 	defer func() {
 		for _, token := range tickets {
 			if token != nil {
@@ -195,13 +276,18 @@ func (r *MultiInterpreterRuntime) Map(ctx context.Context, f func(t *Interpreter
 
 	// We should own all tickets and the runtime. Now pin our go routine and
 	// apply the function to all interpreters. We bail on failure.
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
 	for _, ticket := range tickets {
 		sub := r.interpreters[ticket.idx]
-		py.PyEval_RestoreThread(sub.thread)
-		err := f(ticket)
-		py.PyEval_SaveThread()
+		err := r.onThread(ticket.idx, func() error {
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			unpin := pinThread(ticket.idx)
+			py.PyEval_RestoreThread(sub.thread)
+			err := callSafely(func() error { return f(ticket) })
+			py.PyEval_SaveThread()
+			unpin()
+			return err
+		})
 		if err != nil {
 			return err
 		}
@@ -209,3 +295,89 @@ func (r *MultiInterpreterRuntime) Map(ctx context.Context, f func(t *Interpreter
 
 	return nil
 }
+
+func (r *MultiInterpreterRuntime) Interrupt(ctx context.Context) error {
+	return interruptAll(ctx, r.snapshot())
+}
+
+// Recycle replaces the interpreter of an acquired ticket with a fresh one,
+// e.g. to reclaim memory leaked by a library, and releases the ticket. The
+// ticket must not be used afterwards.
+func (r *MultiInterpreterRuntime) Recycle(ticket *InterpreterTicket, ctx context.Context) error {
+	// Double-check the token is valid.
+	if ticket.idx < 0 || ticket.idx > len(r.interpreters) {
+		return errors.New("invalid ticket: bad index")
+	}
+	old := r.interpreters[ticket.idx]
+	if old.id != ticket.id {
+		return errors.New("invalid ticket: bad interpreter id")
+	}
+
+	sub, err := r.spawn(ctx)
+	if err != nil {
+		_ = r.Release(ticket)
+		return err
+	}
+	r.replace(ticket.idx, sub)
+
+	err = StopSub(old, ctx)
+	if err != nil {
+		return err
+	}
+	r.logger.Debugf("Recycled sub-interpreter %d as %d.", old.id, sub.id)
+	return nil
+}
+
+// spawn a new sub-interpreter, pointing it at our own environment if it's not
+// that of the main interpreter.
+func (r *MultiInterpreterRuntime) spawn(ctx context.Context) (*subInterpreter, error) {
+	sub, err := Spawn(r.legacyMode, ctx)
+	if err != nil || !r.ownEnv {
+		return sub, err
+	}
+
+	// Virtual environments know their executable, otherwise find ours.
+	exe := r.program
+	if exe == "" {
+		exe, err = exec.LookPath(r.exe)
+		if err != nil {
+			_ = StopSub(sub, ctx)
+			return nil, err
+		}
+	}
+
+	runtime.LockOSThread()
+	py.PyEval_RestoreThread(sub.thread)
+	err = UseEnvironment(exe, r.paths)
+	if err == nil && r.isolated {
+		// Our environment's paths came from the host, so isolate them again.
+		err = isolate()
+	}
+	py.PyEval_SaveThread()
+	runtime.UnlockOSThread()
+	if err != nil {
+		_ = StopSub(sub, ctx)
+		return nil, err
+	}
+	return sub, nil
+}
+
+// replace the interpreter at idx with sub, handing a ticket for it to the
+// pool. Any ticket for the old interpreter is no longer valid.
+func (r *MultiInterpreterRuntime) replace(idx int, sub *subInterpreter) {
+	ticket := &InterpreterTicket{idx: idx, id: sub.id}
+
+	r.allMtx.Lock()
+	r.interpreters[idx] = sub
+	r.all[idx] = ticket
+	r.allMtx.Unlock()
+
+	r.pinned.release(r.tickets, ticket)
+}
+
+// snapshot provides a copy of all the tickets, whether in use or not.
+func (r *MultiInterpreterRuntime) snapshot() []*InterpreterTicket {
+	r.allMtx.Lock()
+	defer r.allMtx.Unlock()
+	return slices.Clone(r.all)
+}
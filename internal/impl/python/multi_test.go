@@ -2,9 +2,16 @@ package python
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os/exec"
+	"path/filepath"
 	"runtime"
+	"sync"
 	"testing"
+	"time"
+
+	py "github.com/voutilad/gogopython"
 )
 
 // Test that we can start and stop the runtime multiple times.
@@ -31,3 +38,115 @@ func TestMultiInterpreterRuntimeLifecycle(t *testing.T) {
 		})
 	}
 }
+
+// Test that isolated runtimes can use a virtual environment other than the
+// one the main interpreter started with, while others can't.
+func TestMultiInterpreterRuntimeOwnEnvironment(t *testing.T) {
+	dir := t.TempDir()
+	if err := exec.Command("python3", "-m", "venv", "--without-pip", dir).Run(); err != nil {
+		t.Fatal(err)
+	}
+	venvExe := filepath.Join(dir, "bin", "python")
+
+	ctx := context.Background()
+	main, err := NewSingleInterpreterRuntime("python3", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = main.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = main.Stop(ctx) }()
+
+	other, err := NewSingleInterpreterRuntime(venvExe, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = other.Start(ctx); err == nil {
+		_ = other.Stop(ctx)
+		t.Fatal("expected a global runtime with a different environment to fail")
+	}
+
+	r, err := NewMultiInterpreterRuntime(venvExe, 1, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Stop(ctx) }()
+
+	ticket, err := r.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Release(ticket) }()
+
+	var executable string
+	err = r.Apply(ticket, ctx, func() error {
+		sys := py.PyImport_ImportModule("sys")
+		defer py.Py_DecRef(sys)
+		obj := py.PyObject_GetAttrString(sys, "executable")
+		defer py.Py_DecRef(obj)
+		executable, err = py.UnicodeToString(obj)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if executable != venvExe {
+		t.Fatalf("expected sys.executable to be %s, got %s", venvExe, executable)
+	}
+}
+
+// Test that isolated sub-interpreters, each with a GIL of its own, run at the
+// same time rather than taking turns.
+func TestIsolatedInterpretersRunInParallel(t *testing.T) {
+	r, err := NewMultiInterpreterRuntime("python3", 2, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Stop(ctx) }()
+
+	// Each interpreter waits, holding its GIL, until both are running.
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	met := make(chan struct{})
+	go func() {
+		arrived.Wait()
+		close(met)
+	}()
+
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() {
+			ticket, err := r.Acquire(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer func() { _ = r.Release(ticket) }()
+			errs <- r.Apply(ticket, ctx, func() error {
+				if py.PyRun_SimpleString("x = sum(range(1000))") != 0 {
+					return errors.New("failed to run python")
+				}
+				arrived.Done()
+				select {
+				case <-met:
+					return nil
+				case <-time.After(5 * time.Second):
+					return errors.New("interpreters didn't run in parallel")
+				}
+			})
+		}()
+	}
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
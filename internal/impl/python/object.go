@@ -0,0 +1,87 @@
+package python
+
+import (
+	"errors"
+
+	"github.com/ebitengine/purego"
+	py "github.com/voutilad/gogopython"
+)
+
+// Python C API functions for inspecting objects, looked up once the Python
+// library is loaded.
+var (
+	pyObjectIsTrue          func(obj py.PyObjectPtr) int32
+	pyErrOccurred           func() py.PyObjectPtr
+	pyErrGetRaisedException func() py.PyObjectPtr
+	pySysSetObject          func(name string, obj py.PyObjectPtr) int32
+	pyUnicodeAsUTF8AndSize  func(obj py.PyObjectPtr, size *int64) *byte
+)
+
+// pyNone is Python's None singleton, which gogopython doesn't provide.
+var pyNone py.PyObjectPtr
+
+// loadObjectFuncs looks up the functions for inspecting objects.
+//
+// Must be called with globalMtx locked and after loading the Python library.
+func loadObjectFuncs() {
+	globalMtx.AssertLocked()
+
+	lib := uintptr(library)
+	purego.RegisterLibFunc(&pyObjectIsTrue, lib, "PyObject_IsTrue")
+	purego.RegisterLibFunc(&pyErrOccurred, lib, "PyErr_Occurred")
+	purego.RegisterLibFunc(&pyErrGetRaisedException, lib, "PyErr_GetRaisedException")
+	purego.RegisterLibFunc(&pySysSetObject, lib, "PySys_SetObject")
+	purego.RegisterLibFunc(&pyUnicodeAsUTF8AndSize, lib, "PyUnicode_AsUTF8AndSize")
+
+	none, err := librarySymbol(library, "_Py_NoneStruct")
+	if err != nil {
+		panic(err)
+	}
+	pyNone = py.PyObjectPtr(none)
+}
+
+// NewNone returns a new reference to Python's None.
+func NewNone() py.PyObjectPtr {
+	py.Py_IncRef(pyNone)
+	return pyNone
+}
+
+// IsTrue reports whether obj is considered true, like bool(obj) in Python.
+//
+// The caller must manage the interpreter state for this to succeed.
+func IsTrue(obj py.PyObjectPtr) (bool, error) {
+	switch pyObjectIsTrue(obj) {
+	case 1:
+		return true, nil
+	case 0:
+		return false, nil
+	default:
+		py.PyErr_Print()
+		return false, errors.New("failed to determine truth of python object")
+	}
+}
+
+// ErrOccurred reports whether a Python exception is set, e.g. to tell the end
+// of an iterator apart from a failure.
+//
+// The caller must manage the interpreter state for this to succeed.
+func ErrOccurred() bool {
+	return pyErrOccurred() != py.NullPyObjectPtr
+}
+
+// StashException clears the raised exception, saving it as sys.last_exc so
+// it can be inspected like after py.PyErr_Print, without printing it to
+// stderr. Reports whether an exception was raised.
+//
+// The caller must manage the interpreter state for this to succeed.
+func StashException() bool {
+	exc := pyErrGetRaisedException()
+	if exc == py.NullPyObjectPtr {
+		return false
+	}
+	defer py.Py_DecRef(exc)
+
+	pySysSetObject("last_exc", exc)
+	pySysSetObject("last_value", exc)
+	return true
+}
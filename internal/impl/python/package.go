@@ -1 +1,72 @@
 package python
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// identifier matches names Python can import.
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ImportPackage makes the multi-file project in dir importable and imports
+// its entry module into globals, like `from entry import *`, so the
+// component's script, or the component itself, can use what it defines.
+//
+// If dir is a package, i.e. has an __init__.py, its parent goes on sys.path
+// and the entry module is imported from the package, so relative imports
+// work. Otherwise, dir itself goes on sys.path. Either way, modules find
+// their data files relative to their __file__. The entry module defaults to
+// main. Does nothing if dir is empty.
+//
+// The caller must manage the interpreter state for this to succeed.
+func ImportPackage(dir, entry string, globals py.PyObjectPtr) error {
+	if dir == "" {
+		return nil
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("failed to read script_dir: %w", err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("script_dir '%s' isn't a directory", dir)
+	}
+	if entry == "" {
+		entry = "main"
+	}
+	if !identifier.MatchString(entry) {
+		return fmt.Errorf("invalid entry module name '%s'", entry)
+	}
+
+	name := entry
+	if _, err = os.Stat(filepath.Join(dir, "__init__.py")); err == nil {
+		pkg := filepath.Base(dir)
+		if !identifier.MatchString(pkg) {
+			return fmt.Errorf("script_dir '%s' has an __init__.py but isn't a valid package name", dir)
+		}
+		name = pkg + "." + entry
+		err = ExtendSysPath([]string{filepath.Dir(dir)})
+	} else {
+		err = ExtendSysPath([]string{dir})
+	}
+	if err != nil {
+		return err
+	}
+
+	code, err := Compile(fmt.Sprintf("from %s import *\n", name), "__script_dir__.py")
+	if err != nil {
+		return err
+	}
+	result := py.PyEval_EvalCode(code, globals, globals)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return fmt.Errorf("failed to import entry module '%s'", name)
+	}
+	py.Py_DecRef(result)
+	return nil
+}
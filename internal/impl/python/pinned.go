@@ -0,0 +1,100 @@
+package python
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// A Pinner is a Runtime able to acquire a particular one of its interpreters,
+// so state a script keeps per key, like sequence numbers or producers, stays
+// in one place.
+type Pinner interface {
+	// AcquireFor acquires ownership of the interpreter key maps to, waiting
+	// until it's released if in use. A key always maps to the same
+	// interpreter for the life of the runtime.
+	AcquireFor(ctx context.Context, key uint64) (*InterpreterTicket, error)
+}
+
+// pinnedTickets hands particular tickets of a pool to those waiting on them.
+// Tickets must be released through it for waiters to be woken.
+type pinnedTickets struct {
+	mtx     sync.Mutex
+	waiting map[int][]chan *InterpreterTicket // Waiters by ticket index.
+}
+
+// acquire takes the ticket key maps to from pool, waiting until it's released
+// if it's in use.
+func (p *pinnedTickets) acquire(ctx context.Context, pool chan *InterpreterTicket, key uint64) (*InterpreterTicket, error) {
+	idx := int(key % uint64(cap(pool)))
+
+	// Look for it in the pool, putting back any others. The pool has room
+	// for every ticket, so that never blocks.
+	p.mtx.Lock()
+	var found *InterpreterTicket
+	var others []*InterpreterTicket
+	for found == nil {
+		var ticket *InterpreterTicket
+		select {
+		case ticket = <-pool:
+		default:
+		}
+		if ticket == nil {
+			break
+		}
+		if ticket.idx == idx {
+			found = ticket
+		} else {
+			others = append(others, ticket)
+		}
+	}
+	for _, ticket := range others {
+		pool <- ticket
+	}
+	if found != nil {
+		p.mtx.Unlock()
+		return found, nil
+	}
+
+	// Otherwise wait for it to be released.
+	wait := make(chan *InterpreterTicket, 1)
+	if p.waiting == nil {
+		p.waiting = make(map[int][]chan *InterpreterTicket)
+	}
+	p.waiting[idx] = append(p.waiting[idx], wait)
+	p.mtx.Unlock()
+
+	select {
+	case ticket := <-wait:
+		return ticket, nil
+	case <-ctx.Done():
+		p.mtx.Lock()
+		p.waiting[idx] = slices.DeleteFunc(p.waiting[idx], func(w chan *InterpreterTicket) bool {
+			return w == wait
+		})
+		p.mtx.Unlock()
+
+		// It may have been handed to us in the meantime.
+		select {
+		case ticket := <-wait:
+			p.release(pool, ticket)
+		default:
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// release hands the ticket to the first waiting on it, if any, otherwise
+// returns it to pool.
+func (p *pinnedTickets) release(pool chan *InterpreterTicket, ticket *InterpreterTicket) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if waiters := p.waiting[ticket.idx]; len(waiters) > 0 {
+		// Waiters have room for a ticket, so this never blocks.
+		waiters[0] <- ticket
+		p.waiting[ticket.idx] = waiters[1:]
+		return
+	}
+	pool <- ticket
+}
@@ -0,0 +1,67 @@
+package python
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Test that pinned tickets are taken from the pool, or handed over on release
+// to whoever is waiting on them.
+func TestPinnedTickets(t *testing.T) {
+	pool := make(chan *InterpreterTicket, 3)
+	for idx := range 3 {
+		pool <- &InterpreterTicket{idx: idx, id: int64(idx)}
+	}
+	var pinned pinnedTickets
+	ctx := context.Background()
+
+	ticket, err := pinned.acquire(ctx, pool, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticket.idx != 1 {
+		t.Fatalf("expected ticket 1, got %d", ticket.idx)
+	}
+	if len(pool) != 2 {
+		t.Fatalf("expected the other tickets back in the pool, got %d", len(pool))
+	}
+
+	// Wait on it while it's in use.
+	done := make(chan *InterpreterTicket)
+	go func() {
+		waited, err := pinned.acquire(ctx, pool, 1)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- waited
+	}()
+	for {
+		pinned.mtx.Lock()
+		waiting := len(pinned.waiting[1])
+		pinned.mtx.Unlock()
+		if waiting > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	pinned.release(pool, ticket)
+	if waited := <-done; waited != ticket {
+		t.Fatal("expected the released ticket to be handed over")
+	}
+	if len(pool) != 2 {
+		t.Fatalf("expected the ticket not to go back to the pool, got %d", len(pool))
+	}
+
+	// Give up waiting once our context is done.
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err = pinned.acquire(timeout, pool, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected to time out, got %v", err)
+	}
+	pinned.release(pool, ticket)
+	if len(pool) != 3 {
+		t.Fatalf("expected every ticket back in the pool, got %d", len(pool))
+	}
+}
@@ -0,0 +1,34 @@
+package python
+
+import (
+	"path/filepath"
+	"runtime"
+)
+
+// libraryName is the file name of the Python dynamic library of the given
+// version, like "3.12", including any ABI flags, like "3.13t".
+func libraryName(version string) string {
+	if runtime.GOOS == "darwin" {
+		return "libpython" + version + ".dylib"
+	}
+	return "libpython" + version + ".so.1.0"
+}
+
+// venvExecutable is the Python executable within the virtual environment
+// rooted at dir.
+func venvExecutable(dir string) string {
+	return filepath.Join(dir, "bin", "python")
+}
+
+// condaLibrary is the Python dynamic library of the given version within the
+// conda environment rooted at dir, which conda keeps in the environment's lib
+// directory.
+func condaLibrary(dir, version string) string {
+	return filepath.Join(dir, "lib", libraryName(version))
+}
+
+// standaloneExecutable is the Python executable within an unpacked
+// python-build-standalone install rooted at dir.
+func standaloneExecutable(dir string) string {
+	return filepath.Join(dir, "python", "bin", "python3")
+}
@@ -0,0 +1,88 @@
+package python
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// PreloadModules imports the named modules into the current interpreter, so
+// expensive imports happen before processing any data and import errors are
+// found early.
+//
+// The caller must manage the interpreter state for this to succeed.
+func PreloadModules(modules []string) error {
+	for _, name := range modules {
+		module := py.PyImport_ImportModule(name)
+		if module == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return fmt.Errorf("failed to preload module '%s'", name)
+		}
+		// sys.modules holds on to a reference for us.
+		py.Py_DecRef(module)
+	}
+	return nil
+}
+
+// RequireModules checks the named modules can be imported by the current
+// interpreter, importing no more than the packages containing them, so a missing dependency fails at
+// startup with an error naming the interpreter and where it looked rather
+// than with a traceback on the first message.
+//
+// The caller must manage the interpreter state for this to succeed.
+func RequireModules(modules []string) error {
+	if len(modules) == 0 {
+		return nil
+	}
+	module, err := LoadRpcnModule()
+	if err != nil {
+		return err
+	}
+	missing := py.PyObject_GetAttrString(module, "_missing")
+	if missing == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to find _missing function in rpcn module")
+	}
+	defer py.Py_DecRef(missing)
+
+	args := py.PyTuple_New(int64(len(modules)))
+	if args == py.NullPyObjectPtr {
+		return errors.New("failed to create python tuple")
+	}
+	defer py.Py_DecRef(args)
+	for idx, name := range modules {
+		// Tuples steal our references.
+		py.PyTuple_SetItem(args, int64(idx), py.PyUnicode_FromString(name))
+	}
+
+	result := py.PyObject_Call(missing, args, py.NullPyObjectPtr)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to check required modules")
+	}
+	defer py.Py_DecRef(result)
+	if py.BaseType(result) == py.None {
+		return nil
+	}
+
+	// Borrowed references, kept alive by the result.
+	name, err := UnicodeToString(py.PyTuple_GetItem(result, 0))
+	if err != nil {
+		return err
+	}
+	executable, err := UnicodeToString(py.PyTuple_GetItem(result, 1))
+	if err != nil {
+		return err
+	}
+	sysPath := py.PyTuple_GetItem(result, 2)
+	paths := make([]string, py.PyList_Size(sysPath))
+	for idx := range paths {
+		if paths[idx], err = UnicodeToString(py.PyList_GetItem(sysPath, int64(idx))); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("required module '%s' not found by python '%s' with sys.path [%s]",
+		name, executable, strings.Join(paths, ", "))
+}
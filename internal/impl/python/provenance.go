@@ -0,0 +1,74 @@
+package python
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+)
+
+// resourcesAudited is whether the checksums of script resources were logged
+// since they were last set.
+//
+// Protected by resourcesMtx.
+var resourcesAudited = false
+
+// ScriptChecksum is the hex encoded SHA-256 checksum identifying a script.
+func ScriptChecksum(script string) string {
+	sum := sha256.Sum256([]byte(script))
+	return hex.EncodeToString(sum[:])
+}
+
+// matchesChecksum reports whether checksum, optionally prefixed with
+// "sha256:", is that of script.
+func matchesChecksum(script, checksum string) bool {
+	checksum = strings.TrimPrefix(strings.TrimSpace(checksum), "sha256:")
+	return strings.EqualFold(checksum, ScriptChecksum(script))
+}
+
+// AuditScript logs the checksum of a script a component is going to run, so
+// deployments can tell exactly what code ran. If checksums isn't empty, the
+// script must match one of them, otherwise it's rejected. Empty scripts are
+// ignored.
+//
+// The first script audited also logs the checksums of script resources, as
+// those are parsed before any logger is available.
+func AuditScript(logger *service.Logger, name, script string, checksums []string) error {
+	auditResources(logger)
+	if script == "" {
+		return nil
+	}
+
+	sum := ScriptChecksum(script)
+	logger.With("script", name, "sha256", sum).Info("Loaded Python script.")
+	if len(checksums) == 0 {
+		return nil
+	}
+	if !slices.ContainsFunc(checksums, func(checksum string) bool { return matchesChecksum(script, checksum) }) {
+		return fmt.Errorf("python %s has checksum %s, which isn't one of script_checksums", name, sum)
+	}
+	return nil
+}
+
+// auditResources logs the checksums of script resources, once.
+func auditResources(logger *service.Logger) {
+	resourcesMtx.Lock()
+	defer resourcesMtx.Unlock()
+
+	if logger == nil || resourcesAudited {
+		return
+	}
+	resourcesAudited = true
+
+	labels := make([]string, 0, len(resources))
+	for label := range resources {
+		labels = append(labels, label)
+	}
+	slices.Sort(labels)
+	for _, label := range labels {
+		logger.With("resource", label, "sha256", ScriptChecksum(resources[label])).Info("Loaded Python script resource.")
+	}
+}
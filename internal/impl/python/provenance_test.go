@@ -0,0 +1,41 @@
+package python
+
+import "testing"
+
+// Test that scripts are only rejected if they match none of the checksums.
+func TestAuditScript(t *testing.T) {
+	script := "test"
+	sum := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	if ScriptChecksum(script) != sum {
+		t.Fatalf("expected checksum %s, got %s", sum, ScriptChecksum(script))
+	}
+
+	tests := []struct {
+		name      string
+		checksums []string
+		valid     bool
+	}{
+		{"unchecked", nil, true},
+		{"match", []string{sum}, true},
+		{"prefixed", []string{"sha256:" + sum}, true},
+		{"upper case", []string{"9F86D081884C7D659A2FEAA0C55AD015A3BF4F1B2B0B822CD15D6C15B0F00A08"}, true},
+		{"one of many", []string{"0000", sum}, true},
+		{"mismatch", []string{"0000"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := AuditScript(nil, "script", script, test.checksums)
+			if test.valid && err != nil {
+				t.Fatal(err)
+			}
+			if !test.valid && err == nil {
+				t.Fatal("expected the script to be rejected")
+			}
+		})
+	}
+
+	// Empty scripts, like an unset init script, are never rejected.
+	if err := AuditScript(nil, "init", "", []string{"0000"}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,41 @@
+package python
+
+import (
+	"context"
+	"time"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+)
+
+// readyInterval is how often to check whether Python code is ready.
+const readyInterval = time.Second
+
+// WaitUntilReady calls ready for every interpreter of r, with its state
+// managed, until all report they're ready, e.g. once a model loading in the
+// background is available, or ctx is done. Interpreters are free between
+// checks so background work can make progress.
+func WaitUntilReady(ctx context.Context, r Runtime, ready func(ticket *InterpreterTicket) (bool, error), logger *service.Logger) error {
+	for attempt := 0; ; attempt++ {
+		all := true
+		err := r.Map(ctx, func(ticket *InterpreterTicket) error {
+			ok, err := ready(ticket)
+			all = all && ok
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if all {
+			return nil
+		}
+		if attempt == 0 {
+			logger.Info("Waiting for python to report it's ready.")
+		}
+
+		select {
+		case <-time.After(readyInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package python
+
+import (
+	"context"
+	"testing"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// Test that we keep checking until Python code reports it's ready.
+func TestWaitUntilReady(t *testing.T) {
+	r, err := NewMultiInterpreterRuntime("python3", 1, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Stop(ctx) }()
+
+	err = r.Map(ctx, func(ticket *InterpreterTicket) error {
+		code, err := Compile(`
+checks = 0
+def ready():
+    global checks
+    checks += 1
+    return checks >= 2
+`, "__ready_test__.py")
+		if err != nil {
+			return err
+		}
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+		result := py.PyEval_EvalCode(code, globals, globals)
+		if result == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			t.Fatal("failed to evaluate script")
+		}
+		py.Py_DecRef(result)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := 0
+	err = WaitUntilReady(ctx, r, func(ticket *InterpreterTicket) (bool, error) {
+		checks++
+		globals, err := ticket.Globals()
+		if err != nil {
+			return false, err
+		}
+		result := py.PyObject_CallNoArgs(py.PyDict_GetItemString(globals, "ready"))
+		if result == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			t.Fatal("failed to call ready")
+		}
+		defer py.Py_DecRef(result)
+		return IsTrue(result)
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checks != 2 {
+		t.Fatalf("expected 2 checks, got %d", checks)
+	}
+}
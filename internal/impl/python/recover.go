@@ -0,0 +1,28 @@
+package python
+
+import (
+	"errors"
+	"fmt"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// ErrInterpreterUnusable reports a call into an interpreter failed in a way
+// that leaves it in an unknown state, e.g. a panic part way through. Rather
+// than carrying on, components should rebuild their runtime.
+var ErrInterpreterUnusable = errors.New("python interpreter is unusable")
+
+// callSafely calls f, recovering from any panic so the caller still gives
+// up the interpreter state afterward instead of taking down the process.
+//
+// The caller must manage the interpreter state for this to succeed.
+func callSafely(f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			// Don't leave an exception behind for the next caller.
+			py.PyErr_Clear()
+			err = fmt.Errorf("%w: %v", ErrInterpreterUnusable, r)
+		}
+	}()
+	return f()
+}
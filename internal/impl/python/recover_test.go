@@ -0,0 +1,44 @@
+package python
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// Test that a panic while running in an interpreter is reported instead of
+// taking down the process, leaving the runtime usable.
+func TestApplyRecoversFromPanic(t *testing.T) {
+	single, err := NewSingleInterpreterRuntime("python3", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	multi, err := NewMultiInterpreterRuntime("python3", 1, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, r := range map[string]Runtime{"single": single, "multi": multi} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if err := r.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = r.Stop(ctx) }()
+
+			ticket, err := r.Acquire(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = r.Release(ticket) }()
+
+			err = r.Apply(ticket, ctx, func() error { panic("boom") })
+			if !errors.Is(err, ErrInterpreterUnusable) {
+				t.Fatalf("expected an unusable interpreter, got %v", err)
+			}
+			if err = r.Apply(ticket, ctx, func() error { return nil }); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package python
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// schemaRegistry is the registry rpcn.schema_registry is bound to.
+type schemaRegistry struct {
+	url      string // Base URL, disabled if empty.
+	username string
+	password string
+}
+
+var (
+	registryMtx sync.Mutex
+	registry    schemaRegistry
+)
+
+// SetSchemaRegistry binds rpcn.schema_registry in every interpreter to the
+// Confluent-compatible schema registry at rawURL, optionally using basic
+// authentication. As the rpcn module is shared by components using the same
+// interpreter, all components must agree on the registry.
+func SetSchemaRegistry(rawURL, username, password string) error {
+	if rawURL == "" {
+		return nil
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid schema registry url: %w", err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("invalid schema registry url '%s': scheme must be http or https", rawURL)
+	}
+
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+
+	next := schemaRegistry{url: rawURL, username: username, password: password}
+	if registry.url != "" && registry != next {
+		return fmt.Errorf("schema registry already set to '%s'", registry.url)
+	}
+	registry = next
+	return nil
+}
+
+// bindSchemaRegistry binds rpcn.schema_registry to the registry, if set.
+//
+// The caller must manage the interpreter state for this to succeed.
+func bindSchemaRegistry(module py.PyObjectPtr) error {
+	registryMtx.Lock()
+	r := registry
+	registryMtx.Unlock()
+	if r.url == "" {
+		return nil
+	}
+
+	bind := py.PyObject_GetAttrString(module, "_set_schema_registry")
+	if bind == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to find _set_schema_registry function in rpcn module")
+	}
+	defer py.Py_DecRef(bind)
+
+	args := py.PyTuple_New(3)
+	if args == py.NullPyObjectPtr {
+		return errors.New("failed to create python tuple")
+	}
+	defer py.Py_DecRef(args)
+	// Tuples steal our references.
+	py.PyTuple_SetItem(args, 0, py.PyUnicode_FromString(r.url))
+	py.PyTuple_SetItem(args, 1, py.PyUnicode_FromString(r.username))
+	py.PyTuple_SetItem(args, 2, py.PyUnicode_FromString(r.password))
+
+	result := py.PyObject_Call(bind, args, py.NullPyObjectPtr)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to set schema registry")
+	}
+	py.Py_DecRef(result)
+	return nil
+}
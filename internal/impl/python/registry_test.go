@@ -0,0 +1,122 @@
+package python
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// Test that the schema registry is validated and all components agree on it.
+func TestSetSchemaRegistry(t *testing.T) {
+	defer func() {
+		registryMtx.Lock()
+		registry = schemaRegistry{}
+		registryMtx.Unlock()
+	}()
+
+	if err := SetSchemaRegistry("localhost:8081", "", ""); err == nil {
+		t.Error("expected a url without a scheme to be rejected")
+	}
+	if err := SetSchemaRegistry("http://localhost:8081", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetSchemaRegistry("http://localhost:8081", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetSchemaRegistry("http://localhost:8082", "", ""); err == nil {
+		t.Error("expected a second registry to be rejected")
+	}
+}
+
+// Test that scripts can look up schemas and frame payloads.
+func TestSchemaRegistryHelper(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/subjects/orders-value/versions/latest":
+			_, _ = w.Write([]byte(`{"subject": "orders-value", "version": 3, "id": 258}`))
+		case "/schemas/ids/258":
+			_, _ = w.Write([]byte(`{"schema": "{\"type\": \"object\"}", "schemaType": "JSON"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	if err := SetSchemaRegistry(server.URL, "user", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		registryMtx.Lock()
+		registry = schemaRegistry{}
+		registryMtx.Unlock()
+	}()
+
+	// Extension modules urllib loads in sub-interpreters don't survive later
+	// tests restarting Python, so use the main interpreter.
+	r, err := NewSingleInterpreterRuntime("python3", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Stop(ctx) }()
+
+	ticket, err := r.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Release(ticket) }()
+
+	var result string
+	err = r.Apply(ticket, ctx, func() error {
+		if _, err := LoadRpcnModule(); err != nil {
+			return err
+		}
+		code, err := Compile(`
+import rpcn
+registry = rpcn.schema_registry
+schema_id = registry.schema_id("orders-value")
+framed = registry.encode_json(schema_id, {"n": 1})
+assert framed == b"\x00\x00\x00\x01\x02" + b'{"n": 1}', framed
+assert registry.decode_json(framed) == {"n": 1}
+assert registry.schema(schema_id)["schemaType"] == "JSON"
+
+framed = registry.encode(schema_id, b"pb", [1, 2])
+assert registry.decode(framed, protobuf=True) == (258, [1, 2], b"pb")
+framed = registry.encode(schema_id, b"pb", [0])
+assert framed == b"\x00\x00\x00\x01\x02\x00pb", framed
+assert registry.decode(framed, protobuf=True) == (258, [0], b"pb")
+result = "ok"
+`, "__registry_test__.py")
+		if err != nil {
+			return err
+		}
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+		out := py.PyEval_EvalCode(code, globals, globals)
+		if out == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			t.Fatal("failed to evaluate script")
+		}
+		py.Py_DecRef(out)
+		result, err = py.UnicodeToString(py.PyDict_GetItemString(globals, "result"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "ok" {
+		t.Fatalf("expected 'ok', got '%s'", result)
+	}
+}
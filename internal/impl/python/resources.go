@@ -0,0 +1,162 @@
+package python
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"unsafe"
+
+	"github.com/ebitengine/purego"
+	"github.com/redpanda-data/benthos/v4/public/service"
+	py "github.com/voutilad/gogopython"
+)
+
+// Scripts defined once under python_resources, importable as modules named
+// by their label.
+var (
+	resourcesMtx sync.Mutex
+	resources    = make(map[string]string)
+)
+
+// Python function looking up a script resource, shared by all interpreters
+// as purego can only create a limited number of callbacks.
+var (
+	resourceDefOnce sync.Once
+	resourceDef     py.PyMethodDef
+	resourceName    = []byte("__resource\x00")
+)
+
+// resourceLabel matches labels usable as Python module names.
+var resourceLabel = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// resourcesField is the top-level config field defining script resources.
+const resourcesField = "python_resources"
+
+// SetScriptResources replaces the scripts importable by label from every
+// interpreter. Labels must be valid Python module names.
+func SetScriptResources(scripts map[string]string) error {
+	for label := range scripts {
+		if !resourceLabel.MatchString(label) {
+			return fmt.Errorf("python resource label '%s' isn't a valid module name", label)
+		}
+	}
+
+	resourcesMtx.Lock()
+	defer resourcesMtx.Unlock()
+	resources = make(map[string]string, len(scripts))
+	for label, script := range scripts {
+		resources[label] = script
+	}
+	resourcesAudited = false
+	return nil
+}
+
+// MainConfigSchema extends the config schema of our plugins with a
+// top-level python_resources section.
+func MainConfigSchema() *service.ConfigSchema {
+	return service.GlobalEnvironment().FullConfigSchema("", "").
+		Field(service.NewObjectListField(resourcesField,
+			service.NewStringField("label").
+				Description("Name to import the script as."),
+			service.NewStringField("script").
+				Description("Python code of the module."),
+			service.NewStringField("sha256").
+				Description("SHA-256 checksum, hex encoded, the script must match. Not checked if empty.").
+				Default("")).
+			Description("Python scripts defined once and importable by their label from every python component, for sharing helper code.").
+			Default([]any{}))
+}
+
+// ParseScriptResources reads the python_resources section of a parsed main
+// config, making its scripts importable.
+func ParseScriptResources(conf *service.ParsedConfig) error {
+	if !conf.Contains(resourcesField) {
+		return nil
+	}
+	entries, err := conf.FieldObjectList(resourcesField)
+	if err != nil {
+		return err
+	}
+
+	scripts := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		label, err := entry.FieldString("label")
+		if err != nil {
+			return err
+		}
+		script, err := entry.FieldString("script")
+		if err != nil {
+			return err
+		}
+		checksum, err := entry.FieldString("sha256")
+		if err != nil {
+			return err
+		}
+		if checksum != "" && !matchesChecksum(script, checksum) {
+			return fmt.Errorf("python resource '%s' has checksum %s, not %s", label, ScriptChecksum(script), checksum)
+		}
+		if _, exists := scripts[label]; exists {
+			return fmt.Errorf("python resource '%s' is defined more than once", label)
+		}
+		scripts[label] = script
+	}
+	return SetScriptResources(scripts)
+}
+
+// resourceCallback is called from Python when importing a module. It has a
+// Python function definition like:
+//
+// def __resource(label: str) -> Optional[str]
+//
+// returning the script of the resource with label, or None if there's none.
+func resourceCallback(_, tuple py.PyObjectPtr) py.PyObjectPtr {
+	if py.BaseType(tuple) != py.Tuple {
+		panic("argument should be a Python tuple")
+	}
+	label, err := py.UnicodeToString(py.PyTuple_GetItem(tuple, 0))
+	if err != nil {
+		panic(err)
+	}
+
+	resourcesMtx.Lock()
+	script, ok := resources[label]
+	resourcesMtx.Unlock()
+	if !ok {
+		return NewNone()
+	}
+	return py.PyUnicode_FromString(script)
+}
+
+// installResources lets the current interpreter import script resources.
+//
+// The caller must manage the interpreter state for this to succeed.
+func installResources(module py.PyObjectPtr) error {
+	install := py.PyObject_GetAttrString(module, "_install_resources")
+	if install == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to find _install_resources function in rpcn module")
+	}
+	defer py.Py_DecRef(install)
+
+	resourceDefOnce.Do(func() {
+		resourceDef = py.PyMethodDef{
+			Name:   unsafe.SliceData(resourceName),
+			Flags:  py.MethodVarArgs,
+			Method: purego.NewCallback(resourceCallback),
+		}
+	})
+	lookup := py.PyCFunction_NewEx(&resourceDef, py.NullPyObjectPtr, py.NullPyObjectPtr)
+	if lookup == py.NullPyObjectPtr {
+		return errors.New("failed to create python function")
+	}
+	defer py.Py_DecRef(lookup)
+
+	result := py.PyObject_CallOneArg(install, lookup)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to install python resources")
+	}
+	py.Py_DecRef(result)
+	return nil
+}
@@ -0,0 +1,76 @@
+package python
+
+import (
+	"context"
+	"testing"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// Test that script resources are importable by label, without shadowing
+// installed modules.
+func TestScriptResources(t *testing.T) {
+	err := SetScriptResources(map[string]string{
+		"helpers": "def shout(s):\n    return s.upper() + '!'\n",
+		"json":    "raise RuntimeError('shadowed')\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = SetScriptResources(nil) }()
+
+	r, err := NewMultiInterpreterRuntime("python3", 1, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Stop(ctx) }()
+
+	ticket, err := r.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Release(ticket) }()
+
+	var result string
+	err = r.Apply(ticket, ctx, func() error {
+		if _, err := LoadRpcnModule(); err != nil {
+			return err
+		}
+		code, err := Compile(`
+import helpers
+import json
+result = helpers.shout(json.dumps("hi"))
+`, "__resources_test__.py")
+		if err != nil {
+			return err
+		}
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+		out := py.PyEval_EvalCode(code, globals, globals)
+		if out == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			t.Fatal("failed to evaluate script")
+		}
+		py.Py_DecRef(out)
+		result, err = py.UnicodeToString(py.PyDict_GetItemString(globals, "result"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != `"HI"!` {
+		t.Fatalf("expected '\"HI\"!', got '%s'", result)
+	}
+}
+
+func TestScriptResourceLabels(t *testing.T) {
+	if err := SetScriptResources(map[string]string{"not-a-module": ""}); err == nil {
+		t.Fatal("expected an invalid label to be rejected")
+	}
+}
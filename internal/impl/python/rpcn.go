@@ -0,0 +1,177 @@
+package python
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// Python helper module made available to scripts as `rpcn`.
+//
+//go:embed rpcn.py
+var rpcnSrc string
+
+// LoadRpcnModule imports our rpcn helper module, re-using an existing
+// instance so state like cached values survive multiple components sharing
+// an interpreter, and binds it to the schema registry if one is set. Returns
+// a borrowed reference.
+//
+// The caller must manage the interpreter state for this to succeed.
+func LoadRpcnModule() (py.PyObjectPtr, error) {
+	modules := py.PyImport_GetModuleDict()
+	module := py.PyDict_GetItemString(modules, "rpcn")
+	if module != py.NullPyObjectPtr {
+		// The schema registry may have been set since we were imported.
+		return module, bindSchemaRegistry(module)
+	}
+
+	code, err := Compile(rpcnSrc, "rpcn.py")
+	if err != nil {
+		return py.NullPyObjectPtr, errors.New("failed to compile rpcn helper module")
+	}
+	module = py.PyImport_ExecCodeModule("rpcn", code)
+	if module == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return py.NullPyObjectPtr, errors.New("failed to import rpcn helper module")
+	}
+	// sys.modules holds on to a reference for us.
+	py.Py_DecRef(module)
+
+	// Make script resources importable, now that we have our helpers.
+	if err = installResources(module); err != nil {
+		return py.NullPyObjectPtr, err
+	}
+	if err = bindSchemaRegistry(module); err != nil {
+		return py.NullPyObjectPtr, err
+	}
+	return module, nil
+}
+
+// ExtendSysPath appends the provided directories to sys.path, resolving them
+// to absolute paths first so they don't depend on the working directory
+// of the interpreter.
+//
+// The caller must manage the interpreter state for this to succeed.
+func ExtendSysPath(paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	module, err := LoadRpcnModule()
+	if err != nil {
+		return err
+	}
+	extend := py.PyObject_GetAttrString(module, "_extend_path")
+	if extend == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to find _extend_path function in rpcn module")
+	}
+	defer py.Py_DecRef(extend)
+
+	args := py.PyTuple_New(int64(len(paths)))
+	if args == py.NullPyObjectPtr {
+		return errors.New("failed to create python tuple")
+	}
+	defer py.Py_DecRef(args)
+	for idx, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		// Tuples steal our references.
+		py.PyTuple_SetItem(args, int64(idx), py.PyUnicode_FromString(abs))
+	}
+
+	result := py.PyObject_Call(extend, args, py.NullPyObjectPtr)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to extend sys.path")
+	}
+	py.Py_DecRef(result)
+	return nil
+}
+
+// SetEnvironment applies the provided environment variables to os.environ.
+// Go reads its environment once at startup, so these are only seen by Python
+// and any processes it spawns.
+//
+// The caller must manage the interpreter state for this to succeed.
+func SetEnvironment(environment map[string]string) error {
+	if len(environment) == 0 {
+		return nil
+	}
+
+	module, err := LoadRpcnModule()
+	if err != nil {
+		return err
+	}
+	set := py.PyObject_GetAttrString(module, "_set_environment")
+	if set == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to find _set_environment function in rpcn module")
+	}
+	defer py.Py_DecRef(set)
+
+	env := py.PyDict_New()
+	if env == py.NullPyObjectPtr {
+		return errors.New("failed to create python dict")
+	}
+	defer py.Py_DecRef(env)
+	for key, value := range environment {
+		str := py.PyUnicode_FromString(value)
+		ret := py.PyDict_SetItemString(env, key, str)
+		py.Py_DecRef(str)
+		if ret != 0 {
+			py.PyErr_Print()
+			return fmt.Errorf("failed to set environment variable '%s'", key)
+		}
+	}
+
+	result := py.PyObject_CallOneArg(set, env)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to set environment variables")
+	}
+	py.Py_DecRef(result)
+	return nil
+}
+
+// UseEnvironment points the current interpreter at the environment of a
+// different executable of the same Python installation, replacing sys.path
+// with its module search paths.
+//
+// The caller must manage the interpreter state for this to succeed.
+func UseEnvironment(exe string, paths []string) error {
+	module, err := LoadRpcnModule()
+	if err != nil {
+		return err
+	}
+	use := py.PyObject_GetAttrString(module, "_use_environment")
+	if use == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to find _use_environment function in rpcn module")
+	}
+	defer py.Py_DecRef(use)
+
+	args := py.PyTuple_New(int64(len(paths) + 1))
+	if args == py.NullPyObjectPtr {
+		return errors.New("failed to create python tuple")
+	}
+	defer py.Py_DecRef(args)
+	// Tuples steal our references.
+	py.PyTuple_SetItem(args, 0, py.PyUnicode_FromString(exe))
+	for idx, path := range paths {
+		py.PyTuple_SetItem(args, int64(idx+1), py.PyUnicode_FromString(path))
+	}
+
+	result := py.PyObject_Call(use, args, py.NullPyObjectPtr)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return fmt.Errorf("failed to use environment of '%s'", exe)
+	}
+	py.Py_DecRef(result)
+	return nil
+}
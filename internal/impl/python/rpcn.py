@@ -0,0 +1,1276 @@
+"""
+Helpers for processor and output scripts, importable via `import rpcn`.
+"""
+__cache = {}
+
+
+def once(key, factory):
+    """
+    Provides a value created at most once per interpreter, useful for
+    expensive resources like ML models.
+    :param key: unique name for the value
+    :param factory: zero-argument callable producing the value
+    :return: the cached value for key
+    """
+    if key not in __cache:
+        __cache[key] = factory()
+    return __cache[key]
+
+
+def loaded(key):
+    """
+    Reports whether a value for key has already been created via `once()`.
+    :param key: unique name for the value
+    :return: True if loaded, otherwise False
+    """
+    return key in __cache
+
+
+class RetryableError(Exception):
+    """
+    Raise to signal a transient failure. The batch fails so the runtime can
+    retry it.
+    """
+
+
+class FatalError(Exception):
+    """
+    Raise to fail only the current message, without retrying.
+    """
+
+
+class RejectError(Exception):
+    """
+    Raise to drop the current message on purpose, e.g. because it's invalid
+    and not worth delivering. It's acknowledged without being retried.
+    """
+
+
+__classifier = None
+
+
+def classifier(fn):
+    """
+    Register a function classifying exceptions, usable as a decorator. It's
+    given the exception and should return "retryable", "fatal", "reject", or
+    None to fall back to the default classification.
+    :param fn: classifier function
+    :return: fn
+    """
+    global __classifier
+    __classifier = fn
+    return fn
+
+
+def _classify(retry_on=""):
+    """
+    Classify the last exception raised by a script.
+    :param retry_on: comma-separated exception type names to consider
+                     retryable, including subclasses
+    :return: tuple of the classification ("retryable", "fatal", "reject", or
+             ""), and
+             the type, message, and formatted traceback of the exception
+    """
+    import sys
+    import traceback
+    exc = getattr(sys, "last_exc", None) or getattr(sys, "last_value", None)
+    kind = None
+    if __classifier is not None:
+        try:
+            kind = __classifier(exc)
+        except Exception:
+            kind = None
+    if kind not in ("retryable", "fatal", "reject"):
+        names = {name.strip() for name in retry_on.split(",") if name.strip()}
+        if isinstance(exc, RetryableError):
+            kind = "retryable"
+        elif any(cls.__name__ in names for cls in type(exc).__mro__):
+            kind = "retryable"
+        elif isinstance(exc, FatalError):
+            kind = "fatal"
+        elif isinstance(exc, RejectError):
+            kind = "reject"
+        else:
+            kind = ""
+    return kind, type(exc).__name__, str(exc), "".join(traceback.format_exception(exc))
+
+
+class Tombstone:
+    """
+    Return or yield from an input to emit a tombstone, a message with a null
+    payload and the given key, e.g. to delete the key from a compacted topic.
+    """
+    __slots__ = ("key", "meta")
+
+    def __init__(self, key, meta=None):
+        """
+        :param key: str or bytes key of the deleted record
+        :param meta: optional dict of metadata for the message
+        """
+        self.key = key
+        self.meta = meta
+
+    def __repr__(self):
+        return f"Tombstone({self.key!r})"
+
+
+class Heartbeat:
+    """
+    Return or yield from an input to emit a keep-alive marker, an empty
+    message that downstream components can recognize and drop, rather than
+    abusing an empty string.
+    """
+    __slots__ = ("meta",)
+
+    def __init__(self, meta=None):
+        """
+        :param meta: optional dict of metadata for the message
+        """
+        self.meta = meta
+
+    def __repr__(self):
+        return "Heartbeat()"
+
+
+def _control(obj):
+    """
+    Describe obj if it's a control message.
+    :param obj: object returned by a script
+    :return: tuple of the kind ("tombstone" or "heartbeat"), key, and
+             metadata of the message, or None if obj isn't a control message
+    """
+    if isinstance(obj, Tombstone):
+        return "tombstone", obj.key, obj.meta
+    if isinstance(obj, Heartbeat):
+        return "heartbeat", None, obj.meta
+    return None
+
+
+class Route:
+    """
+    Set as the processor's root to steer the result to a named sink, e.g. a
+    case of a switch output checking the route metadata.
+    """
+    __slots__ = ("name", "payload")
+
+    def __init__(self, name, payload):
+        """
+        :param name: name of the route, set in the route metadata
+        :param payload: the result itself, as root would otherwise be
+        """
+        if not isinstance(name, str):
+            raise TypeError("route name must be a str")
+        self.name = name
+        self.payload = payload
+
+    def __repr__(self):
+        return f"Route({self.name!r}, {self.payload!r})"
+
+
+class ParquetWriter:
+    """
+    Writes batches of structured messages to Parquet files using pyarrow,
+    rotating to a new file once one grows too large or too old. Each batch is
+    written as a row group and files are only renamed into place once
+    complete, so readers never see partial files.
+
+    Instances are callable, so they can be used directly as a routed writer.
+    """
+    def __init__(self, path, prefix="part", max_rows=None, max_bytes=None,
+                 max_age=None, compression="snappy", schema=None):
+        """
+        :param path: directory to write files into, created if needed
+        :param prefix: prefix for file names
+        :param max_rows: rotate after writing this many rows
+        :param max_bytes: rotate after writing this many (in-memory) bytes
+        :param max_age: rotate once a file has been open this many seconds,
+                        checked when writing
+        :param compression: Parquet compression codec
+        :param schema: optional pyarrow.Schema, otherwise inferred from the
+                       first batch of each file
+        """
+        self.path = path
+        self.prefix = prefix
+        self.max_rows = max_rows
+        self.max_bytes = max_bytes
+        self.max_age = max_age
+        self.compression = compression
+        self.schema = schema
+        self.files = 0
+        self._reset()
+
+    def _reset(self):
+        self.writer = None
+        self.filename = None
+        self.rows = 0
+        self.bytes = 0
+        self.opened = None
+
+    def _open(self, schema):
+        import os
+        import time
+        import pyarrow.parquet as pq
+        os.makedirs(self.path, exist_ok=True)
+        self.files += 1
+        self.filename = os.path.join(
+            self.path, f"{self.prefix}-{int(time.time() * 1000)}-{self.files:05d}.parquet")
+        self.writer = pq.ParquetWriter(self.filename + ".tmp", schema, compression=self.compression)
+        self.opened = time.monotonic()
+
+    def _due(self):
+        import time
+        if self.max_rows is not None and self.rows >= self.max_rows:
+            return True
+        if self.max_bytes is not None and self.bytes >= self.max_bytes:
+            return True
+        if self.max_age is not None and time.monotonic() - self.opened >= self.max_age:
+            return True
+        return False
+
+    @staticmethod
+    def _decode(message):
+        import json
+        if isinstance(message, tuple):
+            # (content, metadata) from with_metadata.
+            message = message[0]
+        if isinstance(message, (bytes, str)):
+            return json.loads(message)
+        return message
+
+    def write(self, messages):
+        """
+        Write a batch of messages as a row group, rotating files as needed.
+        :param messages: list of dicts, or JSON bytes or str
+        """
+        import pyarrow as pa
+        rows = [self._decode(m) for m in messages]
+        if not rows:
+            return
+        if self.writer is not None and self._due():
+            self.close()
+        table = pa.Table.from_pylist(rows, schema=self.schema if self.writer is None else self.writer.schema)
+        if self.writer is None:
+            self._open(table.schema)
+        self.writer.write_table(table)
+        self.rows += table.num_rows
+        self.bytes += table.nbytes
+        if self._due():
+            self.close()
+
+    __call__ = write
+
+    def close(self):
+        """
+        Finish the current file, if any, and move it into place.
+        """
+        import os
+        if self.writer is None:
+            return
+        self.writer.close()
+        os.replace(self.filename + ".tmp", self.filename)
+        self._reset()
+
+
+def read_parquet(*paths, columns=None):
+    """
+    Read Parquet files with pyarrow, yielding each row group as a table. An
+    input yielding tables emits each as a batch with a message per row, so
+    `rows = rpcn.read_parquet("data/*.parquet")` ingests files as they are.
+    :param paths: paths of files, or glob patterns, read in order
+    :param columns: optional names of the columns to read
+    :return: generator of pyarrow.Table
+    """
+    import glob
+    import pyarrow.parquet as pq
+    for pattern in paths:
+        for path in sorted(glob.glob(pattern)) or [pattern]:
+            file = pq.ParquetFile(path)
+            for idx in range(file.num_row_groups):
+                yield file.read_row_group(idx, columns=columns)
+
+
+__loop = None
+
+
+def _event_loop():
+    """
+    Provides the event loop used for running async functions, created on
+    first use.
+    """
+    global __loop
+    if __loop is None:
+        import asyncio
+        __loop = asyncio.new_event_loop()
+    return __loop
+
+
+def _resolve(value):
+    """
+    Run value to completion on our event loop if it's awaitable.
+    :param value: result of calling a script function
+    :return: the value, or the result of awaiting it
+    """
+    import inspect
+    if inspect.isawaitable(value):
+        return _event_loop().run_until_complete(value)
+    return value
+
+
+class _AsyncWriter:
+    """
+    Adapts an `async def write(message)` function to take a batch, awaiting
+    the messages concurrently and returning a list of what each call returned.
+    """
+    def __init__(self, fn, limit):
+        self.fn = fn
+        self.limit = limit
+
+    def __call__(self, messages, **kwargs):
+        import asyncio
+
+        async def run():
+            semaphore = asyncio.Semaphore(self.limit)
+
+            async def write(message):
+                async with semaphore:
+                    return await self.fn(message, **kwargs)
+
+            # Let every write finish before failing on the first error, so
+            # nothing is left running between batches.
+            results = await asyncio.gather(*(write(m) for m in messages), return_exceptions=True)
+            for result in results:
+                if isinstance(result, BaseException):
+                    raise result
+            return results
+
+        return _event_loop().run_until_complete(run())
+
+
+def _async_writer(fn, limit):
+    """
+    Wrap fn in an _AsyncWriter if it's an async function.
+    :param fn: write function from a script
+    :param limit: maximum number of concurrent writes
+    :return: a function taking a batch of messages
+    """
+    import inspect
+    if inspect.iscoroutinefunction(fn):
+        return _AsyncWriter(fn, limit)
+    return fn
+
+
+def _accepts(fn):
+    """
+    Find the keyword arguments fn accepts, looking through _AsyncWriter.
+    :param fn: write function or writer from a script
+    :return: set of parameter names, or None if it takes any keywords
+    """
+    import inspect
+    if isinstance(fn, _AsyncWriter):
+        fn = fn.fn
+    try:
+        params = inspect.signature(fn).parameters.values()
+    except (TypeError, ValueError):
+        return set()
+    if any(p.kind == inspect.Parameter.VAR_KEYWORD for p in params):
+        return None
+    return {p.name for p in params
+            if p.kind in (inspect.Parameter.POSITIONAL_OR_KEYWORD, inspect.Parameter.KEYWORD_ONLY)}
+
+
+def _write(fn, messages, attempt, last_error):
+    """
+    Call a write function with a batch, passing it the delivery attempt and
+    the error of the previous one as keyword arguments if it accepts them.
+    :param fn: write function or writer from a script
+    :param messages: list of messages
+    :param attempt: delivery attempt, starting from 1
+    :param last_error: description of why the previous attempt failed, or None
+    :return: the result of fn
+    """
+    accepts = _accepts(fn)
+    kwargs = {}
+    if accepts is None or "attempt" in accepts:
+        kwargs["attempt"] = attempt
+    if accepts is None or "last_error" in accepts:
+        kwargs["last_error"] = last_error
+    return fn(messages, **kwargs)
+
+
+def _extend_path(*paths):
+    """
+    Append paths to sys.path, skipping any already present so components
+    sharing an interpreter don't add them twice.
+    :param paths: directories to make importable
+    """
+    import sys
+    for path in paths:
+        if path not in sys.path:
+            sys.path.append(path)
+
+
+def _missing(*names):
+    """
+    Find the first of the named modules that can't be imported, importing no
+    more than the packages containing them.
+    :param names: dotted names of modules
+    :return: tuple of the missing name, sys.executable, and sys.path, or None
+    """
+    import importlib.util
+    import sys
+    for name in names:
+        try:
+            found = importlib.util.find_spec(name) is not None
+        except (ImportError, ValueError):
+            # A missing parent package, or a module without a spec.
+            found = name in sys.modules
+        if not found:
+            return name, sys.executable, list(sys.path)
+    return None
+
+
+def _identity(stream, label, pipeline):
+    """
+    Describe the deployment and component a script runs in.
+    :param stream: name of the stream, or ""
+    :param label: label of the component, or ""
+    :param pipeline: id of the pipeline, or ""
+    :return: namespace with stream, label, and pipeline attributes
+    """
+    import types
+    return types.SimpleNamespace(stream=stream, label=label, pipeline=pipeline)
+
+def _isolate():
+    """
+    Strip sys.path of what running python with -I leaves off: the working
+    directory, PYTHONPATH, and the user's site-packages. The site-packages of
+    the Python installation go too, unless it's a conda environment.
+    """
+    import os
+    import site
+    import sys
+    drop = {os.getcwd(), site.getusersitepackages()}
+    drop.update(p for p in os.environ.get("PYTHONPATH", "").split(os.pathsep) if p)
+    if not os.path.isdir(os.path.join(sys.base_prefix, "conda-meta")):
+        drop.update(site.getsitepackages([sys.base_prefix]))
+    drop = {os.path.abspath(p) for p in drop}
+    sys.path[:] = [p for p in sys.path if os.path.abspath(p) not in drop]
+
+
+def _set_environment(environment):
+    """
+    Apply environment variables to os.environ for scripts.
+    :param environment: dict of variable names to values
+    """
+    import os
+    os.environ.update(environment)
+
+
+def _use_environment(executable, *paths):
+    """
+    Point the interpreter at a different environment of the same Python
+    installation, e.g. another virtual environment.
+    :param executable: the environment's python executable
+    :param paths: the environment's module search paths
+    """
+    import sys
+    sys.executable = executable
+    sys.path[:] = paths
+
+
+class _LogStream:
+    """
+    Text stream sending complete lines to a component's logger, replacing
+    sys.stdout or sys.stderr.
+    """
+    encoding = "utf-8"
+    errors = "strict"
+
+    def __init__(self, emit, logger, level, original):
+        """
+        :param emit: function taking the logger, level, and a line
+        :param logger: identifier of the component's logger
+        :param level: log level for lines written to this stream
+        :param original: the stream being replaced
+        """
+        import threading
+        self.emit = emit
+        self.logger = logger
+        self.level = level
+        self.original = original
+        self._buffer = ""
+        self._lock = threading.Lock()
+
+    def write(self, s):
+        with self._lock:
+            *lines, self._buffer = (self._buffer + s).split("\n")
+        for line in lines:
+            self._emit(line)
+        return len(s)
+
+    def writelines(self, lines):
+        for line in lines:
+            self.write(line)
+
+    def flush(self):
+        with self._lock:
+            line, self._buffer = self._buffer, ""
+        self._emit(line)
+
+    def _emit(self, line):
+        line = line.rstrip()
+        if line:
+            self.emit(self.logger, self.level, line)
+
+    def fileno(self):
+        # Some libraries, like faulthandler, need a real file descriptor.
+        return self.original.fileno()
+
+    def isatty(self):
+        return False
+
+    def readable(self):
+        return False
+
+    def writable(self):
+        return True
+
+
+def _capture_output(emit, logger):
+    """
+    Send sys.stdout, sys.stderr, and warnings to a component's logger, unless
+    another component sharing the interpreter already did.
+    :param emit: function taking the logger, level, a line, and optional key
+                 and value pairs
+    :param logger: identifier of the component's logger
+    """
+    import sys
+    import warnings
+    if isinstance(sys.stdout, _LogStream):
+        return
+    sys.stdout = _LogStream(emit, logger, "info", sys.stdout)
+    sys.stderr = _LogStream(emit, logger, "warn", sys.stderr)
+
+    def show_warning(message, category, filename, lineno, file=None, line=None):
+        emit(logger, "warn", str(message),
+             "category", category.__name__, "location", f"{filename}:{lineno}")
+
+    warnings.showwarning = show_warning
+    # Deprecations are hidden outside of __main__ by default, but they're
+    # worth knowing about before an upgrade breaks a pipeline. Respect any
+    # filters given via -W or PYTHONWARNINGS, though.
+    if not sys.warnoptions:
+        warnings.simplefilter("default", DeprecationWarning)
+
+
+def _scan(fn, read, reader):
+    """
+    Call a scanner's function with a binary stream reading from a Go io.Reader.
+    :param fn: function taking the stream and returning an iterable of records
+    :param read: function taking the reader and a size, returning up to that
+                 many bytes, empty bytes at the end, or None on error
+    :param reader: identifier of the Go io.Reader
+    :return: an iterator over the records
+    """
+    import io
+
+    class RawStream(io.RawIOBase):
+        def readable(self):
+            return True
+
+        def readinto(self, b):
+            data = read(reader, len(b))
+            if data is None:
+                raise OSError("failed to read from input")
+            n = len(data)
+            b[:n] = data
+            return n
+
+    return iter(fn(io.BufferedReader(RawStream())))
+
+
+def _expression(source):
+    """
+    Compile a Bloblang python() expression into a function evaluating it.
+    :param source: Python expression referring to the current value as `this`
+    :return: function taking the current value, as bytes or a JSON string, and
+             returning the expression's result
+    """
+    import json
+    code = compile(source, "<bloblang>", "eval")
+
+    def evaluate(value):
+        if isinstance(value, str):
+            value = json.loads(value)
+        return eval(code, {"this": value})
+
+    return evaluate
+
+
+def _export_metrics(fn, metrics):
+    """
+    Call a metrics exporter's function with the metrics updated since its last
+    call, running it to completion if it's async.
+    :param fn: function taking a list of metrics
+    :param metrics: JSON array of metrics
+    """
+    import json
+    return _resolve(fn(json.loads(metrics)))
+
+
+def _export_spans(fn, spans, dropped):
+    """
+    Call a tracer's function with the spans that ended since its last call,
+    running it to completion if it's async.
+    :param fn: function taking a list of spans
+    :param spans: JSON array of spans
+    :param dropped: number of spans dropped since the last call
+    """
+    import json
+    import warnings
+    if dropped:
+        warnings.warn(f"dropped {dropped} spans as the tracer's queue was full")
+    spans = json.loads(spans)
+    if spans:
+        return _resolve(fn(spans))
+
+
+def _serve_http(app, interface, request, body):
+    """
+    Run an ASGI or WSGI application to completion for a single request.
+    :param app: the application
+    :param interface: "asgi", "wsgi", or "auto" to tell them apart
+    :param request: JSON object with the method, path, query, headers,
+                    client, and server of the request
+    :param body: the request body as bytes
+    :return: tuple of the response status, its headers as a JSON array of
+             pairs, and its body as bytes
+    """
+    import inspect
+    import json
+    request = json.loads(request)
+
+    if interface == "auto":
+        asgi = inspect.iscoroutinefunction(app) or \
+            inspect.iscoroutinefunction(getattr(app, "__call__", None))
+        interface = "asgi" if asgi else "wsgi"
+
+    if interface == "asgi":
+        status, headers, chunks = _serve_asgi(app, request, body)
+    else:
+        status, headers, chunks = _serve_wsgi(app, request, body)
+    return status, json.dumps(headers), b"".join(chunks)
+
+
+def _serve_asgi(app, request, body):
+    """
+    Run an ASGI application for a request, collecting its response.
+    """
+    scope = {
+        "type": "http",
+        "asgi": {"version": "3.0", "spec_version": "2.3"},
+        "http_version": "1.1",
+        "method": request["method"],
+        "scheme": "http",
+        "path": request["path"],
+        "raw_path": request["path"].encode(),
+        "query_string": request["query"].encode(),
+        "root_path": "",
+        "headers": [(k.lower().encode(), v.encode()) for k, v in request["headers"]],
+        "client": tuple(request["client"]),
+        "server": tuple(request["server"]),
+    }
+    response = {"status": 500, "headers": [], "chunks": []}
+    received = False
+
+    async def receive():
+        nonlocal received
+        if received:
+            return {"type": "http.disconnect"}
+        received = True
+        return {"type": "http.request", "body": body, "more_body": False}
+
+    async def send(message):
+        if message["type"] == "http.response.start":
+            response["status"] = message["status"]
+            response["headers"] = [(k.decode(), v.decode()) for k, v in message.get("headers", [])]
+        elif message["type"] == "http.response.body":
+            response["chunks"].append(message.get("body", b""))
+
+    _event_loop().run_until_complete(app(scope, receive, send))
+    return response["status"], response["headers"], response["chunks"]
+
+
+def _serve_wsgi(app, request, body):
+    """
+    Run a WSGI application for a request, collecting its response.
+    """
+    import io
+    import sys
+    environ = {
+        "REQUEST_METHOD": request["method"],
+        "SCRIPT_NAME": "",
+        "PATH_INFO": request["path"],
+        "QUERY_STRING": request["query"],
+        "SERVER_NAME": request["server"][0],
+        "SERVER_PORT": str(request["server"][1]),
+        "SERVER_PROTOCOL": "HTTP/1.1",
+        "REMOTE_ADDR": request["client"][0],
+        "wsgi.version": (1, 0),
+        "wsgi.url_scheme": "http",
+        "wsgi.input": io.BytesIO(body),
+        "wsgi.errors": sys.stderr,
+        "wsgi.multithread": False,
+        "wsgi.multiprocess": False,
+        "wsgi.run_once": False,
+    }
+    for k, v in request["headers"]:
+        key = k.upper().replace("-", "_")
+        if key in ("CONTENT_TYPE", "CONTENT_LENGTH"):
+            environ[key] = v
+        elif "HTTP_" + key in environ:
+            environ["HTTP_" + key] += "," + v
+        else:
+            environ["HTTP_" + key] = v
+
+    response = {"status": 500, "headers": []}
+    chunks = []
+
+    def start_response(status, headers, exc_info=None):
+        response["status"] = int(status.split(" ", 1)[0])
+        response["headers"] = list(headers)
+        return chunks.append
+
+    result = app(environ, start_response)
+    try:
+        chunks.extend(result)
+    finally:
+        if hasattr(result, "close"):
+            result.close()
+    return response["status"], response["headers"], chunks
+
+
+def _sql_json(value):
+    """
+    Encode database values json can't, like datetimes and decimals.
+    """
+    import base64
+    if isinstance(value, (bytes, bytearray, memoryview)):
+        return base64.b64encode(value).decode()
+    if hasattr(value, "isoformat"):
+        return value.isoformat()
+    return str(value)
+
+
+class _SqlReader:
+    """
+    Streams the rows of a query through a DB-API connection as JSON objects,
+    along with the position of each in the cursor column, if any.
+    """
+    def __init__(self, connection, cursor_column):
+        """
+        :param connection: DB-API connection
+        :param cursor_column: column tracking progress, or an empty string
+        """
+        self.connection = connection
+        self.cursor_column = cursor_column
+        self.cursor = None
+        self.names = []
+
+    def execute(self, query, position):
+        """
+        Execute query, passing the JSON encoded position as its only parameter
+        unless it's None.
+        """
+        import json
+        self.cursor = self.connection.cursor()
+        if position is None:
+            self.cursor.execute(query)
+        else:
+            self.cursor.execute(query, (json.loads(position),))
+        self.names = [d[0] for d in self.cursor.description or []]
+
+    def fetch(self, size):
+        """
+        Fetch up to size rows as tuples of their JSON and position, ending the
+        query once there are none left.
+        """
+        import json
+        rows = []
+        for row in self.cursor.fetchmany(size):
+            record = dict(zip(self.names, row))
+            position = None
+            if self.cursor_column:
+                position = json.dumps(record[self.cursor_column], default=_sql_json)
+            rows.append((json.dumps(record, default=_sql_json).encode(), position))
+        if not rows:
+            self.cursor.close()
+            # End any transaction the driver began, so the next query sees
+            # new rows.
+            rollback = getattr(self.connection, "rollback", None)
+            if rollback:
+                rollback()
+        return rows
+
+    def close(self):
+        self.connection.close()
+
+
+class _ResourceFinder:
+    """
+    Finds modules defined under python_resources, by their label. Consulted
+    after the usual finders, so resources can't shadow installed modules.
+    """
+    def __init__(self, lookup):
+        """
+        :param lookup: function taking a label and returning the resource's
+                       script, or None if there's no such resource
+        """
+        self.lookup = lookup
+
+    def find_spec(self, name, path, target=None):
+        import importlib.util
+        if path is not None:
+            # Resources are top-level modules.
+            return None
+        source = self.lookup(name)
+        if source is None:
+            return None
+        return importlib.util.spec_from_loader(name, _ResourceLoader(name, source))
+
+
+class _ResourceLoader:
+    """
+    Loads a module from the script of a resource.
+    """
+    def __init__(self, name, source):
+        self.name = name
+        self.source = source
+
+    def create_module(self, spec):
+        return None
+
+    def exec_module(self, module):
+        exec(compile(self.source, f"<python_resources:{self.name}>", "exec"), module.__dict__)
+
+
+def _install_resources(lookup):
+    """
+    Make python_resources importable in this interpreter.
+    :param lookup: function taking a label and returning the resource's script
+    """
+    import sys
+    if not any(isinstance(f, _ResourceFinder) for f in sys.meta_path):
+        sys.meta_path.append(_ResourceFinder(lookup))
+
+
+class _Trace:
+    """
+    Trace context of the message a processor script is handling.
+    """
+
+    def __init__(self, parent):
+        self.parent = parent
+        self.spans = []
+        self.stack = []
+        self.token = None
+
+
+_trace = None
+_otel = None
+
+
+def traceparent():
+    """
+    Provides the W3C trace context of the current message, for propagating
+    its trace to other services.
+    :return: traceparent header value, or None if the message isn't traced
+    """
+    return _trace.parent if _trace is not None else None
+
+
+class span:
+    """
+    Context manager recording a span of work as a child of the current
+    message's span, e.g. `with rpcn.span("inference", model="bert"):`. Spans
+    nest and are exported by the pipeline's tracer. Outside a traced message
+    it does nothing.
+    """
+
+    def __init__(self, name, **attributes):
+        self.name = name
+        self.attributes = attributes
+        self._trace = None
+        self._record = None
+
+    def set_attribute(self, key, value):
+        """
+        Set an attribute of the span.
+        :param key: attribute name
+        :param value: string, number, or boolean value
+        """
+        self.attributes[key] = value
+
+    def __enter__(self):
+        import time
+        trace = _trace
+        if trace is not None:
+            self._trace = trace
+            self._record = {
+                "name": self.name,
+                "parent": trace.stack[-1] if trace.stack else -1,
+                "start": time.time_ns(),
+                "attributes": self.attributes,
+            }
+            trace.stack.append(len(trace.spans))
+            trace.spans.append(self._record)
+        return self
+
+    def __exit__(self, kind, value, tb):
+        import time
+        if self._record is not None:
+            self._record["end"] = time.time_ns()
+            if value is not None:
+                self._record["error"] = f"{kind.__name__}: {value}"
+            self._trace.stack.pop()
+            self._record = None
+        return False
+
+
+def _trace_begin(parent):
+    """
+    Start tracing a message, making its trace context current for the
+    opentelemetry package if it's installed.
+    :param parent: traceparent of the message's span
+    """
+    global _trace, _otel
+    _trace = _Trace(parent)
+    if _otel is None:
+        try:
+            from opentelemetry import context, propagate
+            _otel = (context, propagate)
+        except ImportError:
+            _otel = False
+    if _otel:
+        context, propagate = _otel
+        _trace.token = context.attach(propagate.extract({"traceparent": parent}))
+
+
+def _trace_end():
+    """
+    Stop tracing the current message.
+    :return: JSON array of the spans recorded via span(), or None if there
+             were none
+    """
+    import json
+    global _trace
+    trace, _trace = _trace, None
+    if trace is None:
+        return None
+    if trace.token is not None:
+        _otel[0].detach(trace.token)
+    if not trace.spans:
+        return None
+    return json.dumps(trace.spans, default=str)
+
+
+def _enable_debugger(exe, host, port, wait):
+    """
+    Start debugpy listening for a debugger to attach.
+    :param exe: Python executable to run debugpy's adapter with
+    :param host: host to listen on
+    :param port: port to listen on
+    :param wait: whether to block until a debugger attaches
+    """
+    import debugpy
+    import sys
+    debugpy.configure(python=exe)
+    debugpy.listen((host, port))
+    if wait:
+        print(f"Waiting for a debugger to attach on {host}:{port}...",
+              file=sys.__stderr__, flush=True)
+        debugpy.wait_for_client()
+    debugpy.debug_this_thread()
+
+
+class SchemaRegistry:
+    """
+    Client of a Confluent-compatible schema registry, handling the wire format
+    of payloads: a zero magic byte and the schema id as a 4-byte big-endian
+    integer, plus message indexes for Protobuf, ahead of the encoded data.
+    Schemas are cached, so look-ups only hit the registry once per id.
+    """
+
+    def __init__(self, url, username="", password=""):
+        self.url = url.rstrip("/")
+        self._auth = None
+        if username or password:
+            import base64
+            token = base64.b64encode(f"{username}:{password}".encode()).decode()
+            self._auth = f"Basic {token}"
+        self._schemas = {}
+        self._ids = {}
+        self._parsed = {}
+
+    def _request(self, path, body=None):
+        import json
+        import urllib.request
+        headers = {"Accept": "application/vnd.schemaregistry.v1+json"}
+        data = None
+        if body is not None:
+            data = json.dumps(body).encode()
+            headers["Content-Type"] = "application/vnd.schemaregistry.v1+json"
+        if self._auth is not None:
+            headers["Authorization"] = self._auth
+        request = urllib.request.Request(self.url + path, data=data, headers=headers)
+        with urllib.request.urlopen(request, timeout=10) as response:
+            return json.loads(response.read())
+
+    def schema(self, schema_id):
+        """
+        Look up a schema by id.
+        :param schema_id: id of the schema
+        :return: dict with the "schema" string and its "schemaType"
+        """
+        if schema_id not in self._schemas:
+            schema = self._request(f"/schemas/ids/{int(schema_id)}")
+            schema.setdefault("schemaType", "AVRO")
+            self._schemas[schema_id] = schema
+        return self._schemas[schema_id]
+
+    def schema_id(self, subject, version="latest"):
+        """
+        Look up the id of a subject's schema. Ids of the latest version are
+        cached too, so new versions are only seen after a restart.
+        :param subject: subject name, e.g. "orders-value"
+        :param version: version number, or "latest"
+        :return: schema id
+        """
+        from urllib.parse import quote
+        key = (subject, str(version))
+        if key not in self._ids:
+            found = self._request(f"/subjects/{quote(subject, safe='')}/versions/{version}")
+            self._ids[key] = found["id"]
+        return self._ids[key]
+
+    def register(self, subject, schema, schema_type="AVRO"):
+        """
+        Register a schema under a subject, or find it if it's already
+        registered.
+        :param subject: subject name, e.g. "orders-value"
+        :param schema: schema as a string, or a dict serialized to JSON
+        :param schema_type: "AVRO", "PROTOBUF", or "JSON"
+        :return: schema id
+        """
+        import json
+        from urllib.parse import quote
+        if not isinstance(schema, str):
+            schema = json.dumps(schema)
+        body = {"schema": schema}
+        if schema_type != "AVRO":
+            body["schemaType"] = schema_type
+        registered = self._request(f"/subjects/{quote(subject, safe='')}/versions", body)
+        return registered["id"]
+
+    @staticmethod
+    def encode(schema_id, payload, message_indexes=None):
+        """
+        Frame an encoded payload in the wire format.
+        :param schema_id: id of the schema the payload was encoded with
+        :param payload: encoded bytes
+        :param message_indexes: for Protobuf, indexes of the message type
+                                within its schema, e.g. [0] for the first
+        :return: framed bytes
+        """
+        framed = bytearray(b"\x00")
+        framed += int(schema_id).to_bytes(4, "big")
+        if message_indexes is not None:
+            if list(message_indexes) == [0]:
+                # The common case of the first message type is a single 0.
+                framed += b"\x00"
+            else:
+                _write_varint(framed, len(message_indexes))
+                for index in message_indexes:
+                    _write_varint(framed, index)
+        framed += payload
+        return bytes(framed)
+
+    @staticmethod
+    def decode(data, protobuf=False):
+        """
+        Split framed bytes into the schema id and payload.
+        :param data: framed bytes
+        :param protobuf: whether message indexes follow the schema id
+        :return: tuple of the schema id and payload, or of the schema id,
+                 message indexes, and payload for Protobuf
+        """
+        if len(data) < 5 or data[0] != 0:
+            raise ValueError("not in schema registry wire format")
+        schema_id = int.from_bytes(data[1:5], "big")
+        if not protobuf:
+            return schema_id, bytes(data[5:])
+        count, offset = _read_varint(data, 5)
+        indexes = []
+        for _ in range(count):
+            index, offset = _read_varint(data, offset)
+            indexes.append(index)
+        return schema_id, indexes or [0], bytes(data[offset:])
+
+    def _avro_schema(self, schema_id):
+        import json
+        import fastavro
+        if schema_id not in self._parsed:
+            schema = json.loads(self.schema(schema_id)["schema"])
+            self._parsed[schema_id] = fastavro.parse_schema(schema)
+        return self._parsed[schema_id]
+
+    def encode_avro(self, schema_id, obj):
+        """
+        Encode an object as Avro with a registered schema, using fastavro.
+        :param schema_id: id of the schema
+        :param obj: object matching the schema, e.g. a dict for a record
+        :return: framed bytes
+        """
+        import io
+        import fastavro
+        buf = io.BytesIO()
+        fastavro.schemaless_writer(buf, self._avro_schema(schema_id), obj)
+        return self.encode(schema_id, buf.getvalue())
+
+    def decode_avro(self, data):
+        """
+        Decode framed Avro bytes with the schema they name, using fastavro.
+        :param data: framed bytes
+        :return: the decoded object
+        """
+        import io
+        import fastavro
+        schema_id, payload = self.decode(data)
+        schema = self._avro_schema(schema_id)
+        return fastavro.schemaless_reader(io.BytesIO(payload), schema)
+
+    def encode_json(self, schema_id, obj):
+        """
+        Encode an object as JSON, framed with a registered JSON schema's id.
+        :param schema_id: id of the schema
+        :param obj: JSON serializable object
+        :return: framed bytes
+        """
+        import json
+        return self.encode(schema_id, json.dumps(obj).encode())
+
+    @classmethod
+    def decode_json(cls, data):
+        """
+        Decode framed JSON bytes.
+        :param data: framed bytes
+        :return: the decoded object
+        """
+        import json
+        return json.loads(cls.decode(data)[1])
+
+    def encode_protobuf(self, schema_id, message, message_indexes=(0,)):
+        """
+        Encode a Protobuf message, framed with a registered schema's id.
+        :param schema_id: id of the schema
+        :param message: instance of a generated class
+        :param message_indexes: indexes of the message type in the schema
+        :return: framed bytes
+        """
+        return self.encode(schema_id, message.SerializeToString(), message_indexes)
+
+    @classmethod
+    def decode_protobuf(cls, data, message_class):
+        """
+        Decode framed Protobuf bytes.
+        :param data: framed bytes
+        :param message_class: generated class of the message
+        :return: instance of message_class
+        """
+        message = message_class()
+        message.ParseFromString(cls.decode(data, protobuf=True)[2])
+        return message
+
+
+def _write_varint(buf, value):
+    """
+    Append a zig-zag encoded variable length integer, as Protobuf framing
+    uses for message indexes.
+    """
+    value = (value << 1) ^ (value >> 63)
+    while value > 0x7f:
+        buf.append((value & 0x7f) | 0x80)
+        value >>= 7
+    buf.append(value)
+
+
+def _read_varint(data, offset):
+    """
+    Read a zig-zag encoded variable length integer.
+    :return: tuple of the value and the offset after it
+    """
+    value, shift = 0, 0
+    while True:
+        if offset >= len(data):
+            raise ValueError("truncated message indexes")
+        byte = data[offset]
+        offset += 1
+        value |= (byte & 0x7f) << shift
+        if not byte & 0x80:
+            break
+        shift += 7
+    return (value >> 1) ^ -(value & 1), offset
+
+
+schema_registry = None
+
+
+def _set_schema_registry(url, username, password):
+    """
+    Bind schema_registry to the configured registry, keeping an existing
+    client, and its cached schemas, if it's for the same registry.
+    """
+    global schema_registry
+    current = schema_registry
+    if current is None or current.url != url.rstrip("/"):
+        schema_registry = SchemaRegistry(url, username, password)
+
+
+def _enable_faulthandler(target):
+    """
+    Enable faulthandler, dumping the traceback of every thread on a fatal
+    error like a crash in an extension module.
+    :param target: "stderr", a file descriptor number, or a file path
+    """
+    import faulthandler
+    import sys
+    if target == "stderr":
+        file = sys.__stderr__
+    elif target.isdigit():
+        file = int(target)
+    else:
+        # faulthandler holds on to the file, keeping it open.
+        file = open(target, "a")
+    faulthandler.enable(file=file, all_threads=True)
+
+
+def _guard_signals(*signums):
+    """
+    Keep Python code from installing handlers for signals the host process
+    relies on for shutting down gracefully. Attempts are ignored with a
+    warning, as raising would break libraries that install them by default.
+    :param signums: signal numbers to guard
+    """
+    import signal
+    import warnings
+    install = signal.signal
+
+    def guarded(signalnum, handler):
+        if signalnum in signums:
+            warnings.warn(f"ignoring handler for {signal.Signals(signalnum).name}, "
+                          "signals are handled by Redpanda Connect", RuntimeWarning, stacklevel=2)
+            return signal.getsignal(signalnum)
+        return install(signalnum, handler)
+
+    guarded.__doc__ = install.__doc__
+    signal.signal = guarded
@@ -3,8 +3,13 @@ package python
 import (
 	"context"
 	"errors"
+	"fmt"
+	"os"
 	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	py "github.com/voutilad/gogopython"
 )
@@ -27,6 +32,19 @@ var pythonStarted = false
 // Protected by globalMtx.
 var pythonExe = ""
 
+// pythonHome is the home of the Python installation we loaded. Executables
+// from other installations can't be used, as only one libpython can be
+// loaded, but virtual environments based on it can.
+//
+// Protected by globalMtx.
+var pythonHome = ""
+
+// mainPaths are the module search paths the main interpreter was started
+// with, those of the environment of the executable starting it.
+//
+// Protected by globalMtx.
+var mainPaths []string
+
 // pythonMain points to the thread-state of the main Python interpreter.
 //
 // Protected by globalMtx.
@@ -40,8 +58,13 @@ type subInterpreter struct {
 }
 
 type config struct {
-	home  string
-	paths []string
+	home         string
+	program      string // Optional program name, e.g. for virtual environments.
+	paths        []string
+	faultHandler string   // Optional faulthandler target.
+	debugger     debugger // Optional debugger to start.
+	exe          string   // Python executable, e.g. for spawning helpers.
+	isolated     bool     // Whether to isolate Python from the host.
 }
 
 type fnRequest struct {
@@ -87,9 +110,17 @@ func init() {
 // An InterpreterTicket represents ownership of the interpreter of a particular
 // Runtime. Other than its id, it's opaque to the user.
 type InterpreterTicket struct {
-	idx    int     // Index of interpreter (used by the Runtime implementation).
-	id     int64   // Python interpreter id.
-	cookie uintptr // Optional cookie value (used by the Runtime implementation).
+	idx     int            // Index of interpreter (used by the Runtime implementation).
+	id      int64          // Python interpreter id.
+	cookie  uintptr        // Optional cookie value (used by the Runtime implementation).
+	globals py.PyObjectPtr // Optional globals, if not using those of __main__.
+
+	acquired time.Time // When the ticket was acquired. Only used by its holder.
+
+	mtx       sync.Mutex               // Protects the fields below.
+	running   py.PyInterpreterStatePtr // Interpreter running Python code for us, if any.
+	since     time.Time                // When we started running Python code.
+	abandoned bool                     // Whether the runtime gave up on our interpreter.
 }
 
 // Id provides a unique (to the backing Runtime) identifier for an interpreter.
@@ -98,6 +129,27 @@ func (i *InterpreterTicket) Id() int64 {
 	return i.id
 }
 
+// Globals provides a borrowed reference to the globals to use for the
+// ticket's interpreter. Usually these are those of the __main__ module, but
+// tickets running concurrently in the same interpreter each have their own.
+//
+// The caller must manage the interpreter state for this to succeed.
+func (i *InterpreterTicket) Globals() (py.PyObjectPtr, error) {
+	if i.globals != py.NullPyObjectPtr {
+		return i.globals, nil
+	}
+
+	main := py.PyImport_AddModule("__main__")
+	if main == py.NullPyObjectPtr {
+		return py.NullPyObjectPtr, errors.New("failed to add __main__ module")
+	}
+	globals := py.PyModule_GetDict(main)
+	if globals == py.NullPyObjectPtr {
+		return py.NullPyObjectPtr, errors.New("failed to create globals")
+	}
+	return globals, nil
+}
+
 // A Runtime for a Python interpreter.
 type Runtime interface {
 	// Start the Python runtime.
@@ -122,35 +174,51 @@ type Runtime interface {
 	// In the case of multiple interpreters, an error aborts mapping over the
 	// remainder.
 	Map(ctx context.Context, f func(ticket *InterpreterTicket) error) error
+
+	// Interrupt any Python code running in the interpreters by raising
+	// KeyboardInterrupt in it, waiting until raised or ctx is done.
+	Interrupt(ctx context.Context) error
+}
+
+// A Recycler is a Runtime able to replace an interpreter with a fresh one.
+type Recycler interface {
+	// Recycle the interpreter of the acquired ticket, releasing the ticket.
+	Recycle(ticket *InterpreterTicket, ctx context.Context) error
 }
 
 // Initialize the main Python interpreter or increment the global count if
 // already initialized.
 //
-// Returns the Python main thread state on success.
-// On failure, returns a null PyThreadStatePtr and an error.
+// Returns an error if exe isn't based on the Python installation we already
+// loaded.
 //
 // Must be called globalMtx and the OS thread locked.
-func loadPython(exe, home string, paths []string, ctx context.Context) {
+func loadPython(exe, home, program string, paths []string, ctx context.Context) error {
 	globalMtx.AssertLocked()
 
-	// It's ok if we're starting another instance of the same executable, but
-	// we don't want to re-load the libraries as we'll crash.
-	if exe != pythonExe && pythonLoaded {
-		panic("python was already initialized with a different implementation")
+	// It's ok if we're starting another executable of the same installation,
+	// e.g. from a different virtual environment, but we don't want to load
+	// another library as we'll crash.
+	if pythonLoaded && home != pythonHome {
+		return fmt.Errorf("python executable '%s' is based on '%s', but '%s' from '%s' is already loaded",
+			exe, home, pythonExe, pythonHome)
 	}
 
 	// Load our dynamic libraries. This should happen only once per process
 	// lifetime.
 	if !pythonLoaded {
-		err := py.LoadLibrary(exe)
+		err := loadLibrary(exe)
 		if err != nil {
-			panic(err)
+			return err
 		}
+		loadInterruptFuncs()
+		loadMarshalFuncs()
+		loadObjectFuncs()
 
 		// From now on, we're considered "loaded."
 		pythonLoaded = true
 		pythonExe = exe
+		pythonHome = home
 	}
 
 	// Launch the main interpreter.
@@ -161,9 +229,15 @@ func loadPython(exe, home string, paths []string, ctx context.Context) {
 
 	// If we're the first consumer, we're responsible for kicking it off.
 	if consumersCnt == 1 {
+		mainPaths = paths
 		config := &config{
-			home:  home,
-			paths: paths,
+			home:         home,
+			program:      program,
+			paths:        paths,
+			faultHandler: faultHandler,
+			debugger:     debug,
+			exe:          exe,
+			isolated:     isolated,
 		}
 		select {
 		case chanToMain <- config:
@@ -181,6 +255,23 @@ func loadPython(exe, home string, paths []string, ctx context.Context) {
 			panic(ctx.Err())
 		}
 	}
+	return nil
+}
+
+// inMainEnvironment reports whether the module search paths are those of the
+// main interpreter's environment.
+//
+// Must be called with globalMtx locked.
+func inMainEnvironment(paths []string) bool {
+	globalMtx.AssertLocked()
+	return slices.Equal(paths, mainPaths)
+}
+
+// errEnvironment reports exe can't be used by a runtime running code in the
+// main interpreter, as it started with a different environment.
+func errEnvironment(exe string) error {
+	return fmt.Errorf("python executable '%s' uses a different environment than '%s', which requires an isolated mode",
+		exe, pythonExe)
 }
 
 // unloadPython tears down the global interpreter state.
@@ -195,6 +286,12 @@ func unloadPython(_ context.Context) error {
 
 	consumersCnt--
 	if consumersCnt == 0 {
+		if abandonedCnt.Load() > 0 {
+			// An abandoned interpreter may still be running code, so we
+			// can't finalize. Keep Python around for the life of the process.
+			consumersCnt++
+			return nil
+		}
 		chanToMain <- nil
 	}
 
@@ -244,6 +341,10 @@ func launchOnce() {
 			pyConfig.SafePath = 0
 			pyConfig.UserSiteDirectory = 0
 			pyConfig.InstallSignalHandlers = 0 // We don't want Python handling signals.
+			if config.isolated {
+				// Like -I, ignore PYTHON* environment variables.
+				pyConfig.UseEnvironment = 0
+			}
 
 			// We need to write funky wchar_t strings to our config, so we do a little
 			// dance with some helper functions.
@@ -252,7 +353,16 @@ func launchOnce() {
 				msg, _ := py.WCharToString(status.ErrMsg)
 				panic(msg)
 			}
-			path := strings.Join(config.paths, ":") // xxx ';' on windows
+			// Python finds a virtual environment's pyvenv.cfg relative to the
+			// program, which sets up prefix, exec_prefix, and site-packages.
+			if config.program != "" {
+				status = py.PyConfig_SetBytesString(&pyConfig, &pyConfig.ProgramName, config.program)
+				if status.Type != 0 {
+					msg, _ := py.WCharToString(status.ErrMsg)
+					panic(msg)
+				}
+			}
+			path := strings.Join(config.paths, string(os.PathListSeparator))
 			status = py.PyConfig_SetBytesString(&pyConfig, &pyConfig.PythonPathEnv, path)
 			if status.Type != 0 {
 				msg, _ := py.WCharToString(status.ErrMsg)
@@ -266,6 +376,37 @@ func launchOnce() {
 				panic(msg)
 			}
 
+			// We create all our thread states from this thread.
+			mainThreadIdent = pyThreadGetThreadIdent()
+
+			// Python never installs its own signal handlers, but keep scripts
+			// and libraries from doing so on our main thread either.
+			if err := guardSignals(); err != nil {
+				panic(err)
+			}
+
+			// Leave the host's packages off sys.path before anything of ours is
+			// imported.
+			if config.isolated {
+				if err := isolate(); err != nil {
+					panic(err)
+				}
+			}
+
+			// A missing traceback isn't worth failing over, so carry on.
+			if config.faultHandler != "" {
+				_ = enableFaultHandler(config.faultHandler)
+			}
+
+			// Nor is a missing debugger, which explains itself on stderr.
+			if config.debugger.address != "" {
+				_ = enableDebugger(config.debugger, config.exe)
+			}
+
+			// Everything run in the main interpreter runs on this thread.
+			pinMainThread()
+			_ = setThreadName(mainThreadName)
+
 			// If we made it here, the main interpreter is started.
 			// Drop GIL and send back some details on our main thread.
 			ts := py.PyEval_SaveThread()
@@ -294,13 +435,13 @@ func launchOnce() {
 					// XXX Hack to execute functions on the "main" go routine.
 					//     Wastes cycles dancing with locks and thread states.
 					py.PyEval_RestoreThread(ts)
-					result := req.fn()
+					result := callSafely(req.fn)
 					py.PyEval_SaveThread()
 					req.reply <- result
 
 				case req := <-chanSpawnSub:
 					py.PyEval_RestoreThread(ts)
-					sub, err := initSubInterpreter(req.legacyMode)
+					sub, err := initSubInterpreter(req.legacyMode, config.isolated)
 					// XXX No need to save here.
 					req.reply <- &subReply{
 						err:            err,
@@ -310,6 +451,7 @@ func launchOnce() {
 				case req := <-chanStopSub:
 					// Restore the sub-interpreter thread state.
 					sub := req.subInterpreter
+					forgetCode(sub.id)
 					py.PyEval_RestoreThread(sub.thread)
 					py.PyThreadState_Clear(sub.thread)
 
@@ -321,6 +463,7 @@ func launchOnce() {
 			}
 
 			// Finalize Python. This has potential to deadlock or panic!
+			forgetAllCode()
 			py.PyEval_RestoreThread(ts)
 			if py.Py_FinalizeEx() != 0 {
 				panic("failed to finalize Python runtime")
@@ -409,12 +552,14 @@ func StopSub(subInterpreter *subInterpreter, ctx context.Context) error {
 //
 // Caller must have the main interpreter state loaded and Go routine pinned.
 // This must be called from the context of the "main" interpreter.
-func initSubInterpreter(legacyMode bool) (*subInterpreter, error) {
+func initSubInterpreter(legacyMode, isolated bool) (*subInterpreter, error) {
 	// Some of these args are required if we want to use Numpy, etc.
 	var ts py.PyThreadStatePtr
 	interpreterConfig := py.PyInterpreterConfig{}
 
 	if !legacyMode {
+		// Each sub-interpreter gets its own GIL (PEP 684), so tickets run
+		// in parallel.
 		interpreterConfig.Gil = py.OwnGil
 		interpreterConfig.CheckMultiInterpExtensions = 1
 		interpreterConfig.UseMainObMalloc = 0
@@ -435,6 +580,14 @@ func initSubInterpreter(legacyMode bool) (*subInterpreter, error) {
 		return nil, errors.New(msg)
 	}
 
+	// Sub-interpreters set up sys.path afresh, so isolate them, too.
+	if isolated {
+		if err := isolate(); err != nil {
+			py.Py_EndInterpreter(ts)
+			return nil, err
+		}
+	}
+
 	// Collect our information and drop the GIL.
 	state := py.PyInterpreterState_Get()
 	id := py.PyInterpreterState_GetID(state)
@@ -1,22 +1,42 @@
 package python
 
 import (
+	"crypto/sha256"
 	_ "embed"
 	"errors"
 	"fmt"
-	py "github.com/voutilad/gogopython"
+	"time"
 	"unsafe"
+
+	py "github.com/voutilad/gogopython"
 )
 
 //go:embed serializer.py
 var source string
 
+// sourceHash identifies our serializer source, which is compiled once per
+// interpreter and shared by every serializer in it.
+var sourceHash = sha256.Sum256([]byte(source))
+
 const (
 	toJsonString = "to_json_string"
 	toJsonBytes  = "to_json_bytes"
 	toPickle     = "to_pickle"
+	fromPickle   = "from_pickle"
+	avroEncoder  = "avro_encoder"
+	toProtobuf   = "to_protobuf"
+	csvEncoder   = "csv_encoder"
+	arrowRows    = "arrow_rows"
+	jsonEncoders = "json_encoders"
+	cborCodec    = "cbor_codec"
+	bsonCodec    = "bson_codec"
+	toTimestamp  = "to_timestamp"
 )
 
+// ProtobufTypeMetaKey is the metadata key holding the type URL of a protobuf
+// message serialized from a Python result.
+const ProtobufTypeMetaKey = "protobuf_type_url"
+
 const null = py.NullPyObjectPtr
 
 type Serializer struct {
@@ -25,21 +45,67 @@ type Serializer struct {
 	jsonString py.PyObjectPtr
 	jsonBytes  py.PyObjectPtr
 	pickle     py.PyObjectPtr
+	unpickle   py.PyObjectPtr
+	avro       py.PyObjectPtr // Encodes Avro, if a schema was set.
+	protobuf   py.PyObjectPtr
+	csv        py.PyObjectPtr // Encodes CSV, if configured.
+	arrow      py.PyObjectPtr
+	timestamp  py.PyObjectPtr
+	cborEncode py.PyObjectPtr // Encodes CBOR, if prepared.
+	cborDecode py.PyObjectPtr // Decodes CBOR, if prepared.
+	bsonEncode py.PyObjectPtr // Encodes BSON, if prepared.
+	bsonDecode py.PyObjectPtr // Decodes BSON, if prepared.
+
+	compression string         // Codec compressing payloads, if any.
+	zstd        py.PyObjectPtr // Compresses zstd, if prepared.
 }
 
+// Header policies of the csv serializer.
+const (
+	CSVHeaderNone  = "none"  // Never write a header.
+	CSVHeaderFirst = "first" // Write a header before the first row.
+	CSVHeaderEvery = "every" // Write a header before every row.
+)
+
+// CSVOptions describes how the csv serializer writes rows.
+type CSVOptions struct {
+	Columns   []string // Column order, inferred from the first dict if empty.
+	Delimiter string
+	Header    string // One of the CSVHeader policies.
+}
+
+// JSON libraries the serializer can encode JSON with.
+const (
+	JSONLibraryAuto   = "auto"   // The fastest library installed.
+	JSONLibraryJSON   = "json"   // The standard library.
+	JSONLibraryOrjson = "orjson" // Also handles datetimes and numpy arrays.
+	JSONLibraryUjson  = "ujson"
+)
+
 // NewSerializer attempts to compile, import, and prepare a set of Python
 // objects to assist serialization.
 //
 // The caller must manage the interpreter state for this to succeed.
 func NewSerializer() (*Serializer, error) {
-	code := py.Py_CompileString(source, "__serializer__.py", py.PyFileInput)
-	if code == py.NullPyCodeObjectPtr {
+	code, err := compileHashed(source, "__serializer__.py", sourceHash)
+	if err != nil {
 		return nil, errors.New("failed to compile serializer source")
 	}
-	module := py.PyImport_ExecCodeModule("__serializer__", code)
+	// Each serializer gets a module of its own, rather than re-executing one
+	// shared through sys.modules, so serializers in the same interpreter
+	// don't race on its globals and scripts can't import it.
+	module := py.PyModule_New("__serializer__")
 	if module == py.NullPyObjectPtr {
+		return nil, errors.New("failed to create serializer module")
+	}
+	globals := py.PyModule_GetDict(module)
+	result := py.PyEval_EvalCode(code, globals, globals)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		py.Py_DecRef(module)
 		return nil, errors.New("failed to import serializer module")
 	}
+	py.Py_DecRef(result)
 	jsonString := py.PyObject_GetAttrString(module, toJsonString)
 	if jsonString == py.NullPyObjectPtr {
 		return nil, fmt.Errorf("failed to find %s in serializer module", toJsonString)
@@ -53,15 +119,168 @@ func NewSerializer() (*Serializer, error) {
 		return nil, fmt.Errorf("failed to find %s in serializer module", toPickle)
 	}
 
+	unpickle := py.PyObject_GetAttrString(module, fromPickle)
+	if unpickle == py.NullPyObjectPtr {
+		return nil, fmt.Errorf("failed to find %s in serializer module", fromPickle)
+	}
+	protobuf := py.PyObject_GetAttrString(module, toProtobuf)
+	if protobuf == py.NullPyObjectPtr {
+		return nil, fmt.Errorf("failed to find %s in serializer module", toProtobuf)
+	}
+
+	arrow := py.PyObject_GetAttrString(module, arrowRows)
+	if arrow == py.NullPyObjectPtr {
+		return nil, fmt.Errorf("failed to find %s in serializer module", arrowRows)
+	}
+
+	timestamp := py.PyObject_GetAttrString(module, toTimestamp)
+	if timestamp == py.NullPyObjectPtr {
+		return nil, fmt.Errorf("failed to find %s in serializer module", toTimestamp)
+	}
+
 	return &Serializer{
 		code:       code,
 		module:     module,
 		jsonString: jsonString,
 		jsonBytes:  jsonBytes,
 		pickle:     pickle,
+		unpickle:   unpickle,
+		avro:       null,
+		protobuf:   protobuf,
+		csv:        null,
+		arrow:      arrow,
+		timestamp:  timestamp,
+		cborEncode: null,
+		cborDecode: null,
+		bsonEncode: null,
+		bsonDecode: null,
+		zstd:       null,
 	}, nil
 }
 
+// SetAvroSchema prepares encoding objects as Avro binary with the given
+// schema, in JSON, using the fastavro module.
+func (s *Serializer) SetAvroSchema(schema string) error {
+	newEncoder := py.PyObject_GetAttrString(s.module, avroEncoder)
+	if newEncoder == py.NullPyObjectPtr {
+		return fmt.Errorf("failed to find %s in serializer module", avroEncoder)
+	}
+	defer py.Py_DecRef(newEncoder)
+
+	arg := py.PyUnicode_FromString(schema)
+	if arg == py.NullPyObjectPtr {
+		return errors.New("failed to create python string")
+	}
+	defer py.Py_DecRef(arg)
+
+	encoder := py.PyObject_CallOneArg(newEncoder, arg)
+	if encoder == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to parse avro schema, is fastavro installed?")
+	}
+	if s.avro != null {
+		py.Py_DecRef(s.avro)
+	}
+	s.avro = encoder
+	return nil
+}
+
+// SetJSONLibrary switches encoding JSON to the given library, one of the
+// JSONLibrary values, returning the name of the library used. With
+// JSONLibraryAuto, that's orjson or ujson if installed, else json.
+func (s *Serializer) SetJSONLibrary(library string) (string, error) {
+	newEncoders := py.PyObject_GetAttrString(s.module, jsonEncoders)
+	if newEncoders == py.NullPyObjectPtr {
+		return "", fmt.Errorf("failed to find %s in serializer module", jsonEncoders)
+	}
+	defer py.Py_DecRef(newEncoders)
+
+	arg := py.PyUnicode_FromString(library)
+	if arg == py.NullPyObjectPtr {
+		return "", errors.New("failed to create python string")
+	}
+	defer py.Py_DecRef(arg)
+
+	encoders := py.PyObject_CallOneArg(newEncoders, arg)
+	if encoders == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return "", fmt.Errorf("failed to load json library %s, is it installed?", library)
+	}
+	defer py.Py_DecRef(encoders)
+
+	name, err := UnicodeToString(py.PyTuple_GetItem(encoders, 0))
+	if err != nil {
+		return "", err
+	}
+	// Tuple items are borrowed, so take our own references.
+	jsonString := py.PyTuple_GetItem(encoders, 1)
+	jsonBytes := py.PyTuple_GetItem(encoders, 2)
+	py.Py_IncRef(jsonString)
+	py.Py_IncRef(jsonBytes)
+	py.Py_DecRef(s.jsonString)
+	py.Py_DecRef(s.jsonBytes)
+	s.jsonString, s.jsonBytes = jsonString, jsonBytes
+	return name, nil
+}
+
+// SetCBOR prepares encoding objects as CBOR, and decoding them back, using
+// the cbor2 module.
+func (s *Serializer) SetCBOR() error {
+	newCodec := py.PyObject_GetAttrString(s.module, cborCodec)
+	if newCodec == py.NullPyObjectPtr {
+		return fmt.Errorf("failed to find %s in serializer module", cborCodec)
+	}
+	defer py.Py_DecRef(newCodec)
+
+	codec := py.PyObject_CallNoArgs(newCodec)
+	if codec == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to load cbor codec, is cbor2 installed?")
+	}
+	defer py.Py_DecRef(codec)
+
+	// Tuple items are borrowed, so take our own references.
+	encode := py.PyTuple_GetItem(codec, 0)
+	decode := py.PyTuple_GetItem(codec, 1)
+	py.Py_IncRef(encode)
+	py.Py_IncRef(decode)
+	if s.cborEncode != null {
+		py.Py_DecRef(s.cborEncode)
+		py.Py_DecRef(s.cborDecode)
+	}
+	s.cborEncode, s.cborDecode = encode, decode
+	return nil
+}
+
+// SetBSON prepares encoding dicts as BSON documents, and decoding them back,
+// using pymongo's bson module or the standalone bson package.
+func (s *Serializer) SetBSON() error {
+	newCodec := py.PyObject_GetAttrString(s.module, bsonCodec)
+	if newCodec == py.NullPyObjectPtr {
+		return fmt.Errorf("failed to find %s in serializer module", bsonCodec)
+	}
+	defer py.Py_DecRef(newCodec)
+
+	codec := py.PyObject_CallNoArgs(newCodec)
+	if codec == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to load bson codec, is pymongo installed?")
+	}
+	defer py.Py_DecRef(codec)
+
+	// Tuple items are borrowed, so take our own references.
+	encode := py.PyTuple_GetItem(codec, 0)
+	decode := py.PyTuple_GetItem(codec, 1)
+	py.Py_IncRef(encode)
+	py.Py_IncRef(decode)
+	if s.bsonEncode != null {
+		py.Py_DecRef(s.bsonEncode)
+		py.Py_DecRef(s.bsonDecode)
+	}
+	s.bsonEncode, s.bsonDecode = encode, decode
+	return nil
+}
+
 func (s *Serializer) call(fn, obj py.PyObjectPtr) (py.PyObjectPtr, error) {
 	result := py.PyObject_CallOneArg(fn, obj)
 	if result == py.NullPyObjectPtr {
@@ -79,7 +298,7 @@ func (s *Serializer) JsonString(obj py.PyObjectPtr) (string, error) {
 	}
 	defer py.Py_DecRef(result)
 
-	str, err := py.UnicodeToString(result)
+	str, err := UnicodeToString(result)
 	if err != nil {
 		return "", err
 	}
@@ -122,7 +341,286 @@ func (s *Serializer) Pickle(obj py.PyObjectPtr) ([]byte, error) {
 	return buffer, nil
 }
 
+// SetCSV prepares encoding rows as CSV lines, each written as a message.
+// Encoding keeps state, like whether the header was written, so each
+// interpreter's serializer should only encode a single stream of rows.
+func (s *Serializer) SetCSV(opts CSVOptions) error {
+	switch opts.Header {
+	case CSVHeaderNone, CSVHeaderFirst, CSVHeaderEvery:
+	default:
+		return fmt.Errorf("invalid csv header policy '%s'", opts.Header)
+	}
+	if len([]rune(opts.Delimiter)) != 1 {
+		return errors.New("csv delimiter must be a single character")
+	}
+
+	newEncoder := py.PyObject_GetAttrString(s.module, csvEncoder)
+	if newEncoder == py.NullPyObjectPtr {
+		return fmt.Errorf("failed to find %s in serializer module", csvEncoder)
+	}
+	defer py.Py_DecRef(newEncoder)
+
+	columns := py.PyTuple_New(int64(len(opts.Columns)))
+	if columns == py.NullPyObjectPtr {
+		return errors.New("failed to create python tuple")
+	}
+	// Tuples steal our references.
+	for idx, column := range opts.Columns {
+		py.PyTuple_SetItem(columns, int64(idx), py.PyUnicode_FromString(column))
+	}
+	args := py.PyTuple_New(3)
+	if args == py.NullPyObjectPtr {
+		py.Py_DecRef(columns)
+		return errors.New("failed to create python tuple")
+	}
+	defer py.Py_DecRef(args)
+	py.PyTuple_SetItem(args, 0, columns)
+	py.PyTuple_SetItem(args, 1, py.PyUnicode_FromString(opts.Delimiter))
+	py.PyTuple_SetItem(args, 2, py.PyUnicode_FromString(opts.Header))
+
+	encoder := py.PyObject_Call(newEncoder, args, py.NullPyObjectPtr)
+	if encoder == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to create csv encoder")
+	}
+	if s.csv != null {
+		py.Py_DecRef(s.csv)
+	}
+	s.csv = encoder
+	return nil
+}
+
+// CSV encodes the given Python object, a dict, tuple, or list, as a CSV
+// line, preceded by a header line if due.
+func (s *Serializer) CSV(obj py.PyObjectPtr) ([]byte, error) {
+	if s.csv == null {
+		return nil, errors.New("csv serialization not configured")
+	}
+	result, err := s.call(s.csv, obj)
+	if err != nil {
+		return nil, err
+	}
+	defer py.Py_DecRef(result)
+
+	// Before copying out, we need the length to do some unsafe voodoo.
+	sz := py.PyBytes_Size(result)
+	rawBytes := py.PyBytes_AsString(result)
+
+	buffer := make([]byte, sz)
+	copy(buffer, unsafe.Slice(rawBytes, sz))
+
+	return buffer, nil
+}
+
+// Avro encodes the given Python object as Avro binary with the schema set
+// by SetAvroSchema.
+func (s *Serializer) Avro(obj py.PyObjectPtr) ([]byte, error) {
+	if s.avro == null {
+		return nil, errors.New("no avro schema set")
+	}
+	result, err := s.call(s.avro, obj)
+	if err != nil {
+		return nil, err
+	}
+	defer py.Py_DecRef(result)
+
+	// Before copying out, we need the length to do some unsafe voodoo.
+	sz := py.PyBytes_Size(result)
+	rawBytes := py.PyBytes_AsString(result)
+
+	buffer := make([]byte, sz)
+	copy(buffer, unsafe.Slice(rawBytes, sz))
+
+	return buffer, nil
+}
+
+// CBOR encodes the given Python object as CBOR, once prepared by SetCBOR.
+func (s *Serializer) CBOR(obj py.PyObjectPtr) ([]byte, error) {
+	if s.cborEncode == null {
+		return nil, errors.New("cbor codec not loaded")
+	}
+	result, err := s.call(s.cborEncode, obj)
+	if err != nil {
+		return nil, err
+	}
+	defer py.Py_DecRef(result)
+
+	// Before copying out, we need the length to do some unsafe voodoo.
+	sz := py.PyBytes_Size(result)
+	rawBytes := py.PyBytes_AsString(result)
+
+	buffer := make([]byte, sz)
+	copy(buffer, unsafe.Slice(rawBytes, sz))
+
+	return buffer, nil
+}
+
+// BSON encodes the given Python dict as a BSON document, once prepared by
+// SetBSON.
+func (s *Serializer) BSON(obj py.PyObjectPtr) ([]byte, error) {
+	if s.bsonEncode == null {
+		return nil, errors.New("bson codec not loaded")
+	}
+	result, err := s.call(s.bsonEncode, obj)
+	if err != nil {
+		return nil, err
+	}
+	defer py.Py_DecRef(result)
+
+	// Before copying out, we need the length to do some unsafe voodoo.
+	sz := py.PyBytes_Size(result)
+	rawBytes := py.PyBytes_AsString(result)
+
+	buffer := make([]byte, sz)
+	copy(buffer, unsafe.Slice(rawBytes, sz))
+
+	return buffer, nil
+}
+
+// Protobuf serializes the given Python object if it's a protobuf message,
+// returning its bytes and type URL. If it's not, ok is false.
+func (s *Serializer) Protobuf(obj py.PyObjectPtr) (data []byte, typeURL string, ok bool, err error) {
+	result, err := s.call(s.protobuf, obj)
+	if err != nil {
+		return nil, "", false, err
+	}
+	defer py.Py_DecRef(result)
+	if py.BaseType(result) == py.None {
+		return nil, "", false, nil
+	}
+
+	typeURL, err = UnicodeToString(py.PyTuple_GetItem(result, 0))
+	if err != nil {
+		return nil, "", false, err
+	}
+	bytes := py.PyTuple_GetItem(result, 1)
+	sz := py.PyBytes_Size(bytes)
+	rawBytes := py.PyBytes_AsString(bytes)
+
+	buffer := make([]byte, sz)
+	copy(buffer, unsafe.Slice(rawBytes, sz))
+
+	return buffer, typeURL, true, nil
+}
+
+// Timestamp converts the given Python object to a time if it's a datetime,
+// treating naive ones as UTC. If it's not, ok is false.
+func (s *Serializer) Timestamp(obj py.PyObjectPtr) (ts time.Time, ok bool, err error) {
+	result, err := s.call(s.timestamp, obj)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	defer py.Py_DecRef(result)
+	if py.BaseType(result) == py.None {
+		return time.Time{}, false, nil
+	}
+	sec := py.PyLong_AsLong(py.PyTuple_GetItem(result, 0))
+	nsec := py.PyLong_AsLong(py.PyTuple_GetItem(result, 1))
+	return time.Unix(sec, nsec).UTC(), true, nil
+}
+
+// ArrowRows serializes the rows of the given Python object to JSON if it's an
+// Arrow table or record batch, e.g. a Parquet row group. If it's not, ok is
+// false.
+func (s *Serializer) ArrowRows(obj py.PyObjectPtr) (rows [][]byte, ok bool, err error) {
+	result, err := s.call(s.arrow, obj)
+	if err != nil {
+		return nil, false, err
+	}
+	defer py.Py_DecRef(result)
+	if py.BaseType(result) == py.None {
+		return nil, false, nil
+	}
+
+	rows = make([][]byte, py.PyList_Size(result))
+	for idx := range rows {
+		row := py.PyList_GetItem(result, int64(idx))
+		sz := py.PyBytes_Size(row)
+		rawBytes := py.PyBytes_AsString(row)
+		rows[idx] = make([]byte, sz)
+		copy(rows[idx], unsafe.Slice(rawBytes, sz))
+	}
+	return rows, true, nil
+}
+
+// Unpickle the given bytes, returning a new reference to the Python object.
+func (s *Serializer) Unpickle(data []byte) (py.PyObjectPtr, error) {
+	bytes := py.PyBytes_FromStringAndSize(unsafe.SliceData(data), int64(len(data)))
+	if bytes == py.NullPyObjectPtr {
+		return null, errors.New("failed to create python bytes")
+	}
+	defer py.Py_DecRef(bytes)
+
+	result := py.PyObject_CallOneArg(s.unpickle, bytes)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return null, errors.New("failed to unpickle python object")
+	}
+	return result, nil
+}
+
+// FromCBOR decodes the given CBOR bytes, once prepared by SetCBOR, returning
+// a new reference to the Python object.
+func (s *Serializer) FromCBOR(data []byte) (py.PyObjectPtr, error) {
+	if s.cborDecode == null {
+		return null, errors.New("cbor codec not loaded")
+	}
+	bytes := py.PyBytes_FromStringAndSize(unsafe.SliceData(data), int64(len(data)))
+	if bytes == py.NullPyObjectPtr {
+		return null, errors.New("failed to create python bytes")
+	}
+	defer py.Py_DecRef(bytes)
+
+	result := py.PyObject_CallOneArg(s.cborDecode, bytes)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return null, errors.New("failed to decode cbor")
+	}
+	return result, nil
+}
+
+// FromBSON decodes the given BSON document, once prepared by SetBSON,
+// returning a new reference to the Python dict.
+func (s *Serializer) FromBSON(data []byte) (py.PyObjectPtr, error) {
+	if s.bsonDecode == null {
+		return null, errors.New("bson codec not loaded")
+	}
+	bytes := py.PyBytes_FromStringAndSize(unsafe.SliceData(data), int64(len(data)))
+	if bytes == py.NullPyObjectPtr {
+		return null, errors.New("failed to create python bytes")
+	}
+	defer py.Py_DecRef(bytes)
+
+	result := py.PyObject_CallOneArg(s.bsonDecode, bytes)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return null, errors.New("failed to decode bson")
+	}
+	return result, nil
+}
+
 func (s *Serializer) DecRef() {
+	if s.zstd != null {
+		py.Py_DecRef(s.zstd)
+	}
+	if s.bsonEncode != null {
+		py.Py_DecRef(s.bsonEncode)
+		py.Py_DecRef(s.bsonDecode)
+	}
+	if s.cborEncode != null {
+		py.Py_DecRef(s.cborEncode)
+		py.Py_DecRef(s.cborDecode)
+	}
+	if s.csv != null {
+		py.Py_DecRef(s.csv)
+	}
+	if s.avro != null {
+		py.Py_DecRef(s.avro)
+	}
+	py.Py_DecRef(s.timestamp)
+	py.Py_DecRef(s.arrow)
+	py.Py_DecRef(s.protobuf)
+	py.Py_DecRef(s.unpickle)
 	py.Py_DecRef(s.pickle)
 	py.Py_DecRef(s.jsonBytes)
 	py.Py_DecRef(s.jsonString)
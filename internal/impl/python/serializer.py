@@ -1,8 +1,10 @@
 """
-Serializer module for converting data to JSON or Pickles.
+Serializer module for converting data to JSON, Pickles, Avro, Protobuf, CBOR,
+BSON, or CSV, and Arrow tables to rows of JSON.
 """
 import json
 import pickle
+import sys
 
 def to_json_string(obj) -> str:
     """
@@ -22,6 +24,37 @@ def to_json_bytes(obj) -> bytes:
     return json.dumps(obj).encode()
 
 
+def json_encoders(library: str):
+    """
+    Create functions converting objects to JSON strings and bytes with the
+    given library, one of "json", "orjson", "ujson", or "auto" for the
+    fastest one installed. orjson also handles datetimes and numpy arrays.
+    :param library: name of the JSON library to use
+    :return: tuple of the name of the library used and its to_json_string
+             and to_json_bytes functions
+    """
+    if library in ("auto", "orjson"):
+        try:
+            import orjson
+            options = orjson.OPT_SERIALIZE_NUMPY | orjson.OPT_NON_STR_KEYS
+            return ("orjson",
+                    lambda obj: orjson.dumps(obj, option=options).decode(),
+                    lambda obj: orjson.dumps(obj, option=options))
+        except ImportError:
+            if library == "orjson":
+                raise
+    if library in ("auto", "ujson"):
+        try:
+            import ujson
+            return "ujson", ujson.dumps, lambda obj: ujson.dumps(obj).encode()
+        except ImportError:
+            if library == "ujson":
+                raise
+    if library not in ("auto", "json"):
+        raise ValueError(f"unknown json library: {library}")
+    return "json", to_json_string, to_json_bytes
+
+
 def to_pickle(obj) -> bytes:
     """
     Convert object obj to Pickle representation.
@@ -30,3 +63,173 @@ def to_pickle(obj) -> bytes:
     """
     return pickle.dumps(obj)
 
+
+def from_pickle(data: bytes):
+    """
+    Convert bytes of a Pickle representation back into an object.
+    :param data: pickled object in bytes
+    :return: the un-pickled object
+    """
+    return pickle.loads(data)
+
+
+
+def to_protobuf(obj):
+    """
+    Convert object obj to bytes if it's a protobuf message, e.g. an instance
+    of a generated class. Objects can only be protobuf messages if the
+    protobuf module was imported, so we don't import it ourselves.
+    :param obj: object to serialize
+    :return: tuple of the message's type URL and bytes, or None if obj isn't
+             a protobuf message
+    """
+    message = sys.modules.get("google.protobuf.message")
+    if message is None or not isinstance(obj, message.Message):
+        return None
+    return "type.googleapis.com/" + obj.DESCRIPTOR.full_name, obj.SerializeToString()
+
+
+def to_timestamp(obj):
+    """
+    Convert obj to a Unix timestamp if it's a datetime, treating naive ones
+    as UTC. Objects can only be datetimes if the datetime module was imported,
+    so we don't import it ourselves.
+    :param obj: object to convert
+    :return: tuple of seconds and nanoseconds since the epoch, or None if obj
+             isn't a datetime
+    """
+    datetime = sys.modules.get("datetime")
+    if datetime is None or not isinstance(obj, datetime.datetime):
+        return None
+    if obj.tzinfo is None:
+        obj = obj.replace(tzinfo=datetime.timezone.utc)
+    delta = obj - datetime.datetime(1970, 1, 1, tzinfo=datetime.timezone.utc)
+    return delta.days * 86400 + delta.seconds, delta.microseconds * 1000
+
+
+def _arrow_default(value):
+    """
+    Convert values JSON can't represent, like timestamps or decimals from
+    Arrow columns.
+    """
+    import base64
+    if hasattr(value, "isoformat"):
+        return value.isoformat()
+    if isinstance(value, bytes):
+        return base64.b64encode(value).decode()
+    return str(value)
+
+
+def arrow_rows(obj):
+    """
+    Convert obj to rows of JSON if it's an Arrow table or record batch, e.g.
+    a Parquet row group read with pyarrow. Objects can only be Arrow tables if
+    pyarrow was imported, so we don't import it ourselves.
+    :param obj: object to serialize
+    :return: list of bytes of encoded JSON per row, or None if obj isn't an
+             Arrow table or record batch
+    """
+    pa = sys.modules.get("pyarrow")
+    if pa is None or not isinstance(obj, (pa.Table, pa.RecordBatch)):
+        return None
+    return [json.dumps(row, default=_arrow_default).encode() for row in obj.to_pylist()]
+
+
+def avro_encoder(schema: str):
+    """
+    Create a function encoding objects as Avro binary with the given schema,
+    without a header, as fastavro's schemaless_writer does.
+    :param schema: Avro schema as JSON
+    :return: function converting an object to bytes of Avro
+    """
+    import io
+    import fastavro
+
+    parsed = fastavro.parse_schema(json.loads(schema))
+
+    def to_avro(obj) -> bytes:
+        buf = io.BytesIO()
+        fastavro.schemaless_writer(buf, parsed, obj)
+        return buf.getvalue()
+
+    return to_avro
+
+
+def cbor_codec():
+    """
+    Create functions converting objects to and from CBOR with the cbor2
+    module.
+    :return: tuple of functions encoding objects to bytes of CBOR and
+             decoding them back
+    """
+    import cbor2
+    return cbor2.dumps, cbor2.loads
+
+
+def zstd_compressor():
+    """
+    Create a function compressing bytes with Zstandard, using the
+    compression.zstd module of Python 3.14 or the zstandard package.
+    :return: function compressing bytes
+    """
+    try:
+        from compression import zstd
+        return zstd.compress
+    except ImportError:
+        import zstandard
+        return zstandard.ZstdCompressor().compress
+
+
+def bson_codec():
+    """
+    Create functions converting dicts to and from BSON documents, using either
+    pymongo's bson module or the standalone bson package.
+    :return: tuple of functions encoding dicts to bytes of BSON and decoding
+             them back
+    """
+    import bson
+    if hasattr(bson, "encode"):
+        return bson.encode, bson.decode
+    return bson.dumps, bson.loads
+
+
+def csv_encoder(columns, delimiter: str, header: str):
+    """
+    Create a function encoding rows as CSV lines, without a line terminator.
+    Dicts are written in the order of columns, taken from the keys of the
+    first dict if empty, while tuples and lists are written as they are.
+    :param columns: names of the columns, or empty to infer them
+    :param delimiter: character separating fields
+    :param header: "none", "first" to put a header line before the first
+                   row, or "every" to put one before every row
+    :return: function converting a row to bytes of CSV
+    """
+    import csv
+    import io
+
+    columns = list(columns)
+    pending = header != "none"
+
+    def to_csv(obj) -> bytes:
+        nonlocal columns, pending
+        if isinstance(obj, dict) and not columns:
+            columns = list(obj.keys())
+        buf = io.StringIO()
+        writer = csv.writer(buf, delimiter=delimiter, lineterminator="\n")
+        if pending:
+            if not columns:
+                raise ValueError("a csv header requires columns for rows that aren't dicts")
+            writer.writerow(columns)
+            pending = header == "every"
+        if isinstance(obj, dict):
+            unknown = obj.keys() - set(columns)
+            if unknown:
+                raise ValueError(f"row has fields that aren't columns: {sorted(unknown)}")
+            writer.writerow([obj.get(column, "") for column in columns])
+        elif isinstance(obj, (tuple, list)):
+            writer.writerow(obj)
+        else:
+            writer.writerow([obj])
+        return buf.getvalue().removesuffix("\n").encode()
+
+    return to_csv
@@ -0,0 +1,329 @@
+package python
+
+import (
+	"context"
+	"testing"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// Test that rows are encoded as CSV lines following the header policy.
+func TestCSVSerializer(t *testing.T) {
+	r, err := NewSingleInterpreterRuntime("python3", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Stop(ctx) }()
+
+	tests := []struct {
+		name     string
+		opts     CSVOptions
+		expected []string
+	}{
+		{
+			name:     "inferred columns",
+			opts:     CSVOptions{Delimiter: ",", Header: CSVHeaderFirst},
+			expected: []string{"id,name\n1,\"a, b\"", "2,c", "3,d"},
+		},
+		{
+			name:     "every header",
+			opts:     CSVOptions{Columns: []string{"name", "id"}, Delimiter: ";", Header: CSVHeaderEvery},
+			expected: []string{"name;id\na, b;1", "name;id\nc;2", "name;id\n3;d"},
+		},
+		{
+			name:     "no header",
+			opts:     CSVOptions{Delimiter: ",", Header: CSVHeaderNone},
+			expected: []string{"1,\"a, b\"", "2,c", "3,d"},
+		},
+	}
+
+	err = r.Map(ctx, func(ticket *InterpreterTicket) error {
+		code, err := Compile(`rows = [{"id": 1, "name": "a, b"}, {"id": 2, "name": "c"}, (3, "d")]`, "__csv_test__.py")
+		if err != nil {
+			return err
+		}
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+		out := py.PyEval_EvalCode(code, globals, globals)
+		if out == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			t.Fatal("failed to evaluate script")
+		}
+		py.Py_DecRef(out)
+		rows := py.PyDict_GetItemString(globals, "rows")
+
+		for _, test := range tests {
+			serializer, err := NewSerializer()
+			if err != nil {
+				return err
+			}
+			if err = serializer.SetCSV(test.opts); err != nil {
+				return err
+			}
+			for idx, expected := range test.expected {
+				line, err := serializer.CSV(py.PyList_GetItem(rows, int64(idx)))
+				if err != nil {
+					return err
+				}
+				if string(line) != expected {
+					t.Errorf("%s: expected %q, got %q", test.name, expected, line)
+				}
+			}
+			serializer.DecRef()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test that Arrow tables, like Parquet row groups read by rpcn.read_parquet,
+// are serialized as a row of JSON each, while other objects aren't.
+func TestArrowRows(t *testing.T) {
+	r, err := NewSingleInterpreterRuntime("python3", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Stop(ctx) }()
+
+	ticket, err := r.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Release(ticket) }()
+
+	var rows [][]byte
+	var notRows bool
+	err = r.Apply(ticket, ctx, func() error {
+		if _, err := LoadRpcnModule(); err != nil {
+			return err
+		}
+		// Stand in for pyarrow, which is dropped below so later tests don't see
+		// it. Extension modules like datetime don't survive tests restarting
+		// Python, so dates are stand-ins too.
+		code, err := Compile(`
+import sys
+import types
+
+import rpcn
+
+class Date:
+    def isoformat(self):
+        return "2024-01-02"
+
+class Table:
+    def __init__(self, rows):
+        self.rows = rows
+
+    def to_pylist(self):
+        return self.rows
+
+class ParquetFile:
+    num_row_groups = 2
+
+    def __init__(self, path):
+        self.path = path
+
+    def read_row_group(self, idx, columns=None):
+        return Table([{"id": idx, "at": Date(), "path": self.path}])
+
+pyarrow = types.ModuleType("pyarrow")
+pyarrow.Table = Table
+pyarrow.RecordBatch = Table
+pyarrow.parquet = types.ModuleType("pyarrow.parquet")
+pyarrow.parquet.ParquetFile = ParquetFile
+sys.modules["pyarrow"] = pyarrow
+sys.modules["pyarrow.parquet"] = pyarrow.parquet
+
+row_groups = list(rpcn.read_parquet("missing.parquet"))
+assert len(row_groups) == 2, row_groups
+table = row_groups[1]
+`, "__arrow_test__.py")
+		if err != nil {
+			return err
+		}
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+		out := py.PyEval_EvalCode(code, globals, globals)
+		if out == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			t.Fatal("failed to evaluate script")
+		}
+		py.Py_DecRef(out)
+
+		serializer, err := NewSerializer()
+		if err != nil {
+			return err
+		}
+		defer serializer.DecRef()
+		if rows, _, err = serializer.ArrowRows(py.PyDict_GetItemString(globals, "table")); err != nil {
+			return err
+		}
+		_, ok, err := serializer.ArrowRows(py.PyDict_GetItemString(globals, "row_groups"))
+		notRows = !ok
+
+		py.PyRun_SimpleString("import sys; del sys.modules['pyarrow'], sys.modules['pyarrow.parquet']")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !notRows {
+		t.Error("expected a list not to be serialized as Arrow rows")
+	}
+	expected := `{"id": 1, "at": "2024-01-02", "path": "missing.parquet"}`
+	if len(rows) != 1 || string(rows[0]) != expected {
+		t.Fatalf("expected [%s], got %q", expected, rows)
+	}
+}
+
+// Test that JSON is encoded with the chosen library, falling back to json.
+func TestJSONLibrary(t *testing.T) {
+	r, err := NewSingleInterpreterRuntime("python3", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Stop(ctx) }()
+
+	err = r.Map(ctx, func(ticket *InterpreterTicket) error {
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+		code, err := Compile(`obj = {"a": [1, 2]}`, "__json_test__.py")
+		if err != nil {
+			return err
+		}
+		out := py.PyEval_EvalCode(code, globals, globals)
+		if out == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			t.Fatal("failed to evaluate script")
+		}
+		py.Py_DecRef(out)
+		obj := py.PyDict_GetItemString(globals, "obj")
+
+		encode := func(library string) (string, string, error) {
+			serializer, err := NewSerializer()
+			if err != nil {
+				return "", "", err
+			}
+			defer serializer.DecRef()
+			used, err := serializer.SetJSONLibrary(library)
+			if err != nil {
+				return "", "", err
+			}
+			data, err := serializer.JsonBytes(obj)
+			return used, string(data), err
+		}
+
+		for _, library := range []string{JSONLibraryAuto, JSONLibraryJSON} {
+			used, data, err := encode(library)
+			if err != nil {
+				return err
+			}
+			if used != JSONLibraryJSON || data != `{"a": [1, 2]}` {
+				t.Errorf("%s: expected json to encode, got %s encoding %s", library, used, data)
+			}
+		}
+		if _, _, err = encode(JSONLibraryUjson); err == nil {
+			t.Error("expected a missing library to be rejected")
+		}
+
+		// Stand in for orjson, which auto should now prefer.
+		py.PyRun_SimpleString(`
+import json, sys, types
+orjson = types.ModuleType("orjson")
+orjson.OPT_SERIALIZE_NUMPY, orjson.OPT_NON_STR_KEYS = 1, 2
+orjson.dumps = lambda obj, option=0: json.dumps(obj, separators=(",", ":")).encode()
+sys.modules["orjson"] = orjson
+`)
+		defer py.PyRun_SimpleString("import sys; del sys.modules['orjson']")
+		for _, library := range []string{JSONLibraryAuto, JSONLibraryOrjson} {
+			used, data, err := encode(library)
+			if err != nil {
+				return err
+			}
+			if used != JSONLibraryOrjson || data != `{"a":[1,2]}` {
+				t.Errorf("%s: expected orjson to encode, got %s encoding %s", library, used, data)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test that serializers share compiled code but not a module, nor leave one
+// for scripts.
+func TestSerializerModule(t *testing.T) {
+	r, err := NewSingleInterpreterRuntime("python3", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Stop(ctx) }()
+
+	err = r.Map(ctx, func(ticket *InterpreterTicket) error {
+		first, err := NewSerializer()
+		if err != nil {
+			return err
+		}
+		defer first.DecRef()
+		second, err := NewSerializer()
+		if err != nil {
+			return err
+		}
+		defer second.DecRef()
+		if first.module == second.module {
+			t.Error("expected serializers to have their own module")
+		}
+		if first.code != second.code {
+			t.Error("expected serializers to share compiled code")
+		}
+
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+		code, err := Compile(`import sys; imported = "__serializer__" in sys.modules`, "__module_test__.py")
+		if err != nil {
+			return err
+		}
+		out := py.PyEval_EvalCode(code, globals, globals)
+		if out == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			t.Fatal("failed to evaluate script")
+		}
+		py.Py_DecRef(out)
+		imported, err := IsTrue(py.PyDict_GetItemString(globals, "imported"))
+		if imported {
+			t.Error("expected the serializer module not to be importable")
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
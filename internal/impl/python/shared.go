@@ -0,0 +1,182 @@
+package python
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// sharedRuntimes tracks the named runtimes shared by components.
+//
+// Protected by sharedMtx.
+var sharedRuntimes = make(map[string]*sharedRuntime)
+var sharedMtx sync.Mutex
+
+// sharedRuntime is a Runtime shared by name amongst components.
+type sharedRuntime struct {
+	runtime Runtime
+	exe     string
+	mode    Mode
+	users   int // Number of started users. Protected by sharedMtx.
+
+	// Watchdog settings agreed by its users, if any. Protected by sharedMtx.
+	watchdog *Watchdog
+
+	// What each user wants called once the watchdog replaces an interpreter.
+	// Not protected by sharedMtx, which is held while stopping the watchdog.
+	onRestart    []func(id int64, stack string) // Protected by onRestartMtx.
+	onRestartMtx sync.Mutex
+}
+
+// SharedRuntime is a component's handle on a runtime shared by name. The
+// underlying Runtime is started by its first user and only stopped once its
+// last user stops.
+type SharedRuntime struct {
+	shared  *sharedRuntime
+	name    string
+	started bool // Protected by sharedMtx.
+}
+
+// ShareRuntime provides a handle on the runtime shared under the given name,
+// adopting r as the runtime if it's the first use of name. Later users must
+// agree on the Python executable and mode, while the pool size is that of
+// the first user.
+func ShareRuntime(name, exe string, mode Mode, r Runtime) (*SharedRuntime, error) {
+	sharedMtx.Lock()
+	defer sharedMtx.Unlock()
+
+	shared, ok := sharedRuntimes[name]
+	if !ok {
+		shared = &sharedRuntime{runtime: r, exe: exe, mode: mode}
+		sharedRuntimes[name] = shared
+	}
+	if shared.exe != exe {
+		return nil, fmt.Errorf("runtime '%s' already uses python executable '%s'", name, shared.exe)
+	}
+	if shared.mode != mode {
+		return nil, fmt.Errorf("runtime '%s' already uses mode '%s'", name, shared.mode)
+	}
+
+	return &SharedRuntime{shared: shared, name: name}, nil
+}
+
+func (s *SharedRuntime) Start(ctx context.Context) error {
+	sharedMtx.Lock()
+	defer sharedMtx.Unlock()
+
+	if s.started {
+		// Already running.
+		return nil
+	}
+	err := s.shared.runtime.Start(ctx)
+	if err != nil {
+		return err
+	}
+	s.started = true
+	s.shared.users++
+
+	return nil
+}
+
+func (s *SharedRuntime) Stop(ctx context.Context) error {
+	sharedMtx.Lock()
+	defer sharedMtx.Unlock()
+
+	if !s.started {
+		return errors.New("not started")
+	}
+
+	// Only our last user stops the runtime.
+	if s.shared.users == 1 {
+		err := s.shared.runtime.Stop(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	s.started = false
+	s.shared.users--
+
+	return nil
+}
+
+func (s *SharedRuntime) Acquire(ctx context.Context) (*InterpreterTicket, error) {
+	return s.shared.runtime.Acquire(ctx)
+}
+
+func (s *SharedRuntime) AcquireFor(ctx context.Context, key uint64) (*InterpreterTicket, error) {
+	pinner, ok := s.shared.runtime.(Pinner)
+	if !ok {
+		return nil, fmt.Errorf("runtime '%s' can't pin interpreters", s.name)
+	}
+	return pinner.AcquireFor(ctx, key)
+}
+
+func (s *SharedRuntime) Release(ticket *InterpreterTicket) error {
+	return s.shared.runtime.Release(ticket)
+}
+
+func (s *SharedRuntime) Apply(ticket *InterpreterTicket, ctx context.Context, f func() error) error {
+	return s.shared.runtime.Apply(ticket, ctx, f)
+}
+
+func (s *SharedRuntime) Map(ctx context.Context, f func(ticket *InterpreterTicket) error) error {
+	return s.shared.runtime.Map(ctx, f)
+}
+
+func (s *SharedRuntime) Interrupt(ctx context.Context) error {
+	return s.shared.runtime.Interrupt(ctx)
+}
+
+func (s *SharedRuntime) Recycle(ticket *InterpreterTicket, ctx context.Context) error {
+	recycler, ok := s.shared.runtime.(Recycler)
+	if !ok {
+		_ = s.Release(ticket)
+		return fmt.Errorf("runtime '%s' can't recycle interpreters", s.name)
+	}
+	return recycler.Recycle(ticket, ctx)
+}
+
+// SetWatchdog configures a watchdog for the shared runtime, like
+// MultiInterpreterRuntime.SetWatchdog. Every user setting one must agree on
+// its timeout, and each has its OnRestart called. Must be set before the
+// runtime is started.
+func (s *SharedRuntime) SetWatchdog(w Watchdog) error {
+	sharedMtx.Lock()
+	defer sharedMtx.Unlock()
+
+	multi, ok := s.shared.runtime.(*MultiInterpreterRuntime)
+	if !ok {
+		return fmt.Errorf("runtime '%s' can't watch its interpreters", s.name)
+	}
+	if s.shared.watchdog != nil && s.shared.watchdog.Timeout != w.Timeout {
+		return fmt.Errorf("runtime '%s' already uses a watchdog timeout of %s", s.name, s.shared.watchdog.Timeout)
+	}
+	if s.shared.watchdog == nil && s.shared.users > 0 {
+		return fmt.Errorf("runtime '%s' was already started without a watchdog", s.name)
+	}
+	if w.OnRestart != nil {
+		s.shared.onRestartMtx.Lock()
+		s.shared.onRestart = append(s.shared.onRestart, w.OnRestart)
+		s.shared.onRestartMtx.Unlock()
+	}
+	if s.shared.watchdog != nil {
+		return nil
+	}
+
+	s.shared.watchdog = &Watchdog{Timeout: w.Timeout}
+	shared := s.shared
+	multi.SetWatchdog(Watchdog{
+		Timeout: w.Timeout,
+		OnRestart: func(id int64, stack string) {
+			shared.onRestartMtx.Lock()
+			onRestart := slices.Clone(shared.onRestart)
+			shared.onRestartMtx.Unlock()
+			for _, f := range onRestart {
+				f(id, stack)
+			}
+		},
+	})
+	return nil
+}
@@ -0,0 +1,117 @@
+package python
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Test that a shared runtime keeps running until its last user stops.
+func TestSharedRuntimeLifecycle(t *testing.T) {
+	r, err := NewMultiInterpreterRuntime("python3", 2, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := ShareRuntime("test-lifecycle", "python3", Isolated, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ShareRuntime("test-lifecycle", "python3", Isolated, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err = first.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = second.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = first.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !r.started {
+		t.Fatal("expected runtime to still be running")
+	}
+
+	ticket, err := second.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = second.Release(ticket); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = second.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if r.started {
+		t.Fatal("expected runtime to be stopped")
+	}
+}
+
+// Test that users of a shared runtime must agree on its definition.
+func TestSharedRuntimeMismatch(t *testing.T) {
+	r, err := NewSingleInterpreterRuntime("python3", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ShareRuntime("test-mismatch", "python3", Global, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ShareRuntime("test-mismatch", "python3", Isolated, nil)
+	if err == nil {
+		t.Fatal("expected an error for a different mode")
+	}
+	_, err = ShareRuntime("test-mismatch", "python3.13", Global, nil)
+	if err == nil {
+		t.Fatal("expected an error for a different python executable")
+	}
+}
+
+// Test that users of a shared runtime must agree on its watchdog, which
+// tells each of them about replaced interpreters.
+func TestSharedRuntimeWatchdog(t *testing.T) {
+	r, err := NewMultiInterpreterRuntime("python3", 1, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := ShareRuntime("test-watchdog", "python3", Isolated, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ShareRuntime("test-watchdog", "python3", Isolated, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var restarted []string
+	if err = first.SetWatchdog(Watchdog{
+		Timeout:   time.Second,
+		OnRestart: func(int64, string) { restarted = append(restarted, "first") },
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = second.SetWatchdog(Watchdog{Timeout: 2 * time.Second}); err == nil {
+		t.Fatal("expected an error for a different watchdog timeout")
+	}
+	if err = second.SetWatchdog(Watchdog{
+		Timeout:   time.Second,
+		OnRestart: func(int64, string) { restarted = append(restarted, "second") },
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.watchdog.Timeout != time.Second {
+		t.Fatalf("expected the runtime to be watched every second, got %s", r.watchdog.Timeout)
+	}
+	r.watchdog.OnRestart(1, "")
+	if len(restarted) != 2 || restarted[0] != "first" || restarted[1] != "second" {
+		t.Fatalf("expected both users to be told of the restart, got %v", restarted)
+	}
+}
@@ -0,0 +1,48 @@
+package python
+
+import (
+	"errors"
+	"syscall"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// guardedSignals are those Python code may not install handlers for, as
+// Redpanda Connect relies on them to shut down gracefully.
+var guardedSignals = []syscall.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
+
+// guardSignals keeps Python code from installing handlers for our guarded
+// signals via the signal module. Python only allows this from the main thread
+// of the main interpreter, which runs our code in global mode.
+//
+// The caller must manage the interpreter state for this to succeed.
+func guardSignals() error {
+	module, err := LoadRpcnModule()
+	if err != nil {
+		return err
+	}
+	guard := py.PyObject_GetAttrString(module, "_guard_signals")
+	if guard == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to find _guard_signals function in rpcn module")
+	}
+	defer py.Py_DecRef(guard)
+
+	args := py.PyTuple_New(int64(len(guardedSignals)))
+	if args == py.NullPyObjectPtr {
+		return errors.New("failed to create python tuple")
+	}
+	defer py.Py_DecRef(args)
+	for idx, sig := range guardedSignals {
+		// Tuples steal our references.
+		py.PyTuple_SetItem(args, int64(idx), py.PyLong_FromLong(int64(sig)))
+	}
+
+	result := py.PyObject_Call(guard, args, py.NullPyObjectPtr)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to guard signals")
+	}
+	py.Py_DecRef(result)
+	return nil
+}
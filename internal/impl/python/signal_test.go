@@ -0,0 +1,60 @@
+package python
+
+import (
+	"context"
+	"testing"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// Test that Python code can't install handlers for signals we rely on.
+func TestGuardedSignalsIgnoreHandlers(t *testing.T) {
+	r, err := NewSingleInterpreterRuntime("python3", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Stop(ctx) }()
+
+	ticket, err := r.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Release(ticket) }()
+
+	var unchanged int64
+	err = r.Apply(ticket, ctx, func() error {
+		code, err := Compile(`
+import signal
+import warnings
+before = signal.getsignal(signal.SIGTERM)
+with warnings.catch_warnings(record=True):
+    signal.signal(signal.SIGTERM, lambda signum, frame: None)
+unchanged = int(signal.getsignal(signal.SIGTERM) is before)
+`, "__signal_test__.py")
+		if err != nil {
+			return err
+		}
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+		result := py.PyEval_EvalCode(code, globals, globals)
+		if result == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			t.Fatal("failed to evaluate script")
+		}
+		py.Py_DecRef(result)
+		unchanged = py.PyLong_AsLong(py.PyDict_GetItemString(globals, "unchanged"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unchanged != 1 {
+		t.Fatal("expected the SIGTERM handler to be left alone")
+	}
+}
@@ -4,25 +4,27 @@ import (
 	"context"
 	"errors"
 	"github.com/redpanda-data/benthos/v4/public/service"
-	py "github.com/voutilad/gogopython"
 )
 
 // SingleInterpreterRuntime provides an implementation for using main
 // Python interpreter.
 type SingleInterpreterRuntime struct {
-	exe   string
-	home  string
-	paths []string
+	exe     string
+	home    string
+	program string
+	paths   []string
 
 	replyChans []chan error
 	tickets    chan *InterpreterTicket // SingleInterpreterRuntime uses a single ticket.
+	all        []*InterpreterTicket    // All tickets, whether in use or not.
+	pinned     pinnedTickets           // Hands out particular tickets.
 
 	started bool // protected by globalMtx in runtime.go
 	logger  *service.Logger
 }
 
 func NewSingleInterpreterRuntime(exe string, cnt int, logger *service.Logger) (*SingleInterpreterRuntime, error) {
-	home, paths, err := py.FindPythonHomeAndPaths(exe)
+	home, program, paths, err := findHomeAndPaths(exe)
 	if err != nil {
 		return nil, err
 	}
@@ -30,10 +32,12 @@ func NewSingleInterpreterRuntime(exe string, cnt int, logger *service.Logger) (*
 	return &SingleInterpreterRuntime{
 		exe:        exe,
 		home:       home,
+		program:    program,
 		paths:      paths,
 		logger:     logger,
 		tickets:    make(chan *InterpreterTicket, cnt),
 		replyChans: make([]chan error, cnt),
+		all:        make([]*InterpreterTicket, cnt),
 	}, nil
 }
 
@@ -49,12 +53,20 @@ func (r *SingleInterpreterRuntime) Start(ctx context.Context) error {
 		return nil
 	}
 
-	loadPython(r.exe, r.home, r.paths, ctx)
+	err = loadPython(r.exe, r.home, r.program, r.paths, ctx)
+	if err != nil {
+		return err
+	}
+	if !inMainEnvironment(r.paths) {
+		_ = unloadPython(ctx)
+		return errEnvironment(r.exe)
+	}
 	r.logger.Debug("Python interpreter started.")
 
 	for idx := range len(r.replyChans) {
 		r.replyChans[idx] = make(chan error)
-		r.tickets <- &InterpreterTicket{idx: idx, id: -1}
+		r.all[idx] = &InterpreterTicket{idx: idx, id: -1}
+		r.tickets <- r.all[idx]
 	}
 
 	r.started = true
@@ -74,12 +86,17 @@ func (r *SingleInterpreterRuntime) Stop(ctx context.Context) error {
 		return errors.New("not started")
 	}
 
-	// Collect all the tickets so nobody else can get them.
-	tickets := make([]*InterpreterTicket, len(r.tickets))
+	// Collect all the tickets so nobody else can get them, waiting for any
+	// in use.
+	tickets := make([]*InterpreterTicket, cap(r.tickets))
 	for idx := range tickets {
 		ticket, err := r.Acquire(ctx)
 		if err != nil {
-			panic("cannot acquire ticket while stopping")
+			// Give them back so we can try again.
+			for _, ticket := range tickets[:idx] {
+				_ = r.Release(ticket)
+			}
+			return err
 		}
 		tickets[idx] = ticket
 	}
@@ -111,33 +128,48 @@ func (r *SingleInterpreterRuntime) Acquire(ctx context.Context) (*InterpreterTic
 
 func (r *SingleInterpreterRuntime) Release(ticket *InterpreterTicket) error {
 	// Double-check the token is valid.
-	if ticket.idx < 0 || ticket.idx > len(r.tickets) {
+	if ticket.idx < 0 || ticket.idx >= cap(r.tickets) {
 		return errors.New("invalid ticket: bad index")
 	}
 
-	// Return the ticket to the pool. This should not block as the channel is
-	// buffered.
-	r.tickets <- ticket
+	// Return the ticket to the pool, or whoever is waiting on it. This should
+	// not block as the channel is buffered.
+	r.pinned.release(r.tickets, ticket)
 
 	return nil
 }
 
+// AcquireFor acquires ownership of the ticket key maps to, waiting until it's
+// available. As every ticket shares the main interpreter, this only keeps
+// calls for the same key from running concurrently.
+func (r *SingleInterpreterRuntime) AcquireFor(ctx context.Context, key uint64) (*InterpreterTicket, error) {
+	return r.pinned.acquire(ctx, r.tickets, key)
+}
+
 func (r *SingleInterpreterRuntime) Apply(ticket *InterpreterTicket, ctx context.Context, f func() error) error {
 	// Double-check the token is valid.
-	if ticket.idx < 0 || ticket.idx > len(r.tickets) {
+	if ticket.idx < 0 || ticket.idx >= cap(r.tickets) {
 		return errors.New("invalid ticket: bad index")
 	}
 
-	return Evaluate(f, r.replyChans[ticket.idx], ctx)
+	return Evaluate(func() error {
+		ticket.enter()
+		defer ticket.exit()
+		return f()
+	}, r.replyChans[ticket.idx], ctx)
 }
 
 func (r *SingleInterpreterRuntime) Map(ctx context.Context, f func(ticket *InterpreterTicket) error) error {
 	ticket, err := r.Acquire(ctx)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	err = r.Apply(ticket, ctx, func() error { return f(ticket) })
 	_ = r.Release(ticket)
 	return err
 }
+
+func (r *SingleInterpreterRuntime) Interrupt(ctx context.Context) error {
+	return interruptAll(ctx, r.all)
+}
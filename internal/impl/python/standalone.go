@@ -0,0 +1,206 @@
+package python
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+)
+
+// Standalone describes a pinned python-build-standalone CPython build to
+// bootstrap if no suitable Python executable is available.
+type Standalone struct {
+	Enabled bool
+	Version string // CPython version, e.g. "3.12.7".
+	Release string // python-build-standalone release, e.g. "20241016".
+	URL     string // Optional URL overriding the one derived from the above.
+	SHA256  string // Optional checksum of the archive to verify.
+}
+
+// ParseStandalone extracts the standalone configuration from a component's
+// standalone field.
+func ParseStandalone(conf *service.ParsedConfig) (Standalone, error) {
+	s := Standalone{}
+	var err error
+	if s.Enabled, err = conf.FieldBool("standalone", "enabled"); err != nil {
+		return s, err
+	}
+	if s.Version, err = conf.FieldString("standalone", "version"); err != nil {
+		return s, err
+	}
+	if s.Release, err = conf.FieldString("standalone", "release"); err != nil {
+		return s, err
+	}
+	if s.URL, err = conf.FieldString("standalone", "url"); err != nil {
+		return s, err
+	}
+	if s.SHA256, err = conf.FieldString("standalone", "sha256"); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+const standaloneURL = "https://github.com/indygreg/python-build-standalone/releases/download/%s/cpython-%s+%s-%s-install_only.tar.gz"
+
+// standaloneTarget maps our platform to a python-build-standalone target.
+func standaloneTarget() (string, error) {
+	switch runtime.GOOS + "/" + runtime.GOARCH {
+	case "linux/amd64":
+		return "x86_64-unknown-linux-gnu", nil
+	case "linux/arm64":
+		return "aarch64-unknown-linux-gnu", nil
+	case "darwin/amd64":
+		return "x86_64-apple-darwin", nil
+	case "darwin/arm64":
+		return "aarch64-apple-darwin", nil
+	default:
+		return "", fmt.Errorf("no standalone python build for %s/%s", runtime.GOOS, runtime.GOARCH)
+	}
+}
+
+// EnsureStandalone returns exe if it can be found, otherwise downloading and
+// unpacking the standalone build on first use and returning its Python
+// executable.
+func EnsureStandalone(exe string, s Standalone, logger *service.Logger) (string, error) {
+	if !s.Enabled {
+		return exe, nil
+	}
+	if _, err := exec.LookPath(exe); err == nil {
+		return exe, nil
+	}
+
+	url := s.URL
+	if url == "" {
+		target, err := standaloneTarget()
+		if err != nil {
+			return "", err
+		}
+		url = fmt.Sprintf(standaloneURL, s.Release, s.Version, s.Release, target)
+	}
+
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		cache = os.TempDir()
+	}
+	sum := sha256.Sum256([]byte(url))
+	dir := filepath.Join(cache, "rp-connect-python", "standalone", hex.EncodeToString(sum[:])[:16])
+	python := standaloneExecutable(dir)
+
+	envMtx.Lock()
+	defer envMtx.Unlock()
+
+	if _, err := os.Stat(python); err == nil {
+		logger.Debugf("Using standalone Python %s.", python)
+		return python, nil
+	}
+
+	logger.Infof("Python executable '%s' not found, downloading standalone Python from %s.", exe, url)
+	tmp := dir + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return "", err
+	}
+	if err := downloadAndUnpack(url, s.SHA256, tmp); err != nil {
+		_ = os.RemoveAll(tmp)
+		return "", fmt.Errorf("failed to bootstrap standalone python: %w", err)
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return "", err
+	}
+
+	logger.Infof("Installed standalone Python into %s.", dir)
+	return python, nil
+}
+
+// downloadAndUnpack fetches a gzipped tarball, verifying its checksum if
+// provided, and unpacks it into dir.
+func downloadAndUnpack(url, checksum, dir string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status downloading %s: %s", url, resp.Status)
+	}
+
+	// Spool to disk so we can verify before unpacking anything.
+	archive, err := os.CreateTemp("", "rpcn-python-*.tar.gz")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = archive.Close()
+		_ = os.Remove(archive.Name())
+	}()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(archive, hash), resp.Body); err != nil {
+		return err
+	}
+	if checksum != "" && !strings.EqualFold(checksum, hex.EncodeToString(hash.Sum(nil))) {
+		return errors.New("checksum mismatch")
+	}
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	gz, err := gzip.NewReader(archive)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = gz.Close() }()
+
+	reader := tar.NewReader(gz)
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(dir, header.Name)
+		if !strings.HasPrefix(path, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return fmt.Errorf("invalid path in archive: %s", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, path); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode)&os.ModePerm)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, reader)
+			_ = f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
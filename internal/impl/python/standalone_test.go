@@ -0,0 +1,105 @@
+package python
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// standaloneArchive builds a gzipped tarball laid out like a
+// python-build-standalone install, or with extra entries.
+func standaloneArchive(t *testing.T, entries map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range entries {
+		header := &tar.Header{Name: name, Mode: 0o755, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Test that a standalone Python is only downloaded when exe is missing, and
+// only once.
+func TestEnsureStandalone(t *testing.T) {
+	isolateCache(t)
+	archive := standaloneArchive(t, map[string]string{
+		"python/bin/python3":     "#!/bin/sh\necho standalone\n",
+		"python/python.exe":      "standalone",
+		"python/lib/placeholder": "",
+	})
+	var downloads atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+		_, _ = w.Write(archive)
+	}))
+	defer server.Close()
+	sum := sha256.Sum256(archive)
+	s := Standalone{Enabled: true, URL: server.URL + "/python.tar.gz", SHA256: hex.EncodeToString(sum[:])}
+
+	exe, err := EnsureStandalone("python3", s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exe != "python3" || downloads.Load() != 0 {
+		t.Fatalf("expected python3 to be used as is, got %s after %d downloads", exe, downloads.Load())
+	}
+
+	for range 2 {
+		exe, err = EnsureStandalone("no-such-python", s, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = os.Stat(exe); err != nil {
+			t.Fatalf("expected the standalone python to be unpacked: %s", err)
+		}
+	}
+	if downloads.Load() != 1 {
+		t.Fatalf("expected a single download, got %d", downloads.Load())
+	}
+
+	// Bad archives aren't unpacked.
+	tests := []struct {
+		name     string
+		archive  []byte
+		checksum string
+		err      string
+	}{
+		{name: "checksum mismatch", archive: archive, checksum: strings.Repeat("0", 64), err: "checksum mismatch"},
+		{name: "path traversal", archive: standaloneArchive(t, map[string]string{"../escape": ""}), err: "invalid path"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write(test.archive)
+			}))
+			defer server.Close()
+
+			s := Standalone{Enabled: true, URL: server.URL + "/python.tar.gz", SHA256: test.checksum}
+			_, err := EnsureStandalone("no-such-python", s, nil)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected an error containing '%s', got %v", test.err, err)
+			}
+		})
+	}
+}
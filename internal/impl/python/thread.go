@@ -0,0 +1,114 @@
+package python
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+)
+
+// mainThreadName names the OS thread running the main interpreter.
+const mainThreadName = "rpcn-py-main"
+
+// dedicatedThreads makes runtimes run each of their interpreters on an OS
+// thread of its own instead of whichever go routine calls into it.
+var dedicatedThreads atomic.Bool
+
+// SetDedicatedThreads makes interpreters of isolated and free-threaded
+// runtimes started from now on run on an OS thread of their own, named
+// rpcn-py-<n> after their index, so profiles of the process are legible. As
+// threads are process-wide, enabling it for any component enables it for all.
+func SetDedicatedThreads(enabled bool) {
+	if enabled {
+		dedicatedThreads.Store(true)
+	}
+}
+
+// threadName names the OS thread of the interpreter with index idx.
+func threadName(idx int) string {
+	return fmt.Sprintf("rpcn-py-%d", idx)
+}
+
+// worker calls functions on a locked OS thread of its own. Tickets ensure it
+// only makes one call at a time.
+type worker struct {
+	requests chan func() error
+	reply    chan workerReply
+	done     chan struct{}
+}
+
+// workerReply is the result of a function called by a worker.
+type workerReply struct {
+	err       error
+	recovered any // Passed on to the caller if the function panicked.
+}
+
+// startWorker starts a worker with its thread named for the interpreter with
+// index idx.
+func startWorker(idx int) *worker {
+	w := &worker{
+		requests: make(chan func() error),
+		reply:    make(chan workerReply),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		// Threads that ran Python crash on exiting, so we hand ours back to
+		// the go scheduler when we're done instead of exiting with it.
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		defer close(w.done)
+
+		// Naming is best effort, so failures are ignored. The thread gets
+		// its original name back before others use it.
+		if original, err := getThreadName(); err == nil {
+			defer func() { _ = setThreadName(original) }()
+			_ = setThreadName(threadName(idx))
+		}
+		for fn := range w.requests {
+			w.reply <- callRecovering(fn)
+		}
+	}()
+	return w
+}
+
+// callRecovering calls fn, recovering from it panicking.
+func callRecovering(fn func() error) (reply workerReply) {
+	defer func() { reply.recovered = recover() }()
+	return workerReply{err: fn()}
+}
+
+// call calls fn on the worker's thread, returning its result. If fn panics,
+// so does call.
+func (w *worker) call(fn func() error) error {
+	w.requests <- fn
+	reply := <-w.reply
+	if reply.recovered != nil {
+		panic(reply.recovered)
+	}
+	return reply.err
+}
+
+// stop stops the worker, waiting for its thread to exit.
+func (w *worker) stop() {
+	close(w.requests)
+	<-w.done
+}
+
+// startWorkers starts a worker per interpreter if we're using dedicated
+// threads, otherwise returns nil.
+func startWorkers(cnt int) []*worker {
+	if !dedicatedThreads.Load() {
+		return nil
+	}
+	workers := make([]*worker, cnt)
+	for idx := range workers {
+		workers[idx] = startWorker(idx)
+	}
+	return workers
+}
+
+// stopWorkers stops the workers started by startWorkers.
+func stopWorkers(workers []*worker) {
+	for _, w := range workers {
+		w.stop()
+	}
+}
@@ -0,0 +1,27 @@
+package python
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// setThreadName names the calling OS thread, as shown by tools like top, perf,
+// and py-spy. Linux truncates names to 15 bytes.
+func setThreadName(name string) error {
+	if len(name) > 15 {
+		name = name[:15]
+	}
+	buf := append([]byte(name), 0)
+	return unix.Prctl(unix.PR_SET_NAME, uintptr(unsafe.Pointer(&buf[0])), 0, 0, 0)
+}
+
+// getThreadName returns the name of the calling OS thread.
+func getThreadName() (string, error) {
+	var buf [16]byte
+	err := unix.Prctl(unix.PR_GET_NAME, uintptr(unsafe.Pointer(&buf[0])), 0, 0, 0)
+	if err != nil {
+		return "", err
+	}
+	return unix.ByteSliceToString(buf[:]), nil
+}
@@ -0,0 +1,92 @@
+package python
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// threadNameOf reads the name of the OS thread running Python code for the
+// ticket.
+func threadNameOf(t *testing.T, r Runtime, ticket *InterpreterTicket) string {
+	var name string
+	err := r.Apply(ticket, context.Background(), func() error {
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+		code, err := Compile("name = open('/proc/thread-self/comm').read()", "thread.py")
+		if err != nil {
+			return err
+		}
+		result := py.PyEval_EvalCode(code, globals, globals)
+		if result == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			t.Fatal("failed to read thread name")
+		}
+		py.Py_DecRef(result)
+		name, err = py.UnicodeToString(py.PyDict_GetItemString(globals, "name"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(name)
+}
+
+// Test that the main interpreter's thread is always named.
+func TestMainThreadNamed(t *testing.T) {
+	r, err := NewSingleInterpreterRuntime("python3", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Stop(ctx) }()
+
+	ticket, err := r.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Release(ticket) }()
+
+	if name := threadNameOf(t, r, ticket); name != mainThreadName {
+		t.Fatalf("expected thread named '%s', got '%s'", mainThreadName, name)
+	}
+}
+
+// Test that interpreters run on dedicated threads named after their index.
+func TestDedicatedThreadsNamed(t *testing.T) {
+	SetDedicatedThreads(true)
+	defer dedicatedThreads.Store(false)
+
+	r, err := NewMultiInterpreterRuntime("python3", 2, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Stop(ctx) }()
+
+	for range 2 {
+		ticket, err := r.Acquire(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := threadName(ticket.idx)
+		for range 3 {
+			if name := threadNameOf(t, r, ticket); name != expected {
+				t.Fatalf("expected thread named '%s', got '%s'", expected, name)
+			}
+		}
+		if err = r.Release(ticket); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
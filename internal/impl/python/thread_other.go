@@ -0,0 +1,13 @@
+//go:build !linux
+
+package python
+
+import "errors"
+
+func setThreadName(_ string) error {
+	return errors.New("not supported")
+}
+
+func getThreadName() (string, error) {
+	return "", errors.New("not supported")
+}
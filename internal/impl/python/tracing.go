@@ -0,0 +1,43 @@
+package python
+
+import (
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName identifies the spans around calls into Python and those
+// recorded by scripts.
+const TracerName = "rp-connect-python"
+
+// Attribute keys of the spans around calls into Python.
+const (
+	modeAttribute      = "python.mode"
+	scriptAttribute    = "python.script.sha256"
+	exceptionAttribute = "exception.type"
+)
+
+// SpanAttributes describes the Python code of a component for the spans
+// around calls into it. The script is identified by its hash, so spans can
+// be attributed to a version of it without leaking its contents.
+func SpanAttributes(mode Mode, script string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String(modeAttribute, string(mode)),
+		attribute.String(scriptAttribute, ScriptChecksum(script)),
+	}
+}
+
+// EndSpan ends a span around a call into Python. If the call failed, the
+// span is marked as errored with err and, if the failure was an exception
+// described like "TypeError: message", with the exception's type.
+func EndSpan(span trace.Span, exception string, err error) {
+	if kind, _, ok := strings.Cut(exception, ":"); ok {
+		span.SetAttributes(attribute.String(exceptionAttribute, kind))
+	}
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
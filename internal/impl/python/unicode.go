@@ -0,0 +1,47 @@
+package python
+
+import (
+	"errors"
+	"unsafe"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// utf8Of returns the UTF-8 encoding of a Python str without copying it. For
+// ASCII strings this is the string's own storage, otherwise Python caches the
+// encoding with the string, so it's only valid while obj is alive.
+//
+// The caller must manage the interpreter state for this to succeed.
+func utf8Of(obj py.PyObjectPtr) ([]byte, error) {
+	var size int64
+	data := pyUnicodeAsUTF8AndSize(obj, &size)
+	if data == nil {
+		py.PyErr_Print()
+		return nil, errors.New("failed to encode python string")
+	}
+	return unsafe.Slice(data, size), nil
+}
+
+// UnicodeToString converts a Python str to a Go string, copying it once
+// rather than first encoding it into an intermediate bytes object.
+//
+// The caller must manage the interpreter state for this to succeed.
+func UnicodeToString(obj py.PyObjectPtr) (string, error) {
+	data, err := utf8Of(obj)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// UnicodeToBytes is UnicodeToString for when the string is wanted as bytes,
+// like a message payload, sparing converting a string.
+//
+// The caller must manage the interpreter state for this to succeed.
+func UnicodeToBytes(obj py.PyObjectPtr) ([]byte, error) {
+	data, err := utf8Of(obj)
+	if err != nil {
+		return nil, err
+	}
+	return append(make([]byte, 0, len(data)), data...), nil
+}
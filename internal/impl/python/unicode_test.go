@@ -0,0 +1,62 @@
+package python
+
+import (
+	"context"
+	"testing"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// Test that Python strings convert to Go, whether ASCII or not.
+func TestUnicodeToString(t *testing.T) {
+	r, err := NewSingleInterpreterRuntime("python3", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Stop(ctx) }()
+
+	err = r.Map(ctx, func(ticket *InterpreterTicket) error {
+		for _, expected := range []string{"", "hello", "héllo wörld", "🐍 and 蛇"} {
+			str := py.PyUnicode_FromString(expected)
+			actual, err := UnicodeToString(str)
+			if err != nil {
+				return err
+			}
+			data, err := UnicodeToBytes(str)
+			py.Py_DecRef(str)
+			if err != nil {
+				return err
+			}
+			if actual != expected || string(data) != expected {
+				t.Errorf("expected %q, got %q and %q", expected, actual, data)
+			}
+		}
+
+		// Lone surrogates can't be encoded as UTF-8.
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+		code, err := Compile(`surrogate = "\ud800"`, "__unicode_test__.py")
+		if err != nil {
+			return err
+		}
+		out := py.PyEval_EvalCode(code, globals, globals)
+		if out == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			t.Fatal("failed to evaluate script")
+		}
+		py.Py_DecRef(out)
+		if _, err = UnicodeToString(py.PyDict_GetItemString(globals, "surrogate")); err == nil {
+			t.Error("expected a lone surrogate to fail")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,79 @@
+package python
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// virtualEnv describes a Python virtual environment (PEP 405).
+type virtualEnv struct {
+	prefix     string // Root of the virtual environment.
+	basePrefix string // Prefix of the Python installation it's based on.
+	executable string // Python executable within the virtual environment.
+}
+
+const venvHelper string = "import sys; print(sys.prefix); print(sys.base_prefix); print(sys.executable)"
+
+// findVirtualEnv uses the provided Python executable to detect whether it
+// belongs to a virtual environment, returning nil if it doesn't.
+func findVirtualEnv(exe string) (*virtualEnv, error) {
+	out, err := exec.Command(exe, "-c", venvHelper).Output()
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 3 || lines[0] == lines[1] {
+		// Not a virtual environment.
+		return nil, nil
+	}
+
+	// Python only honors virtual environments with a pyvenv.cfg, which lives
+	// in their root. Older tools might not create one.
+	_, err = os.Stat(filepath.Join(lines[0], "pyvenv.cfg"))
+	if err != nil {
+		return nil, nil
+	}
+
+	return &virtualEnv{
+		prefix:     lines[0],
+		basePrefix: lines[1],
+		executable: lines[2],
+	}, nil
+}
+
+// findHomeAndPaths discovers the Python home and paths for the provided
+// Python executable, along with the program name to configure Python with.
+//
+// If the executable belongs to a virtual environment, home is that of the
+// base installation and the program name is the virtual environment's
+// executable, letting Python set up prefix, exec_prefix, and site-packages
+// from pyvenv.cfg just like it does when run from the command line. A conda
+// environment is an installation of its own, so only the program name is set,
+// pointing sys.executable and anything run with it at the environment.
+func findHomeAndPaths(exe string) (string, string, []string, error) {
+	home, paths, err := py.FindPythonHomeAndPaths(exe)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	venv, err := findVirtualEnv(exe)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if venv == nil {
+		conda, err := findCondaEnv(exe)
+		if err != nil {
+			return "", "", nil, err
+		}
+		if conda != nil {
+			return home, conda.executable, paths, nil
+		}
+		return home, "", paths, nil
+	}
+
+	return venv.basePrefix, venv.executable, paths, nil
+}
@@ -0,0 +1,81 @@
+package python
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// Test that virtual environments are detected from their executable, and that
+// their site-packages are importable.
+func TestVirtualEnv(t *testing.T) {
+	venv, err := findVirtualEnv("python3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if venv != nil {
+		t.Skip("requires python3 outside of a virtual environment")
+	}
+
+	dir := t.TempDir()
+	if err = exec.Command("python3", "-m", "venv", "--without-pip", dir).Run(); err != nil {
+		t.Fatal(err)
+	}
+	exe := venvExecutable(dir)
+	venv, err = findVirtualEnv(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if venv == nil {
+		t.Fatal("expected a virtual environment")
+	}
+	if venv.prefix != dir {
+		t.Errorf("expected prefix %s, got %s", dir, venv.prefix)
+	}
+	_, program, _, err := findHomeAndPaths(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if program != venv.executable {
+		t.Errorf("expected the program to be %s, got %s", venv.executable, program)
+	}
+
+	// Install a module only the virtual environment has.
+	sitePackages, _ := filepath.Glob(filepath.Join(dir, "lib", "python3*", "site-packages"))
+	if len(sitePackages) != 1 {
+		t.Fatalf("expected a site-packages directory, got %q", sitePackages)
+	}
+	module := filepath.Join(sitePackages[0], "only_in_venv.py")
+	if err = os.WriteFile(module, []byte("answer = 42\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewMultiInterpreterRuntime(exe, 1, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Stop(ctx) }()
+
+	ticket, err := r.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Release(ticket) }()
+	err = r.Apply(ticket, ctx, func() error {
+		if py.PyRun_SimpleString("import only_in_venv; assert only_in_venv.answer == 42") != 0 {
+			t.Error("expected the module in the virtual environment to be importable")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
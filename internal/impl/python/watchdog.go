@@ -0,0 +1,180 @@
+package python
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"time"
+
+	py "github.com/voutilad/gogopython"
+)
+
+// Watchdog replaces interpreters stuck running Python code, e.g. because of
+// a deadlocked C extension.
+type Watchdog struct {
+	Timeout   time.Duration                // Hard ceiling on a single call into Python. Disabled if 0.
+	OnRestart func(id int64, stack string) // Optional, called after replacing a stuck interpreter.
+}
+
+// abandonedCnt counts interpreters we've given up on while they were still
+// running code. Finalizing Python with any of them around would crash.
+var abandonedCnt atomic.Int32
+
+// stackDumpTimeout bounds how long we wait to dump the stack of a stuck
+// interpreter, which requires taking its GIL.
+const stackDumpTimeout = time.Second
+
+// runningFor reports how long the ticket has been running Python code, or 0
+// if it isn't.
+func (i *InterpreterTicket) runningFor() time.Duration {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	if i.running == py.NullInterpreterState {
+		return 0
+	}
+	return time.Since(i.since)
+}
+
+// abandonIfRunning abandons the ticket if it's still running Python code, so
+// it's dropped instead of being released back to its runtime. Reports whether
+// the ticket was abandoned.
+func (i *InterpreterTicket) abandonIfRunning() bool {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	if i.running == py.NullInterpreterState {
+		return false
+	}
+	i.abandoned = true
+	return true
+}
+
+// isAbandoned reports whether the ticket was abandoned.
+func (i *InterpreterTicket) isAbandoned() bool {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	return i.abandoned
+}
+
+// dumpAndInterrupt dumps the Python stacks of the interpreter running code
+// for the ticket before raising KeyboardInterrupt in it, in case it's only
+// slow. Gives up on the dump if the interpreter won't give up its GIL.
+func (i *InterpreterTicket) dumpAndInterrupt() string {
+	result := make(chan string, 1)
+	go func() {
+		// faulthandler writes straight to a file descriptor without giving
+		// up the GIL, so the stuck code can't move on while we look at it.
+		f, err := os.CreateTemp("", "rpcn-stack-*")
+		if err != nil {
+			result <- "<unavailable: " + err.Error() + ">"
+			return
+		}
+		defer func() {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}()
+
+		i.whileRunning(func() {
+			dumpStacks(f.Fd())
+			raiseInterrupt()
+		})
+
+		stack, err := os.ReadFile(f.Name())
+		if err != nil {
+			result <- "<unavailable: " + err.Error() + ">"
+			return
+		}
+		result <- string(stack)
+	}()
+
+	select {
+	case stack := <-result:
+		return stack
+	case <-time.After(stackDumpTimeout):
+		return "<unavailable: interpreter is holding its GIL>"
+	}
+}
+
+// dumpStacks writes the stacks of all threads in the current interpreter to
+// the file descriptor fd.
+//
+// The caller must manage the interpreter state for this to succeed.
+func dumpStacks(fd uintptr) {
+	module := py.PyImport_ImportModule("faulthandler")
+	if module == py.NullPyObjectPtr {
+		py.PyErr_Clear()
+		return
+	}
+	defer py.Py_DecRef(module)
+
+	dump := py.PyObject_GetAttrString(module, "dump_traceback")
+	if dump == py.NullPyObjectPtr {
+		py.PyErr_Clear()
+		return
+	}
+	defer py.Py_DecRef(dump)
+
+	file := py.PyLong_FromLong(int64(fd))
+	defer py.Py_DecRef(file)
+
+	result := py.PyObject_CallOneArg(dump, file)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Clear()
+		return
+	}
+	py.Py_DecRef(result)
+}
+
+// watch the runtime's tickets until stop is closed, replacing interpreters
+// running a single call for longer than our watchdog allows.
+func (r *MultiInterpreterRuntime) watch(stop, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(max(r.watchdog.Timeout/4, 10*time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		for _, ticket := range r.snapshot() {
+			if ticket.runningFor() > r.watchdog.Timeout {
+				r.restart(ticket)
+			}
+		}
+	}
+}
+
+// restart the stuck interpreter for the ticket, replacing it with a fresh
+// one. The stuck interpreter can't safely be torn down, so it's abandoned.
+func (r *MultiInterpreterRuntime) restart(ticket *InterpreterTicket) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sub, err := r.spawn(ctx)
+	if err != nil {
+		r.logger.Errorf("Failed to replace stuck sub-interpreter %d: %s", ticket.id, err)
+		return
+	}
+
+	// The call may have finished while we were spawning. If not, the ticket
+	// won't come back to the pool, leaving room for its replacement.
+	if !ticket.abandonIfRunning() {
+		_ = StopSub(sub, ctx)
+		return
+	}
+	abandonedCnt.Add(1)
+	r.replace(ticket.idx, sub)
+
+	stack := ticket.dumpAndInterrupt()
+
+	r.logger.Errorf("Replaced sub-interpreter %d stuck for over %s with %d. Python stack:\n%s",
+		ticket.id, r.watchdog.Timeout, sub.id, stack)
+	if r.watchdog.OnRestart != nil {
+		r.watchdog.OnRestart(ticket.id, stack)
+	}
+}
@@ -2,12 +2,22 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"os"
 
 	"github.com/redpanda-data/benthos/v4/public/service"
 	_ "github.com/redpanda-data/connect/public/bundle/free/v4"
+	"github.com/voutilad/rp-connect-python/bloblang"
+	_ "github.com/voutilad/rp-connect-python/buffer"
+	_ "github.com/voutilad/rp-connect-python/cache"
 	_ "github.com/voutilad/rp-connect-python/input"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+	_ "github.com/voutilad/rp-connect-python/metrics"
 	_ "github.com/voutilad/rp-connect-python/output"
 	_ "github.com/voutilad/rp-connect-python/processor"
+	_ "github.com/voutilad/rp-connect-python/ratelimit"
+	_ "github.com/voutilad/rp-connect-python/scanner"
+	_ "github.com/voutilad/rp-connect-python/tracer"
 )
 
 func main() {
@@ -17,5 +27,14 @@ func main() {
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
 	*/
-	service.RunCLI(context.Background())
+	code, err := service.RunCLIToCode(context.Background(),
+		service.CLIOptSetMainSchemaFrom(python.MainConfigSchema),
+		service.CLIOptOnConfigParse(python.ParseScriptResources))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+
+	// Bloblang plugins have no lifecycle, so stop their Python once we're done.
+	_ = bloblang.Stop(context.Background())
+	os.Exit(code)
 }
@@ -0,0 +1,405 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+	py "github.com/voutilad/gogopython"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+)
+
+var configSpec = service.NewConfigSpec().
+	Summary("Export metrics with Python.").
+	Description("Aggregates metric updates and periodically hands them to a Python function, defined by the script, so they can be pushed to observability backends that only have a Python client. Each call receives a list of `dict`s, one per counter or timer updated since the last call and per gauge ever set, with the keys `type` (`counter`, `gauge`, or `timer`), `name`, and `labels`. Counters have a `value` holding the increase since the last call, gauges a `value` holding their latest value, and timers `values` holding each timing recorded since the last call in nanoseconds.").
+	Field(service.NewStringField("script").
+		Description("Python code defining the export function.")).
+	Fields(python.RuntimeFields()...).
+	Field(service.NewStringField("function").
+		Description("Name of the Python function, defined by the script, called with each list of metrics. May be `async def`.").
+		Default("export")).
+	Field(service.NewDurationField("flush_interval").
+		Description("How often to call the function with the metrics updated since the last call. Metrics are flushed once more when closing.").
+		Default("10s")).
+	LintRule(`root = python_syntax_error("script", this.script | "", this.exe | "python3")`)
+
+// Kinds of metric series.
+const (
+	counterKind = "counter"
+	gaugeKind   = "gauge"
+	timerKind   = "timer"
+)
+
+// series is a metric with a specific set of label values, aggregating
+// updates until the next flush.
+type series struct {
+	kind   string
+	name   string
+	labels map[string]string
+
+	count    atomic.Int64 // Counter increase since the last flush.
+	gauge    atomic.Int64 // Latest gauge value.
+	gaugeSet atomic.Bool  // Whether the gauge was ever set.
+
+	timingsMtx sync.Mutex
+	timings    []int64 // Timings since the last flush.
+}
+
+func (s *series) Incr(count int64) {
+	s.count.Add(count)
+}
+
+func (s *series) Set(value int64) {
+	s.gauge.Store(value)
+	s.gaugeSet.Store(true)
+}
+
+func (s *series) Timing(delta int64) {
+	s.timingsMtx.Lock()
+	s.timings = append(s.timings, delta)
+	s.timingsMtx.Unlock()
+}
+
+// snapshot describes the updates to s since the last snapshot, or nil if
+// there were none, resetting them.
+func (s *series) snapshot() map[string]any {
+	m := map[string]any{"type": s.kind, "name": s.name, "labels": s.labels}
+	switch s.kind {
+	case counterKind:
+		count := s.count.Swap(0)
+		if count == 0 {
+			return nil
+		}
+		m["value"] = count
+	case gaugeKind:
+		if !s.gaugeSet.Load() {
+			return nil
+		}
+		m["value"] = s.gauge.Load()
+	case timerKind:
+		s.timingsMtx.Lock()
+		timings := s.timings
+		s.timings = nil
+		s.timingsMtx.Unlock()
+		if len(timings) == 0 {
+			return nil
+		}
+		m["values"] = timings
+	}
+	return m
+}
+
+type pythonMetrics struct {
+	logger          *service.Logger
+	runtime         python.Runtime
+	script          string
+	path            []string
+	environment     map[string]string
+	preload         []string
+	requires        []string
+	functionName    string
+	flushInterval   time.Duration
+	shutdownTimeout time.Duration
+
+	// Python state, only used with our single interpreter's ticket.
+	function py.PyObjectPtr
+	export   py.PyObjectPtr
+
+	mtx    sync.Mutex
+	series map[string]*series // Keyed by kind, name, and label values.
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func init() {
+	err := service.RegisterMetricsExporter("python", configSpec,
+		func(conf *service.ParsedConfig, logger *service.Logger) (service.MetricsExporter, error) {
+			// Extract our configuration.
+			runtimeConf, err := python.ParseRuntimeConfig(conf, logger)
+			if err != nil {
+				return nil, err
+			}
+			script, err := conf.FieldString("script")
+			if err != nil {
+				return nil, err
+			}
+			if err = python.AuditScript(logger, "script", script, runtimeConf.ScriptChecksums); err != nil {
+				return nil, err
+			}
+
+			m, err := newPythonMetrics(runtimeConf.Exe, runtimeConf.Mode, logger)
+			if err != nil {
+				return nil, err
+			}
+			m.script = script
+			m.path = runtimeConf.Path
+			m.environment = runtimeConf.Environment
+			m.preload = runtimeConf.Preload
+			m.requires = runtimeConf.Requires
+			m.shutdownTimeout = runtimeConf.ShutdownTimeout
+			if m.functionName, err = conf.FieldString("function"); err != nil {
+				return nil, err
+			}
+			if m.flushInterval, err = conf.FieldDuration("flush_interval"); err != nil {
+				return nil, err
+			}
+			if m.flushInterval <= 0 {
+				return nil, errors.New("flush_interval must be positive")
+			}
+
+			if err = m.start(context.Background()); err != nil {
+				return nil, err
+			}
+			return m, nil
+		})
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+// newPythonMetrics creates a python metrics exporter. It uses a single
+// interpreter of its own, which isn't metered itself.
+func newPythonMetrics(exe string, mode python.Mode, logger *service.Logger) (*pythonMetrics, error) {
+	var err error
+	var r python.Runtime
+
+	switch mode {
+	case python.IsolatedLegacy:
+		r, err = python.NewMultiInterpreterRuntime(exe, 1, true, logger)
+	case python.Global:
+		r, err = python.NewSingleInterpreterRuntime(exe, 1, logger)
+	case python.Isolated:
+		r, err = python.NewMultiInterpreterRuntime(exe, 1, false, logger)
+	case python.FreeThreaded:
+		r, err = python.NewFreeThreadedRuntime(exe, 1, logger)
+	default:
+		return nil, errors.New("invalid mode")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &pythonMetrics{
+		logger:          logger,
+		runtime:         r,
+		flushInterval:   10 * time.Second,
+		shutdownTimeout: 10 * time.Second,
+		series:          make(map[string]*series),
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}, nil
+}
+
+// start starts our runtime, runs our script to find our export function, and
+// starts flushing periodically.
+func (m *pythonMetrics) start(ctx context.Context) error {
+	err := m.runtime.Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = m.runtime.Map(ctx, func(ticket *python.InterpreterTicket) error {
+		code, err := python.Compile(m.script, "__rp_connect_python_metrics__.py")
+		if err != nil {
+			return err
+		}
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+
+		// Provide our rpcn helper module, which we also need for decoding
+		// metrics and running async functions.
+		rpcn, err := python.LoadRpcnModule()
+		if err != nil {
+			return err
+		}
+		py.PyDict_SetItemString(globals, "rpcn", rpcn)
+		m.export = py.PyObject_GetAttrString(rpcn, "_export_metrics")
+		if m.export == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find _export_metrics function in rpcn module")
+		}
+
+		// Send print() and friends to our logger.
+		if err = python.CaptureOutput(m.logger); err != nil {
+			return err
+		}
+
+		// Apply environment variables before running anything of the user's.
+		if err = python.SetEnvironment(m.environment); err != nil {
+			return err
+		}
+
+		// Make any local helper modules importable.
+		if err = python.ExtendSysPath(m.path); err != nil {
+			return err
+		}
+
+		// Fail fast, saying where we looked, if a dependency is missing.
+		if err = python.RequireModules(m.requires); err != nil {
+			return err
+		}
+
+		// Pay for slow imports now rather than on the first flush.
+		if err = python.PreloadModules(m.preload); err != nil {
+			return err
+		}
+
+		// Execute the script to define our export function.
+		result := py.PyEval_EvalCode(code, globals, py.NullPyObjectPtr)
+		if result == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to evaluate metrics script")
+		}
+		py.Py_DecRef(result)
+
+		m.function = py.PyDict_GetItemString(globals, m.functionName)
+		if m.function == py.NullPyObjectPtr {
+			return fmt.Errorf("failed to find python function '%s'", m.functionName)
+		}
+		return nil
+	})
+	if err != nil {
+		// Try cleaning up if we had an issue.
+		_ = m.runtime.Stop(ctx)
+		return err
+	}
+
+	go m.flushPeriodically()
+	return nil
+}
+
+// flushPeriodically flushes every flushInterval until we're closed.
+func (m *pythonMetrics) flushPeriodically() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.flush(context.Background()); err != nil {
+				m.logger.Errorf("Failed to export metrics: %s", err)
+			}
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// flush hands the metrics updated since the last flush to our function.
+func (m *pythonMetrics) flush(ctx context.Context) error {
+	m.mtx.Lock()
+	snapshots := make([]map[string]any, 0, len(m.series))
+	for _, s := range m.series {
+		if snapshot := s.snapshot(); snapshot != nil {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	m.mtx.Unlock()
+	if len(snapshots) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(snapshots)
+	if err != nil {
+		return err
+	}
+
+	ticket, err := m.runtime.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = m.runtime.Release(ticket) }()
+
+	return m.runtime.Apply(ticket, ctx, func() error {
+		metrics := py.PyUnicode_FromString(string(data))
+		if metrics == py.NullPyObjectPtr {
+			return errors.New("failed to create python string")
+		}
+
+		args := py.PyTuple_New(2)
+		if args == py.NullPyObjectPtr {
+			py.Py_DecRef(metrics)
+			return errors.New("failed to create python tuple")
+		}
+		defer py.Py_DecRef(args)
+		// Tuples steal our references.
+		py.Py_IncRef(m.function)
+		py.PyTuple_SetItem(args, 0, m.function)
+		py.PyTuple_SetItem(args, 1, metrics)
+
+		result := py.PyObject_Call(m.export, args, py.NullPyObjectPtr)
+		if result == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return fmt.Errorf("python function '%s' failed", m.functionName)
+		}
+		py.Py_DecRef(result)
+		return nil
+	})
+}
+
+// seriesFor finds or creates the series of kind for name and labels.
+func (m *pythonMetrics) seriesFor(kind, name string, labelKeys, labelValues []string) *series {
+	key := kind + "\x00" + name + "\x00" + strings.Join(labelValues, "\x00")
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if s, ok := m.series[key]; ok {
+		return s
+	}
+	labels := make(map[string]string, len(labelKeys))
+	for idx, k := range labelKeys {
+		if idx < len(labelValues) {
+			labels[k] = labelValues[idx]
+		}
+	}
+	s := &series{kind: kind, name: name, labels: labels}
+	m.series[key] = s
+	return s
+}
+
+func (m *pythonMetrics) NewCounterCtor(name string, labelKeys ...string) service.MetricsExporterCounterCtor {
+	return func(labelValues ...string) service.MetricsExporterCounter {
+		return m.seriesFor(counterKind, name, labelKeys, labelValues)
+	}
+}
+
+func (m *pythonMetrics) NewTimerCtor(name string, labelKeys ...string) service.MetricsExporterTimerCtor {
+	return func(labelValues ...string) service.MetricsExporterTimer {
+		return m.seriesFor(timerKind, name, labelKeys, labelValues)
+	}
+}
+
+func (m *pythonMetrics) NewGaugeCtor(name string, labelKeys ...string) service.MetricsExporterGaugeCtor {
+	return func(labelValues ...string) service.MetricsExporterGauge {
+		return m.seriesFor(gaugeKind, name, labelKeys, labelValues)
+	}
+}
+
+func (m *pythonMetrics) Close(ctx context.Context) error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.stop)
+		<-m.done
+
+		// Don't lose what was recorded since the last flush.
+		if err = m.flush(ctx); err != nil {
+			m.logger.Errorf("Failed to export metrics: %s", err)
+		}
+
+		err = python.StopWithDeadline(ctx, m.runtime, m.shutdownTimeout, m.logger)
+	})
+	return err
+}
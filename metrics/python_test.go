@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+	"golang.org/x/net/context"
+)
+
+func TestExportsOnClose(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "metrics.json")
+
+	m, err := newPythonMetrics("python3", python.Global, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.environment = map[string]string{"METRICS_OUT": out}
+	m.script = `
+import json, os
+
+def export(metrics):
+    with open(os.environ["METRICS_OUT"], "w") as f:
+        json.dump(sorted(metrics, key=lambda m: m["type"]), f)
+`
+	m.functionName = "export"
+	ctx := context.Background()
+	if err = m.start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	counter := m.NewCounterCtor("input_received", "label")("kafka")
+	counter.Incr(2)
+	counter.Incr(3)
+	m.NewGaugeCtor("batch_size")().Set(7)
+	m.NewTimerCtor("latency_ns")().Timing(100)
+	m.NewCounterCtor("unused")()
+
+	if err = m.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []map[string]any
+	if err = json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	expected := []map[string]any{
+		{"type": "counter", "name": "input_received", "labels": map[string]any{"label": "kafka"}, "value": 5.0},
+		{"type": "gauge", "name": "batch_size", "labels": map[string]any{}, "value": 7.0},
+		{"type": "timer", "name": "latency_ns", "labels": map[string]any{}, "values": []any{100.0}},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+}
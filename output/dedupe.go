@@ -0,0 +1,135 @@
+package output
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+	py "github.com/voutilad/gogopython"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+)
+
+// fingerprint identifies a message by its content, so we can tell it was
+// already delivered before writing it again.
+func fingerprint(m *service.Message) (string, error) {
+	data, err := m.AsBytes()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// dedupeBatch drops the messages of the batch our dedupe cache says were
+// already delivered, along with repeats within the batch, returning what's
+// left along with their fingerprints. If the cache can't be checked, the
+// batch fails rather than risking writing it again.
+//
+// The cache may be slow, so this must not be called holding an interpreter.
+func (p *pythonOutput) dedupeBatch(ctx context.Context, batch service.MessageBatch) (service.MessageBatch, []string, error) {
+	var remaining service.MessageBatch
+	var fingerprints []string
+	seen := make(map[string]bool, len(batch))
+	for _, m := range batch {
+		f, err := fingerprint(m)
+		if err != nil {
+			return nil, nil, err
+		}
+		if seen[f] {
+			continue
+		}
+		seen[f] = true
+		remaining = append(remaining, m)
+		fingerprints = append(fingerprints, f)
+	}
+
+	var cacheErr error
+	var deduped service.MessageBatch
+	var dedupedFingerprints []string
+	err := p.mgr.AccessCache(ctx, p.dedupeCache, func(c service.Cache) {
+		for idx, f := range fingerprints {
+			key, err := c.Get(ctx, f)
+			if err == nil {
+				p.logger.Debugf("Skipping message already delivered with dedupe key '%s'.", key)
+				continue
+			}
+			if !errors.Is(err, service.ErrKeyNotFound) {
+				cacheErr = err
+				return
+			}
+			deduped = append(deduped, remaining[idx])
+			dedupedFingerprints = append(dedupedFingerprints, f)
+		}
+	})
+	if err == nil {
+		err = cacheErr
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to check dedupe cache: %w", err)
+	}
+	return deduped, dedupedFingerprints, nil
+}
+
+// dedupeKeys converts what a write function returned for n messages into a
+// dedupe key for each, which is empty if it's None. A result of None has no
+// keys at all.
+//
+// The caller must manage the interpreter state for this to succeed.
+func dedupeKeys(result py.PyObjectPtr, n int, fn string) ([]string, error) {
+	keys := make([]string, n)
+	size, item := py.PyList_Size, py.PyList_GetItem
+	switch py.BaseType(result) {
+	case py.None:
+		return keys, nil
+	case py.List:
+	case py.Tuple:
+		size, item = py.PyTuple_Size, py.PyTuple_GetItem
+	default:
+		return nil, fmt.Errorf("python function '%s' must return a list of dedupe keys", fn)
+	}
+	if got := size(result); got != int64(n) {
+		return nil, fmt.Errorf("python function '%s' returned %d dedupe keys for %d messages", fn, got, n)
+	}
+
+	for idx := range keys {
+		// Borrowed references, so nothing to drop.
+		key := item(result, int64(idx))
+		switch py.BaseType(key) {
+		case py.None:
+		case py.String:
+			str, err := python.UnicodeToString(key)
+			if err != nil {
+				return nil, err
+			}
+			keys[idx] = str
+		case py.Bytes:
+			keys[idx] = string(unsafe.Slice(py.PyBytes_AsString(key), py.PyBytes_Size(key)))
+		default:
+			return nil, fmt.Errorf("python function '%s' must return dedupe keys as a str, bytes, or None", fn)
+		}
+	}
+	return keys, nil
+}
+
+// recordDelivered stores the dedupe keys of delivered messages in our dedupe
+// cache under their fingerprints. Failing to do so only risks delivering them
+// again, so it's just logged.
+func (p *pythonOutput) recordDelivered(ctx context.Context, fingerprints, keys []string) {
+	err := p.mgr.AccessCache(ctx, p.dedupeCache, func(c service.Cache) {
+		for idx, key := range keys {
+			if key == "" {
+				continue
+			}
+			if err := c.Set(ctx, fingerprints[idx], []byte(key), p.dedupeTTL); err != nil {
+				p.logger.Warnf("Failed to record dedupe key '%s': %s", key, err)
+			}
+		}
+	})
+	if err != nil {
+		p.logger.Warnf("Failed to access dedupe cache: %s", err)
+	}
+}
@@ -2,59 +2,548 @@ package output
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/cenkalti/backoff/v4"
 	"github.com/redpanda-data/benthos/v4/public/service"
+	py "github.com/voutilad/gogopython"
 	"github.com/voutilad/rp-connect-python/internal/impl/python"
 	"github.com/voutilad/rp-connect-python/processor"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var configSpec = service.NewConfigSpec().
 	Summary("Post-process data with Python.").
 	Field(service.NewStringField("script").
-		Description("Python code to execute.")).
-	Field(service.NewStringField("exe").
-		Description("Path to a Python executable.").
-		Default("python3")).
-	Field(service.NewStringField("mode").
-		Description("Toggle different Python runtime modes.").
-		Examples(string(python.Global), string(python.Isolated), string(python.IsolatedLegacy)).
-		Default(string(python.Global))).
+		Description("Python code to execute. Optional if `script_dir` is set.").
+		Default("")).
+	Fields(python.RuntimeFields()...).
+	Field(python.SharedRuntimeField()).
+	Field(service.NewObjectField("debug",
+		service.NewStringField("address").
+			Description("Host and port for debugpy to listen on, e.g. `localhost:5678`. Disabled if empty.").
+			Default(""),
+		service.NewBoolField("wait").
+			Description("Whether to wait for a debugger to attach before running any scripts.").
+			Default(false)).
+		Description("Start [debugpy](https://github.com/microsoft/debugpy) in the main interpreter so a debugger can attach and stop at breakpoints, e.g. `breakpoint()` calls, in scripts while they handle real traffic. Requires the `debugpy` module and `global` mode. As the debugger is process-wide, all components must agree on its address.").
+		Advanced()).
+	Field(service.NewObjectField("schema_registry",
+		service.NewStringField("url").
+			Description("Base URL of the schema registry. Disabled if empty.").
+			Example("http://localhost:8081").
+			Default(""),
+		service.NewStringField("username").
+			Description("Username for basic authentication, if required.").
+			Default(""),
+		service.NewStringField("password").
+			Description("Password for basic authentication, if required.").
+			Secret().
+			Default("")).
+		Description("Bind `rpcn.schema_registry` to a Confluent-compatible schema registry, for framing Avro, Protobuf, and JSON schema payloads in its wire format from scripts. As interpreters may be shared, all components must agree on the registry.").
+		Advanced()).
+	Field(service.NewStringField("script_dir").
+		Description("Directory of a multi-file Python project backing the output. It's made importable and its `entry_module` imported into every interpreter, like `from main import *`, before `script` runs, so the functions the output calls may be defined by the project instead. If the directory has an `__init__.py`, the entry module is imported from it as a package so relative imports work.").
+		Example("./my_sink").
+		Default("")).
+	Field(service.NewStringField("entry_module").
+		Description("Module of `script_dir` to import.").
+		Default("main")).
+	Field(service.NewObjectField("identity",
+		service.NewStringField("stream").
+			Description("Name of the stream, e.g. in streams mode, made available to scripts as `identity.stream`.").
+			Example("${STREAM_NAME}").
+			Default(""),
+		service.NewStringField("pipeline_id").
+			Description("Id of the pipeline, e.g. per deployment, made available to scripts as `identity.pipeline`.").
+			Default("")).
+		Description("Identity of the deployment made available to the script as `identity`, along with the component's `label` as `identity.label`, so logs, metrics, and external checkpoints written from Python can be namespaced per deployment.").
+		Advanced()).
 	Field(service.NewStringField("serializer").
-		Description("Serialization mode to use on results.").
-		Examples(string(python.None), string(python.Pickle), string(python.Bloblang)).
-		Default(string(python.Bloblang)))
+		Description("Serialization mode to use on results. With `cbor` or `bson`, messages are decoded from CBOR or BSON before being passed to the batch function.").
+		Examples(string(python.None), string(python.Pickle), string(python.Bloblang), string(python.CBOR), string(python.BSON)).
+		Default(string(python.Bloblang))).
+	Field(service.NewStringField("function").
+		Description("Name of a Python function, defined by the script, called with each batch as a list of messages. If not set, the script is executed per message like a processor.").
+		Example("write_batch").
+		Optional()).
+	Field(service.NewStringField("route_function").
+		Description("Name of a Python function, defined by the script, called with each message and returning the name of its destination. Messages are grouped by destination and written by the writer `open_function` returns for it. Used instead of `function`.").
+		Example("route").
+		Optional()).
+	Field(service.NewStringField("open_function").
+		Description("Name of a Python function, defined by the script, called with the name of each new destination and returning a callable writer for it. Writers are kept for the life of the output and their `close` method, if any, is called when the output closes. Required by `route_function`.").
+		Example("open_writer").
+		Optional()).
+	Field(service.NewBoolField("with_metadata").
+		Description("Pass each message to `function` (or `route_function` and writers) as a `(content, metadata)` tuple, where metadata is a `dict` of the message's metadata.").
+		Default(false)).
+	Field(service.NewBoolField("lazy").
+		Description("Defer starting Python, and connecting, until the first batch is written, so rarely used branches of a pipeline don't pay the startup time and memory up front. The first batch waits for it instead.").
+		Advanced().
+		Default(false)).
+	Field(service.NewIntField("async_concurrency").
+		Description("If `function` is an `async def` function, it's called with each message rather than the batch and this many calls are awaited concurrently.").
+		Default(16)).
+	Field(service.NewStringField("connect_function").
+		Description("Name of a Python function, defined by the script, called with no arguments when the output connects. Only used when `function` or `route_function` is set.").
+		Example("connect").
+		Optional()).
+	Field(service.NewStringField("ready_function").
+		Description("Name of a Python function, defined by the script, called with no arguments after `connect_function` until it returns a true value, e.g. once a model loading in the background is available. The output isn't connected, and so the pipeline isn't ready, until then. Only used when `function` or `route_function` is set.").
+		Example("ready").
+		Optional()).
+	Field(service.NewStringField("close_function").
+		Description("Name of a Python function, defined by the script, called with no arguments when the output closes. Only used when `function` or `route_function` is set.").
+		Example("close").
+		Optional()).
+	Field(service.NewStringField("flush_function").
+		Description("Name of a Python function, defined by the script, called with no arguments when the output shuts down gracefully, before `close_function`, to write out anything buffered. Only used when `function` or `route_function` is set.").
+		Example("flush").
+		Optional()).
+	Field(service.NewDurationField("flush_timeout").
+		Description("Maximum time to wait for `flush_function` to finish before giving up on it.").
+		Default("30s")).
+	Field(service.NewStringField("failed_function").
+		Description("Name of a Python function, defined by the script, called as `failed_function(message, error, attempts)` for each message of a batch that failed with a fatal error, was rejected, or ran out of retries. If it returns without raising, the batch is considered handled, otherwise it's nacked, unless it was rejected. Only used when `function` or `route_function` is set.").
+		Example("on_failed").
+		Optional()).
+	Field(service.NewStringField("dedupe_cache").
+		Description("Name of a cache resource recording written messages, so retries and restarts don't deliver them twice. The write function, or writers with `route_function`, return a list with a dedupe key for each message they were given, like an event id, as a `str` or `bytes`, or `None` to not record it. Written messages are recorded with their key under a fingerprint of their content, and messages already recorded, or repeated within a batch, are skipped. Only used when `function` or `route_function` is set.").
+		Example("delivered").
+		Optional()).
+	Field(service.NewDurationField("dedupe_ttl").
+		Description("How long written messages are remembered, if the cache supports expiry. Uses the cache's default if not set.").
+		Example("24h").
+		Optional()).
+	Field(service.NewStringField("begin_function").
+		Description("Name of a Python function, defined by the script, called with no arguments before writing each batch to begin a transaction. Requires `commit_function`.").
+		Example("begin").
+		Optional()).
+	Field(service.NewStringField("commit_function").
+		Description("Name of a Python function, defined by the script, called with no arguments after a batch is written to commit the transaction. The batch is only acknowledged once it returns.").
+		Example("commit").
+		Optional()).
+	Field(service.NewStringField("abort_function").
+		Description("Name of a Python function, defined by the script, called with no arguments to roll back the transaction if writing or committing a batch fails.").
+		Example("abort").
+		Optional()).
+	Field(service.NewStringListField("retry_on").
+		Description("Names of Python exception types, including subclasses, that cause a batch to be retried with back off. Raising `rpcn.RetryableError` always retries. Only used when `function` or `route_function` is set.").
+		Example([]string{"ConnectionError", "TimeoutError"}).
+		Default([]string{})).
+	Field(service.NewBackOffField("backoff", false, nil)).
+	Field(service.NewInterpolatedStringField("affinity_key").
+		Description("Key pinning each message to one of the interpreters, like its partition or destination, so state the script keeps per key, e.g. sequence numbers or producers, stays consistent with `max_in_flight` above 1. Messages with the same key are always written by the same interpreter, and never concurrently. Batches mixing keys are split, writing the messages of each key in turn. Requires `function` or `route_function`.").
+		Example(`${! @kafka_partition }`).
+		Advanced().
+		Optional()).
+	Field(service.NewIntField("max_in_flight").
+		Description("Maximum number of batches to write concurrently. Each in-flight batch uses its own interpreter, so concurrency beyond 1 is most useful with the isolated modes.").
+		Default(1)).
+	Field(service.NewBatchPolicyField("batching")).
+	LintRule(`root = python_syntax_error("script", this.script | "", this.exe | "python3")`)
 
 type pythonOutput struct {
 	logger    *service.Logger
+	mgr       *service.Resources
 	processor service.BatchProcessor
+
+	// State for when we're calling a Python function per batch.
+	runtime          python.Runtime
+	script           string
+	path             []string
+	scriptDir        string // Directory of a multi-file project, if any.
+	entryModule      string // Module of scriptDir to import.
+	environment      map[string]string
+	identity         python.Identity
+	preload          []string
+	requires         []string
+	function         string
+	routeFn          string
+	openFn           string
+	connectFn        string
+	readyFn          string
+	closeFn          string
+	flushFn          string
+	failedFn         string
+	dedupeCache      string
+	dedupeTTL        *time.Duration
+	beginFn          string
+	commitFn         string
+	abortFn          string
+	flushTimeout     time.Duration
+	shutdownTimeout  time.Duration
+	serializerMode   python.SerializerMode
+	withMetadata     bool
+	asyncConcurrency int
+	retryOn          []string
+	backoff          *backoff.ExponentialBackOff
+	affinityKey      *service.InterpolatedString // Pins messages to interpreters, if set.
+	interpreters     map[int64]*interpreter      // Protected by mtx.
+	mtx              sync.RWMutex
+	lazy             bool
+	connected        atomic.Bool // Whether our runtime is started and initialized.
+	connectMtx       sync.Mutex
+	spanAttributes   []attribute.KeyValue
+}
+
+// interpreter holds the state for our function in a particular interpreter.
+type interpreter struct {
+	globals    py.PyObjectPtr
+	serializer *python.Serializer
+	writeBatch py.PyObjectPtr
+	route      py.PyObjectPtr
+	open       py.PyObjectPtr
+	writers    map[string]py.PyObjectPtr // writers by destination
+	close      py.PyObjectPtr
+	flush      py.PyObjectPtr
+	failed     py.PyObjectPtr
+	begin      py.PyObjectPtr
+	commit     py.PyObjectPtr
+	abort      py.PyObjectPtr
+	listType   py.PyObjectPtr
+	classify   py.PyObjectPtr
+	resolve    py.PyObjectPtr
+	write      py.PyObjectPtr
+}
+
+// errorKind describes how a failure of our Python function was classified.
+type errorKind string
+
+const (
+	retryable errorKind = "retryable"
+	fatal     errorKind = "fatal"
+	reject    errorKind = "reject"
+)
+
+// writeError describes a failure of our Python function.
+type writeError struct {
+	function    string
+	destination string // set when writing to a routed destination
+	kind        errorKind
+	exception   *python.Exception // nil if it couldn't be described
+}
+
+func (e *writeError) Error() string {
+	msg := fmt.Sprintf("python function '%s' failed", e.function)
+	if e.destination != "" {
+		msg = fmt.Sprintf("writer from python function '%s' for destination '%s' failed", e.function, e.destination)
+	}
+	if e.exception == nil {
+		return msg
+	}
+	return fmt.Sprintf("%s: %s", msg, e.exception)
+}
+
+// logger adds the traceback of the failure, if we have one, to logger.
+func (e *writeError) logger(logger *service.Logger) *service.Logger {
+	if e.exception == nil {
+		return logger
+	}
+	return logger.With(python.TracebackMetaKey, e.exception.Traceback)
 }
 
 func init() {
 	err := service.RegisterBatchOutput("python",
 		configSpec,
 		func(conf *service.ParsedConfig, mgr *service.Resources) (service.BatchOutput, service.BatchPolicy, int, error) {
-			policy := service.BatchPolicy{}
+			policy, err := conf.FieldBatchPolicy("batching")
+			if err != nil {
+				return nil, policy, 0, err
+			}
 			// Extract our configuration.
-			exe, err := conf.FieldString("exe")
+			runtimeConf, err := python.ParseRuntimeConfig(conf, mgr.Logger())
 			if err != nil {
-				panic(err)
+				return nil, policy, 0, err
+			}
+			scriptDir, err := conf.FieldString("script_dir")
+			if err != nil {
+				return nil, policy, 0, err
+			}
+			entryModule, err := conf.FieldString("entry_module")
+			if err != nil {
+				return nil, policy, 0, err
+			}
+			identity, err := python.ParseIdentity(conf, mgr)
+			if err != nil {
+				return nil, policy, 0, err
+			}
+			runtimeName, err := conf.FieldString("runtime")
+			if err != nil {
+				return nil, policy, 0, err
 			}
 			script, err := conf.FieldString("script")
 			if err != nil {
 				return nil, policy, 0, err
 			}
-			modeString, err := conf.FieldString("mode")
+			if err = python.AuditScript(mgr.Logger(), "script", script, runtimeConf.ScriptChecksums); err != nil {
+				return nil, policy, 0, err
+			}
+			if script == "" && scriptDir == "" {
+				return nil, policy, 0, errors.New("either script or script_dir is required")
+			}
+			debugAddress, err := conf.FieldString("debug", "address")
+			if err != nil {
+				return nil, policy, 0, err
+			}
+			debugWait, err := conf.FieldBool("debug", "wait")
+			if err != nil {
+				return nil, policy, 0, err
+			}
+			if err = python.SetDebugger(debugAddress, debugWait, runtimeConf.Mode); err != nil {
+				return nil, policy, 0, err
+			}
+			registryURL, err := conf.FieldString("schema_registry", "url")
+			if err != nil {
+				return nil, policy, 0, err
+			}
+			registryUsername, err := conf.FieldString("schema_registry", "username")
+			if err != nil {
+				return nil, policy, 0, err
+			}
+			registryPassword, err := conf.FieldString("schema_registry", "password")
+			if err != nil {
+				return nil, policy, 0, err
+			}
+			if err = python.SetSchemaRegistry(registryURL, registryUsername, registryPassword); err != nil {
+				return nil, policy, 0, err
+			}
+			serializer, err := conf.FieldString("serializer")
+			if err != nil {
+				return nil, policy, 0, err
+			}
+			function := ""
+			if conf.Contains("function") {
+				function, err = conf.FieldString("function")
+				if err != nil {
+					return nil, policy, 0, err
+				}
+			}
+
+			routeFn, openFn := "", ""
+			if conf.Contains("route_function") {
+				routeFn, err = conf.FieldString("route_function")
+				if err != nil {
+					return nil, policy, 0, err
+				}
+			}
+			if conf.Contains("open_function") {
+				openFn, err = conf.FieldString("open_function")
+				if err != nil {
+					return nil, policy, 0, err
+				}
+			}
+			if routeFn != "" && function != "" {
+				return nil, policy, 0, errors.New("only one of function and route_function may be set")
+			}
+			if (routeFn == "") != (openFn == "") {
+				return nil, policy, 0, errors.New("route_function and open_function must be set together")
+			}
+
+			withMetadata, err := conf.FieldBool("with_metadata")
+			if err != nil {
+				return nil, policy, 0, err
+			}
+			lazy, err := conf.FieldBool("lazy")
+			if err != nil {
+				return nil, policy, 0, err
+			}
+			asyncConcurrency, err := conf.FieldInt("async_concurrency")
+			if err != nil {
+				return nil, policy, 0, err
+			}
+			if asyncConcurrency < 1 {
+				return nil, policy, 0, errors.New("async_concurrency must be at least 1")
+			}
+
+			connectFn, readyFn, closeFn := "", "", ""
+			if conf.Contains("connect_function") {
+				connectFn, err = conf.FieldString("connect_function")
+				if err != nil {
+					return nil, policy, 0, err
+				}
+			}
+			if conf.Contains("ready_function") {
+				readyFn, err = conf.FieldString("ready_function")
+				if err != nil {
+					return nil, policy, 0, err
+				}
+			}
+			if conf.Contains("close_function") {
+				closeFn, err = conf.FieldString("close_function")
+				if err != nil {
+					return nil, policy, 0, err
+				}
+			}
+
+			flushFn := ""
+			if conf.Contains("flush_function") {
+				flushFn, err = conf.FieldString("flush_function")
+				if err != nil {
+					return nil, policy, 0, err
+				}
+			}
+			failedFn := ""
+			if conf.Contains("failed_function") {
+				failedFn, err = conf.FieldString("failed_function")
+				if err != nil {
+					return nil, policy, 0, err
+				}
+			}
+			dedupeCache := ""
+			var dedupeTTL *time.Duration
+			if conf.Contains("dedupe_cache") {
+				dedupeCache, err = conf.FieldString("dedupe_cache")
+				if err != nil {
+					return nil, policy, 0, err
+				}
+				if !mgr.HasCache(dedupeCache) {
+					return nil, policy, 0, fmt.Errorf("cache resource '%s' was not found", dedupeCache)
+				}
+			}
+			if conf.Contains("dedupe_ttl") {
+				ttl, err := conf.FieldDuration("dedupe_ttl")
+				if err != nil {
+					return nil, policy, 0, err
+				}
+				dedupeTTL = &ttl
+			}
+			beginFn, commitFn, abortFn := "", "", ""
+			if conf.Contains("begin_function") {
+				beginFn, err = conf.FieldString("begin_function")
+				if err != nil {
+					return nil, policy, 0, err
+				}
+			}
+			if conf.Contains("commit_function") {
+				commitFn, err = conf.FieldString("commit_function")
+				if err != nil {
+					return nil, policy, 0, err
+				}
+			}
+			if conf.Contains("abort_function") {
+				abortFn, err = conf.FieldString("abort_function")
+				if err != nil {
+					return nil, policy, 0, err
+				}
+			}
+			if (beginFn == "") != (commitFn == "") {
+				return nil, policy, 0, errors.New("begin_function and commit_function must be set together")
+			}
+			if abortFn != "" && beginFn == "" {
+				return nil, policy, 0, errors.New("abort_function requires begin_function and commit_function to be set")
+			}
+
+			flushTimeout, err := conf.FieldDuration("flush_timeout")
+			if err != nil {
+				return nil, policy, 0, err
+			}
+
+			retryOn, err := conf.FieldStringList("retry_on")
+			if err != nil {
+				return nil, policy, 0, err
+			}
+			boff, err := conf.FieldBackOff("backoff")
+			if err != nil {
+				return nil, policy, 0, err
+			}
+
+			var affinityKey *service.InterpolatedString
+			if conf.Contains("affinity_key") {
+				affinityKey, err = conf.FieldInterpolatedString("affinity_key")
+				if err != nil {
+					return nil, policy, 0, err
+				}
+			}
+
+			maxInFlight, err := conf.FieldInt("max_in_flight")
 			if err != nil {
 				return nil, policy, 0, err
 			}
+			if maxInFlight < 1 {
+				return nil, policy, 0, errors.New("max_in_flight must be at least 1")
+			}
+
+			if function != "" || routeFn != "" {
+				o, err := newFunctionOutput(runtimeConf.Exe, script, function, runtimeConf.Mode, runtimeName,
+					python.StringAsSerializerMode(serializer), maxInFlight, mgr.Metrics(), mgr.Logger())
+				if err != nil {
+					return nil, policy, 0, err
+				}
+				o.path = runtimeConf.Path
+				o.scriptDir = scriptDir
+				o.entryModule = entryModule
+				o.environment = runtimeConf.Environment
+				o.identity = identity
+				o.preload = runtimeConf.Preload
+				o.requires = runtimeConf.Requires
+				o.routeFn = routeFn
+				o.openFn = openFn
+				o.connectFn = connectFn
+				o.readyFn = readyFn
+				o.closeFn = closeFn
+				o.flushFn = flushFn
+				o.flushTimeout = flushTimeout
+				o.shutdownTimeout = runtimeConf.ShutdownTimeout
+				o.failedFn = failedFn
+				o.mgr = mgr
+				o.dedupeCache = dedupeCache
+				o.dedupeTTL = dedupeTTL
+				o.beginFn = beginFn
+				o.commitFn = commitFn
+				o.abortFn = abortFn
+				o.withMetadata = withMetadata
+				o.lazy = lazy
+				o.asyncConcurrency = asyncConcurrency
+				o.retryOn = retryOn
+				o.backoff = boff
+				o.affinityKey = affinityKey
+				return o, policy, maxInFlight, nil
+			}
+			if connectFn != "" || readyFn != "" || closeFn != "" || flushFn != "" || failedFn != "" || dedupeCache != "" || beginFn != "" {
+				return nil, policy, 0, errors.New("lifecycle functions require function or route_function to be set")
+			}
+			if withMetadata {
+				return nil, policy, 0, errors.New("with_metadata requires function or route_function to be set")
+			}
+			if affinityKey != nil {
+				return nil, policy, 0, errors.New("affinity_key requires function or route_function to be set")
+			}
 
-			p, err := processor.NewPythonProcessor(exe, script, 1, python.StringAsMode(modeString), python.Bloblang, mgr.Logger())
+			p, err := processor.NewPythonProcessor(processor.Config{
+				Exe:             runtimeConf.Exe,
+				Script:          script,
+				Path:            runtimeConf.Path,
+				ScriptDir:       scriptDir,
+				EntryModule:     entryModule,
+				Environment:     runtimeConf.Environment,
+				Identity:        identity,
+				PreloadModules:  runtimeConf.Preload,
+				RequireModules:  runtimeConf.Requires,
+				Runtime:         runtimeName,
+				ShutdownTimeout: runtimeConf.ShutdownTimeout,
+				Interpreters:    maxInFlight,
+				Lazy:            lazy,
+				Mode:            runtimeConf.Mode,
+				Serializer:      python.Bloblang,
+				Metrics:         mgr.Metrics(),
+			}, mgr.Logger())
 			if err != nil {
 				return nil, policy, 0, err
 			}
 			return &pythonOutput{
 				logger:    mgr.Logger(),
 				processor: p,
-			}, policy, 1, nil
+			}, policy, maxInFlight, nil
 		})
 
 	if err != nil {
@@ -62,18 +551,1061 @@ func init() {
 	}
 }
 
-func (p *pythonOutput) Connect(_ context.Context) error {
-	// noop
+// newFunctionOutput creates a python output that calls the named function
+// with each batch, using up to cnt interpreters.
+func newFunctionOutput(exe, script, function string, mode python.Mode, runtimeName string, serializer python.SerializerMode,
+	cnt int, metrics *service.Metrics, logger *service.Logger) (*pythonOutput, error) {
+	var err error
+	var r python.Runtime
+
+	// XXX for now, enforce that we only support non-serializing modes when
+	// using the main interpreter.
+	if serializer == python.None && mode != python.Global && mode != python.FreeThreaded {
+		return nil,
+			errors.New("isolated interpreters require bloblang or pickle serialization")
+	}
+	if serializer == python.Avro {
+		return nil, errors.New("avro serialization is only supported by the python processor")
+	}
+	if serializer == python.CSV {
+		return nil, errors.New("csv serialization is only supported by the python input")
+	}
+
+	switch mode {
+	case python.IsolatedLegacy:
+		r, err = python.NewMultiInterpreterRuntime(exe, cnt, true, logger)
+	case python.Global:
+		r, err = python.NewSingleInterpreterRuntime(exe, cnt, logger)
+	case python.Isolated:
+		r, err = python.NewMultiInterpreterRuntime(exe, cnt, false, logger)
+	case python.FreeThreaded:
+		r, err = python.NewFreeThreadedRuntime(exe, cnt, logger)
+	default:
+		return nil, errors.New("invalid mode")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if runtimeName != "" {
+		r, err = python.ShareRuntime(runtimeName, exe, mode, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r = python.NewMeteredRuntime(r, metrics)
+
+	return &pythonOutput{
+		logger:         logger,
+		runtime:        r,
+		script:         script,
+		function:       function,
+		serializerMode: serializer,
+		interpreters:   make(map[int64]*interpreter),
+		spanAttributes: python.SpanAttributes(mode, script),
+	}, nil
+}
+
+func (p *pythonOutput) Connect(ctx context.Context) error {
+	if p.processor != nil {
+		// noop
+		return nil
+	}
+	if p.lazy {
+		// We connect on our first write instead.
+		return nil
+	}
+	return p.connect(ctx)
+}
+
+// connect starts our runtime and runs our script in every interpreter, unless
+// that's already done.
+func (p *pythonOutput) connect(ctx context.Context) error {
+	p.connectMtx.Lock()
+	defer p.connectMtx.Unlock()
+	if p.connected.Load() {
+		return nil
+	}
+
+	err := p.runtime.Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = p.runtime.Map(ctx, func(ticket *python.InterpreterTicket) error {
+		code, err := python.Compile(p.script, "__rp_connect_python_output__.py")
+		if err != nil {
+			return err
+		}
+
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+		i := &interpreter{
+			globals: globals,
+			writers: make(map[string]py.PyObjectPtr),
+		}
+
+		// Provide our rpcn helper module, which we also need for classifying
+		// errors.
+		rpcn, err := python.LoadRpcnModule()
+		if err != nil {
+			return err
+		}
+		py.PyDict_SetItemString(i.globals, "rpcn", rpcn)
+		classify := py.PyObject_GetAttrString(rpcn, "_classify")
+		if classify == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find _classify function in rpcn module")
+		}
+		i.classify = classify
+		resolve := py.PyObject_GetAttrString(rpcn, "_resolve")
+		if resolve == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find _resolve function in rpcn module")
+		}
+		i.resolve = resolve
+		write := py.PyObject_GetAttrString(rpcn, "_write")
+		if write == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find _write function in rpcn module")
+		}
+		i.write = write
+
+		// Send print() and friends to our logger.
+		if err = python.CaptureOutput(p.logger); err != nil {
+			return err
+		}
+
+		// Apply environment variables before running anything of the user's.
+		if err = python.SetEnvironment(p.environment); err != nil {
+			return err
+		}
+
+		// Make any local helper modules importable.
+		if err = python.ExtendSysPath(p.path); err != nil {
+			return err
+		}
+
+		// Fail fast, saying where we looked, if a dependency is missing.
+		if err = python.RequireModules(p.requires); err != nil {
+			return err
+		}
+
+		// Pay for slow imports now rather than on the first write.
+		if err = python.PreloadModules(p.preload); err != nil {
+			return err
+		}
+
+		// Bring in the project backing us, if any.
+		if err = python.ImportPackage(p.scriptDir, p.entryModule, i.globals); err != nil {
+			return err
+		}
+
+		// Tell the script who we are.
+		if err = python.SetIdentity(i.globals, p.identity); err != nil {
+			return err
+		}
+
+		// Execute the script to define our function.
+		result := py.PyEval_EvalCode(code, i.globals, py.NullPyObjectPtr)
+		if result == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to evaluate output script")
+		}
+		py.Py_DecRef(result)
+
+		if p.function != "" {
+			fn, err := i.lookupFunction(p.function)
+			if err != nil {
+				return err
+			}
+			// Async functions are called per message, so adapt them to take
+			// the batch.
+			asyncWriter := py.PyObject_GetAttrString(rpcn, "_async_writer")
+			if asyncWriter == py.NullPyObjectPtr {
+				py.PyErr_Print()
+				return errors.New("failed to find _async_writer function in rpcn module")
+			}
+			defer py.Py_DecRef(asyncWriter)
+			args := py.PyTuple_New(2)
+			if args == py.NullPyObjectPtr {
+				return errors.New("failed to create python tuple")
+			}
+			defer py.Py_DecRef(args)
+			// Tuples steal our references.
+			py.Py_IncRef(fn)
+			py.PyTuple_SetItem(args, 0, fn)
+			py.PyTuple_SetItem(args, 1, py.PyLong_FromLong(int64(p.asyncConcurrency)))
+			writeBatch := py.PyObject_Call(asyncWriter, args, py.NullPyObjectPtr)
+			if writeBatch == py.NullPyObjectPtr {
+				py.PyErr_Print()
+				return fmt.Errorf("failed to prepare python function '%s'", p.function)
+			}
+			i.writeBatch = writeBatch
+		}
+
+		// Or, if routing, our functions for finding destinations.
+		if p.routeFn != "" {
+			route, err := i.lookupFunction(p.routeFn)
+			if err != nil {
+				return err
+			}
+			py.Py_IncRef(route)
+			i.route = route
+			open, err := i.lookupFunction(p.openFn)
+			if err != nil {
+				return err
+			}
+			py.Py_IncRef(open)
+			i.open = open
+		}
+
+		// Hold on to our close function, if any.
+		if p.closeFn != "" {
+			closeFn, err := i.lookupFunction(p.closeFn)
+			if err != nil {
+				return err
+			}
+			py.Py_IncRef(closeFn)
+			i.close = closeFn
+		}
+
+		// And our flush function, if any.
+		if p.flushFn != "" {
+			flushFn, err := i.lookupFunction(p.flushFn)
+			if err != nil {
+				return err
+			}
+			py.Py_IncRef(flushFn)
+			i.flush = flushFn
+		}
+
+		// And our dead-letter function, if any.
+		if p.failedFn != "" {
+			failedFn, err := i.lookupFunction(p.failedFn)
+			if err != nil {
+				return err
+			}
+			py.Py_IncRef(failedFn)
+			i.failed = failedFn
+		}
+
+		// And our transaction functions, if any.
+		if p.beginFn != "" {
+			beginFn, err := i.lookupFunction(p.beginFn)
+			if err != nil {
+				return err
+			}
+			py.Py_IncRef(beginFn)
+			i.begin = beginFn
+
+			commitFn, err := i.lookupFunction(p.commitFn)
+			if err != nil {
+				return err
+			}
+			py.Py_IncRef(commitFn)
+			i.commit = commitFn
+		}
+		if p.abortFn != "" {
+			abortFn, err := i.lookupFunction(p.abortFn)
+			if err != nil {
+				return err
+			}
+			py.Py_IncRef(abortFn)
+			i.abort = abortFn
+		}
+
+		// Let the script set itself up, if it wants.
+		if p.connectFn != "" {
+			connectFn, err := i.lookupFunction(p.connectFn)
+			if err != nil {
+				return err
+			}
+			result := i.callNoArgs(connectFn)
+			if result == py.NullPyObjectPtr {
+				py.PyErr_Print()
+				return fmt.Errorf("python function '%s' failed", p.connectFn)
+			}
+			py.Py_DecRef(result)
+		}
+
+		// We need the list type for building our batches.
+		builtins := py.PyImport_ImportModule("builtins")
+		if builtins == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to import builtins module")
+		}
+		defer py.Py_DecRef(builtins)
+		listType := py.PyObject_GetAttrString(builtins, "list")
+		if listType == py.NullPyObjectPtr {
+			return errors.New("failed to find list type")
+		}
+		i.listType = listType
+
+		serializer, err := python.NewSerializer()
+		if err != nil {
+			return err
+		}
+		if p.serializerMode == python.CBOR {
+			if err = serializer.SetCBOR(); err != nil {
+				return err
+			}
+		}
+		if p.serializerMode == python.BSON {
+			if err = serializer.SetBSON(); err != nil {
+				return err
+			}
+		}
+		i.serializer = serializer
+
+		p.mtx.Lock()
+		p.interpreters[ticket.Id()] = i
+		p.mtx.Unlock()
+		return nil
+	})
+
+	// Hold off until the script says it's ready.
+	if err == nil && p.readyFn != "" {
+		err = python.WaitUntilReady(ctx, p.runtime, p.ready, p.logger)
+	}
+
+	if err != nil {
+		// Try cleaning up if we had an issue.
+		_ = p.runtime.Stop(ctx)
+		return err
+	}
+	p.connected.Store(true)
 	return nil
 }
 
+// callNoArgs calls fn, running its result to completion if it's awaitable so
+// lifecycle functions may be async.
+//
+// The caller must manage the interpreter state for this to succeed.
+func (i *interpreter) callNoArgs(fn py.PyObjectPtr) py.PyObjectPtr {
+	result := py.PyObject_CallNoArgs(fn)
+	if result == py.NullPyObjectPtr {
+		return py.NullPyObjectPtr
+	}
+	defer py.Py_DecRef(result)
+	return py.PyObject_CallOneArg(i.resolve, result)
+}
+
+// ready calls our ready function in the ticket's interpreter, reporting
+// whether it returned a true value.
+//
+// The caller must manage the interpreter state for this to succeed.
+func (p *pythonOutput) ready(ticket *python.InterpreterTicket) (bool, error) {
+	i, ok := p.stateFor(ticket)
+	if !ok {
+		return false, service.ErrNotConnected
+	}
+	fn, err := i.lookupFunction(p.readyFn)
+	if err != nil {
+		return false, err
+	}
+	result := i.callNoArgs(fn)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return false, fmt.Errorf("python function '%s' failed", p.readyFn)
+	}
+	defer py.Py_DecRef(result)
+	return python.IsTrue(result)
+}
+
+// lookupFunction finds a function defined by our script, returning a
+// borrowed reference.
+func (i *interpreter) lookupFunction(name string) (py.PyObjectPtr, error) {
+	fn := py.PyDict_GetItemString(i.globals, name)
+	if fn == py.NullPyObjectPtr {
+		return py.NullPyObjectPtr, fmt.Errorf("failed to find python function '%s'", name)
+	}
+	if py.BaseType(fn) != py.Function {
+		return py.NullPyObjectPtr, fmt.Errorf("python object '%s' is not a function", name)
+	}
+	return fn, nil
+}
+
 func (p *pythonOutput) WriteBatch(ctx context.Context, batch service.MessageBatch) error {
-	// TODO: for now we hack and just pass it to a PythonProcessor and ignore
-	//       if it returns a batch.
-	_, err := p.processor.ProcessBatch(ctx, batch)
+	if p.processor == nil {
+		return p.callWriteBatch(ctx, batch)
+	}
+
+	// TODO: for now we hack and just pass it to a PythonProcessor.
+	batches, err := p.processor.ProcessBatch(ctx, batch)
+	if err != nil {
+		return err
+	}
+
+	// Rejected messages were dropped, but any that failed must not be acked.
+	var failed int
+	var firstErr error
+	for _, b := range batches {
+		for _, m := range b {
+			if err := m.GetError(); err != nil {
+				p.logger.Errorf("Failed to write message: %s", err)
+				if failed++; firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to write %d messages: %w", failed, firstErr)
+	}
+	return nil
+}
+
+// callWriteBatch calls our Python function with the batch, or if we pin
+// messages to interpreters, with the messages of each key in turn.
+func (p *pythonOutput) callWriteBatch(ctx context.Context, batch service.MessageBatch) error {
+	if p.affinityKey == nil {
+		return p.retryWriteBatch(ctx, batch, p.runtime.Acquire)
+	}
+	pinner, ok := p.runtime.(python.Pinner)
+	if !ok {
+		return errors.New("runtime can't pin interpreters")
+	}
+
+	var keys []string
+	groups := make(map[string]service.MessageBatch)
+	for _, m := range batch {
+		key, err := p.affinityKey.TryString(m)
+		if err != nil {
+			return fmt.Errorf("failed to interpolate affinity_key: %w", err)
+		}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], m)
+	}
+	for _, key := range keys {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		hash := h.Sum64()
+		err := p.retryWriteBatch(ctx, groups[key], func(ctx context.Context) (*python.InterpreterTicket, error) {
+			return pinner.AcquireFor(ctx, hash)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retryWriteBatch calls our Python function with the batch in an interpreter
+// from acquire, retrying with back off if it fails with a retryable error.
+func (p *pythonOutput) retryWriteBatch(ctx context.Context, batch service.MessageBatch,
+	acquire func(context.Context) (*python.InterpreterTicket, error)) error {
+	boff := *p.backoff
+	boff.Reset()
+
+	var lastErr error
+	for attempts := 1; ; attempts++ {
+		err := p.tryWriteBatch(ctx, batch, acquire, attempts, lastErr)
+		var werr *writeError
+		if !errors.As(err, &werr) {
+			return err
+		}
+		lastErr = werr
+
+		switch werr.kind {
+		case reject:
+			// Drop it on purpose, letting our dead-letter function see it.
+			werr.logger(p.logger).Warnf("Dropping rejected batch: %s", werr)
+			if p.failedFn != "" {
+				_ = p.callFailed(ctx, batch, werr, attempts)
+			}
+			return nil
+		case fatal:
+			// Don't retry, but don't lose it either unless our dead-letter
+			// function took care of it.
+			if p.failedFn != "" && p.callFailed(ctx, batch, werr, attempts) == nil {
+				return nil
+			}
+			werr.logger(p.logger).Errorf("Failed to write batch: %s", werr)
+			return werr
+		case retryable:
+			wait := boff.NextBackOff()
+			if wait == backoff.Stop {
+				if p.failedFn != "" && p.callFailed(ctx, batch, werr, attempts) == nil {
+					return nil
+				}
+				werr.logger(p.logger).Errorf("Giving up on batch: %s", werr)
+				return werr
+			}
+			werr.logger(p.logger).Debugf("Retrying batch in %s: %s", wait, werr)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		default:
+			werr.logger(p.logger).Errorf("Failed to write batch: %s", werr)
+			return werr
+		}
+	}
+}
+
+// callFailed hands each message of a batch we gave up on to our dead-letter
+// function, along with the error and how many attempts we made.
+func (p *pythonOutput) callFailed(ctx context.Context, batch service.MessageBatch, werr *writeError, attempts int) error {
+	ticket, err := p.runtime.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = p.runtime.Release(ticket) }()
+
+	i, ok := p.stateFor(ticket)
+	if !ok {
+		return service.ErrNotConnected
+	}
+
+	err = p.runtime.Apply(ticket, ctx, func() error {
+		for _, m := range batch {
+			args := py.PyTuple_New(3)
+			if args == py.NullPyObjectPtr {
+				return errors.New("failed to create python tuple")
+			}
+			obj, err := p.messageToPython(i, m)
+			if err != nil {
+				py.Py_DecRef(args)
+				return err
+			}
+			// Tuples steal our references.
+			py.PyTuple_SetItem(args, 0, obj)
+			py.PyTuple_SetItem(args, 1, py.PyUnicode_FromString(werr.Error()))
+			py.PyTuple_SetItem(args, 2, py.PyLong_FromLong(int64(attempts)))
+
+			result := py.PyObject_Call(i.failed, args, py.NullPyObjectPtr)
+			py.Py_DecRef(args)
+			if result == py.NullPyObjectPtr {
+				py.PyErr_Print()
+				return fmt.Errorf("python function '%s' failed", p.failedFn)
+			}
+			py.Py_DecRef(result)
+		}
+		return nil
+	})
+	if err != nil {
+		p.logger.Errorf("Failed to handle failed batch: %s", err)
+	}
+	return err
+}
+
+// tryWriteBatch converts the batch into a Python list and calls our Python
+// function with it, returning a writeError if the function raised. The
+// attempt, starting from 1, and why the previous one failed are passed along
+// to the function if it takes them.
+//
+// Each call acquires its own interpreter with acquire, so concurrent writes
+// don't wait on each other unless they share one.
+func (p *pythonOutput) tryWriteBatch(ctx context.Context, batch service.MessageBatch,
+	acquire func(context.Context) (*python.InterpreterTicket, error), attempt int, lastErr error) error {
+	if !p.connected.Load() {
+		if !p.lazy {
+			return service.ErrNotConnected
+		}
+		if err := p.connect(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Skip anything we already delivered, if we're deduplicating, before
+	// holding an interpreter.
+	var fingerprints []string
+	if p.dedupeCache != "" {
+		var err error
+		batch, fingerprints, err = p.dedupeBatch(ctx, batch)
+		if err != nil || len(batch) == 0 {
+			return err
+		}
+	}
+
+	ticket, err := acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Look up our previously initialized interpreter state. It's gone if we
+	// were torn down while waiting.
+	i, ok := p.stateFor(ticket)
+	if !ok {
+		_ = p.runtime.Release(ticket)
+		return service.ErrNotConnected
+	}
+
+	var keys []string // Dedupe keys of the batch, if we're deduplicating.
+	spans := p.startSpans(batch)
+	err = p.runtime.Apply(ticket, ctx, func() error {
+		// Start a transaction, if we're using them.
+		if i.begin != py.NullPyObjectPtr {
+			result := i.callNoArgs(i.begin)
+			if result == py.NullPyObjectPtr {
+				python.StashException()
+				return p.classifyError(i, p.beginFn)
+			}
+			py.Py_DecRef(result)
+		}
+
+		var err error
+		if i.route != py.NullPyObjectPtr {
+			keys, err = p.writeRouted(i, batch, attempt, lastErr)
+		} else {
+			keys, err = p.writeList(i, batch, attempt, lastErr)
+		}
+
+		if err == nil && i.commit != py.NullPyObjectPtr {
+			result := i.callNoArgs(i.commit)
+			if result == py.NullPyObjectPtr {
+				python.StashException()
+				err = p.classifyError(i, p.commitFn)
+			}
+			py.Py_DecRef(result)
+		}
+
+		// Roll back on any failure, after classifying it.
+		if err != nil && i.abort != py.NullPyObjectPtr {
+			result := i.callNoArgs(i.abort)
+			if result == py.NullPyObjectPtr {
+				py.PyErr_Print()
+				p.logger.Warnf("Python function '%s' failed.", p.abortFn)
+			}
+			py.Py_DecRef(result)
+		}
+		return err
+	})
+	_ = p.runtime.Release(ticket)
+
+	var exception string
+	var werr *writeError
+	if errors.As(err, &werr) {
+		if werr.exception != nil {
+			exception = werr.exception.Error()
+		}
+	}
+	for _, span := range spans {
+		python.EndSpan(span, exception, err)
+	}
+
+	if errors.Is(err, python.ErrInterpreterUnusable) {
+		// Tear down our runtime so it's rebuilt when we're reconnected.
+		p.logger.Errorf("Disconnecting after Python failure: %s", err)
+		_ = p.disconnect(ctx)
+		return service.ErrNotConnected
+	}
+	if err == nil && keys != nil {
+		p.recordDelivered(ctx, fingerprints, keys)
+	}
 	return err
 }
 
+// stateFor looks up the state of the ticket's interpreter, which is missing
+// if we're not connected.
+func (p *pythonOutput) stateFor(ticket *python.InterpreterTicket) (*interpreter, bool) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	i, ok := p.interpreters[ticket.Id()]
+	return i, ok
+}
+
+// startSpans starts a span around writing each traced message of batch, as a
+// child of the message's span.
+func (p *pythonOutput) startSpans(batch service.MessageBatch) []trace.Span {
+	var spans []trace.Span
+	for _, m := range batch {
+		parent := trace.SpanFromContext(m.Context())
+		if !parent.SpanContext().IsValid() {
+			continue
+		}
+		_, span := parent.TracerProvider().Tracer(python.TracerName).
+			Start(m.Context(), "python.write", trace.WithAttributes(p.spanAttributes...))
+		spans = append(spans, span)
+	}
+	return spans
+}
+
+// writeList calls our Python function with the batch as a list, returning
+// the dedupe keys it gave for the messages if we're deduplicating.
+//
+// The caller must manage the interpreter state for this to succeed.
+func (p *pythonOutput) writeList(i *interpreter, batch service.MessageBatch, attempt int, lastErr error) ([]string, error) {
+	list := py.PyObject_CallNoArgs(i.listType)
+	if list == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return nil, errors.New("failed to create python list")
+	}
+	defer py.Py_DecRef(list)
+
+	for _, m := range batch {
+		obj, err := p.messageToPython(i, m)
+		if err != nil {
+			return nil, err
+		}
+		// Lists take their own reference.
+		rc := py.PyList_Append(list, obj)
+		py.Py_DecRef(obj)
+		if rc != 0 {
+			py.PyErr_Print()
+			return nil, errors.New("failed to append to python list")
+		}
+	}
+
+	result, err := i.callWriter(i.writeBatch, list, attempt, lastErr)
+	if err != nil {
+		return nil, err
+	}
+	if result == py.NullPyObjectPtr {
+		python.StashException()
+		return nil, p.classifyError(i, p.function)
+	}
+	defer py.Py_DecRef(result)
+	return p.writtenKeys(result, len(batch), p.function), nil
+}
+
+// writtenKeys returns the dedupe keys a write function returned for n
+// messages, if we're deduplicating. The messages were written regardless, so
+// a bad result only costs us recording them.
+//
+// The caller must manage the interpreter state for this to succeed.
+func (p *pythonOutput) writtenKeys(result py.PyObjectPtr, n int, fn string) []string {
+	if p.dedupeCache == "" {
+		return nil
+	}
+	keys, err := dedupeKeys(result, n, fn)
+	if err != nil {
+		p.logger.Warnf("Not recording written messages: %s", err)
+		return nil
+	}
+	return keys
+}
+
+// writeRouted asks our route function for the destination of each message in
+// the batch and writes each group of messages with the writer for its
+// destination, returning the dedupe keys the writers gave for the messages if
+// we're deduplicating.
+//
+// The caller must manage the interpreter state for this to succeed.
+func (p *pythonOutput) writeRouted(i *interpreter, batch service.MessageBatch, attempt int, lastErr error) ([]string, error) {
+	var destinations []string
+	groups := make(map[string]py.PyObjectPtr)
+	members := make(map[string][]int) // Indices of each group's messages.
+	defer func() {
+		for _, list := range groups {
+			py.Py_DecRef(list)
+		}
+	}()
+
+	for idx, m := range batch {
+		obj, err := p.messageToPython(i, m)
+		if err != nil {
+			return nil, err
+		}
+
+		result := py.PyObject_CallOneArg(i.route, obj)
+		if result == py.NullPyObjectPtr {
+			python.StashException()
+			py.Py_DecRef(obj)
+			return nil, p.classifyError(i, p.routeFn)
+		}
+		destination, err := python.UnicodeToString(result)
+		py.Py_DecRef(result)
+		if err != nil {
+			py.Py_DecRef(obj)
+			return nil, fmt.Errorf("python function '%s' must return a string", p.routeFn)
+		}
+
+		list, ok := groups[destination]
+		if !ok {
+			list = py.PyObject_CallNoArgs(i.listType)
+			if list == py.NullPyObjectPtr {
+				py.PyErr_Print()
+				py.Py_DecRef(obj)
+				return nil, errors.New("failed to create python list")
+			}
+			groups[destination] = list
+			destinations = append(destinations, destination)
+		}
+
+		// Lists take their own reference.
+		rc := py.PyList_Append(list, obj)
+		py.Py_DecRef(obj)
+		if rc != 0 {
+			py.PyErr_Print()
+			return nil, errors.New("failed to append to python list")
+		}
+		members[destination] = append(members[destination], idx)
+	}
+
+	var keys []string
+	if p.dedupeCache != "" {
+		keys = make([]string, len(batch))
+	}
+	for _, destination := range destinations {
+		writer, err := p.writerFor(i, destination)
+		if err != nil {
+			return nil, err
+		}
+		result, err := i.callWriter(writer, groups[destination], attempt, lastErr)
+		if err != nil {
+			return nil, err
+		}
+		if result == py.NullPyObjectPtr {
+			python.StashException()
+			werr := p.classifyError(i, p.openFn)
+			werr.destination = destination
+			return nil, werr
+		}
+		written := p.writtenKeys(result, len(members[destination]), p.openFn)
+		py.Py_DecRef(result)
+		for n, key := range written {
+			keys[members[destination][n]] = key
+		}
+	}
+	return keys, nil
+}
+
+// callWriter calls fn with a list of messages, passing along the delivery
+// attempt and why the previous one failed if it takes them. Returns a new
+// reference to the result, or NULL if fn raised.
+//
+// The caller must manage the interpreter state for this to succeed.
+func (i *interpreter) callWriter(fn, list py.PyObjectPtr, attempt int, lastErr error) (py.PyObjectPtr, error) {
+	args := py.PyTuple_New(4)
+	if args == py.NullPyObjectPtr {
+		return py.NullPyObjectPtr, errors.New("failed to create python tuple")
+	}
+	defer py.Py_DecRef(args)
+
+	lastError := python.NewNone()
+	if lastErr != nil {
+		str := py.PyUnicode_FromString(lastErr.Error())
+		if str == py.NullPyObjectPtr {
+			py.PyErr_Clear()
+			py.Py_DecRef(lastError)
+			return py.NullPyObjectPtr, errors.New("failed to convert error to a python string")
+		}
+		py.Py_DecRef(lastError)
+		lastError = str
+	}
+
+	// Tuples steal our references.
+	py.Py_IncRef(fn)
+	py.PyTuple_SetItem(args, 0, fn)
+	py.Py_IncRef(list)
+	py.PyTuple_SetItem(args, 1, list)
+	py.PyTuple_SetItem(args, 2, py.PyLong_FromLong(int64(attempt)))
+	py.PyTuple_SetItem(args, 3, lastError)
+	return py.PyObject_Call(i.write, args, py.NullPyObjectPtr), nil
+}
+
+// writerFor returns a borrowed reference to the writer for the destination,
+// opening a new one if we haven't seen the destination before.
+//
+// The caller must manage the interpreter state for this to succeed.
+func (p *pythonOutput) writerFor(i *interpreter, destination string) (py.PyObjectPtr, error) {
+	writer, ok := i.writers[destination]
+	if ok {
+		return writer, nil
+	}
+
+	str := py.PyUnicode_FromString(destination)
+	if str == py.NullPyObjectPtr {
+		py.PyErr_Clear()
+		return py.NullPyObjectPtr, errors.New("failed to convert destination to a python string")
+	}
+	defer py.Py_DecRef(str)
+
+	writer = py.PyObject_CallOneArg(i.open, str)
+	if writer == py.NullPyObjectPtr {
+		python.StashException()
+		werr := p.classifyError(i, p.openFn)
+		werr.destination = destination
+		return py.NullPyObjectPtr, werr
+	}
+	i.writers[destination] = writer
+	p.logger.Debugf("Opened writer for destination '%s'.", destination)
+	return writer, nil
+}
+
+// messageToPython converts a message into a new reference to a Python
+// object, pairing it with its metadata if configured to.
+func (p *pythonOutput) messageToPython(i *interpreter, m *service.Message) (py.PyObjectPtr, error) {
+	obj, err := p.toPython(i, m)
+	if err != nil {
+		return py.NullPyObjectPtr, err
+	}
+	if p.withMetadata {
+		return python.WithMetadata(obj, m)
+	}
+	return obj, nil
+}
+
+// classifyError classifies the last exception raised by our Python function.
+// Must be called after python.StashException.
+func (p *pythonOutput) classifyError(i *interpreter, function string) *writeError {
+	kind, exc := python.ClassifyException(i.classify, strings.Join(p.retryOn, ","))
+	return &writeError{function: function, kind: errorKind(kind), exception: exc}
+}
+
+// toPython converts a message into a new reference to a Python object based
+// on our serializer mode.
+func (p *pythonOutput) toPython(i *interpreter, m *service.Message) (py.PyObjectPtr, error) {
+	if p.serializerMode == python.None {
+		mode, ok := m.MetaGetMut(python.SerializerMetaKey)
+		if ok && mode.(python.SerializerMode) == python.None {
+			obj, err := m.AsStructured()
+			if err != nil {
+				return py.NullPyObjectPtr, err
+			}
+			py.Py_IncRef(obj.(py.PyObjectPtr))
+			return obj.(py.PyObjectPtr), nil
+		}
+	}
+
+	data, err := m.AsBytes()
+	if err != nil {
+		return py.NullPyObjectPtr, err
+	}
+	if p.serializerMode == python.Pickle {
+		return i.serializer.Unpickle(data)
+	}
+	if p.serializerMode == python.CBOR {
+		return i.serializer.FromCBOR(data)
+	}
+	if p.serializerMode == python.BSON {
+		return i.serializer.FromBSON(data)
+	}
+
+	bytes := py.PyBytes_FromStringAndSize(unsafe.SliceData(data), int64(len(data)))
+	if bytes == py.NullPyObjectPtr {
+		return py.NullPyObjectPtr, errors.New("failed to create python bytes")
+	}
+	return bytes, nil
+}
+
 func (p *pythonOutput) Close(ctx context.Context) error {
-	return p.processor.Close(ctx)
+	if p.processor != nil {
+		return p.processor.Close(ctx)
+	}
+
+	if !p.connected.Load() {
+		// Already torn down.
+		return nil
+	}
+	// Tear down even if flushing failed, so our interpreters don't outlive us.
+	flushErr := p.flushAll(ctx)
+	return errors.Join(flushErr, p.disconnect(ctx))
+}
+
+// disconnect lets our script clean up before stopping our runtime. Only the
+// first of any concurrent callers does so.
+func (p *pythonOutput) disconnect(ctx context.Context) error {
+	if !p.connected.CompareAndSwap(true, false) {
+		return nil
+	}
+
+	// An interpreter may still be busy, e.g. with a flush that timed out, so
+	// don't wait on it forever to clean up.
+	mapCtx, cancel := context.WithTimeout(ctx, p.shutdownTimeout)
+	defer cancel()
+	_ = p.runtime.Map(mapCtx, func(ticket *python.InterpreterTicket) error {
+		p.mtx.Lock()
+		i, ok := p.interpreters[ticket.Id()]
+		delete(p.interpreters, ticket.Id())
+		p.mtx.Unlock()
+		if !ok {
+			return nil
+		}
+
+		// Let the script clean up, if it wants.
+		if i.close != py.NullPyObjectPtr {
+			result := i.callNoArgs(i.close)
+			if result == py.NullPyObjectPtr {
+				py.PyErr_Print()
+				p.logger.Warnf("Python function '%s' failed.", p.closeFn)
+			}
+			py.Py_DecRef(result)
+		}
+
+		// Close any writers we opened for routed destinations.
+		for destination, writer := range i.writers {
+			closer := py.PyObject_GetAttrString(writer, "close")
+			if closer == py.NullPyObjectPtr {
+				// Not every writer needs closing.
+				py.PyErr_Clear()
+			} else {
+				result := py.PyObject_CallNoArgs(closer)
+				if result == py.NullPyObjectPtr {
+					py.PyErr_Print()
+					p.logger.Warnf("Failed to close writer for destination '%s'.", destination)
+				}
+				py.Py_DecRef(result)
+				py.Py_DecRef(closer)
+			}
+			py.Py_DecRef(writer)
+		}
+		clear(i.writers)
+
+		// Py_DecRef is fine being passed NULL.
+		py.Py_DecRef(i.close)
+		py.Py_DecRef(i.flush)
+		py.Py_DecRef(i.failed)
+		py.Py_DecRef(i.begin)
+		py.Py_DecRef(i.commit)
+		py.Py_DecRef(i.abort)
+		py.Py_DecRef(i.route)
+		py.Py_DecRef(i.open)
+		py.Py_DecRef(i.writeBatch)
+		py.Py_DecRef(i.listType)
+		py.Py_DecRef(i.classify)
+		py.Py_DecRef(i.resolve)
+		py.Py_DecRef(i.write)
+		if i.serializer != nil {
+			i.serializer.DecRef()
+		}
+		return nil
+	})
+
+	// Stop our runtime even if our caller gave up, interrupting it if needed.
+	return python.StopWithDeadline(context.WithoutCancel(ctx), p.runtime, p.shutdownTimeout, p.logger)
+}
+
+// flushAll calls our flush function in each interpreter, waiting up to our
+// flush timeout for them to finish.
+func (p *pythonOutput) flushAll(ctx context.Context) error {
+	if p.flushFn == "" {
+		return nil
+	}
+
+	// We can't interrupt Python once it's running, so wait on it separately
+	// and don't let our context cancel it part way through.
+	done := make(chan error, 1)
+	go func() {
+		done <- p.runtime.Map(context.WithoutCancel(ctx), func(ticket *python.InterpreterTicket) error {
+			i, ok := p.stateFor(ticket)
+			if !ok || i.flush == py.NullPyObjectPtr {
+				return nil
+			}
+			result := i.callNoArgs(i.flush)
+			if result == py.NullPyObjectPtr {
+				py.PyErr_Print()
+				p.logger.Errorf("Python function '%s' failed, buffered writes may be lost.", p.flushFn)
+				return nil
+			}
+			py.Py_DecRef(result)
+			return nil
+		})
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(p.flushTimeout):
+		// The interpreter is still busy, so we can't safely tear it down.
+		return fmt.Errorf("python function '%s' did not finish within %s", p.flushFn, p.flushTimeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
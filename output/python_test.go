@@ -0,0 +1,1110 @@
+package output
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/redpanda-data/benthos/v4/public/service"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+	"github.com/voutilad/rp-connect-python/processor"
+	"golang.org/x/net/context"
+)
+
+// prelude gives test scripts a record() function appending a line to the
+// file named by the LOG environment variable, so tests can see what Python
+// was called with.
+const prelude = `
+import os
+
+def record(*args):
+    with open(os.environ["LOG"], "a") as f:
+        f.write(" ".join(str(a) for a in args) + "\n")
+
+`
+
+// newTestOutput creates a python output calling function, defined by script,
+// in a single interpreter of the global mode. Returns the output and the path
+// of the file record() appends to.
+func newTestOutput(t *testing.T, script, function string) (*pythonOutput, string) {
+	t.Helper()
+	return newPooledTestOutput(t, script, function, python.Global, 1)
+}
+
+// newPooledTestOutput is like newTestOutput, but with cnt interpreters of the
+// given mode.
+func newPooledTestOutput(t *testing.T, script, function string, mode python.Mode, cnt int) (*pythonOutput, string) {
+	t.Helper()
+	o, err := newFunctionOutput("python3", prelude+script, function, mode, "",
+		python.Bloblang, cnt, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := filepath.Join(t.TempDir(), "log")
+	o.environment = map[string]string{"LOG": log}
+	o.mgr = service.MockResources()
+	o.asyncConcurrency = 16
+	o.flushTimeout = 5 * time.Second
+	o.shutdownTimeout = 5 * time.Second
+	o.backoff = backoff.NewExponentialBackOff()
+	o.backoff.InitialInterval = time.Millisecond
+	o.backoff.MaxInterval = time.Millisecond
+	o.backoff.MaxElapsedTime = time.Second
+	return o, log
+}
+
+// readLog returns the lines record() appended to log.
+func readLog(t *testing.T, log string) []string {
+	t.Helper()
+	data, err := os.ReadFile(log)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// newBatch creates a batch with a message per payload.
+func newBatch(payloads ...string) service.MessageBatch {
+	batch := service.MessageBatch{}
+	for _, payload := range payloads {
+		batch = append(batch, service.NewMessage([]byte(payload)))
+	}
+	return batch
+}
+
+func TestWriteBatchCallsFunction(t *testing.T) {
+	o, log := newTestOutput(t, `
+def write_batch(messages):
+    record("write", *[m.decode() for m in messages])
+`, "write_batch")
+	ctx := context.Background()
+	if err := o.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = o.Close(ctx) }()
+
+	if err := o.WriteBatch(ctx, newBatch("a", "b", "c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.WriteBatch(ctx, newBatch("d")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"write a b c", "write d"}
+	if lines := readLog(t, log); !slices.Equal(lines, expected) {
+		t.Fatalf("expected %q, got %q", expected, lines)
+	}
+}
+
+func TestRetryWriteBatch(t *testing.T) {
+	failed := `
+def on_failed(message, error, attempts):
+    record("failed", message.decode(), attempts)
+`
+	tests := []struct {
+		name     string
+		raise    string   // Python statement run by each attempt.
+		retryOn  []string // Extra exception types to retry.
+		failedFn string   // Dead-letter function, if any.
+		kind     *errorKind
+		writes   int  // Expected number of attempts, or 0 if retrying until we give up.
+		failed   bool // Whether the dead-letter function should see the batch.
+	}{
+		{
+			name:   "retryable error retries",
+			raise:  `if attempts < 3: raise rpcn.RetryableError("busy")`,
+			writes: 3,
+		},
+		{
+			name:    "retry_on retries subclasses",
+			raise:   `if attempts < 2: raise ConnectionResetError("reset")`,
+			retryOn: []string{"ConnectionError"},
+			writes:  2,
+		},
+		{
+			name:   "unclassified error fails",
+			raise:  `raise ValueError("bad")`,
+			kind:   ptr(errorKind("")),
+			writes: 1,
+		},
+		{
+			name:   "fatal error fails without retrying",
+			raise:  `raise rpcn.FatalError("nope")`,
+			kind:   ptr(fatal),
+			writes: 1,
+		},
+		{
+			name:     "fatal error goes to the dead-letter function",
+			raise:    `raise rpcn.FatalError("nope")`,
+			failedFn: "on_failed",
+			writes:   1,
+			failed:   true,
+		},
+		{
+			name:   "rejected batch is dropped",
+			raise:  `raise rpcn.RejectError("invalid")`,
+			writes: 1,
+		},
+		{
+			name:     "rejected batch goes to the dead-letter function",
+			raise:    `raise rpcn.RejectError("invalid")`,
+			failedFn: "on_failed",
+			writes:   1,
+			failed:   true,
+		},
+		{
+			name:  "giving up on retries fails",
+			raise: `raise rpcn.RetryableError("down")`,
+			kind:  ptr(retryable),
+		},
+		{
+			name:     "giving up on retries goes to the dead-letter function",
+			raise:    `raise rpcn.RetryableError("down")`,
+			failedFn: "on_failed",
+			failed:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o, log := newTestOutput(t, fmt.Sprintf(`
+attempts = 0
+
+def write_batch(messages):
+    global attempts
+    attempts += 1
+    record("write", *[m.decode() for m in messages])
+    %s
+%s`, test.raise, failed), "write_batch")
+			o.retryOn = test.retryOn
+			o.failedFn = test.failedFn
+			o.backoff.MaxElapsedTime = 50 * time.Millisecond
+			ctx := context.Background()
+			if err := o.Connect(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = o.Close(ctx) }()
+
+			err := o.WriteBatch(ctx, newBatch("a"))
+			if test.kind == nil {
+				if err != nil {
+					t.Fatalf("expected the batch to be handled, got %s", err)
+				}
+			} else {
+				var werr *writeError
+				if !errors.As(err, &werr) {
+					t.Fatalf("expected a write error, got %v", err)
+				}
+				if werr.kind != *test.kind {
+					t.Fatalf("expected a '%s' error, got '%s'", *test.kind, werr.kind)
+				}
+			}
+
+			lines := readLog(t, log)
+			var writes int
+			for _, line := range lines {
+				if line == "write a" {
+					writes++
+				}
+			}
+			if test.writes > 0 && writes != test.writes {
+				t.Fatalf("expected %d attempts, got %d: %q", test.writes, writes, lines)
+			}
+			if test.writes == 0 && writes < 2 {
+				t.Fatalf("expected retries, got %q", lines)
+			}
+			expected := fmt.Sprintf("failed a %d", writes)
+			if test.failed != slices.Contains(lines, expected) {
+				t.Fatalf("expected dead-letter call %q to be %v, got %q", expected, test.failed, lines)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestConnectAndCloseFunctions(t *testing.T) {
+	o, log := newTestOutput(t, `
+def connect():
+    record("connect")
+
+def write_batch(messages):
+    record("write", *[m.decode() for m in messages])
+
+def close():
+    record("close")
+`, "write_batch")
+	o.connectFn, o.closeFn = "connect", "close"
+	ctx := context.Background()
+
+	if err := o.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if lines := readLog(t, log); !slices.Equal(lines, []string{"connect"}) {
+		t.Fatalf("expected connect to be called on connecting, got %q", lines)
+	}
+	if err := o.WriteBatch(ctx, newBatch("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"connect", "write a", "close"}
+	if lines := readLog(t, log); !slices.Equal(lines, expected) {
+		t.Fatalf("expected %q, got %q", expected, lines)
+	}
+
+	// Writing after closing fails rather than calling into Python.
+	if err := o.WriteBatch(ctx, newBatch("b")); !errors.Is(err, service.ErrNotConnected) {
+		t.Fatalf("expected not connected, got %v", err)
+	}
+}
+
+func TestLazyConnectsOnFirstWrite(t *testing.T) {
+	o, log := newTestOutput(t, `
+def connect():
+    record("connect")
+
+def write_batch(messages):
+    record("write", *[m.decode() for m in messages])
+`, "write_batch")
+	o.connectFn = "connect"
+	o.lazy = true
+	ctx := context.Background()
+
+	if err := o.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if lines := readLog(t, log); lines != nil {
+		t.Fatalf("expected nothing to run before the first write, got %q", lines)
+	}
+	defer func() { _ = o.Close(ctx) }()
+
+	if err := o.WriteBatch(ctx, newBatch("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.WriteBatch(ctx, newBatch("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"connect", "write a", "write b"}
+	if lines := readLog(t, log); !slices.Equal(lines, expected) {
+		t.Fatalf("expected %q, got %q", expected, lines)
+	}
+}
+
+func TestClassifierDecidesErrorKind(t *testing.T) {
+	o, log := newTestOutput(t, `
+@rpcn.classifier
+def classify(exc):
+    if isinstance(exc, KeyError):
+        return "reject"
+    if isinstance(exc, TimeoutError):
+        return "fatal"
+    return None
+
+def write_batch(messages):
+    payload = messages[0].decode()
+    record("write", payload)
+    if payload == "reject":
+        raise KeyError(payload)
+    if payload == "fatal":
+        raise TimeoutError(payload)
+`, "write_batch")
+	// The classifier wins over retry_on.
+	o.retryOn = []string{"TimeoutError"}
+	ctx := context.Background()
+	if err := o.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = o.Close(ctx) }()
+
+	if err := o.WriteBatch(ctx, newBatch("reject")); err != nil {
+		t.Fatalf("expected the rejected batch to be acked, got %s", err)
+	}
+	err := o.WriteBatch(ctx, newBatch("fatal"))
+	var werr *writeError
+	if !errors.As(err, &werr) || werr.kind != fatal {
+		t.Fatalf("expected a fatal error, got %v", err)
+	}
+
+	expected := []string{"write reject", "write fatal"}
+	if lines := readLog(t, log); !slices.Equal(lines, expected) {
+		t.Fatalf("expected %q, got %q", expected, lines)
+	}
+}
+
+func TestScriptOutputNeverAcksFatalErrors(t *testing.T) {
+	p, err := processor.NewPythonProcessor(processor.Config{
+		Exe: "python3",
+		Script: `
+if content() == b"fatal":
+    raise rpcn.FatalError("nope")
+if content() == b"reject":
+    raise rpcn.RejectError("invalid")
+`,
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &pythonOutput{processor: p}
+	ctx := context.Background()
+	if err = o.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = o.Close(ctx) }()
+
+	if err = o.WriteBatch(ctx, newBatch("ok", "reject")); err != nil {
+		t.Fatalf("expected rejected messages to be acked, got %s", err)
+	}
+	if err = o.WriteBatch(ctx, newBatch("ok", "fatal")); err == nil {
+		t.Fatal("expected a batch with a fatal error not to be acked")
+	}
+}
+
+func TestConcurrentWritesUseTheirOwnInterpreters(t *testing.T) {
+	dir := t.TempDir()
+	o, log := newPooledTestOutput(t, fmt.Sprintf(`
+import time
+
+def write_batch(messages):
+    payload = messages[0].decode()
+    open(os.path.join(%q, payload), "w").close()
+    # Wait for the other write, which can only arrive if we're not blocking it.
+    other = "b" if payload == "a" else "a"
+    deadline = time.monotonic() + 5
+    while not os.path.exists(os.path.join(%q, other)):
+        if time.monotonic() > deadline:
+            raise rpcn.FatalError("writes were not concurrent")
+        time.sleep(0.01)
+    record("write", payload)
+`, dir, dir), "write_batch", python.Isolated, 2)
+	ctx := context.Background()
+	if err := o.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = o.Close(ctx) }()
+
+	errs := make(chan error, 2)
+	for _, payload := range []string{"a", "b"} {
+		go func() {
+			errs <- o.WriteBatch(ctx, newBatch(payload))
+		}()
+	}
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lines := readLog(t, log)
+	slices.Sort(lines)
+	if expected := []string{"write a", "write b"}; !slices.Equal(lines, expected) {
+		t.Fatalf("expected %q, got %q", expected, lines)
+	}
+}
+
+func TestWithMetadata(t *testing.T) {
+	o, log := newTestOutput(t, `
+def write_batch(messages):
+    for content, meta in messages:
+        record("write", content.decode(), meta["topic"])
+`, "write_batch")
+	o.withMetadata = true
+	ctx := context.Background()
+	if err := o.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = o.Close(ctx) }()
+
+	batch := newBatch("a", "b")
+	batch[0].MetaSetMut("topic", "orders")
+	batch[1].MetaSetMut("topic", "refunds")
+	if err := o.WriteBatch(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"write a orders", "write b refunds"}
+	if lines := readLog(t, log); !slices.Equal(lines, expected) {
+		t.Fatalf("expected %q, got %q", expected, lines)
+	}
+}
+
+func TestRoutedWriters(t *testing.T) {
+	o, log := newTestOutput(t, `
+class Writer:
+    def __init__(self, destination):
+        record("open", destination)
+        self.destination = destination
+
+    def __call__(self, messages):
+        if self.destination == "broken":
+            raise rpcn.FatalError("broken")
+        record("write", self.destination, *[m.decode() for m in messages])
+
+    def close(self):
+        record("close", self.destination)
+
+def route(message):
+    return message.decode().split(":")[0]
+`, "")
+	o.routeFn, o.openFn = "route", "Writer"
+	ctx := context.Background()
+	if err := o.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages are grouped by destination, each writer opened once.
+	if err := o.WriteBatch(ctx, newBatch("x:1", "y:2", "x:3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.WriteBatch(ctx, newBatch("y:4")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failing writer names its destination.
+	err := o.WriteBatch(ctx, newBatch("broken:5"))
+	var werr *writeError
+	if !errors.As(err, &werr) || werr.kind != fatal || werr.destination != "broken" {
+		t.Fatalf("expected a fatal error for destination 'broken', got %v", err)
+	}
+
+	if err = o.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	lines := readLog(t, log)
+	expected := []string{"open x", "write x x:1 x:3", "open y", "write y y:2", "write y y:4", "open broken"}
+	if !slices.Equal(lines[:len(expected)], expected) {
+		t.Fatalf("expected %q, got %q", expected, lines)
+	}
+	// Writers are all closed, in no particular order.
+	closed := lines[len(expected):]
+	slices.Sort(closed)
+	if expected := []string{"close broken", "close x", "close y"}; !slices.Equal(closed, expected) {
+		t.Fatalf("expected %q, got %q", expected, closed)
+	}
+}
+
+// pyarrowStub is just enough of pyarrow for rpcn.ParquetWriter, writing each
+// table as a line of JSON instead of a Parquet row group.
+var pyarrowStub = map[string]string{
+	"pyarrow/__init__.py": `
+import json
+
+class Table:
+    def __init__(self, rows, schema):
+        self.rows, self.schema = rows, schema
+        self.num_rows = len(rows)
+        self.nbytes = len(json.dumps(rows))
+
+    @staticmethod
+    def from_pylist(rows, schema=None):
+        return Table(rows, schema or sorted(rows[0]))
+`,
+	"pyarrow/parquet.py": `
+import json
+
+class ParquetWriter:
+    def __init__(self, where, schema, compression=None):
+        self.schema = schema
+        self.file = open(where, "w")
+
+    def write_table(self, table):
+        self.file.write(json.dumps(table.rows) + "\n")
+
+    def close(self):
+        self.file.close()
+`,
+}
+
+func TestParquetWriterRotates(t *testing.T) {
+	stubs := t.TempDir()
+	for name, src := range pyarrowStub {
+		if err := os.MkdirAll(filepath.Join(stubs, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(stubs, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := t.TempDir()
+
+	o, _ := newTestOutput(t, fmt.Sprintf(`
+def route(message):
+    return "events"
+
+def open_writer(destination):
+    return rpcn.ParquetWriter(os.path.join(%q, destination), max_rows=3)
+`, out), "")
+	o.routeFn, o.openFn = "route", "open_writer"
+	o.path = []string{stubs}
+	ctx := context.Background()
+	if err := o.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second batch takes the first file past max_rows, finishing it.
+	for _, batch := range []service.MessageBatch{
+		newBatch(`{"n": 1}`, `{"n": 2}`),
+		newBatch(`{"n": 3}`, `{"n": 4}`),
+		newBatch(`{"n": 5}`),
+	} {
+		if err := o.WriteBatch(ctx, batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := filepath.Join(out, "events")
+	finished, _ := filepath.Glob(filepath.Join(dir, "*.parquet"))
+	partial, _ := filepath.Glob(filepath.Join(dir, "*.parquet.tmp"))
+	if len(finished) != 1 || len(partial) != 1 {
+		t.Fatalf("expected 1 finished and 1 partial file, got %q and %q", finished, partial)
+	}
+
+	// Closing the output closes the writer, moving the last file into place.
+	if err := o.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	partial, _ = filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if len(partial) != 0 {
+		t.Fatalf("expected no partial files, got %q", partial)
+	}
+	finished, _ = filepath.Glob(filepath.Join(dir, "*.parquet"))
+	slices.Sort(finished)
+	var contents []string
+	for _, name := range finished {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(data))
+	}
+	expected := []string{
+		"[{\"n\": 1}, {\"n\": 2}]\n[{\"n\": 3}, {\"n\": 4}]\n",
+		"[{\"n\": 5}]\n",
+	}
+	if !slices.Equal(contents, expected) {
+		t.Fatalf("expected %q, got %q", expected, contents)
+	}
+}
+
+func TestFlushBeforeClose(t *testing.T) {
+	o, log := newTestOutput(t, `
+buffered = []
+
+def write_batch(messages):
+    buffered.extend(m.decode() for m in messages)
+
+def flush():
+    record("flush", *buffered)
+    buffered.clear()
+
+def close():
+    record("close", *buffered)
+`, "write_batch")
+	o.flushFn, o.closeFn = "flush", "close"
+	ctx := context.Background()
+	if err := o.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.WriteBatch(ctx, newBatch("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"flush a b", "close"}
+	if lines := readLog(t, log); !slices.Equal(lines, expected) {
+		t.Fatalf("expected %q, got %q", expected, lines)
+	}
+}
+
+func TestFlushTimeoutStillCloses(t *testing.T) {
+	o, log := newTestOutput(t, `
+import time
+
+def write_batch(messages):
+    pass
+
+def flush():
+    time.sleep(0.5)
+    record("flush")
+
+def close():
+    record("close")
+`, "write_batch")
+	o.flushFn, o.closeFn = "flush", "close"
+	o.flushTimeout = 50 * time.Millisecond
+	ctx := context.Background()
+	if err := o.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.Close(ctx); err == nil || !strings.Contains(err.Error(), "did not finish") {
+		t.Fatalf("expected the flush to time out, got %v", err)
+	}
+	if o.connected.Load() {
+		t.Fatal("expected the output to be disconnected")
+	}
+	// We still let the script clean up once the flush was done with the
+	// interpreter.
+	expected := []string{"flush", "close"}
+	if lines := readLog(t, log); !slices.Equal(lines, expected) {
+		t.Fatalf("expected %q, got %q", expected, lines)
+	}
+}
+
+func TestCloseWaitsForWritesInFlight(t *testing.T) {
+	started := filepath.Join(t.TempDir(), "started")
+	o, log := newPooledTestOutput(t, fmt.Sprintf(`
+import time
+
+buffered = []
+
+def write_batch(messages):
+    open(%q, "w").close()
+    time.sleep(0.5)
+    buffered.extend(m.decode() for m in messages)
+    record("write", *buffered)
+
+def flush():
+    record("flush", *buffered)
+    buffered.clear()
+
+def close():
+    record("close")
+`, started), "write_batch", python.Isolated, 2)
+	o.flushFn, o.closeFn = "flush", "close"
+	ctx := context.Background()
+	if err := o.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		written <- o.WriteBatch(ctx, newBatch("a"))
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(started); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("write never started")
+		}
+	}
+
+	if err := o.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	// The busy interpreter is flushed and closed too, once it's written.
+	lines := readLog(t, log)
+	slices.Sort(lines)
+	if expected := []string{"close", "close", "flush", "flush a", "write a"}; !slices.Equal(lines, expected) {
+		t.Fatalf("expected %q, got %q", expected, lines)
+	}
+}
+
+func TestDeadLetterFunction(t *testing.T) {
+	o, log := newTestOutput(t, `
+def write_batch(messages):
+    payload = messages[0].decode()
+    if payload.startswith("reject"):
+        raise rpcn.RejectError("unwanted")
+    raise rpcn.FatalError("disk full")
+
+def on_failed(message, error, attempts):
+    record("failed", message.decode(), attempts, error)
+    if message.decode().endswith("!"):
+        raise IOError("dead-letter queue is down")
+`, "write_batch")
+	o.failedFn = "on_failed"
+	ctx := context.Background()
+	if err := o.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = o.Close(ctx) }()
+
+	// Handling every message of the batch acks it.
+	if err := o.WriteBatch(ctx, newBatch("a", "b")); err != nil {
+		t.Fatalf("expected the dead-letter function to handle the batch, got %s", err)
+	}
+	// Failing to handle it nacks it, with the original error.
+	err := o.WriteBatch(ctx, newBatch("c!"))
+	var werr *writeError
+	if !errors.As(err, &werr) || werr.kind != fatal {
+		t.Fatalf("expected a fatal error, got %v", err)
+	}
+	// A rejected batch is dropped regardless.
+	if err = o.WriteBatch(ctx, newBatch("reject!")); err != nil {
+		t.Fatalf("expected the rejected batch to be acked, got %s", err)
+	}
+
+	const msg = "python function 'write_batch' failed: "
+	expected := []string{
+		"failed a 1 " + msg + "FatalError: disk full",
+		"failed b 1 " + msg + "FatalError: disk full",
+		"failed c! 1 " + msg + "FatalError: disk full",
+		"failed reject! 1 " + msg + "RejectError: unwanted",
+	}
+	if lines := readLog(t, log); !slices.Equal(lines, expected) {
+		t.Fatalf("expected %q, got %q", expected, lines)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	o, log := newTestOutput(t, `
+current = None
+
+def begin():
+    record("begin")
+
+def write_batch(messages):
+    global current
+    current = messages[0].decode()
+    record("write", current)
+    if current == "bad write":
+        raise rpcn.FatalError("bad write")
+
+def commit():
+    record("commit")
+    if current == "bad commit":
+        raise rpcn.RejectError("bad commit")
+
+def abort():
+    record("abort")
+    if current == "bad write":
+        # Classifying must not see this exception instead of the write's.
+        raise RuntimeError("abort failed")
+`, "write_batch")
+	o.beginFn, o.commitFn, o.abortFn = "begin", "commit", "abort"
+	ctx := context.Background()
+	if err := o.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = o.Close(ctx) }()
+
+	tests := []struct {
+		payload  string
+		function string
+		kind     errorKind
+		expected []string
+	}{
+		{
+			payload:  "good",
+			expected: []string{"begin", "write good", "commit"},
+		},
+		{
+			payload:  "bad write",
+			function: "write_batch",
+			kind:     fatal,
+			expected: []string{"begin", "write bad write", "abort"},
+		},
+		{
+			payload:  "bad commit",
+			function: "commit",
+			kind:     reject,
+			expected: []string{"begin", "write bad commit", "commit", "abort"},
+		},
+	}
+	var lines []string
+	for _, test := range tests {
+		t.Run(test.payload, func(t *testing.T) {
+			// Call tryWriteBatch directly so rejected batches still return
+			// their error.
+			err := o.tryWriteBatch(ctx, newBatch(test.payload), o.runtime.Acquire, 1, nil)
+			if test.kind == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				var werr *writeError
+				if !errors.As(err, &werr) {
+					t.Fatalf("expected a write error, got %v", err)
+				}
+				if werr.kind != test.kind || werr.function != test.function {
+					t.Fatalf("expected a '%s' error from '%s', got a '%s' error from '%s'",
+						test.kind, test.function, werr.kind, werr.function)
+				}
+			}
+
+			all := readLog(t, log)
+			if got := all[len(lines):]; !slices.Equal(got, test.expected) {
+				t.Fatalf("expected %q, got %q", test.expected, got)
+			}
+			lines = all
+		})
+	}
+}
+
+func TestAsyncWrite(t *testing.T) {
+	o, log := newTestOutput(t, `
+import asyncio
+
+running = 0
+peak = 0
+
+async def write(message):
+    global running, peak
+    running += 1
+    peak = max(peak, running)
+    await asyncio.sleep(0.01)
+    running -= 1
+    if message == b"bad":
+        raise rpcn.FatalError("bad")
+    record("write", message.decode())
+
+def close():
+    record("peak", peak)
+`, "write")
+	o.closeFn = "close"
+	o.asyncConcurrency = 2
+	ctx := context.Background()
+	if err := o.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.WriteBatch(ctx, newBatch("a", "b", "c", "d")); err != nil {
+		t.Fatal(err)
+	}
+	// Every write finishes before the batch fails.
+	err := o.WriteBatch(ctx, newBatch("bad", "e"))
+	var werr *writeError
+	if !errors.As(err, &werr) || werr.kind != fatal {
+		t.Fatalf("expected a fatal error, got %v", err)
+	}
+	if err = o.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := readLog(t, log)
+	if len(lines) == 0 || lines[len(lines)-1] != "peak 2" {
+		t.Fatalf("expected at most 2 concurrent writes, got %q", lines)
+	}
+	written := lines[:len(lines)-1]
+	slices.Sort(written)
+	expected := []string{"write a", "write b", "write c", "write d", "write e"}
+	if !slices.Equal(written, expected) {
+		t.Fatalf("expected %q, got %q", expected, written)
+	}
+}
+
+func TestAttemptAndLastError(t *testing.T) {
+	o, log := newTestOutput(t, `
+def write_batch(messages, attempt, last_error):
+    record("attempt", attempt, last_error)
+    if attempt < 3:
+        raise rpcn.RetryableError(f"busy {attempt}")
+`, "write_batch")
+	ctx := context.Background()
+	if err := o.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = o.Close(ctx) }()
+
+	if err := o.WriteBatch(ctx, newBatch("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	const msg = "python function 'write_batch' failed: RetryableError: busy "
+	expected := []string{"attempt 1 None", "attempt 2 " + msg + "1", "attempt 3 " + msg + "2"}
+	if lines := readLog(t, log); !slices.Equal(lines, expected) {
+		t.Fatalf("expected %q, got %q", expected, lines)
+	}
+}
+
+func TestWriteWithoutAttemptArguments(t *testing.T) {
+	o, log := newTestOutput(t, `
+def write_batch(messages):
+    record("write", len(messages))
+`, "write_batch")
+	ctx := context.Background()
+	if err := o.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = o.Close(ctx) }()
+
+	// Functions not taking them aren't passed them.
+	if err := o.WriteBatch(ctx, newBatch("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if lines := readLog(t, log); !slices.Equal(lines, []string{"write 2"}) {
+		t.Fatalf("expected a single write, got %q", lines)
+	}
+}
+
+func TestAffinityKeyPinsInterpreters(t *testing.T) {
+	o, log := newPooledTestOutput(t, `
+import uuid
+
+# Each interpreter runs the script, so gets its own id.
+me = uuid.uuid4().hex
+
+def write_batch(messages):
+    for m in messages:
+        record(m.decode(), me)
+`, "write_batch", python.Isolated, 2)
+	key, err := service.NewInterpolatedString(`${! content().string().split(":").index(0) }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.affinityKey = key
+	ctx := context.Background()
+	if err := o.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = o.Close(ctx) }()
+
+	for n := range 5 {
+		batch := newBatch(fmt.Sprintf("x:%d", n), fmt.Sprintf("y:%d", n), fmt.Sprintf("z:%d", n))
+		if err := o.WriteBatch(ctx, batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every message with the same key was written by the same interpreter.
+	interpreters := make(map[string]string)
+	lines := readLog(t, log)
+	if len(lines) != 15 {
+		t.Fatalf("expected 15 writes, got %q", lines)
+	}
+	for _, line := range lines {
+		payload, id, _ := strings.Cut(line, " ")
+		key, _, _ := strings.Cut(payload, ":")
+		if pinned, ok := interpreters[key]; ok && pinned != id {
+			t.Fatalf("expected key '%s' to be written by %s, got %s", key, pinned, id)
+		}
+		interpreters[key] = id
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	o, log := newTestOutput(t, `
+def write_batch(messages):
+    payloads = [m.decode() for m in messages]
+    record("write", *payloads)
+    if payloads == ["bad"]:
+        return "not a list"
+    return [None if p == "again" else p for p in payloads]
+`, "write_batch")
+	o.dedupeCache = "delivered"
+	o.mgr = service.MockResources(service.MockResourcesOptAddCache("delivered"))
+	ctx := context.Background()
+	if err := o.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = o.Close(ctx) }()
+
+	// Repeats within a batch are written once, and messages with a key
+	// aren't written again, unlike those without.
+	for _, batch := range []service.MessageBatch{
+		newBatch("a", "b", "a", "again"),
+		newBatch("a", "c", "again"),
+		newBatch("b"),
+		newBatch("bad"),
+		newBatch("bad"),
+	} {
+		if err := o.WriteBatch(ctx, batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []string{"write a b again", "write c again", "write bad", "write bad"}
+	if lines := readLog(t, log); !slices.Equal(lines, expected) {
+		t.Fatalf("expected %q, got %q", expected, lines)
+	}
+
+	f, err := fingerprint(service.NewMessage([]byte("c")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key []byte
+	var cacheErr error
+	err = o.mgr.AccessCache(ctx, "delivered", func(c service.Cache) {
+		key, cacheErr = c.Get(ctx, f)
+	})
+	if err == nil {
+		err = cacheErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != "c" {
+		t.Fatalf("expected dedupe key 'c', got '%s'", key)
+	}
+}
+
+func TestDedupeWithoutCacheFails(t *testing.T) {
+	o, log := newTestOutput(t, `
+def write_batch(messages):
+    record("write", *[m.decode() for m in messages])
+    return [m.decode() for m in messages]
+`, "write_batch")
+	o.dedupeCache = "missing"
+	ctx := context.Background()
+	if err := o.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = o.Close(ctx) }()
+
+	// Better to retry than risk writing a batch twice.
+	err := o.WriteBatch(ctx, newBatch("a"))
+	if err == nil || !strings.Contains(err.Error(), "failed to check dedupe cache") {
+		t.Fatalf("expected the dedupe cache to fail, got %v", err)
+	}
+	if lines := readLog(t, log); lines != nil {
+		t.Fatalf("expected nothing written, got %q", lines)
+	}
+}
+
+func TestDedupeRoutedWriters(t *testing.T) {
+	o, log := newTestOutput(t, `
+class Writer:
+    def __init__(self, destination):
+        self.destination = destination
+
+    def __call__(self, messages):
+        payloads = [m.decode() for m in messages]
+        record("write", self.destination, *payloads)
+        return payloads
+
+def route(message):
+    return message.decode().split(":")[0]
+`, "")
+	o.routeFn, o.openFn = "route", "Writer"
+	o.dedupeCache = "delivered"
+	o.mgr = service.MockResources(service.MockResourcesOptAddCache("delivered"))
+	ctx := context.Background()
+	if err := o.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = o.Close(ctx) }()
+
+	if err := o.WriteBatch(ctx, newBatch("x:1", "y:1", "x:2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.WriteBatch(ctx, newBatch("y:1", "x:2", "y:2")); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"write x x:1 x:2", "write y y:1", "write y y:2"}
+	if lines := readLog(t, log); !slices.Equal(lines, expected) {
+		t.Fatalf("expected %q, got %q", expected, lines)
+	}
+}
@@ -0,0 +1,83 @@
+package processor
+
+import (
+	"context"
+	"runtime"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+)
+
+// benchBatchSize is how many messages each benchmark operation processes.
+const benchBatchSize = 100
+
+var benchScript = `
+this = content().decode()
+root.text = this[::-1]
+`
+
+var benchPayload = []byte(`Lorem ipsum dolor sit amet, consectetur adipiscing elit.
+Vivamus faucibus est et metus sodales, vitae faucibus leo faucibus.`)
+
+// Benchmark the processor in each mode with batches sent from as many
+// goroutines as there are CPUs, reporting throughput, the p99 latency of a
+// batch, and how long each batch waited on an interpreter (or, in the global
+// mode, the GIL). Run with:
+//
+//	go test ./processor -run '^$' -bench Modes
+func BenchmarkModes(b *testing.B) {
+	for _, m := range []python.Mode{python.Global, python.Isolated, python.IsolatedLegacy} {
+		b.Run(string(m), func(b *testing.B) {
+			proc, err := NewPythonProcessor(Config{
+				Exe:          "python3",
+				Script:       benchScript,
+				Interpreters: runtime.NumCPU(),
+				Mode:         m,
+				Serializer:   python.Bloblang,
+			}, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer func() { _ = proc.Close(context.Background()) }()
+			metered := proc.(*PythonProcessor).runtime.(*python.MeteredRuntime)
+
+			var mtx sync.Mutex
+			var latencies []time.Duration
+			waited := metered.Waited()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				var local []time.Duration
+				for pb.Next() {
+					batch := make(service.MessageBatch, benchBatchSize)
+					for idx := range batch {
+						batch[idx] = service.NewMessage(benchPayload)
+					}
+					start := time.Now()
+					if _, err := proc.ProcessBatch(context.Background(), batch); err != nil {
+						b.Error(err)
+						return
+					}
+					local = append(local, time.Since(start))
+				}
+				mtx.Lock()
+				latencies = append(latencies, local...)
+				mtx.Unlock()
+			})
+			b.StopTimer()
+
+			if len(latencies) == 0 {
+				return
+			}
+			slices.Sort(latencies)
+			p99 := latencies[len(latencies)*99/100]
+			b.ReportMetric(float64(b.N*benchBatchSize)/b.Elapsed().Seconds(), "msgs/s")
+			b.ReportMetric(float64(p99.Microseconds()), "p99-µs")
+			b.ReportMetric(float64((metered.Waited()-waited).Nanoseconds())/float64(b.N), "wait-ns/op")
+		})
+	}
+}
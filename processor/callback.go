@@ -1,11 +1,13 @@
 package processor
 
 import (
+	"encoding/json"
 	"fmt"
 	"unsafe"
 
 	"github.com/redpanda-data/benthos/v4/public/service"
 	py "github.com/voutilad/gogopython"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
 )
 
 // contentCallback is called from Python and copies the underlying bytes of
@@ -65,7 +67,7 @@ func metadataCallback(_, tuple py.PyObjectPtr) py.PyObjectPtr {
 
 	// Second argument is an optional key. Empty string denotes "all keys".
 	str := py.PyTuple_GetItem(tuple, 1)
-	key, err := py.UnicodeToString(str)
+	key, err := python.UnicodeToString(str)
 	if err != nil {
 		// TODO: raise Python exception
 		panic(err)
@@ -148,3 +150,114 @@ func metadataCallback(_, tuple py.PyObjectPtr) py.PyObjectPtr {
 		return py.PyUnicode_FromString(s)
 	}
 }
+
+// documentFields holds the top-level fields of the structured payload of the
+// message a Document proxy reads from, parsed at most once per message.
+type documentFields struct {
+	m      *service.Message
+	obj    map[string]any
+	parsed bool
+}
+
+// reset points the fields at a new message.
+func (f *documentFields) reset(m *service.Message) {
+	f.m, f.obj, f.parsed = m, nil, false
+}
+
+// get returns the fields of the payload, or nil if it isn't an object.
+func (f *documentFields) get() map[string]any {
+	if !f.parsed {
+		f.parsed = true
+		structured, err := f.m.AsStructured()
+		if err == nil {
+			f.obj, _ = structured.(map[string]any)
+		}
+	}
+	return f.obj
+}
+
+// fieldCallback is called from Python and copies a top-level field of a
+// service.Message's structured payload into Python as JSON. It has a Python
+// function definition like:
+//
+// def __field(__fields -> int, key = None)
+//
+// where __fields is the virtual address of the documentFields and key is the
+// name of the field. A key of None returns a JSON list of all field names. If
+// the payload isn't an object, there's no such field, or the key isn't a
+// string, returns "".
+func fieldCallback(_, tuple py.PyObjectPtr) py.PyObjectPtr {
+	if py.BaseType(tuple) != py.Tuple {
+		panic("argument should be a Python tuple")
+	}
+
+	// First argument is a pointer to our documentFields.
+	var f *documentFields
+	addr := py.PyTuple_GetItem(tuple, 0)
+	if addr == py.NullPyObjectPtr {
+		panic("first tuple item should not be null")
+	}
+	f = (*documentFields)(unsafe.Pointer(uintptr(py.PyLong_AsUnsignedLong(addr))))
+
+	obj := f.get()
+	if obj == nil {
+		return py.PyUnicode_FromString("")
+	}
+
+	// Second argument is the field name, or None for all of them.
+	var val any
+	arg := py.PyTuple_GetItem(tuple, 1)
+	switch py.BaseType(arg) {
+	case py.None:
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		val = keys
+	case py.String:
+		key, err := python.UnicodeToString(arg)
+		if err != nil {
+			return py.PyUnicode_FromString("")
+		}
+		var ok bool
+		if val, ok = obj[key]; !ok {
+			return py.PyUnicode_FromString("")
+		}
+	default:
+		// Fields of JSON objects are only ever named by strings.
+		return py.PyUnicode_FromString("")
+	}
+
+	data, err := json.Marshal(val)
+	if err != nil {
+		return py.PyUnicode_FromString("")
+	}
+	return py.PyUnicode_FromString(string(data))
+}
+
+// errorCallback is called from Python and copies the error, if any, flagged
+// on a service.Message into Python. It has a Python function definition like:
+//
+// def __error(__msg -> int)
+//
+// where __msg is the virtual address of the service.Message. If the message
+// has no error, returns "".
+func errorCallback(_, tuple py.PyObjectPtr) py.PyObjectPtr {
+	if py.BaseType(tuple) != py.Tuple {
+		panic("argument should be a Python tuple")
+	}
+
+	// First argument is a pointer to our service.Message.
+	var m *service.Message
+	addr := py.PyTuple_GetItem(tuple, 0)
+	if addr == py.NullPyObjectPtr {
+		panic("first tuple item should not be null")
+	}
+	m = (*service.Message)(unsafe.Pointer(uintptr(py.PyLong_AsUnsignedLong(addr))))
+
+	err := m.GetError()
+	if err == nil {
+		return py.PyUnicode_FromString("")
+	}
+	return py.PyUnicode_FromString(err.Error())
+}
@@ -0,0 +1,58 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+)
+
+var (
+	// ErrRetryable wraps script failures classified as transient. The batch
+	// fails so the runtime may retry it.
+	ErrRetryable = errors.New("retryable python error")
+
+	// ErrFatal wraps script failures classified as fatal. Only the message
+	// that caused it fails and it should not be retried.
+	ErrFatal = errors.New("fatal python error")
+
+	// ErrRejected wraps script failures classified as rejecting the message.
+	// The message is dropped on purpose.
+	ErrRejected = errors.New("python rejected message")
+)
+
+// errorKind describes how a script failure was classified.
+type errorKind string
+
+const (
+	unclassified errorKind = ""
+	retryable    errorKind = "retryable"
+	fatal        errorKind = "fatal"
+	reject       errorKind = "reject"
+)
+
+// classifyError classifies the last exception raised by a script using the
+// rpcn module's classifier. Must be called after python.StashException so
+// the exception is available via sys.last_exc. The description of the
+// exception is nil if it couldn't be classified.
+func classifyError(i *interpreter) (errorKind, *python.Exception) {
+	kind, exc := python.ClassifyException(i.classify, "")
+	return errorKind(kind), exc
+}
+
+// scriptError converts a classified script failure into an error.
+func scriptError(kind errorKind, exc *python.Exception) error {
+	if exc == nil {
+		return errors.New("problem executing Python script")
+	}
+	switch kind {
+	case retryable:
+		return fmt.Errorf("%w: %s", ErrRetryable, exc)
+	case fatal:
+		return fmt.Errorf("%w: %s", ErrFatal, exc)
+	case reject:
+		return fmt.Errorf("%w: %s", ErrRejected, exc)
+	default:
+		return fmt.Errorf("problem executing Python script: %w", exc)
+	}
+}
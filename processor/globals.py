@@ -1,13 +1,20 @@
 """
 Creates an environment similar to the one available in Bloblang.
 """
+import json
+from collections.abc import MutableMapping
+
+
 def __noop(_x, _y):
     raise Exception("callback not wired!")
 
 
 __content_callback = __noop   # our content callback function implemented in Go
 __metadata_callback = __noop  # our metadata callback function implemented in Go
+__field_callback = __noop     # our structured field callback function implemented in Go
+__error_callback = __noop     # our message error callback function implemented in Go
 __message_addr = 0            # the virtual address of a service.Message
+__fields_addr = 0             # the virtual address of the fields a Document reads
 
 
 def content():
@@ -42,6 +49,194 @@ def unpickle():
     return pickle.loads(__content_callback(__message_addr))
 
 
+def unbson():
+    """
+    Helper function for decoding a BSON message, e.g. a MongoDB document,
+    using either pymongo's bson module or the standalone bson package.
+    :return: decoded dict
+    """
+    import bson
+    if hasattr(bson, "decode"):
+        return bson.decode(__content_callback(__message_addr))
+    return bson.loads(__content_callback(__message_addr))
+
+
+def _field(key=None):
+    """
+    Fetch a top-level field of the message's structured payload as JSON.
+    :param key: field name, or None for a JSON list of all field names
+    :return: JSON string, or "" if there's no such field
+    """
+    return __field_callback(__fields_addr, key)
+
+
+class Document(MutableMapping):
+    """
+    A mutable mapping proxy over a message's structured payload. Fields are
+    copied in lazily on access and only changed fields are written back.
+    """
+    def __init__(self):
+        self._cache = {}
+        self._changed = set()
+        self._deleted = set()
+        self._keys = None
+
+    def _fields(self):
+        """
+        Names of the fields of the payload, fetched once per message.
+        :return: set of field names
+        """
+        if self._keys is None:
+            self._keys = set(json.loads(_field() or "[]"))
+        return self._keys
+
+    def __getitem__(self, key):
+        if not isinstance(key, str) or key in self._deleted:
+            raise KeyError(key)
+        if key not in self._cache:
+            if key not in self._fields():
+                raise KeyError(key)
+            self._cache[key] = json.loads(_field(key))
+        value = self._cache[key]
+        if isinstance(value, (dict, list)):
+            # We can't see nested mutations, so assume the worst.
+            self._changed.add(key)
+        return value
+
+    def __setitem__(self, key, value):
+        if not isinstance(key, str):
+            raise TypeError(f"field names must be str, not {type(key).__name__}")
+        self._cache[key] = value
+        self._changed.add(key)
+        self._deleted.discard(key)
+
+    def __delitem__(self, key):
+        if key not in self:
+            raise KeyError(key)
+        self._cache.pop(key, None)
+        self._changed.discard(key)
+        self._deleted.add(key)
+
+    def __contains__(self, key):
+        if not isinstance(key, str) or key in self._deleted:
+            return False
+        return key in self._cache or key in self._fields()
+
+    def __iter__(self):
+        keys = [k for k in self._fields() if k not in self._deleted]
+        keys.extend(k for k in self._cache if k not in keys)
+        return iter(keys)
+
+    def __len__(self):
+        return sum(1 for _ in self)
+
+    def __str__(self):
+        return str(dict(self))
+
+    def changes(self):
+        """
+        Serialize the changes made to the payload.
+        :return: JSON string with the "set" fields and "deleted" field names
+        """
+        return json.dumps({
+            "set": {k: self._cache[k] for k in self._changed},
+            "deleted": list(self._deleted),
+        })
+
+    def clear_state(self):
+        """
+        Reset the proxy for use with a new message.
+        :return: None
+        """
+        self._cache.clear()
+        self._changed.clear()
+        self._deleted.clear()
+        self._keys = None
+
+
+def _error():
+    """
+    Fetch the error, if any, flagged on the message.
+    :return: error string, or "" if there's no error
+    """
+    return __error_callback(__message_addr)
+
+
+class Message:
+    """
+    Provides access to the error state of the current message, e.g. to
+    inspect upstream failures inside a `catch` block, and sets its
+    synchronous response.
+    """
+    def __init__(self):
+        self._updated = False
+        self._error = None
+        self._response = None
+
+    def error(self):
+        """
+        Get the error flagged on the message.
+        :return: error string, or None if the message hasn't failed
+        """
+        if self._updated:
+            return self._error
+        err = _error()
+        return err if err != "" else None
+
+    def set_error(self, err):
+        """
+        Flag the message with an error, or clear it if err is None.
+        :param err: error description or None
+        :return: None
+        """
+        self._updated = True
+        self._error = None if err is None else str(err)
+
+    def _pending_error(self):
+        """
+        Report any update to the error state made by the script.
+        :return: None if unchanged, "" if cleared, otherwise the new error
+        """
+        if not self._updated:
+            return None
+        return self._error or ""
+
+    def respond(self, body, status=None, headers=None):
+        """
+        Set the synchronous response to the source of the message, e.g. the
+        reply to an `http_server` request with `sync_response`, computed
+        inline.
+        :param body: str, bytes, or an object encoded as JSON
+        :param status: optional HTTP status code, set in the
+                       http_status_code metadata of the response
+        :param headers: optional dict of headers, set as metadata of the
+                        response
+        :return: None
+        """
+        if status is not None and not isinstance(status, int):
+            raise TypeError("status must be an int")
+        if headers is not None and not isinstance(headers, dict):
+            raise TypeError("headers must be a dict")
+        self._response = (body, status, headers)
+
+    def _pending_response(self):
+        """
+        Report the synchronous response set by the script.
+        :return: None if unset, otherwise a tuple of the body, status, and
+                 headers
+        """
+        return self._response
+
+    def _clear(self):
+        """
+        Reset the state for use with a new message.
+        :return: None
+        """
+        self._updated = False
+        self._error = None
+        self._response = None
+
+
 class Root:
     """
     Provides an experience similar to Bloblang's `root` object, allowing
@@ -0,0 +1,80 @@
+package processor
+
+import (
+	_ "embed"
+	"errors"
+	"time"
+
+	py "github.com/voutilad/gogopython"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+)
+
+// Python helper for finding reference leaks.
+//
+//go:embed leaks.py
+var leaksSrc string
+
+// leakTracker periodically reports growth in live Python objects and checks
+// that the objects we hold from Go keep a stable reference count, which
+// catches a missing or extra Py_DecRef in our bindings.
+type leakTracker struct {
+	report   py.PyObjectPtr
+	tracked  py.PyObjectPtr // Dict of the objects we hold from Go.
+	lastDump time.Time
+}
+
+// newLeakTracker tracks the given objects held from Go in the current
+// interpreter.
+//
+// The caller must manage the interpreter state for this to succeed.
+func newLeakTracker(tracked map[string]py.PyObjectPtr) (*leakTracker, error) {
+	code, err := python.Compile(leaksSrc, "__leaks__.py")
+	if err != nil {
+		return nil, errors.New("failed to compile leaks source")
+	}
+	module := py.PyImport_ExecCodeModule("__leaks__", code)
+	if module == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return nil, errors.New("failed to import leaks module")
+	}
+	defer py.Py_DecRef(module)
+
+	report := py.PyObject_GetAttrString(module, "report")
+	if report == py.NullPyObjectPtr {
+		return nil, errors.New("failed to find report in leaks module")
+	}
+
+	dict := py.PyDict_New()
+	for name, obj := range tracked {
+		if obj != py.NullPyObjectPtr {
+			py.PyDict_SetItemString(dict, name, obj)
+		}
+	}
+
+	return &leakTracker{report: report, tracked: dict, lastDump: time.Now()}, nil
+}
+
+// DumpIfDue summarizes object growth if at least interval has elapsed since
+// the previous dump, returning the summary, how many tracked objects had their
+// reference count drift, and whether a dump occurred.
+func (t *leakTracker) DumpIfDue(interval time.Duration) (string, int64, bool, error) {
+	if time.Since(t.lastDump) < interval {
+		return "", 0, false, nil
+	}
+	t.lastDump = time.Now()
+
+	result := py.PyObject_CallOneArg(t.report, t.tracked)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return "", 0, false, errors.New("failed to report object counts")
+	}
+	defer py.Py_DecRef(result)
+
+	// Borrowed references.
+	summary, err := py.UnicodeToString(py.PyTuple_GetItem(result, 0))
+	if err != nil {
+		return "", 0, false, err
+	}
+	drifted := py.PyLong_AsLong(py.PyTuple_GetItem(result, 1))
+	return summary, drifted, true, nil
+}
@@ -0,0 +1,67 @@
+"""
+Reference leak diagnostics helper, counting live objects by type.
+"""
+import gc
+import sys
+
+# Live objects by type as of the previous report.
+_previous = None
+
+# Reference counts of tracked objects as of the first report.
+_baseline = None
+
+
+def _count():
+    """
+    Count live objects by type. Debug builds of Python can enumerate every
+    object, while others only track containers.
+    :return: dict of type names to counts
+    """
+    if hasattr(sys, "getobjects"):
+        objects = sys.getobjects(0)
+    else:
+        objects = gc.get_objects()
+    counts = {}
+    for obj in objects:
+        kind = type(obj)
+        name = f"{kind.__module__}.{kind.__qualname__}"
+        counts[name] = counts.get(name, 0) + 1
+    return counts
+
+
+def report(tracked, limit=10):
+    """
+    Summarize growth in live objects by type since the previous report, along
+    with any drift in the reference counts of objects held from Go.
+    :param tracked: dict of names to objects held from Go
+    :param limit: number of types to report
+    :return: a summary string suitable for logging and the number of tracked
+             objects whose reference counts drifted
+    """
+    global _previous, _baseline
+
+    # Cyclic garbage isn't a leak, so get it out of the way first.
+    unreachable = gc.collect()
+    counts = _count()
+    refcounts = {name: sys.getrefcount(obj) for name, obj in tracked.items()}
+
+    lines = [f"collected={unreachable} uncollectable={len(gc.garbage)} "
+             f"gc_counts={gc.get_count()}"]
+    if _previous is not None:
+        growth = sorted(((counts[name] - _previous.get(name, 0), name)
+                         for name in counts), reverse=True)
+        for delta, name in growth[:limit]:
+            if delta <= 0:
+                break
+            lines.append(f"{name}: {counts[name]} (+{delta})")
+    _previous = counts
+
+    drifted = 0
+    if _baseline is None:
+        _baseline = refcounts
+    for name, refcount in refcounts.items():
+        delta = refcount - _baseline[name]
+        if delta != 0:
+            drifted += 1
+            lines.append(f"refcount drift on '{name}': {refcount} ({delta:+d})")
+    return "\n".join(lines), drifted
@@ -0,0 +1,49 @@
+import importlib
+import unittest
+
+import leaks
+
+class Leaky:
+    pass
+
+class TestReport(unittest.TestCase):
+    """
+    Tests for our reference leak diagnostics.
+    """
+
+    def setUp(self):
+        # Each test starts without a previous report or baseline.
+        importlib.reload(leaks)
+
+    def test_reports_growth_by_type(self):
+        leaks.report({})
+        kept = [Leaky() for _ in range(100)]
+        summary, drifted = leaks.report({})
+        self.assertIn(f"{__name__}.Leaky: ", summary,
+                      "Should report types that grew since the previous report.")
+        self.assertIn("(+100)", summary, "Should report by how much a type grew.")
+        self.assertEqual(drifted, 0)
+        del kept
+
+    def test_ignores_collected_cycles(self):
+        leaks.report({})
+        for _ in range(100):
+            cycle = Leaky()
+            cycle.me = cycle
+        del cycle
+        summary, _ = leaks.report({})
+        self.assertNotIn(f"{__name__}.Leaky: ", summary,
+                         "Should collect cyclic garbage before counting.")
+
+    def test_reports_refcount_drift(self):
+        held = object()
+        leaks.report({"held": held})
+        extra = [held, held]
+        summary, drifted = leaks.report({"held": held})
+        self.assertEqual(drifted, 1, "Should count tracked objects whose refcount changed.")
+        self.assertIn("refcount drift on 'held'", summary)
+        self.assertIn("(+2)", summary)
+        del extra
+
+if __name__ == "__main__":
+    unittest.main()
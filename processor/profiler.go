@@ -0,0 +1,120 @@
+package processor
+
+import (
+	_ "embed"
+	"errors"
+	"time"
+
+	py "github.com/voutilad/gogopython"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+)
+
+// Python helper for profiling script execution.
+//
+//go:embed profiler.py
+var profilerSrc string
+
+// profiler wraps a Python Profiler instance.
+type profiler struct {
+	instance py.PyObjectPtr
+	enable   py.PyObjectPtr
+	disable  py.PyObjectPtr
+	dump     py.PyObjectPtr
+	lastDump time.Time
+}
+
+// newProfiler creates a new Python Profiler writing pstats files to path, or
+// summarizing to text if path is empty.
+//
+// The caller must manage the interpreter state for this to succeed.
+func newProfiler(path string) (*profiler, error) {
+	code, err := python.Compile(profilerSrc, "__profiler__.py")
+	if err != nil {
+		return nil, errors.New("failed to compile profiler source")
+	}
+	module := py.PyImport_ExecCodeModule("__profiler__", code)
+	if module == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return nil, errors.New("failed to import profiler module")
+	}
+	defer py.Py_DecRef(module)
+
+	class := py.PyObject_GetAttrString(module, "Profiler")
+	if class == py.NullPyObjectPtr {
+		return nil, errors.New("failed to find Profiler class in profiler module")
+	}
+	defer py.Py_DecRef(class)
+
+	str := py.PyUnicode_FromString(path)
+	if str == py.NullPyObjectPtr {
+		py.PyErr_Clear()
+		return nil, errors.New("failed to convert profile path to a python string")
+	}
+	defer py.Py_DecRef(str)
+
+	instance := py.PyObject_CallOneArg(class, str)
+	if instance == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return nil, errors.New("failed to create new Profiler instance")
+	}
+
+	enable := py.PyObject_GetAttrString(instance, "enable")
+	if enable == py.NullPyObjectPtr {
+		return nil, errors.New("failed to find enable method on Profiler instance")
+	}
+	disable := py.PyObject_GetAttrString(instance, "disable")
+	if disable == py.NullPyObjectPtr {
+		return nil, errors.New("failed to find disable method on Profiler instance")
+	}
+	dump := py.PyObject_GetAttrString(instance, "dump")
+	if dump == py.NullPyObjectPtr {
+		return nil, errors.New("failed to find dump method on Profiler instance")
+	}
+
+	return &profiler{
+		instance: instance,
+		enable:   enable,
+		disable:  disable,
+		dump:     dump,
+		lastDump: time.Now(),
+	}, nil
+}
+
+// Enable profiling.
+func (p *profiler) Enable() {
+	py.Py_DecRef(py.PyObject_CallNoArgs(p.enable))
+}
+
+// Disable profiling.
+func (p *profiler) Disable() {
+	py.Py_DecRef(py.PyObject_CallNoArgs(p.disable))
+}
+
+// DumpIfDue dumps the statistics if at least interval has elapsed since the
+// previous dump, returning the summary and whether a dump occurred.
+func (p *profiler) DumpIfDue(name string, interval time.Duration) (string, bool, error) {
+	if time.Since(p.lastDump) < interval {
+		return "", false, nil
+	}
+	p.lastDump = time.Now()
+
+	str := py.PyUnicode_FromString(name)
+	if str == py.NullPyObjectPtr {
+		py.PyErr_Clear()
+		return "", false, errors.New("failed to convert profile name to a python string")
+	}
+	defer py.Py_DecRef(str)
+
+	result := py.PyObject_CallOneArg(p.dump, str)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return "", false, errors.New("failed to dump profile")
+	}
+	defer py.Py_DecRef(result)
+
+	summary, err := py.UnicodeToString(result)
+	if err != nil {
+		return "", false, err
+	}
+	return summary, true, nil
+}
@@ -0,0 +1,41 @@
+"""
+Profiling helper wrapping script execution with cProfile.
+"""
+import cProfile
+import io
+import os
+import pstats
+import time
+
+
+class Profiler:
+    """
+    Accumulates cProfile statistics across script executions and dumps them
+    either to pstats files or as a text summary of the top functions.
+    """
+    def __init__(self, path="", top=20):
+        self.profile = cProfile.Profile()
+        self.path = path
+        self.top = top
+
+    def enable(self):
+        self.profile.enable()
+
+    def disable(self):
+        self.profile.disable()
+
+    def dump(self, name):
+        """
+        Dump the statistics collected so far.
+        :param name: prefix used to identify the dump
+        :return: a summary string suitable for logging
+        """
+        if self.path:
+            os.makedirs(self.path, exist_ok=True)
+            filename = os.path.join(self.path, f"{name}-{int(time.time())}.pstats")
+            self.profile.dump_stats(filename)
+            return f"wrote profile to {filename}"
+        stream = io.StringIO()
+        stats = pstats.Stats(self.profile, stream=stream)
+        stats.sort_stats(pstats.SortKey.CUMULATIVE).print_stats(self.top)
+        return stream.getvalue()
@@ -7,13 +7,19 @@ import (
 	"errors"
 	"fmt"
 	"github.com/voutilad/rp-connect-python/internal/impl/python"
+	"os"
+	"regexp"
 	"runtime"
+	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/redpanda-data/benthos/v4/public/service"
 
 	py "github.com/voutilad/gogopython"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -21,16 +27,189 @@ const (
 	GlobalContent = "__content_callback"
 	// GlobalMetadata provides the "metadata" function.
 	GlobalMetadata = "__metadata_callback"
+	// GlobalField provides top-level fields of a structured payload.
+	GlobalField = "__field_callback"
+	// GlobalError provides the error state of a Message.
+	GlobalError = "__error_callback"
 	// GlobalMessageAddr points to a service.Message
 	GlobalMessageAddr = "__message_addr"
+
+	// GlobalFieldsAddr points to the documentFields a Document reads from.
+	GlobalFieldsAddr = "__fields_addr"
+)
+
+// ContentTypeMetaKey is the metadata key describing the payload of results
+// when content_type is enabled, as one of the ContentType values.
+const ContentTypeMetaKey = "content_type"
+
+const (
+	ContentTypeJSON  = "json"
+	ContentTypeText  = "text"
+	ContentTypeBytes = "bytes"
 )
 
+// handlerName matches the (dotted) name of a function to use as a handler.
+var handlerName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*$`)
+
+// DefaultRouteMetaKey is the metadata key naming the route of results set to
+// an rpcn.Route, unless configured otherwise.
+const DefaultRouteMetaKey = "route"
+
+// Config describes how to construct a PythonProcessor.
+type Config struct {
+	Exe          string                // Path to a Python executable.
+	Script       string                // Python script to execute per message.
+	Handler      string                // Function called per message instead of Script.
+	Interpreters int                   // Number of interpreters to run, at least 1.
+	Mode         python.Mode           // Python runtime mode.
+	Serializer   python.SerializerMode // Serialization mode to use on results.
+
+	// Args are interpolated per message and provided to the script as the
+	// "args" dict, and to the Handler as keyword arguments.
+	Args map[string]*service.InterpolatedString
+
+	// Model optionally names a pydantic model ("module:Model") used to
+	// validate payloads before the script runs.
+	Model string
+	// JSONSchema optionally provides a JSON schema document used to validate
+	// payloads before the script runs.
+	JSONSchema string
+
+	// AvroSchema is the Avro schema, in JSON, results are encoded with by
+	// the avro serializer.
+	AvroSchema string
+
+	// JSONLibrary optionally names the library results are encoded as JSON
+	// with, one of the python.JSONLibrary values. Uses json if empty.
+	JSONLibrary string
+
+	// Path lists directories appended to sys.path in every interpreter.
+	Path []string
+
+	// ScriptDir optionally names the directory of a multi-file project whose
+	// EntryModule is imported into every interpreter's globals.
+	ScriptDir   string
+	EntryModule string
+
+	// PreloadModules lists modules imported in every interpreter on startup.
+	PreloadModules []string
+
+	// RequireModules lists modules that must be importable in every
+	// interpreter, checked on startup.
+	RequireModules []string
+
+	// Environment holds variables set in os.environ of every interpreter.
+	Environment map[string]string
+
+	// Identity names the deployment and processor, provided to scripts as
+	// "identity".
+	Identity python.Identity
+
+	// Runtime optionally names a runtime to share with other components.
+	Runtime string
+
+	// ShutdownTimeout bounds how long closing waits for running Python code
+	// before interrupting it. Defaults to 10s.
+	ShutdownTimeout time.Duration
+
+	// WatchdogTimeout bounds a single batch, after which the interpreter is
+	// replaced. Disabled if 0. Requires an isolated mode.
+	WatchdogTimeout time.Duration
+
+	// MaxAllocatedBlocks recycles an interpreter between batches once Python
+	// has more memory blocks allocated in it. Disabled if 0. Requires the
+	// isolated mode.
+	MaxAllocatedBlocks int
+
+	// MaxMessages recycles an interpreter once it has processed this many
+	// messages. Disabled if 0. Requires an isolated mode.
+	MaxMessages int
+
+	// Init is optional Python code executed once per interpreter before any
+	// messages are processed.
+	Init string
+
+	// Lazy defers starting the runtime, and running Init, until the first
+	// batch arrives.
+	Lazy bool
+
+	// Profile wraps script execution with cProfile, dumping statistics every
+	// ProfileInterval either to pstats files in ProfilePath or to the log.
+	Profile         bool
+	ProfileInterval time.Duration
+	ProfilePath     string
+
+	// Tracemalloc enables tracing of Python memory allocations, logging the
+	// top allocation sites every TracemallocInterval.
+	Tracemalloc         bool
+	TracemallocInterval time.Duration
+
+	// LeakDetection reports growth in live Python objects by type every
+	// LeakDetectionInterval, warning if the reference counts of objects we
+	// hold from Go drift.
+	LeakDetection         bool
+	LeakDetectionInterval time.Duration
+
+	// Patch exposes the structured payload to the script as a mutable
+	// mapping, "this", writing back only the changed fields.
+	Patch bool
+
+	// ContentType sets the ContentTypeMetaKey metadata of results by their
+	// type, unless the script set it.
+	ContentType bool
+
+	// MessageDicts treats a root of {"content": ..., "meta": ..., "key": ...}
+	// as the content, metadata, and key of the result.
+	MessageDicts bool
+
+	// Compression optionally names the codec, one of the python.Compression
+	// values, payloads of results are compressed with.
+	Compression string
+
+	// ResultCacheSize declares the script pure, caching up to this many
+	// results keyed by a hash of the payload and args. Disabled if 0.
+	ResultCacheSize int
+	// ResultCacheTTL bounds how long a cached result is reused. Kept until
+	// evicted if 0.
+	ResultCacheTTL time.Duration
+
+	// RouteMeta names the metadata key a root of rpcn.Route sets the name of
+	// its route in. Defaults to DefaultRouteMetaKey.
+	RouteMeta string
+
+	// Metrics is an optional metrics provider.
+	Metrics *service.Metrics
+}
+
 type PythonProcessor struct {
-	logger         *service.Logger
-	runtime        python.Runtime
-	interpreters   map[int64]*interpreter
-	alive          atomic.Int32
-	serializerMode python.SerializerMode
+	logger           *service.Logger
+	runtime          python.Runtime
+	interpreters     map[int64]*interpreter // Protected by mtx.
+	mtx              sync.RWMutex
+	init             func(ticket *python.InterpreterTicket) error
+	lazy             bool
+	started          atomic.Bool // Whether our runtime is started and initialized.
+	startMtx         sync.Mutex
+	ready            *service.MetricGauge
+	closed           atomic.Bool // Whether we were closed, so we stop our runtime once.
+	serializerMode   python.SerializerMode
+	args             map[string]*service.InterpolatedString
+	profileEvery     time.Duration
+	tracemallocEvery time.Duration
+	leaksEvery       time.Duration
+	shutdownTimeout  time.Duration
+	patch            bool
+	contentType      bool
+	messageDicts     bool
+	compression      string
+	routeMeta        string
+	results          *resultCache // Results of a pure script, if cached.
+	spanAttributes   []attribute.KeyValue
+
+	maxAllocatedBlocks int64
+	maxMessages        int
+	recyclable         bool // Whether our runtime can recycle interpreters.
+	recycles           *service.MetricCounter
 }
 
 type interpreter struct {
@@ -58,11 +237,59 @@ type interpreter struct {
 	rootClass  py.PyObjectPtr
 	rootToDict py.PyObjectPtr
 
+	// routeClass is the rpcn module's Route class, steering results to sinks.
+	routeClass py.PyObjectPtr
+
 	// meta is our metadata dictionary.
 	meta py.PyObjectPtr
 
+	// msg is our Message instance exposing the message error state.
+	msg py.PyObjectPtr
+	// msgClear is the _clear() method on our Message instance.
+	msgClear py.PyObjectPtr
+	// msgPendingError is the _pending_error() method on our Message instance.
+	msgPendingError py.PyObjectPtr
+	// msgPendingResponse is the _pending_response() method on our Message
+	// instance.
+	msgPendingResponse py.PyObjectPtr
+
+	// document is our Document proxy used in patch mode.
+	document py.PyObjectPtr
+	// documentClear is the clear_state() method on our Document instance.
+	documentClear py.PyObjectPtr
+	// documentChanges is the changes() method on our Document instance.
+	documentChanges py.PyObjectPtr
+	// fields holds the parsed payload our Document instance reads from.
+	fields *documentFields
+
+	// args is our dictionary of interpolated arguments.
+	args py.PyObjectPtr
+
+	// validate is our optional payload validation function.
+	validate py.PyObjectPtr
+
+	// profiler is our optional cProfile wrapper.
+	profiler *profiler
+
+	// memoryTracer is our optional tracemalloc wrapper.
+	memoryTracer *memoryTracer
+
+	// leakTracker is our optional reference leak detector.
+	leakTracker *leakTracker
+
+	// classify is the rpcn module's exception classifier.
+	classify py.PyObjectPtr
+
+	// traceBegin and traceEnd scope the rpcn module's trace context to a
+	// message.
+	traceBegin py.PyObjectPtr
+	traceEnd   py.PyObjectPtr
+
 	// callbacks we've registered with the interpreter.
 	callbacks []*python.Callback
+
+	// messages counts the messages processed by the interpreter.
+	messages int
 }
 
 // Python helper for initializing a `content` function, returning bytes from
@@ -80,44 +307,403 @@ func init() {
 		NewConfigSpec().
 		Summary("Process data with Python.").
 		Field(service.NewStringField("script").
-			Description("Python code to execute.")).
-		Field(service.NewStringField("exe").
-			Description("Path to a Python executable.").
-			Default("python3")).
-		Field(service.NewStringField("mode").
-			Description("Toggle different Python runtime modes.").
-			Examples(string(python.Global), string(python.Isolated), string(python.IsolatedLegacy)).
-			Default(string(python.Global))).
+			Description("Python code to execute. Required unless `handler` is set.").
+			Default("")).
+		Field(service.NewStringField("handler").
+			Description("Name of a function, defined by `init` or the `entry_module` of `script_dir`, to call per message instead of running `script`. It's called with the resolved `args` as keyword arguments and what it returns becomes `root`.").
+			Example("process").
+			Default("")).
+		Fields(python.RuntimeFields()...).
+		Field(python.SharedRuntimeField()).
+		Field(service.NewObjectField("debug",
+			service.NewStringField("address").
+				Description("Host and port for debugpy to listen on, e.g. `localhost:5678`. Disabled if empty.").
+				Default(""),
+			service.NewBoolField("wait").
+				Description("Whether to wait for a debugger to attach before running any scripts.").
+				Default(false)).
+			Description("Start [debugpy](https://github.com/microsoft/debugpy) in the main interpreter so a debugger can attach and stop at breakpoints, e.g. `breakpoint()` calls, in scripts while they handle real traffic. Requires the `debugpy` module and `global` mode. As the debugger is process-wide, all components must agree on its address.").
+			Advanced()).
+		Field(service.NewObjectField("schema_registry",
+			service.NewStringField("url").
+				Description("Base URL of the schema registry. Disabled if empty.").
+				Example("http://localhost:8081").
+				Default(""),
+			service.NewStringField("username").
+				Description("Username for basic authentication, if required.").
+				Default(""),
+			service.NewStringField("password").
+				Description("Password for basic authentication, if required.").
+				Secret().
+				Default("")).
+			Description("Bind `rpcn.schema_registry` to a Confluent-compatible schema registry, for framing Avro, Protobuf, and JSON schema payloads in its wire format from scripts. As interpreters may be shared, all components must agree on the registry.").
+			Advanced()).
+		Field(service.NewStringField("script_dir").
+			Description("Directory of a multi-file Python project backing the processor. It's made importable and its `entry_module` imported into every interpreter, like `from main import *`, so `script` can call what it defines. If the directory has an `__init__.py`, the entry module is imported from it as a package so relative imports work.").
+			Example("./my_project").
+			Default("")).
+		Field(service.NewStringField("entry_module").
+			Description("Module of `script_dir` to import.").
+			Default("main")).
+		Field(service.NewObjectField("identity",
+			service.NewStringField("stream").
+				Description("Name of the stream, e.g. in streams mode, made available to scripts as `identity.stream`.").
+				Example("${STREAM_NAME}").
+				Default(""),
+			service.NewStringField("pipeline_id").
+				Description("Id of the pipeline, e.g. per deployment, made available to scripts as `identity.pipeline`.").
+				Default("")).
+			Description("Identity of the deployment made available to scripts as `identity`, along with the component's `label` as `identity.label`, so logs, metrics, and external checkpoints written from Python can be namespaced per deployment.").
+			Advanced()).
+		Field(service.NewDurationField("watchdog_timeout").
+			Description("Hard ceiling on processing a single batch. Interpreters exceeding it have their Python stack logged and are replaced with a fresh one, running `init` again. The stuck interpreter is interrupted and abandoned. Requires an `isolated` mode. Disabled if `0s`.").
+			Advanced().
+			Default("0s")).
+		Field(service.NewIntField("max_allocated_blocks").
+			Description("Recycle an interpreter, between batches, once Python reports more memory blocks allocated in it than this (see `sys.getallocatedblocks()`), mitigating leaks in third-party libraries. The fresh interpreter runs `init` again before its first batch. Requires the `isolated` mode. Disabled if 0.").
+			Advanced().
+			Default(0)).
+		Field(service.NewIntField("max_messages_per_interpreter").
+			Description("Recycle an interpreter, between batches, once it has processed this many messages, guarding against slow leaks. The fresh interpreter runs `init` again before its first batch. Requires an `isolated` mode. Disabled if 0.").
+			Advanced().
+			Default(0)).
 		Field(service.NewStringField("serializer").
 			Description("Serialization mode to use on results.").
-			Examples(string(python.None), string(python.Pickle), string(python.Bloblang)).
-			Default(string(python.Bloblang)))
-	// TODO: linting rules for configuration fields
+			Examples(string(python.None), string(python.Pickle), string(python.Bloblang), string(python.Avro), string(python.CBOR), string(python.BSON)).
+			Default(string(python.Bloblang))).
+		Field(service.NewObjectField("avro",
+			service.NewStringField("schema").
+				Description("An Avro schema, in JSON, to encode results with.").
+				Optional(),
+			service.NewStringField("schema_file").
+				Description("Path to a file holding the Avro schema, instead of `schema`.").
+				Optional()).
+			Description("Schema for the `avro` serializer, which encodes results, e.g. dicts, as Avro binary without a header using the `fastavro` module. Requires one of `schema` or `schema_file`.").
+			Optional()).
+		Field(service.NewStringEnumField("compression", python.CompressionNone, python.CompressionGzip, python.CompressionZstd).
+			Description("Compress the payload of each result, e.g. large generated blobs, naming the codec in the `content_encoding` metadata. `zstd` requires Python 3.14 or the `zstandard` module.").
+			Advanced().
+			Default(python.CompressionNone)).
+		Field(service.NewStringEnumField("json_library", python.JSONLibraryAuto, python.JSONLibraryJSON, python.JSONLibraryOrjson, python.JSONLibraryUjson).
+			Description("Library encoding results as JSON. `orjson` is several times faster than the standard `json` module and also handles datetimes and numpy arrays, while `auto` uses `orjson` or `ujson` if installed, falling back to `json`.").
+			Advanced().
+			Default(python.JSONLibraryJSON)).
+		Field(service.NewIntField("interpreters").
+			Description("Number of interpreters to run, bounding how many batches are processed in parallel. Defaults to the number of CPUs.").
+			Default(runtime.NumCPU())).
+		Field(service.NewInterpolatedStringMapField("args").
+			Description("A map of interpolated strings resolved per message and provided to the script as the `args` dict.").
+			Example(map[string]any{"tenant": `${! meta("tenant_id") }`}).
+			Default(map[string]any{})).
+		Field(service.NewStringField("init").
+			Description("Python code executed once per interpreter before any messages are processed, e.g. to warm-load models with `rpcn.once()`.").
+			Default("")).
+		Field(service.NewBoolField("lazy").
+			Description("Defer starting Python, and running `init`, until the first batch arrives, so rarely used branches of a pipeline don't pay the startup time and memory up front. The first batch waits for it instead.").
+			Advanced().
+			Default(false)).
+		Field(service.NewBoolField("patch").
+			Description("Expose a structured payload to the script as a mutable mapping, `this`, writing back only changed fields. The resulting payload is `this`; `root` is ignored unless set to `None`.").
+			Default(false)).
+		Field(service.NewBoolField("content_type").
+			Description("Set the `content_type` metadata of each result to `json`, `text`, or `bytes` by the type of `root`, unless the script set it in `meta`. Results of the binary serializers are `bytes`.").
+			Default(false)).
+		Field(service.NewBoolField("message_dicts").
+			Description("Treat a `root` dict of the form `{\"content\": ..., \"meta\": {...}, \"key\": ...}`, where only `content` is required, as the payload, metadata, and key of the result. The key is set in the `key` metadata.").
+			Advanced().
+			Default(false)).
+		Field(service.NewStringField("route_meta").
+			Description("Metadata key a `root` of `rpcn.Route(name, payload)` sets to the name of its route, so a companion `switch` output can steer subsets of traffic to different sinks. The payload of the result is `payload`.").
+			Advanced().
+			Default(DefaultRouteMetaKey)).
+		Field(service.NewObjectField("result_cache",
+			service.NewIntField("size").
+				Description("Maximum number of results to keep, evicting the least recently used. Disabled if 0.").
+				Default(0),
+			service.NewDurationField("ttl").
+				Description("How long a result is reused. Kept until evicted if `0s`.").
+				Default("0s")).
+			Description("Declare the script pure, a function of the payload and `args` alone, and cache its results keyed by a hash of them so repeated identical payloads skip Python entirely. Cached results reproduce the payload and metadata changes of the original, but not side effects like `msg.respond()`. Results that failed aren't cached. Requires serialization.").
+			Advanced()).
+		Field(service.NewBoolField("profile").
+			Description("Profile script execution with cProfile.").
+			Advanced().
+			Default(false)).
+		Field(service.NewDurationField("profile_interval").
+			Description("How often to dump profiling statistics.").
+			Advanced().
+			Default("60s")).
+		Field(service.NewStringField("profile_path").
+			Description("Directory to write pstats files to. If empty, the top functions are logged instead.").
+			Advanced().
+			Default("")).
+		Field(service.NewBoolField("tracemalloc").
+			Description("Trace Python memory allocations with tracemalloc, periodically logging the top allocation sites.").
+			Advanced().
+			Default(false)).
+		Field(service.NewDurationField("tracemalloc_interval").
+			Description("How often to log the top allocation sites.").
+			Advanced().
+			Default("60s")).
+		Field(service.NewBoolField("leak_detection").
+			Description("Debug reference leaks by periodically logging the growth in live Python objects by type, warning if the reference counts of objects held by the processor itself drift. Release builds of Python only count container objects.").
+			Advanced().
+			Default(false)).
+		Field(service.NewDurationField("leak_detection_interval").
+			Description("How often to report growth in live objects.").
+			Advanced().
+			Default("60s")).
+		Field(service.NewObjectField("validation",
+			service.NewStringField("model").
+				Description("A pydantic model, in the form `module:Model`, to validate payloads against.").
+				Optional(),
+			service.NewStringField("json_schema").
+				Description("A JSON schema document to validate payloads against. Requires the `jsonschema` module.").
+				Optional()).
+			Description("Validate payloads before executing the script. Messages failing validation are flagged as errored with the validation details.").
+			Optional()).
+		LintRule(`root = [
+  python_syntax_error("script", this.script | "", this.exe | "python3"),
+  python_syntax_error("init", this.init | "", this.exe | "python3"),
+]`)
 
 	err := service.RegisterBatchProcessor("python", configSpec,
 		func(conf *service.ParsedConfig, mgr *service.Resources) (service.BatchProcessor, error) {
 			// Extract our configuration.
-			exe, err := conf.FieldString("exe")
+			runtimeConf, err := python.ParseRuntimeConfig(conf, mgr.Logger())
+			if err != nil {
+				return nil, err
+			}
+			scriptDir, err := conf.FieldString("script_dir")
+			if err != nil {
+				return nil, err
+			}
+			entryModule, err := conf.FieldString("entry_module")
+			if err != nil {
+				return nil, err
+			}
+			identity, err := python.ParseIdentity(conf, mgr)
+			if err != nil {
+				return nil, err
+			}
+			runtimeName, err := conf.FieldString("runtime")
+			if err != nil {
+				return nil, err
+			}
+			watchdogTimeout, err := conf.FieldDuration("watchdog_timeout")
+			if err != nil {
+				return nil, err
+			}
+			maxAllocatedBlocks, err := conf.FieldInt("max_allocated_blocks")
 			if err != nil {
-				panic(err)
+				return nil, err
+			}
+			maxMessages, err := conf.FieldInt("max_messages_per_interpreter")
+			if err != nil {
+				return nil, err
 			}
 			script, err := conf.FieldString("script")
 			if err != nil {
 				return nil, err
 			}
-			modeString, err := conf.FieldString("mode")
+			if err = python.AuditScript(mgr.Logger(), "script", script, runtimeConf.ScriptChecksums); err != nil {
+				return nil, err
+			}
+			handler, err := conf.FieldString("handler")
+			if err != nil {
+				return nil, err
+			}
+			debugAddress, err := conf.FieldString("debug", "address")
+			if err != nil {
+				return nil, err
+			}
+			debugWait, err := conf.FieldBool("debug", "wait")
 			if err != nil {
 				return nil, err
 			}
+			if err = python.SetDebugger(debugAddress, debugWait, runtimeConf.Mode); err != nil {
+				return nil, err
+			}
+			registryURL, err := conf.FieldString("schema_registry", "url")
+			if err != nil {
+				return nil, err
+			}
+			registryUsername, err := conf.FieldString("schema_registry", "username")
+			if err != nil {
+				return nil, err
+			}
+			registryPassword, err := conf.FieldString("schema_registry", "password")
+			if err != nil {
+				return nil, err
+			}
+			if err = python.SetSchemaRegistry(registryURL, registryUsername, registryPassword); err != nil {
+				return nil, err
+			}
 			serializer, err := conf.FieldString("serializer")
 			if err != nil {
 				return nil, err
 			}
+			interpreters, err := conf.FieldInt("interpreters")
+			if err != nil {
+				return nil, err
+			}
+			if interpreters < 1 {
+				return nil, errors.New("interpreters must be at least 1")
+			}
+			args, err := conf.FieldInterpolatedStringMap("args")
+			if err != nil {
+				return nil, err
+			}
+			initScript, err := conf.FieldString("init")
+			if err != nil {
+				return nil, err
+			}
+			if err = python.AuditScript(mgr.Logger(), "init", initScript, runtimeConf.ScriptChecksums); err != nil {
+				return nil, err
+			}
+			lazy, err := conf.FieldBool("lazy")
+			if err != nil {
+				return nil, err
+			}
+			contentType, err := conf.FieldBool("content_type")
+			if err != nil {
+				return nil, err
+			}
+			messageDicts, err := conf.FieldBool("message_dicts")
+			if err != nil {
+				return nil, err
+			}
+			routeMeta, err := conf.FieldString("route_meta")
+			if err != nil {
+				return nil, err
+			}
+			resultCacheSize, err := conf.FieldInt("result_cache", "size")
+			if err != nil {
+				return nil, err
+			}
+			resultCacheTTL, err := conf.FieldDuration("result_cache", "ttl")
+			if err != nil {
+				return nil, err
+			}
+			patch, err := conf.FieldBool("patch")
+			if err != nil {
+				return nil, err
+			}
+			profile, err := conf.FieldBool("profile")
+			if err != nil {
+				return nil, err
+			}
+			profileInterval, err := conf.FieldDuration("profile_interval")
+			if err != nil {
+				return nil, err
+			}
+			profilePath, err := conf.FieldString("profile_path")
+			if err != nil {
+				return nil, err
+			}
+			tracemalloc, err := conf.FieldBool("tracemalloc")
+			if err != nil {
+				return nil, err
+			}
+			tracemallocInterval, err := conf.FieldDuration("tracemalloc_interval")
+			if err != nil {
+				return nil, err
+			}
+			leakDetection, err := conf.FieldBool("leak_detection")
+			if err != nil {
+				return nil, err
+			}
+			leakDetectionInterval, err := conf.FieldDuration("leak_detection_interval")
+			if err != nil {
+				return nil, err
+			}
+			model, schema := "", ""
+			if conf.Contains("validation", "model") {
+				model, err = conf.FieldString("validation", "model")
+				if err != nil {
+					return nil, err
+				}
+			}
+			if conf.Contains("validation", "json_schema") {
+				schema, err = conf.FieldString("validation", "json_schema")
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			avroSchema := ""
+			if conf.Contains("avro", "schema") {
+				avroSchema, err = conf.FieldString("avro", "schema")
+				if err != nil {
+					return nil, err
+				}
+			}
+			if conf.Contains("avro", "schema_file") {
+				if avroSchema != "" {
+					return nil, errors.New("avro supports either a schema or a schema_file, not both")
+				}
+				schemaFile, err := conf.FieldString("avro", "schema_file")
+				if err != nil {
+					return nil, err
+				}
+				data, err := os.ReadFile(schemaFile)
+				if err != nil {
+					return nil, fmt.Errorf("failed to read avro schema: %w", err)
+				}
+				avroSchema = string(data)
+			}
+
+			jsonLibrary, err := conf.FieldString("json_library")
+			if err != nil {
+				return nil, err
+			}
+			compression, err := conf.FieldString("compression")
+			if err != nil {
+				return nil, err
+			}
 
-			return NewPythonProcessor(exe, script, runtime.NumCPU(),
-				python.StringAsMode(modeString),
-				python.StringAsSerializerMode(serializer),
-				mgr.Logger())
+			return NewPythonProcessor(Config{
+				Exe:                   runtimeConf.Exe,
+				Script:                script,
+				Handler:               handler,
+				Interpreters:          interpreters,
+				Mode:                  runtimeConf.Mode,
+				Serializer:            python.StringAsSerializerMode(serializer),
+				Args:                  args,
+				Model:                 model,
+				JSONSchema:            schema,
+				AvroSchema:            avroSchema,
+				JSONLibrary:           jsonLibrary,
+				Compression:           compression,
+				Path:                  runtimeConf.Path,
+				ScriptDir:             scriptDir,
+				EntryModule:           entryModule,
+				PreloadModules:        runtimeConf.Preload,
+				RequireModules:        runtimeConf.Requires,
+				Environment:           runtimeConf.Environment,
+				Identity:              identity,
+				Runtime:               runtimeName,
+				ShutdownTimeout:       runtimeConf.ShutdownTimeout,
+				WatchdogTimeout:       watchdogTimeout,
+				MaxAllocatedBlocks:    maxAllocatedBlocks,
+				MaxMessages:           maxMessages,
+				Init:                  initScript,
+				Lazy:                  lazy,
+				Patch:                 patch,
+				ContentType:           contentType,
+				MessageDicts:          messageDicts,
+				RouteMeta:             routeMeta,
+				ResultCacheSize:       resultCacheSize,
+				ResultCacheTTL:        resultCacheTTL,
+				Profile:               profile,
+				ProfileInterval:       profileInterval,
+				ProfilePath:           profilePath,
+				Tracemalloc:           tracemalloc,
+				TracemallocInterval:   tracemallocInterval,
+				LeakDetection:         leakDetection,
+				LeakDetectionInterval: leakDetectionInterval,
+				Metrics:               mgr.Metrics(),
+			}, mgr.Logger())
 		})
 	if err != nil {
 		// There's no way to fail initialization. We must panic. :(
@@ -130,18 +716,69 @@ func init() {
 //
 // This will create and initialize a new sub-interpreter from the main Python
 // Go routine and precompile some Python code objects.
-func NewPythonProcessor(exe, script string, cnt int, mode python.Mode, serializer python.SerializerMode,
-	logger *service.Logger) (service.BatchProcessor, error) {
-
+func NewPythonProcessor(cfg Config, logger *service.Logger) (service.BatchProcessor, error) {
 	var err error
 	ctx := context.Background()
 
+	exe, script, cnt := cfg.Exe, cfg.Script, cfg.Interpreters
+	mode, serializer := cfg.Mode, cfg.Serializer
+
+	if cnt < 1 {
+		return nil, errors.New("interpreters must be at least 1")
+	}
+	if cfg.Handler != "" {
+		if script != "" {
+			return nil, errors.New("script and handler are mutually exclusive")
+		}
+		if !handlerName.MatchString(cfg.Handler) {
+			return nil, fmt.Errorf("handler '%s' is not a python name", cfg.Handler)
+		}
+		// Calling the handler is just a script of its own.
+		script = fmt.Sprintf("root = %s(**args)", cfg.Handler)
+	} else if script == "" {
+		return nil, errors.New("either script or handler is required")
+	}
+
 	// XXX for now, enforce that we only support non-serializing modes when
-	// using a global interpreter mode.
-	if serializer == python.None && mode != python.Global {
+	// using the main interpreter.
+	if serializer == python.None && mode != python.Global && mode != python.FreeThreaded {
 		return nil,
 			errors.New("isolated interpreters require bloblang or pickle serialization")
 	}
+	if cfg.Patch && serializer != python.Bloblang {
+		return nil, errors.New("patch mode requires bloblang serialization")
+	}
+	if serializer == python.CSV {
+		return nil, errors.New("csv serialization is only supported by the python input")
+	}
+	if serializer == python.Avro && cfg.AvroSchema == "" {
+		return nil, errors.New("avro serialization requires an avro schema")
+	}
+	if serializer != python.Avro && cfg.AvroSchema != "" {
+		return nil, errors.New("an avro schema requires avro serialization")
+	}
+	if serializer == python.None && cfg.Compression != "" && cfg.Compression != python.CompressionNone {
+		return nil, errors.New("compression requires serialization")
+	}
+	if serializer == python.None && cfg.ResultCacheSize > 0 {
+		return nil, errors.New("result_cache requires serialization")
+	}
+	if cfg.ResultCacheSize < 0 {
+		return nil, errors.New("result_cache size must not be negative")
+	}
+	if cfg.Model != "" && cfg.JSONSchema != "" {
+		return nil, errors.New("validation supports either a model or a json_schema, not both")
+	}
+	if cfg.WatchdogTimeout > 0 && mode != python.Isolated && mode != python.IsolatedLegacy {
+		return nil, errors.New("watchdog requires an isolated mode")
+	}
+	if cfg.MaxAllocatedBlocks > 0 && mode != python.Isolated {
+		// Other modes share the main interpreter's allocator.
+		return nil, errors.New("max_allocated_blocks requires the isolated mode")
+	}
+	if cfg.MaxMessages > 0 && mode != python.Isolated && mode != python.IsolatedLegacy {
+		return nil, errors.New("max_messages_per_interpreter requires an isolated mode")
+	}
 
 	// Spin up our runtime.
 	var processor *PythonProcessor
@@ -152,35 +789,89 @@ func NewPythonProcessor(exe, script string, cnt int, mode python.Mode, serialize
 		processor, err = newLegacyRuntimeProcessor(exe, cnt, logger)
 	case python.Global:
 		processor, err = newSingleRuntimeProcessor(exe, cnt, logger)
+	case python.FreeThreaded:
+		processor, err = newFreeThreadedRuntimeProcessor(exe, cnt, logger)
 	default:
 		return nil, errors.New("invalid mode")
 	}
 	if err != nil {
 		return nil, err
 	}
+	if cfg.Runtime != "" {
+		shared, err := python.ShareRuntime(cfg.Runtime, exe, mode, processor.runtime)
+		if err != nil {
+			return nil, err
+		}
+		processor.runtime = shared
+	}
+	// Watch whichever runtime we ended up with, as a shared one may not be
+	// the one we just created.
+	if cfg.WatchdogTimeout > 0 {
+		restarts := cfg.Metrics.NewCounter("python_interpreter_restarts")
+		watchdog := python.Watchdog{
+			Timeout: cfg.WatchdogTimeout,
+			OnRestart: func(id int64, _ string) {
+				// Drop the stuck interpreter's state. Its replacement is
+				// initialized when first used.
+				processor.mtx.Lock()
+				delete(processor.interpreters, id)
+				processor.mtx.Unlock()
+				restarts.Incr(1)
+			},
+		}
+		switch r := processor.runtime.(type) {
+		case *python.SharedRuntime:
+			if err = r.SetWatchdog(watchdog); err != nil {
+				return nil, err
+			}
+		case *python.MultiInterpreterRuntime:
+			r.SetWatchdog(watchdog)
+		}
+	}
+	processor.runtime = python.NewMeteredRuntime(processor.runtime, cfg.Metrics)
 
 	// TODO: should probably tie this logic into the runtime mode as they go hand-in-hand.
 	processor.serializerMode = serializer
-
-	// Start the runtime now to ferret out errors.
-	err = processor.runtime.Start(ctx)
-	if err != nil {
-		return nil, err
+	processor.spanAttributes = python.SpanAttributes(mode, script)
+	processor.args = cfg.Args
+	processor.profileEvery = cfg.ProfileInterval
+	processor.tracemallocEvery = cfg.TracemallocInterval
+	processor.leaksEvery = cfg.LeakDetectionInterval
+	processor.patch = cfg.Patch
+	processor.contentType = cfg.ContentType
+	processor.messageDicts = cfg.MessageDicts
+	processor.compression = cfg.Compression
+	processor.routeMeta = cfg.RouteMeta
+	if cfg.ResultCacheSize > 0 {
+		processor.results = newResultCache(cfg.ResultCacheSize, cfg.ResultCacheTTL, cfg.Metrics)
+	}
+	if processor.routeMeta == "" {
+		processor.routeMeta = DefaultRouteMetaKey
+	}
+	processor.maxAllocatedBlocks = int64(cfg.MaxAllocatedBlocks)
+	processor.maxMessages = cfg.MaxMessages
+	processor.recyclable = mode == python.Isolated || mode == python.IsolatedLegacy
+	processor.recycles = cfg.Metrics.NewCounter("python_interpreter_recycles")
+	processor.shutdownTimeout = cfg.ShutdownTimeout
+	if processor.shutdownTimeout <= 0 {
+		processor.shutdownTimeout = 10 * time.Second
 	}
 
-	// Initialize our sub-interpreter state.
-	err = processor.runtime.Map(ctx, func(token *python.InterpreterTicket) error {
+	processor.lazy = cfg.Lazy
+	processor.ready = cfg.Metrics.NewGauge("python_interpreters_ready")
+
+	// Initialize our sub-interpreter state. We hang onto this for any
+	// interpreters replaced by our watchdog.
+	processor.init = func(token *python.InterpreterTicket) error {
 		// Pre-compile our script and helpers.
-		code := py.Py_CompileString(script, "__rp_connect_python__.py", py.PyFileInput)
-		if code == py.NullPyCodeObjectPtr {
-			py.PyErr_Print()
-			return errors.New("failed to compile python script")
+		code, err := python.Compile(script, "__rp_connect_python__.py")
+		if err != nil {
+			return err
 		}
 
 		// Pre-compile our script and helpers.
-		helperCode := py.Py_CompileString(globalHelperSrc, "__bloblang__.py", py.PyFileInput)
-		if helperCode == py.NullPyCodeObjectPtr {
-			py.PyErr_Print()
+		helperCode, err := python.Compile(globalHelperSrc, "__bloblang__.py")
+		if err != nil {
 			return errors.New("failed to compile python helper script")
 		}
 		helperModule := py.PyImport_ExecCodeModule("__bloblang__", helperCode)
@@ -200,6 +891,16 @@ func NewPythonProcessor(exe, script string, cnt int, mode python.Mode, serialize
 			return err
 		}
 		py.PyModule_AddObjectRef(helperModule, GlobalContent, content.Object)
+		field, err := python.NewCallback(GlobalField, fieldCallback)
+		if err != nil {
+			return err
+		}
+		py.PyModule_AddObjectRef(helperModule, GlobalField, field.Object)
+		errorFn, err := python.NewCallback(GlobalError, errorCallback)
+		if err != nil {
+			return err
+		}
+		py.PyModule_AddObjectRef(helperModule, GlobalError, errorFn.Object)
 
 		// Prepare our Root instance and get a reference to it's clear method.
 		rootClass := py.PyObject_GetAttrString(helperModule, "Root")
@@ -223,14 +924,67 @@ func NewPythonProcessor(exe, script string, cnt int, mode python.Mode, serialize
 			return errors.New("failed to find to_dict method on Root instance")
 		}
 
-		// Set up our main module and derive our globals from it.
-		main := py.PyImport_AddModule("__main__")
-		if main == py.NullPyObjectPtr {
-			return errors.New("failed to add __main__ module")
+		// Prepare our Message instance.
+		msgClass := py.PyObject_GetAttrString(helperModule, "Message")
+		if msgClass == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find Message class in helper module")
+		}
+		msg := py.PyObject_CallNoArgs(msgClass)
+		py.Py_DecRef(msgClass)
+		if msg == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to create new Message instance")
+		}
+		msgClear := py.PyObject_GetAttrString(msg, "_clear")
+		if msgClear == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find _clear method on Message instance")
+		}
+		msgPendingError := py.PyObject_GetAttrString(msg, "_pending_error")
+		if msgPendingError == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find _pending_error method on Message instance")
+		}
+		msgPendingResponse := py.PyObject_GetAttrString(msg, "_pending_response")
+		if msgPendingResponse == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find _pending_response method on Message instance")
+		}
+
+		// Prepare our Document instance used in patch mode.
+		documentClass := py.PyObject_GetAttrString(helperModule, "Document")
+		if documentClass == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find Document class in helper module")
+		}
+		document := py.PyObject_CallNoArgs(documentClass)
+		py.Py_DecRef(documentClass)
+		if document == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to create new Document instance")
+		}
+		documentClear := py.PyObject_GetAttrString(document, "clear_state")
+		if documentClear == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find clear_state method on Document instance")
+		}
+		documentChanges := py.PyObject_GetAttrString(document, "changes")
+		if documentChanges == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find changes method on Document instance")
 		}
-		globals := py.PyModule_GetDict(main)
-		if globals == py.NullPyObjectPtr {
-			return errors.New("failed to create globals")
+		fields := &documentFields{}
+		addr := py.PyLong_FromUnsignedLong(uint64(uintptr(unsafe.Pointer(fields))))
+		if py.PyModule_AddObjectRef(helperModule, GlobalFieldsAddr, addr) != 0 {
+			return errors.New("failed to set address of document fields")
+		}
+		py.Py_DecRef(addr)
+
+		// Look up the globals for this interpreter.
+		globals, err := token.Globals()
+		if err != nil {
+			return err
 		}
 
 		// Pre-populate globals.
@@ -252,70 +1006,277 @@ func NewPythonProcessor(exe, script string, cnt int, mode python.Mode, serialize
 			return errors.New("failed to find unpickle function in helper module")
 		}
 		py.PyDict_SetItemString(globals, "unpickle", unpickleFn)
+		unbsonFn := py.PyObject_GetAttrString(helperModule, "unbson")
+		if unbsonFn == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find unbson function in helper module")
+		}
+		py.PyDict_SetItemString(globals, "unbson", unbsonFn)
 
-		// Wire in root and "meta" objects.
-		locals := py.PyDict_New()
-		meta := py.PyDict_New()
-
-		// Create our serializer.
-		serializer, err := python.NewSerializer()
+		// Provide our rpcn helper module, both importable and as a global.
+		rpcnModule, err := python.LoadRpcnModule()
 		if err != nil {
 			return err
 		}
-
-		processor.interpreters[token.Id()] = &interpreter{
-			code:         code,
-			helperCode:   helperCode,
-			helperModule: helperModule,
-			root:         root,
-			rootClass:    rootClass,
-			rootClear:    rootClear,
-			rootToDict:   rootToDict,
-			meta:         meta,
-			globals:      globals,
-			locals:       locals,
-			serializer:   serializer,
-			callbacks:    []*python.Callback{metadata, content},
+		py.PyDict_SetItemString(globals, "rpcn", rpcnModule)
+		classify := py.PyObject_GetAttrString(rpcnModule, "_classify")
+		if classify == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find _classify function in rpcn module")
+		}
+		traceBegin := py.PyObject_GetAttrString(rpcnModule, "_trace_begin")
+		if traceBegin == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find _trace_begin function in rpcn module")
+		}
+		traceEnd := py.PyObject_GetAttrString(rpcnModule, "_trace_end")
+		if traceEnd == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find _trace_end function in rpcn module")
+		}
+		routeClass := py.PyObject_GetAttrString(rpcnModule, "Route")
+		if routeClass == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find Route class in rpcn module")
 		}
-		return nil
-	})
 
-	if err != nil {
-		// Something is borked. Try to clean up.
-		_ = processor.runtime.Stop(ctx)
-		return nil, err
-	}
+		// Send print() and friends to our logger.
+		if err = python.CaptureOutput(processor.logger); err != nil {
+			return err
+		}
 
-	return processor, nil
-}
+		// Apply environment variables before running anything of the user's.
+		if err = python.SetEnvironment(cfg.Environment); err != nil {
+			return err
+		}
 
-func newMultiRuntimeProcessor(exe string, cnt int, logger *service.Logger) (*PythonProcessor, error) {
-	r, err := python.NewMultiInterpreterRuntime(exe, cnt, false, logger)
-	if err != nil {
-		return nil, err
-	}
+		// Make any local helper modules importable.
+		if err = python.ExtendSysPath(cfg.Path); err != nil {
+			return err
+		}
 
-	p := PythonProcessor{
-		logger:       logger,
-		runtime:      r,
-		interpreters: make(map[int64]*interpreter),
-	}
-	p.alive.Store(int32(cnt))
-	return &p, nil
-}
+		// Fail fast, saying where we looked, if a dependency is missing.
+		if err = python.RequireModules(cfg.RequireModules); err != nil {
+			return err
+		}
 
-func newLegacyRuntimeProcessor(exe string, cnt int, logger *service.Logger) (*PythonProcessor, error) {
-	r, err := python.NewMultiInterpreterRuntime(exe, cnt, true, logger)
-	if err != nil {
-		return nil, err
-	}
+		// Pay for slow imports now rather than on the first message.
+		if err = python.PreloadModules(cfg.PreloadModules); err != nil {
+			return err
+		}
+
+		// Bring in the project backing us, if any.
+		if err = python.ImportPackage(cfg.ScriptDir, cfg.EntryModule, globals); err != nil {
+			return err
+		}
+
+		// Tell scripts who we are.
+		if err = python.SetIdentity(globals, cfg.Identity); err != nil {
+			return err
+		}
+
+		// Run any initialization code, e.g. warm-loading of models.
+		if cfg.Init != "" {
+			initCode, err := python.Compile(cfg.Init, "__rp_connect_python_init__.py")
+			if err != nil {
+				return err
+			}
+			result := py.PyEval_EvalCode(initCode, globals, globals)
+			if result == py.NullPyObjectPtr {
+				py.PyErr_Print()
+				return errors.New("failed to execute python init script")
+			}
+			py.Py_DecRef(result)
+		}
+
+		// Wire in root and "meta" objects.
+		locals := py.PyDict_New()
+		meta := py.PyDict_New()
+		args := py.PyDict_New()
+
+		// Globals may be shared with other components, so our identity also
+		// goes in our locals.
+		if err = python.SetIdentity(locals, cfg.Identity); err != nil {
+			return err
+		}
+
+		// Create our serializer.
+		serializer, err := python.NewSerializer()
+		if err != nil {
+			return err
+		}
+		if cfg.Serializer == python.Avro {
+			if err = serializer.SetAvroSchema(cfg.AvroSchema); err != nil {
+				return err
+			}
+		}
+		if cfg.Serializer == python.CBOR {
+			if err = serializer.SetCBOR(); err != nil {
+				return err
+			}
+		}
+		if cfg.Serializer == python.BSON {
+			if err = serializer.SetBSON(); err != nil {
+				return err
+			}
+		}
+		if cfg.Compression != "" {
+			if err = serializer.SetCompression(cfg.Compression); err != nil {
+				return err
+			}
+		}
+		if cfg.JSONLibrary != "" {
+			library, err := serializer.SetJSONLibrary(cfg.JSONLibrary)
+			if err != nil {
+				return err
+			}
+			processor.logger.Debugf("Encoding JSON with %s.", library)
+		}
+
+		// Create our validator, if configured.
+		validate := py.NullPyObjectPtr
+		if cfg.Model != "" || cfg.JSONSchema != "" {
+			validate, err = newValidator(cfg.Model, cfg.JSONSchema)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Create our profiler, if enabled.
+		var prof *profiler
+		if cfg.Profile {
+			prof, err = newProfiler(cfg.ProfilePath)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Start tracing memory allocations, if enabled.
+		var tracer *memoryTracer
+		if cfg.Tracemalloc {
+			tracer, err = newMemoryTracer()
+			if err != nil {
+				return err
+			}
+		}
+
+		// Track the objects we hold onto for leaks, if enabled.
+		var leaks *leakTracker
+		if cfg.LeakDetection {
+			leaks, err = newLeakTracker(map[string]py.PyObjectPtr{
+				"globals":  globals,
+				"locals":   locals,
+				"root":     root,
+				"meta":     meta,
+				"msg":      msg,
+				"document": document,
+				"args":     args,
+				"validate": validate,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		processor.mtx.Lock()
+		defer processor.mtx.Unlock()
+		processor.interpreters[token.Id()] = &interpreter{
+			code:               code,
+			helperCode:         helperCode,
+			helperModule:       helperModule,
+			root:               root,
+			rootClass:          rootClass,
+			rootClear:          rootClear,
+			rootToDict:         rootToDict,
+			routeClass:         routeClass,
+			msg:                msg,
+			msgClear:           msgClear,
+			msgPendingError:    msgPendingError,
+			msgPendingResponse: msgPendingResponse,
+			document:           document,
+			documentClear:      documentClear,
+			documentChanges:    documentChanges,
+			fields:             fields,
+			meta:               meta,
+			args:               args,
+			validate:           validate,
+			profiler:           prof,
+			classify:           classify,
+			traceBegin:         traceBegin,
+			traceEnd:           traceEnd,
+			memoryTracer:       tracer,
+			leakTracker:        leaks,
+			globals:            globals,
+			locals:             locals,
+			serializer:         serializer,
+			callbacks:          []*python.Callback{metadata, content, field, errorFn},
+		}
+		return nil
+	}
+	if cfg.Lazy {
+		// We're started by the first batch instead.
+		return processor, nil
+	}
+
+	// Start the runtime now to ferret out errors.
+	if err = processor.start(ctx); err != nil {
+		return nil, err
+	}
+	return processor, nil
+}
+
+// start starts our runtime and initializes every interpreter, unless that's
+// already done.
+func (p *PythonProcessor) start(ctx context.Context) error {
+	p.startMtx.Lock()
+	defer p.startMtx.Unlock()
+	if p.started.Load() {
+		return nil
+	}
+
+	err := p.runtime.Start(ctx)
+	if err != nil {
+		return err
+	}
+	err = p.runtime.Map(ctx, p.init)
+	if err != nil {
+		// Something is borked. Try to clean up.
+		_ = p.runtime.Stop(ctx)
+		return err
+	}
+	p.started.Store(true)
+
+	// Signal readiness now that every interpreter is warm.
+	p.logger.Debugf("Initialized %d interpreters.", len(p.interpreters))
+	p.ready.Set(int64(len(p.interpreters)))
+	return nil
+}
+
+func newMultiRuntimeProcessor(exe string, cnt int, logger *service.Logger) (*PythonProcessor, error) {
+	r, err := python.NewMultiInterpreterRuntime(exe, cnt, false, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	p := PythonProcessor{
+		logger:       logger,
+		runtime:      r,
+		interpreters: make(map[int64]*interpreter),
+	}
+	return &p, nil
+}
+
+func newLegacyRuntimeProcessor(exe string, cnt int, logger *service.Logger) (*PythonProcessor, error) {
+	r, err := python.NewMultiInterpreterRuntime(exe, cnt, true, logger)
+	if err != nil {
+		return nil, err
+	}
 
 	p := PythonProcessor{
 		logger:       logger,
 		runtime:      r,
 		interpreters: make(map[int64]*interpreter),
 	}
-	p.alive.Store(int32(cnt))
 	return &p, nil
 }
 
@@ -330,30 +1291,126 @@ func newSingleRuntimeProcessor(exe string, cnt int, logger *service.Logger) (*Py
 		runtime:      r,
 		interpreters: make(map[int64]*interpreter),
 	}
-	p.alive.Store(1)
 	return &p, nil
 }
 
+func newFreeThreadedRuntimeProcessor(exe string, cnt int, logger *service.Logger) (*PythonProcessor, error) {
+	r, err := python.NewFreeThreadedRuntime(exe, cnt, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	p := PythonProcessor{
+		logger:       logger,
+		runtime:      r,
+		interpreters: make(map[int64]*interpreter),
+	}
+	return &p, nil
+}
+
+// stateFor looks up the state of the ticket's interpreter, initializing it
+// first if it's a replacement for one our watchdog gave up on.
+func (p *PythonProcessor) stateFor(ctx context.Context, ticket *python.InterpreterTicket) (*interpreter, error) {
+	p.mtx.RLock()
+	i, ok := p.interpreters[ticket.Id()]
+	p.mtx.RUnlock()
+	if ok {
+		return i, nil
+	}
+
+	err := p.runtime.Apply(ticket, ctx, func() error { return p.init(ticket) })
+	if err != nil {
+		return nil, err
+	}
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	return p.interpreters[ticket.Id()], nil
+}
+
+// recycle replaces the ticket's interpreter with a fresh one, releasing the
+// ticket. The state of the old interpreter is dropped.
+func (p *PythonProcessor) recycle(ctx context.Context, ticket *python.InterpreterTicket) {
+	p.mtx.Lock()
+	delete(p.interpreters, ticket.Id())
+	p.mtx.Unlock()
+
+	err := p.runtime.(python.Recycler).Recycle(ticket, ctx)
+	if err != nil {
+		p.logger.Warnf("Failed to recycle interpreter %d: %s", ticket.Id(), err)
+		return
+	}
+	p.recycles.Incr(1)
+}
+
 // ProcessBatch executes the given Python script against each message in the batch.
 func (p *PythonProcessor) ProcessBatch(ctx context.Context, batch service.MessageBatch) ([]service.MessageBatch, error) {
+	// Start up if we're lazy and this is our first batch.
+	if !p.started.Load() {
+		if err := p.start(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	// Reuse the results of a pure script for payloads we've seen, skipping
+	// Python entirely if we've seen them all.
+	var keys []string
+	var hits []*cachedResult
+	if p.results != nil {
+		var all bool
+		keys, hits, all = p.results.lookup(batch, p.args)
+		if all {
+			newBatch := service.MessageBatch{}
+			for idx, m := range batch {
+				if result := hits[idx].apply(m); result != nil {
+					newBatch = append(newBatch, result)
+				}
+			}
+			if len(newBatch) == 0 {
+				return nil, nil
+			}
+			return []service.MessageBatch{newBatch}, nil
+		}
+	}
+
 	// Acquire an interpreter and look up our local state.
 	ticket, err := p.runtime.Acquire(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer func() { _ = p.runtime.Release(ticket) }()
+	recycle := false
+	defer func() {
+		if recycle {
+			p.recycle(ctx, ticket)
+		} else {
+			_ = p.runtime.Release(ticket)
+		}
+	}()
 
 	// Look up our previously initialized interpreter state.
-	i := p.interpreters[ticket.Id()]
+	i, err := p.stateFor(ctx, ticket)
+	if err != nil {
+		return nil, err
+	}
 
 	newBatch := service.MessageBatch{}
+	// Where the results of each message start in newBatch, for caching them.
+	offsets := make([]int, len(batch)+1)
 
 	err = p.runtime.Apply(ticket, ctx, func() error {
-		for _, m := range batch {
+		for idx, m := range batch {
 			// Abort if we're cancelling execution.
 			if ctx.Err() != nil {
 				return ctx.Err()
 			}
+			offsets[idx] = len(newBatch)
+
+			// Use what we made of the payload before, if we can.
+			if hits != nil && hits[idx] != nil {
+				if result := hits[idx].apply(m); result != nil {
+					newBatch = append(newBatch, result)
+				}
+				continue
+			}
 
 			// Clear out any local state from previous messages.
 			py.PyDict_Clear(i.meta)
@@ -363,6 +1420,33 @@ func (p *PythonProcessor) ProcessBatch(ctx context.Context, batch service.Messag
 			// the interpreter and serializer modes.
 			py.PyDict_SetItemString(i.locals, "root", i.root)
 			py.PyDict_SetItemString(i.locals, "meta", i.meta)
+			py.Py_DecRef(py.PyObject_CallNoArgs(i.msgClear))
+			py.PyDict_SetItemString(i.locals, "msg", i.msg)
+
+			// Resolve our interpolated arguments against the message.
+			err = setArgs(p.args, m, i)
+			if err != nil {
+				newMessage := m.Copy()
+				newMessage.SetError(err)
+				newBatch = append(newBatch, newMessage)
+				continue
+			}
+			py.PyDict_SetItemString(i.locals, "args", i.args)
+
+			// Reject invalid payloads before they reach the script.
+			if i.validate != py.NullPyObjectPtr {
+				err = validateMessage(m, i)
+				if err != nil {
+					newMessage := m.Copy()
+					newMessage.SetError(err)
+					var exc *python.Exception
+					if errors.As(err, &exc) {
+						exc.SetMetadata(newMessage)
+					}
+					newBatch = append(newBatch, newMessage)
+					continue
+				}
+			}
 
 			// Set up our pointer to our service.Message in case the script is
 			// accessing raw bytes.
@@ -384,15 +1468,68 @@ func (p *PythonProcessor) ProcessBatch(ctx context.Context, batch service.Messag
 				py.PyDict_SetItemString(i.locals, "this", this.(py.PyObjectPtr))
 			}
 
+			// In patch mode, "this" is our lazy Document proxy.
+			if p.patch {
+				i.fields.reset(m)
+				py.Py_DecRef(py.PyObject_CallNoArgs(i.documentClear))
+				py.PyDict_SetItemString(i.locals, "this", i.document)
+			}
+
 			// Evaluate the Python script that was pre-compiled into a code object.
 			// It should have access to global helper functions/classes and should
 			// set a local called "root".
+			eval, err := p.beginEvaluation(m, i)
+			if err != nil {
+				return err
+			}
+			if i.profiler != nil {
+				i.profiler.Enable()
+			}
 			result := py.PyEval_EvalCode(i.code, i.globals, i.locals)
+			if i.profiler != nil {
+				i.profiler.Disable()
+			}
 			if result == py.NullPyObjectPtr {
-				py.PyErr_Print()
-				return errors.New("problem executing Python script")
+				python.StashException()
+				kind, exc := classifyError(i)
+				err = scriptError(kind, exc)
+				if eval != nil {
+					var exception string
+					if exc != nil {
+						exception = exc.Error()
+					}
+					if endErr := eval.end(i, exception, err); endErr != nil {
+						p.logger.Warnf("Failed to record spans of python script: %s", endErr)
+					}
+				}
+				if kind == reject {
+					// Drop just this message and keep going.
+					p.logger.Debugf("Dropping message: %s", err)
+					continue
+				}
+				if kind == fatal {
+					// Fail just this message and keep going.
+					newMessage := m.Copy()
+					newMessage.SetError(err)
+					if exc != nil {
+						exc.SetMetadata(newMessage)
+					}
+					newBatch = append(newBatch, newMessage)
+					continue
+				}
+				// The batch fails and is passed on as it is, so describe the
+				// exception on the message we were given.
+				if exc != nil {
+					exc.SetMetadata(m)
+				}
+				return err
 			}
 			py.Py_DecRef(result)
+			if eval != nil {
+				if err = eval.end(i, "", nil); err != nil {
+					p.logger.Warnf("Failed to record spans of python script: %s", err)
+				}
+			}
 
 			// The user script should have modified a local called "root".
 			// Note: we don't call Py_DecRef as this is a borrowed reference.
@@ -416,50 +1553,309 @@ func (p *PythonProcessor) ProcessBatch(ctx context.Context, batch service.Messag
 				}
 			}
 
-			// Handle the actual message data based on our serializer mode.
-			switch p.serializerMode {
-			case python.None:
-				// We don't serialize and instead pass a Python object pointer.
+			// The user might have set or cleared the error on the message.
+			err = handleError(newMessage, i)
+			if err != nil {
+				newMessage.SetError(err)
+			}
+
+			// The user might have replied to the source of the message.
+			err = handleResponse(newMessage, i)
+			if err != nil {
+				newMessage.SetError(err)
+			}
+
+			// In patch mode, we apply the changes to "this" instead of using
+			// "root", though we still honor dropping.
+			if p.patch {
 				if py.BaseType(root) == py.None {
-					// Drop the message.
-					// TODO: Is this correct? To drop do we just not output a new message?
-					continue
-				} else {
-					// XXX validate we're using global interpreter mode?
-					newMessage.SetStructured(root)
-				}
-			case python.Bloblang:
-				drop, err := handleRootAsJson(root, newMessage, i)
-				if drop {
-					// TODO: Is this correct? To drop do we just not output a new message?
 					continue
 				}
+				err = applyPatch(newMessage, i)
 				if err != nil {
 					newMessage.SetError(err)
 				}
-
-			case python.Pickle:
-				drop, err := handleRootAsPickle(root, newMessage, i)
-				if drop {
-					// TODO: Is this correct? To drop do we just not output a new message?
-					continue
+				if p.contentType && !inMeta(meta, ContentTypeMetaKey) {
+					newMessage.MetaSetMut(ContentTypeMetaKey, ContentTypeJSON)
 				}
-				if err != nil {
+				if err = p.compress(newMessage, i); err != nil {
 					newMessage.SetError(err)
 				}
+				newMessage.MetaSetMut(python.SerializerMetaKey, p.serializerMode)
+				newBatch = append(newBatch, newMessage)
+				continue
+			}
+
+			// A generator yields results over time, each becoming a message
+			// of its own as it's yielded.
+			if py.BaseType(root) == py.Generator {
+				newBatch, err = p.appendYielded(newBatch, root, m, newMessage, meta, i)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			newBatch = p.appendResult(newBatch, root, newMessage, meta, i)
+		}
+		offsets[len(batch)] = len(newBatch)
+
+		// Periodically report our profiling statistics.
+		if i.profiler != nil {
+			name := "python"
+			if ticket.Id() >= 0 {
+				// Global mode interpreters don't have a meaningful id.
+				name = fmt.Sprintf("python-%d", ticket.Id())
+			}
+			summary, dumped, err := i.profiler.DumpIfDue(name, p.profileEvery)
+			if err != nil {
+				p.logger.Warnf("Failed to dump profile: %s", err)
+			} else if dumped {
+				p.logger.Infof("Profile for %s:\n%s", name, summary)
+			}
+		}
+
+		// Periodically report our top allocation sites.
+		if i.memoryTracer != nil {
+			summary, dumped, err := i.memoryTracer.DumpIfDue(p.tracemallocEvery)
+			if err != nil {
+				p.logger.Warnf("Failed to snapshot memory allocations: %s", err)
+			} else if dumped {
+				p.logger.Infof("Top memory allocations:\n%s", summary)
+			}
+		}
+
+		// Periodically report growth in live objects.
+		if i.leakTracker != nil {
+			summary, drifted, dumped, err := i.leakTracker.DumpIfDue(p.leaksEvery)
+			if err != nil {
+				p.logger.Warnf("Failed to count live objects: %s", err)
+			} else if drifted > 0 {
+				p.logger.Warnf("Reference counts of %d objects held by the processor drifted, likely a leak in the bindings:\n%s", drifted, summary)
+			} else if dumped {
+				p.logger.Infof("Growth in live objects:\n%s", summary)
 			}
+		}
 
-			newMessage.MetaSetMut(python.SerializerMetaKey, p.serializerMode)
-			newBatch = append(newBatch, newMessage)
+		// Retire interpreters that have done their share of the work.
+		i.messages += len(batch)
+		if p.maxMessages > 0 && i.messages >= p.maxMessages {
+			p.logger.Debugf("Recycling interpreter %d after %d messages.", ticket.Id(), i.messages)
+			recycle = true
+		}
+
+		// Check whether we've leaked enough to warrant a fresh interpreter.
+		if !recycle && p.maxAllocatedBlocks > 0 {
+			blocks, err := python.AllocatedBlocks()
+			if err != nil {
+				p.logger.Warnf("Failed to check allocated memory: %s", err)
+			} else if blocks > p.maxAllocatedBlocks {
+				p.logger.Infof("Recycling interpreter %d with %d allocated blocks.", ticket.Id(), blocks)
+				recycle = true
+			}
 		}
 		return nil
 	})
 
-	if len(newBatch) == 0 || err != nil {
+	// Replace the interpreter if we left it in an unknown state.
+	if errors.Is(err, python.ErrInterpreterUnusable) && p.recyclable {
+		p.logger.Errorf("Recycling interpreter %d after Python failure: %s", ticket.Id(), err)
+		recycle = true
+	}
+
+	if err != nil {
 		return nil, err
 	}
+	p.remember(batch, newBatch, offsets, keys, hits)
+	if len(newBatch) == 0 {
+		return nil, nil
+	}
+
+	return []service.MessageBatch{newBatch}, nil
+}
+
+// appendResult makes root the payload of newMessage, serialized per our
+// serializer mode, and appends it to newBatch unless it's dropped.
+func (p *PythonProcessor) appendResult(newBatch service.MessageBatch, root py.PyObjectPtr, newMessage *service.Message, meta py.PyObjectPtr, i *interpreter) service.MessageBatch {
+	var err error
+
+	// A route names the sink for the result, wrapping its payload.
+	if py.BaseType(root) == py.Unknown && py.PyObject_IsInstance(root, i.routeClass) == 1 {
+		name, payload, err := unwrapRoute(root)
+		if err != nil {
+			newMessage.SetError(err)
+		} else {
+			newMessage.MetaSetMut(p.routeMeta, name)
+			root = payload
+		}
+	}
+
+	// A message dict describes the whole message, not just its
+	// content.
+	if p.messageDicts {
+		if content, ok := python.MessageDictContent(root); ok {
+			if err = python.SetMessageDictMetadata(root, newMessage, i.serializer); err != nil {
+				newMessage.SetError(err)
+			}
+			root = content
+		}
+	}
+
+	// Handle the actual message data based on our serializer mode.
+	switch p.serializerMode {
+	case python.None:
+		// We don't serialize and instead pass a Python object pointer.
+		if py.BaseType(root) == py.None {
+			// Drop the message.
+			// TODO: Is this correct? To drop do we just not output a new message?
+			return newBatch
+		} else {
+			// XXX validate we're using global interpreter mode?
+			newMessage.SetStructured(root)
+		}
+	case python.Bloblang:
+		drop, err := handleRootAsJson(root, newMessage, i)
+		if drop {
+			// TODO: Is this correct? To drop do we just not output a new message?
+			return newBatch
+		}
+		if err != nil {
+			newMessage.SetError(err)
+		}
+
+	case python.Pickle:
+		drop, err := handleRootAsPickle(root, newMessage, i)
+		if drop {
+			// TODO: Is this correct? To drop do we just not output a new message?
+			return newBatch
+		}
+		if err != nil {
+			newMessage.SetError(err)
+		}
+
+	case python.Avro:
+		drop, err := handleRootAsAvro(root, newMessage, i)
+		if drop {
+			return newBatch
+		}
+		if err != nil {
+			newMessage.SetError(err)
+		}
+
+	case python.CBOR:
+		drop, err := handleRootAsCBOR(root, newMessage, i)
+		if drop {
+			return newBatch
+		}
+		if err != nil {
+			newMessage.SetError(err)
+		}
+
+	case python.BSON:
+		drop, err := handleRootAsBSON(root, newMessage, i)
+		if drop {
+			return newBatch
+		}
+		if err != nil {
+			newMessage.SetError(err)
+		}
+	}
+
+	if p.contentType && p.serializerMode != python.None && !inMeta(meta, ContentTypeMetaKey) {
+		newMessage.MetaSetMut(ContentTypeMetaKey, contentTypeOf(p.serializerMode, root, newMessage))
+	}
+	if p.serializerMode != python.None {
+		if err = p.compress(newMessage, i); err != nil {
+			newMessage.SetError(err)
+		}
+	}
+	newMessage.MetaSetMut(python.SerializerMetaKey, p.serializerMode)
+	return append(newBatch, newMessage)
+}
+
+// appendYielded appends a message per result yielded by a generator,
+// serializing each as it's yielded so they're never all in memory. A
+// generator failing with a fatal error fails a copy of m after the results
+// it yielded, one rejecting m just stops, while other errors fail the batch.
+func (p *PythonProcessor) appendYielded(newBatch service.MessageBatch, gen py.PyObjectPtr, m, newMessage *service.Message, meta py.PyObjectPtr, i *interpreter) (service.MessageBatch, error) {
+	if p.serializerMode == python.None {
+		newMessage.SetError(errors.New("generator results require serialization"))
+		return append(newBatch, newMessage), nil
+	}
+
+	for {
+		item := py.PyIter_Next(gen)
+		if item == py.NullPyObjectPtr {
+			break
+		}
+		newBatch = p.appendResult(newBatch, item, newMessage.Copy(), meta, i)
+		py.Py_DecRef(item)
+	}
+	if !python.StashException() {
+		// Exhausted.
+		return newBatch, nil
+	}
+
+	kind, exc := classifyError(i)
+	err := scriptError(kind, exc)
+	if kind == reject {
+		p.logger.Debugf("Dropping message: %s", err)
+		return newBatch, nil
+	}
+	if kind == fatal {
+		failed := m.Copy()
+		failed.SetError(err)
+		if exc != nil {
+			exc.SetMetadata(failed)
+		}
+		return append(newBatch, failed), nil
+	}
+	if exc != nil {
+		exc.SetMetadata(m)
+	}
+	return newBatch, err
+}
+
+// remember caches what a pure script made of each message of a batch it
+// processed, given where the results of each start in newBatch.
+func (p *PythonProcessor) remember(batch, newBatch service.MessageBatch, offsets []int, keys []string, hits []*cachedResult) {
+	if p.results == nil {
+		return
+	}
+	for idx, m := range batch {
+		if hits[idx] != nil {
+			// Already cached.
+			continue
+		}
+		if offsets[idx+1]-offsets[idx] > 1 {
+			// Generators aren't cached.
+			continue
+		}
+		var result *service.Message
+		if offsets[idx+1] > offsets[idx] {
+			result = newBatch[offsets[idx]]
+		}
+		p.results.remember(keys[idx], m, result)
+	}
+}
 
-	return []service.MessageBatch{newBatch}, err
+// setArgs resolves the interpolated arguments against the given message and
+// populates the interpreter's args dict.
+func setArgs(args map[string]*service.InterpolatedString, m *service.Message, i *interpreter) error {
+	py.PyDict_Clear(i.args)
+	for key, arg := range args {
+		val, err := arg.TryString(m)
+		if err != nil {
+			return fmt.Errorf("failed to resolve arg '%s': %w", key, err)
+		}
+		str := py.PyUnicode_FromString(val)
+		if str == py.NullPyObjectPtr {
+			py.PyErr_Clear()
+			return fmt.Errorf("failed to convert arg '%s' to a python string", key)
+		}
+		py.PyDict_SetItemString(i.args, key, str)
+		py.Py_DecRef(str)
+	}
+	return nil
 }
 
 func handleRootAsPickle(root py.PyObjectPtr, m *service.Message, i *interpreter) (bool, error) {
@@ -475,6 +1871,52 @@ func handleRootAsPickle(root py.PyObjectPtr, m *service.Message, i *interpreter)
 	return false, nil
 }
 
+// handleRootAsAvro encodes the `root` object as Avro binary, e.g. a dict
+// matching a record schema. Objects not matching the schema fail the
+// message.
+func handleRootAsAvro(root py.PyObjectPtr, m *service.Message, i *interpreter) (bool, error) {
+	if py.BaseType(root) == py.None {
+		// Drop the message.
+		return true, nil
+	}
+	encoded, err := i.serializer.Avro(root)
+	if err != nil {
+		return false, err
+	}
+	m.SetBytes(encoded)
+	return false, nil
+}
+
+// handleRootAsCBOR encodes the `root` object as CBOR. Objects cbor2 can't
+// encode fail the message.
+func handleRootAsCBOR(root py.PyObjectPtr, m *service.Message, i *interpreter) (bool, error) {
+	if py.BaseType(root) == py.None {
+		// Drop the message.
+		return true, nil
+	}
+	encoded, err := i.serializer.CBOR(root)
+	if err != nil {
+		return false, err
+	}
+	m.SetBytes(encoded)
+	return false, nil
+}
+
+// handleRootAsBSON encodes the `root` object, a dict, as a BSON document.
+// Objects that aren't documents fail the message.
+func handleRootAsBSON(root py.PyObjectPtr, m *service.Message, i *interpreter) (bool, error) {
+	if py.BaseType(root) == py.None {
+		// Drop the message.
+		return true, nil
+	}
+	encoded, err := i.serializer.BSON(root)
+	if err != nil {
+		return false, err
+	}
+	m.SetBytes(encoded)
+	return false, nil
+}
+
 // handleRoot post-processes the `root` object the Python script may have
 // mutated at runtime.
 func handleRootAsJson(root py.PyObjectPtr, m *service.Message, i *interpreter) (bool, error) {
@@ -493,13 +1935,13 @@ func handleRootAsJson(root py.PyObjectPtr, m *service.Message, i *interpreter) (
 		m.SetStructured(long)
 
 	case py.String:
-		str, err := py.UnicodeToString(root)
+		data, err := python.UnicodeToBytes(root)
 		if err != nil {
 			return false, errors.New("unable to decode Python string")
 		} else {
 			// We use SetBytes instead of SetStructured to avoid
 			// having our string wrapped in double-quotes.
-			m.SetBytes([]byte(str))
+			m.SetBytes(data)
 		}
 
 	case py.Bytes:
@@ -512,6 +1954,20 @@ func handleRootAsJson(root py.PyObjectPtr, m *service.Message, i *interpreter) (
 		m.SetBytes(buffer)
 
 	case py.Tuple, py.List, py.Dict, py.Unknown:
+		// Protobuf messages, e.g. instances of generated classes, are sent
+		// as their bytes, sparing scripts calling SerializeToString().
+		if py.BaseType(root) == py.Unknown {
+			data, typeURL, ok, err := i.serializer.Protobuf(root)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				m.SetBytes(data)
+				m.MetaSetMut(python.ProtobufTypeMetaKey, typeURL)
+				return false, nil
+			}
+		}
+
 		obj := root
 		// Convert to JSON bytes for now with Python's help ;) because YOLO
 		if py.PyObject_IsInstance(root, i.rootClass) == 1 {
@@ -533,99 +1989,220 @@ func handleRootAsJson(root py.PyObjectPtr, m *service.Message, i *interpreter) (
 	return false, nil
 }
 
-// handleMeta extracts any metadata updates made by the Python script.
-//
-// It's far from efficient for container values (lists, tuples, dicts) as it
-// relies on the Python side serializing to JSON and the Go side
-// deserializing from JSON.
-func handleMeta(meta py.PyObjectPtr, m *service.Message, i *interpreter) error {
-	if py.BaseType(meta) != py.Dict {
-		return errors.New("meta python type is not a dictionary")
-	}
-
-	keys := py.PyDict_Keys(meta)
-	if keys == py.NullPyObjectPtr {
-		return errors.New("failed to get keys from metadata dictionary")
+// unwrapRoute returns the name and payload of an rpcn.Route. The payload is a
+// borrowed reference, kept alive by the route.
+func unwrapRoute(route py.PyObjectPtr) (string, py.PyObjectPtr, error) {
+	nameObj := py.PyObject_GetAttrString(route, "name")
+	if nameObj == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return "", py.NullPyObjectPtr, errors.New("failed to find name of route")
 	}
-	defer py.Py_DecRef(keys)
-	if py.BaseType(keys) != py.List {
-		// This should not happen. If it does, something is horribly wrong.
-		panic("keys wasn't a Python list?!")
+	defer py.Py_DecRef(nameObj)
+	name, err := python.UnicodeToString(nameObj)
+	if err != nil {
+		return "", py.NullPyObjectPtr, errors.New("route name must be a str")
 	}
 
-	for idx := int64(0); idx < py.PyList_Size(keys); idx++ {
-		key := py.PyList_GetItem(keys, idx)
-		if key == py.NullPyObjectPtr {
-			// Shouldn't happen...
-			panic("metadata dictionary key was null")
-		}
-		keyString, err := py.UnicodeToString(key)
-		if err != nil {
-			panic("could not decode dictionary key")
-		}
-		val := py.PyDict_GetItem(meta, key)
-		if val == py.NullPyObjectPtr {
-			// We shouldn't get null pointers. Something is wrong.
-			panic(fmt.Sprintf("metadata dictionary value was null for key %s", keyString))
-		}
+	payload := py.PyObject_GetAttrString(route, "payload")
+	if payload == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return "", py.NullPyObjectPtr, errors.New("failed to find payload of route")
+	}
+	// The route holds on to its payload for us.
+	py.Py_DecRef(payload)
+	return name, payload, nil
+}
 
-		switch py.BaseType(val) {
-		case py.None:
-			// Remove our dictionary item.
-			m.MetaDelete(keyString)
+// applyPatch writes the changes made to the interpreter's Document proxy back
+// to the structured payload of the message, leaving untouched fields alone.
+func applyPatch(m *service.Message, i *interpreter) error {
+	result := py.PyObject_CallNoArgs(i.documentChanges)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to collect changes to 'this'")
+	}
+	defer py.Py_DecRef(result)
 
-		case py.String:
-			valString, err := py.UnicodeToString(val)
-			if err != nil {
-				panic("could not decode Python string used as metadata value")
-			}
-			m.MetaSetMut(keyString, valString)
+	str, err := python.UnicodeToString(result)
+	if err != nil {
+		return err
+	}
+	var changes struct {
+		Set     map[string]any `json:"set"`
+		Deleted []string       `json:"deleted"`
+	}
+	err = json.Unmarshal([]byte(str), &changes)
+	if err != nil {
+		return fmt.Errorf("failed to decode changes to 'this': %w", err)
+	}
+	if len(changes.Set) == 0 && len(changes.Deleted) == 0 {
+		// Nothing to do.
+		return nil
+	}
 
-		case py.Bytes:
-			p := py.PyBytes_AsString(val)
-			sz := py.PyBytes_Size(val)
-			m.MetaSetMut(keyString, unsafe.Slice(p, sz))
+	structured, err := m.AsStructuredMut()
+	if err != nil {
+		return err
+	}
+	obj, ok := structured.(map[string]any)
+	if !ok {
+		return errors.New("patch mode requires a structured object payload")
+	}
+	for key, val := range changes.Set {
+		obj[key] = val
+	}
+	for _, key := range changes.Deleted {
+		delete(obj, key)
+	}
+	m.SetStructuredMut(obj)
+	return nil
+}
 
-		case py.Long:
-			long := py.PyLong_AsLong(val)
-			m.MetaSetMut(keyString, long)
+// handleError applies any changes the Python script made to the error state
+// of the message via "msg".
+func handleError(m *service.Message, i *interpreter) error {
+	result := py.PyObject_CallNoArgs(i.msgPendingError)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to check error state of 'msg'")
+	}
+	defer py.Py_DecRef(result)
 
-		case py.Float:
-			float := py.PyFloat_AsDouble(val)
-			m.MetaSetMut(keyString, float)
+	if py.BaseType(result) == py.None {
+		// Unchanged.
+		return nil
+	}
+	str, err := python.UnicodeToString(result)
+	if err != nil {
+		return err
+	}
+	if str == "" {
+		m.SetError(nil)
+	} else {
+		m.SetError(errors.New(str))
+	}
+	return nil
+}
 
-		case py.Tuple, py.List, py.Dict:
-			// Convert to a JSON string
-			str, err := i.serializer.JsonString(val)
-			if err != nil {
-				panic(err)
-			}
+// StatusCodeMetaKey is the metadata key holding the status code of a
+// synchronous response set with msg.respond(), as http_server expects.
+const StatusCodeMetaKey = "http_status_code"
+
+// handleResponse adds the synchronous response the Python script may have set
+// via "msg" to the transaction of the message. The response is a copy of the
+// message, with its metadata, holding the body.
+func handleResponse(m *service.Message, i *interpreter) error {
+	result := py.PyObject_CallNoArgs(i.msgPendingResponse)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to check response of 'msg'")
+	}
+	defer py.Py_DecRef(result)
 
-			// XXX unmarshal the JSON back into Go objects using the json
-			// module. This handles nested structures nicely and saves on
-			// writing a bunch of recursive extraction code.
-			var _map map[string]any
-			err = json.Unmarshal([]byte(str), &_map)
-			if err != nil {
-				panic(fmt.Sprintf("%s: %s", "failed to unmarshal json", err))
-			}
-			m.MetaSetMut(keyString, _map)
+	if py.BaseType(result) == py.None {
+		// No response.
+		return nil
+	}
 
-		default:
-			return errors.New("unhandled metadata dictionary value")
+	// Tuple items are borrowed.
+	response := m.Copy()
+	body := py.PyTuple_GetItem(result, 0)
+	switch py.BaseType(body) {
+	case py.None:
+		response.SetBytes(nil)
+	case py.String:
+		data, err := python.UnicodeToBytes(body)
+		if err != nil {
+			return errors.New("unable to decode Python string")
+		}
+		response.SetBytes(data)
+	case py.Bytes:
+		p := py.PyBytes_AsString(body)
+		sz := py.PyBytes_Size(body)
+		buffer := make([]byte, sz)
+		copy(buffer, unsafe.Slice(p, sz))
+		response.SetBytes(buffer)
+	default:
+		buffer, err := i.serializer.JsonBytes(body)
+		if err != nil {
+			return err
+		}
+		response.SetBytes(buffer)
+	}
+	if status := py.PyTuple_GetItem(result, 1); py.BaseType(status) == py.Long {
+		response.MetaSetMut(StatusCodeMetaKey, strconv.FormatInt(py.PyLong_AsLong(status), 10))
+	}
+	if headers := py.PyTuple_GetItem(result, 2); py.BaseType(headers) == py.Dict {
+		if err := python.SetMetadata(headers, response, i.serializer); err != nil {
+			return err
 		}
 	}
+	if err := response.AddSyncResponse(); err != nil {
+		return fmt.Errorf("failed to set synchronous response: %w", err)
+	}
 	return nil
 }
 
-// Close a processor.
-//
-// If we're the last Python Processor, ask the main Go routine to stop the runtime.
-func (p *PythonProcessor) Close(ctx context.Context) error {
-	if p.alive.Add(-1) == 0 {
-		p.logger.Debug("Stopping all sub-interpreters for processor")
-		return p.runtime.Stop(ctx)
+// contentTypeOf describes the payload serialized from root, as set in the
+// ContentTypeMetaKey metadata.
+func contentTypeOf(mode python.SerializerMode, root py.PyObjectPtr, m *service.Message) string {
+	if mode != python.Bloblang {
+		return ContentTypeBytes
 	}
+	switch py.BaseType(root) {
+	case py.String:
+		return ContentTypeText
+	case py.Bytes:
+		return ContentTypeBytes
+	case py.Unknown:
+		// Protobuf messages are sent as their bytes.
+		if _, ok := m.MetaGetMut(python.ProtobufTypeMetaKey); ok {
+			return ContentTypeBytes
+		}
+	}
+	return ContentTypeJSON
+}
 
+// compress compresses the payload of a result with our codec, if any,
+// naming it in the python.CompressionMetaKey metadata.
+func (p *PythonProcessor) compress(m *service.Message, i *interpreter) error {
+	if p.compression == "" || p.compression == python.CompressionNone {
+		return nil
+	}
+	data, err := m.AsBytes()
+	if err != nil {
+		return err
+	}
+	compressed, err := i.serializer.Compress(data)
+	if err != nil {
+		return err
+	}
+	m.SetBytes(compressed)
+	m.MetaSetMut(python.CompressionMetaKey, p.compression)
 	return nil
 }
+
+// inMeta reports whether the script set key in the meta dict.
+func inMeta(meta py.PyObjectPtr, key string) bool {
+	return meta != py.NullPyObjectPtr && py.BaseType(meta) == py.Dict &&
+		py.PyDict_GetItemString(meta, key) != py.NullPyObjectPtr
+}
+
+// handleMeta extracts any metadata updates made by the Python script.
+func handleMeta(meta py.PyObjectPtr, m *service.Message, i *interpreter) error {
+	return python.SetMetadata(meta, m, i.serializer)
+}
+
+// Close a processor, stopping its runtime, however many interpreters it has.
+// A shared runtime only stops once its last user stops it.
+func (p *PythonProcessor) Close(ctx context.Context) error {
+	if p.closed.Swap(true) {
+		return nil
+	}
+	if !p.started.Load() {
+		// Lazy and never used, so there's nothing to stop.
+		return nil
+	}
+	p.logger.Debug("Stopping all sub-interpreters for processor")
+	return python.StopWithDeadline(ctx, p.runtime, p.shutdownTimeout, p.logger)
+}
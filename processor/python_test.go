@@ -1,8 +1,18 @@
 package processor
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/redpanda-data/benthos/v4/public/service"
 	"github.com/voutilad/rp-connect-python/internal/impl/python"
@@ -25,7 +35,13 @@ func TestDifferentInterpreterModes(t *testing.T) {
 
 	for _, m := range []python.Mode{python.Isolated, python.IsolatedLegacy, python.Global} {
 		t.Run(string(m), func(t *testing.T) {
-			proc, err := NewPythonProcessor("python3", script, runtime.NumCPU(), m, python.Bloblang, nil)
+			proc, err := NewPythonProcessor(Config{
+				Exe:          "python3",
+				Script:       script,
+				Interpreters: runtime.NumCPU(),
+				Mode:         m,
+				Serializer:   python.Bloblang,
+			}, nil)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -67,3 +83,1624 @@ func TestDifferentInterpreterModes(t *testing.T) {
 		})
 	}
 }
+
+func TestInterpolatedArgs(t *testing.T) {
+	tenant, err := service.NewInterpolatedString(`${! meta("tenant") }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proc, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Script:       `root = args["tenant"]`,
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+		Args:         map[string]*service.InterpolatedString{"tenant": tenant},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	msg := service.NewMessage([]byte("hello"))
+	msg.MetaSetMut("tenant", "acme")
+
+	batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{msg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 1 || len(batches[0]) != 1 {
+		t.Fatal("expected a single batch with a single message")
+	}
+	data, err := batches[0][0].AsBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "acme" {
+		t.Fatalf("expected 'acme', got '%s'", data)
+	}
+}
+
+func TestHandlerKwargs(t *testing.T) {
+	tenant, err := service.NewInterpolatedString(`${! meta("tenant") }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	region, err := service.NewInterpolatedString(`${! meta("region") }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proc, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Init:         "def process(tenant, region):\n    return tenant + '/' + region\n",
+		Handler:      "process",
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+		Args: map[string]*service.InterpolatedString{
+			"tenant": tenant,
+			"region": region,
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	// Each message resolves its own args.
+	batch := service.MessageBatch{}
+	for _, tenant := range []string{"acme", "initech"} {
+		msg := service.NewMessage(nil)
+		msg.MetaSetMut("tenant", tenant)
+		msg.MetaSetMut("region", "eu")
+		batch = append(batch, msg)
+	}
+
+	batches, err := proc.ProcessBatch(context.Background(), batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatal("expected a single batch with two messages")
+	}
+	for idx, expected := range []string{"acme/eu", "initech/eu"} {
+		data, err := batches[0][idx].AsBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Fatalf("expected '%s', got '%s'", expected, data)
+		}
+	}
+}
+
+func TestHandlerRequiresNoScript(t *testing.T) {
+	_, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Script:       `root = "hello"`,
+		Handler:      "process",
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+	}, nil)
+	if err == nil {
+		t.Fatal("expected script and handler to be rejected")
+	}
+}
+
+func TestInitScriptWarmsOnce(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Init:         `rpcn.once("greeting", lambda: "hello")`,
+		Script:       `root = rpcn.once("greeting", lambda: "goodbye")`,
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage(nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := batches[0][0].AsBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("expected 'hello', got '%s'", data)
+	}
+}
+
+func TestPatchModeWritesBackChanges(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Script:       "this[\"a\"] += 1\ndel this[\"b\"]",
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+		Patch:        true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	msg := service.NewMessage(nil)
+	msg.SetStructured(map[string]any{"a": 1, "b": 2, "c": "untouched"})
+
+	batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{msg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := batches[0][0].AsBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"a":2,"c":"untouched"}` {
+		t.Fatalf("unexpected payload: %s", data)
+	}
+}
+
+func TestPatchModeKeys(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe: "python3",
+		Script: `
+results = []
+try:
+    this[0]
+    results.append("found")
+except KeyError:
+    results.append("missing")
+results.append(1 in this)
+results.append(this.get(1, "default"))
+results.append(this[""])
+try:
+    this["nope"]
+    results.append("found")
+except KeyError:
+    results.append("missing")
+this["results"] = results
+`,
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+		Patch:        true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	msg := service.NewMessage(nil)
+	msg.SetStructured(map[string]any{"": "empty", "a": 1})
+
+	batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{msg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := batches[0][0].GetError(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := batches[0][0].AsBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"":"empty","a":1,"results":["missing",false,"default","empty","missing"]}` {
+		t.Fatalf("unexpected payload: %s", data)
+	}
+}
+
+func TestFatalErrorFailsOnlyTheMessage(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Script:       "if content() == b\"bad\":\n  raise rpcn.FatalError(\"nope\")\nroot = content()",
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	batch := service.MessageBatch{
+		service.NewMessage([]byte("bad")),
+		service.NewMessage([]byte("good")),
+	}
+	batches, err := proc.ProcessBatch(context.Background(), batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches[0]) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(batches[0]))
+	}
+	if !errors.Is(batches[0][0].GetError(), ErrFatal) {
+		t.Fatalf("expected a fatal error, got %v", batches[0][0].GetError())
+	}
+	for key, expected := range map[string]string{
+		python.ExceptionTypeMetaKey:    "FatalError",
+		python.ExceptionMessageMetaKey: "nope",
+	} {
+		if val, _ := batches[0][0].MetaGet(key); val != expected {
+			t.Errorf("expected %s to be '%s', got '%s'", key, expected, val)
+		}
+	}
+	if tb, _ := batches[0][0].MetaGet(python.TracebackMetaKey); !strings.Contains(tb, "Traceback") || !strings.Contains(tb, "line 2") {
+		t.Errorf("expected a traceback, got '%s'", tb)
+	}
+	if batches[0][1].GetError() != nil {
+		t.Fatalf("expected no error, got %v", batches[0][1].GetError())
+	}
+}
+
+func TestRejectErrorDropsOnlyTheMessage(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Script:       "if content() == b\"bad\":\n  raise rpcn.RejectError(\"nope\")\nroot = content()",
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	batch := service.MessageBatch{
+		service.NewMessage([]byte("bad")),
+		service.NewMessage([]byte("good")),
+	}
+	batches, err := proc.ProcessBatch(context.Background(), batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches[0]) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(batches[0]))
+	}
+	if data, _ := batches[0][0].AsBytes(); string(data) != "good" || batches[0][0].GetError() != nil {
+		t.Fatalf("expected the good message, got '%s' with error %v", data, batches[0][0].GetError())
+	}
+}
+
+// modelStub stands in for a pydantic model, requiring a "sensor" field.
+const modelStub = `
+import json
+
+class Reading:
+    @classmethod
+    def model_validate_json(cls, data):
+        if "sensor" not in json.loads(data):
+            raise ValueError("sensor: field required")
+`
+
+func TestValidationFlagsInvalidPayloads(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "models.py"), []byte(modelStub), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	proc, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Script:       `root = "ran"`,
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+		Model:        "models:Reading",
+		Path:         []string{dir},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	batch := service.MessageBatch{
+		service.NewMessage([]byte(`{"sensor": "a"}`)),
+		service.NewMessage([]byte(`{"value": 1}`)),
+	}
+	batches, err := proc.ProcessBatch(context.Background(), batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatal("expected a single batch with two messages")
+	}
+
+	if err := batches[0][0].GetError(); err != nil {
+		t.Fatalf("expected the valid message to pass, got %s", err)
+	}
+	data, err := batches[0][0].AsBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "ran" {
+		t.Fatalf("expected the script to run, got '%s'", data)
+	}
+
+	err = batches[0][1].GetError()
+	if err == nil || !strings.Contains(err.Error(), "sensor: field required") {
+		t.Fatalf("expected validation details, got %v", err)
+	}
+	data, err = batches[0][1].AsBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"value": 1}` {
+		t.Fatalf("expected the invalid payload untouched, got '%s'", data)
+	}
+}
+
+func TestMessageErrors(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe: "python3",
+		Script: `
+root = msg.error() or "none"
+if root == "upstream":
+    msg.set_error(None)
+else:
+    msg.set_error("flagged")
+`,
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	failed := service.NewMessage(nil)
+	failed.SetError(errors.New("upstream"))
+	batch := service.MessageBatch{failed, service.NewMessage(nil)}
+
+	batches, err := proc.ProcessBatch(context.Background(), batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatal("expected a single batch with two messages")
+	}
+
+	// The upstream error is visible to the script, which clears it.
+	data, err := batches[0][0].AsBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "upstream" {
+		t.Fatalf("expected 'upstream', got '%s'", data)
+	}
+	if err := batches[0][0].GetError(); err != nil {
+		t.Fatalf("expected the error to be cleared, got %s", err)
+	}
+
+	// A message without an error gets flagged by the script.
+	data, err = batches[0][1].AsBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "none" {
+		t.Fatalf("expected 'none', got '%s'", data)
+	}
+	err = batches[0][1].GetError()
+	if err == nil || err.Error() != "flagged" {
+		t.Fatalf("expected the message to be flagged, got %v", err)
+	}
+}
+
+func TestProfileWritesStats(t *testing.T) {
+	dir := t.TempDir()
+	proc, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Script:       `root = sum(range(1000))`,
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+		Profile:      true,
+		ProfilePath:  dir,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	// With no interval, statistics are dumped after every batch.
+	_, err = proc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage(nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dumps, err := filepath.Glob(filepath.Join(dir, "python*.pstats"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dumps) == 0 {
+		t.Fatal("expected a pstats file to be written")
+	}
+}
+
+func TestTracemallocTracesAllocations(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe: "python3",
+		Script: `
+import tracemalloc
+root = str(tracemalloc.is_tracing())
+`,
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+		Tracemalloc:  true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage(nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := batches[0][0].AsBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "True" {
+		t.Fatalf("expected tracemalloc to be tracing, got '%s'", data)
+	}
+}
+
+func TestCloseInterruptsRunningScript(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe:             "python3",
+		Script:          "while True:\n  pass",
+		Interpreters:    1,
+		Mode:            python.Isolated,
+		Serializer:      python.Bloblang,
+		ShutdownTimeout: 100 * time.Millisecond,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := proc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage([]byte("x"))})
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	if err = proc.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-done:
+		if err == nil {
+			t.Fatal("expected the interrupted batch to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("script was not interrupted")
+	}
+}
+
+func TestWatchdogReplacesStuckInterpreter(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe:             "python3",
+		Script:          "while content() == b\"hang\":\n  pass\nroot = content()",
+		Interpreters:    1,
+		Mode:            python.Isolated,
+		Serializer:      python.Bloblang,
+		WatchdogTimeout: 200 * time.Millisecond,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	_, err = proc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage([]byte("hang"))})
+	if err == nil {
+		t.Fatal("expected the stuck batch to fail")
+	}
+
+	// The replacement interpreter should be initialized on first use.
+	batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage([]byte("ok"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := batches[0][0].AsBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "ok" {
+		t.Fatalf("unexpected payload: %s", data)
+	}
+}
+
+func TestMaxAllocatedBlocksRecyclesInterpreter(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe:                "python3",
+		Init:               "leaked = []",
+		Script:             "leaked.extend(object() for _ in range(100000))\nroot = str(len(leaked))",
+		Interpreters:       1,
+		Mode:               python.Isolated,
+		Serializer:         python.Bloblang,
+		MaxAllocatedBlocks: 50000,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	// Each batch should run in a fresh interpreter, so nothing accumulates.
+	for range 2 {
+		batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage(nil)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := batches[0][0].AsBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "100000" {
+			t.Fatalf("expected a fresh interpreter, got %s leaked objects", data)
+		}
+	}
+}
+
+func TestMaxMessagesRecyclesInterpreter(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Init:         "seen = []",
+		Script:       "seen.append(1)\nroot = str(len(seen))",
+		Interpreters: 1,
+		Mode:         python.IsolatedLegacy,
+		Serializer:   python.Bloblang,
+		MaxMessages:  2,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	for _, expected := range []string{"1", "2", "1", "2"} {
+		batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage(nil)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := batches[0][0].AsBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Fatalf("expected %s messages seen, got %s", expected, data)
+		}
+	}
+}
+
+func TestPreloadModules(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe:            "python3",
+		Script:         "import sys\nroot = str('colorsys' in sys.modules)",
+		Interpreters:   1,
+		Mode:           python.Isolated,
+		Serializer:     python.Bloblang,
+		PreloadModules: []string{"colorsys"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage(nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := batches[0][0].AsBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "True" {
+		t.Fatal("expected colorsys to be preloaded")
+	}
+
+	_, err = NewPythonProcessor(Config{
+		Exe:            "python3",
+		Script:         "root = content()",
+		Interpreters:   1,
+		Mode:           python.Isolated,
+		Serializer:     python.Bloblang,
+		PreloadModules: []string{"no_such_module"},
+	}, nil)
+	if err == nil {
+		t.Fatal("expected preloading a missing module to fail")
+	}
+}
+
+func TestRequireModules(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe:            "python3",
+		Script:         "import sys\nroot = str('colorsys' in sys.modules)",
+		Interpreters:   1,
+		Mode:           python.Isolated,
+		Serializer:     python.Bloblang,
+		RequireModules: []string{"colorsys", "os.path"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage(nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := batches[0][0].AsBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "False" {
+		t.Fatal("expected colorsys to be checked without being imported")
+	}
+
+	_, err = NewPythonProcessor(Config{
+		Exe:            "python3",
+		Script:         "root = content()",
+		Interpreters:   1,
+		Mode:           python.Isolated,
+		Serializer:     python.Bloblang,
+		RequireModules: []string{"no_such_package.module"},
+	}, nil)
+	if err == nil {
+		t.Fatal("expected requiring a missing module to fail")
+	}
+	if !strings.Contains(err.Error(), "'no_such_package.module'") || !strings.Contains(err.Error(), "sys.path") {
+		t.Fatalf("expected the error to name the module and sys.path, got: %s", err)
+	}
+}
+
+func TestLazyStartsOnFirstBatch(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe:            "python3",
+		Script:         "root = content()",
+		Interpreters:   1,
+		Mode:           python.Isolated,
+		Serializer:     python.Bloblang,
+		PreloadModules: []string{"no_such_module"},
+		Lazy:           true,
+	}, nil)
+	if err != nil {
+		t.Fatal("expected starting up to be deferred")
+	}
+
+	_, err = proc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage(nil)})
+	if err == nil {
+		t.Fatal("expected the first batch to fail starting up")
+	}
+	if err = proc.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	proc, err = NewPythonProcessor(Config{
+		Exe:          "python3",
+		Script:       "root = content()",
+		Interpreters: 1,
+		Mode:         python.Isolated,
+		Serializer:   python.Bloblang,
+		Lazy:         true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage([]byte("hello"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := batches[0][0].AsBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("expected 'hello', got '%s'", data)
+	}
+}
+
+// fastavroStub stands in for the fastavro module, encoding records of string
+// and long fields like it does.
+const fastavroStub = `
+def parse_schema(schema):
+    return schema
+
+def _long(buf, n):
+    n = (n << 1) ^ (n >> 63)
+    while n > 0x7f:
+        buf.write(bytes([(n & 0x7f) | 0x80]))
+        n >>= 7
+    buf.write(bytes([n]))
+
+def schemaless_writer(buf, schema, record):
+    for field in schema["fields"]:
+        value = record[field["name"]]
+        if field["type"] == "string":
+            value = value.encode()
+            _long(buf, len(value))
+            buf.write(value)
+        else:
+            _long(buf, value)
+`
+
+func TestAvroSerializer(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "fastavro.py"), []byte(fastavroStub), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	schema := `{"type": "record", "name": "Reading", "fields": [
+		{"name": "sensor", "type": "string"},
+		{"name": "value", "type": "long"}
+	]}`
+
+	_, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Script:       "root = this",
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Avro,
+	}, nil)
+	if err == nil {
+		t.Fatal("expected avro serialization without a schema to fail")
+	}
+
+	proc, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Script:       `root = {"sensor": "a", "value": -2}`,
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Avro,
+		AvroSchema:   schema,
+		Path:         []string{dir},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage(nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := batches[0][0].AsBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "\x02a\x03"; string(data) != expected {
+		t.Fatalf("expected %q, got %q", expected, data)
+	}
+}
+
+// cbor2Stub stands in for the cbor2 module, encoding maps of short strings
+// to small integers like it does.
+const cbor2Stub = `
+def dumps(obj):
+    out = bytes([0xa0 | len(obj)])
+    for key, value in obj.items():
+        if not isinstance(value, int) or not 0 <= value < 24:
+            raise ValueError("unsupported value")
+        out += bytes([0x60 | len(key)]) + key.encode() + bytes([value])
+    return out
+
+def loads(data):
+    raise NotImplementedError
+`
+
+func TestCBORSerializer(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "cbor2.py"), []byte(cbor2Stub), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Script:       "root = this",
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.CBOR,
+	}, nil)
+	if err == nil {
+		t.Fatal("expected cbor serialization without cbor2 to fail")
+	}
+
+	proc, err := NewPythonProcessor(Config{
+		Exe: "python3",
+		Script: `
+n = int(content())
+root = None if n == 0 else {"n": n}`,
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.CBOR,
+		Path:         []string{dir},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{
+		service.NewMessage([]byte("1")),
+		service.NewMessage([]byte("0")),
+		service.NewMessage([]byte("99")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches[0]) != 2 {
+		t.Fatalf("expected None to be dropped, got %d messages", len(batches[0]))
+	}
+	data, err := batches[0][0].AsBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "\xa1\x61n\x01"; string(data) != expected {
+		t.Fatalf("expected %q, got %q", expected, data)
+	}
+	if batches[0][1].GetError() == nil {
+		t.Fatal("expected a result cbor2 can't encode to fail its message")
+	}
+}
+
+// bsonStub stands in for pymongo's bson module, framing JSON rather than
+// encoding real BSON documents.
+const bsonStub = `
+import json
+
+def encode(doc):
+    if not isinstance(doc, dict):
+        raise TypeError("documents must be dicts")
+    return b"bson:" + json.dumps(doc).encode()
+
+def decode(data):
+    return json.loads(data[len(b"bson:"):])
+`
+
+func TestBSONSerializer(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "bson.py"), []byte(bsonStub), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	proc, err := NewPythonProcessor(Config{
+		Exe: "python3",
+		Script: `
+doc = unbson()
+root = {"n": doc["n"] + 1} if doc["n"] > 0 else [doc["n"]]`,
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.BSON,
+		Path:         []string{dir},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{
+		service.NewMessage([]byte(`bson:{"n": 1}`)),
+		service.NewMessage([]byte(`bson:{"n": 0}`)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := batches[0][0].AsBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `bson:{"n": 2}`; string(data) != expected {
+		t.Fatalf("expected %s, got %s", expected, data)
+	}
+	if batches[0][1].GetError() == nil {
+		t.Fatal("expected a result that isn't a document to fail its message")
+	}
+}
+
+func TestProtobufResults(t *testing.T) {
+	// Stand in for the protobuf module and a class generated with it.
+	dir := t.TempDir()
+	pkg := filepath.Join(dir, "google", "protobuf")
+	if err := os.MkdirAll(pkg, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{filepath.Join(dir, "google", "__init__.py"), filepath.Join(pkg, "__init__.py")} {
+		if err := os.WriteFile(name, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(pkg, "message.py"), []byte("class Message:\n    pass\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	proc, err := NewPythonProcessor(Config{
+		Exe: "python3",
+		Script: `
+from google.protobuf import message
+
+class Reading(message.Message):
+    class DESCRIPTOR:
+        full_name = "sensors.Reading"
+
+    def SerializeToString(self):
+        return b"\x08\x01"
+
+root = Reading()
+`,
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+		Path:         []string{dir},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage(nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := batches[0][0].AsBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "\x08\x01"; string(data) != expected {
+		t.Fatalf("expected %q, got %q", expected, data)
+	}
+	typeURL, _ := batches[0][0].MetaGet(python.ProtobufTypeMetaKey)
+	if expected := "type.googleapis.com/sensors.Reading"; typeURL != expected {
+		t.Fatalf("expected type url '%s', got '%s'", expected, typeURL)
+	}
+}
+
+func TestLintReportsSyntaxErrors(t *testing.T) {
+	err := service.NewStreamBuilder().AddProcessorYAML(`
+python:
+  script: |
+    root = content()
+    if True
+      root = "oops"
+`)
+	if err == nil {
+		t.Fatal("expected a lint error")
+	}
+	if !strings.Contains(err.Error(), "syntax error in script at line 2") {
+		t.Fatalf("unexpected lint error: %s", err)
+	}
+
+	err = service.NewStreamBuilder().AddProcessorYAML(`
+python:
+  script: |
+    root = content()
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJSONLibrary(t *testing.T) {
+	_, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Script:       "root = this",
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+		JSONLibrary:  python.JSONLibraryUjson,
+	}, nil)
+	if err == nil {
+		t.Fatal("expected a json library that isn't installed to fail")
+	}
+
+	// Without orjson or ujson installed, auto falls back to json.
+	proc, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Script:       `root = {"a": [1, 2]}`,
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+		JSONLibrary:  python.JSONLibraryAuto,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage(nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := batches[0][0].AsBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"a": [1, 2]}`; string(data) != expected {
+		t.Fatalf("expected %s, got %s", expected, data)
+	}
+}
+
+func TestContentTypeAndTimestamp(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe: "python3",
+		Script: `
+import datetime
+kind = content().decode()
+meta["timestamp"] = datetime.datetime(2024, 1, 2, 3, 4, 5, 6000)
+if kind == "text":
+    root = "hello"
+elif kind == "bytes":
+    root = b"hello"
+elif kind == "custom":
+    meta["content_type"] = "csv"
+    root = "a,b"
+else:
+    root = {"kind": kind}
+`,
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+		ContentType:  true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	kinds := map[string]string{"json": ContentTypeJSON, "text": ContentTypeText, "bytes": ContentTypeBytes, "custom": "csv"}
+	var batch service.MessageBatch
+	for kind := range kinds {
+		batch = append(batch, service.NewMessage([]byte(kind)))
+	}
+	batches, err := proc.ProcessBatch(context.Background(), batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedTs := time.Date(2024, 1, 2, 3, 4, 5, 6000000, time.UTC)
+	for idx, m := range batches[0] {
+		kind, _ := batch[idx].AsBytes()
+		if contentType, _ := m.MetaGet(ContentTypeMetaKey); contentType != kinds[string(kind)] {
+			t.Errorf("%s: expected content type %s, got %s", kind, kinds[string(kind)], contentType)
+		}
+		ts, ok := m.MetaGetMut("timestamp")
+		if !ok || !ts.(time.Time).Equal(expectedTs) {
+			t.Errorf("%s: expected timestamp %s, got %v", kind, expectedTs, ts)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Script:       `root = {"greeting": "hello"}`,
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+		Compression:  python.CompressionGzip,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage(nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := batches[0][0]
+	if codec, _ := m.MetaGet(python.CompressionMetaKey); codec != python.CompressionGzip {
+		t.Fatalf("expected content_encoding gzip, got '%s'", codec)
+	}
+	data, err := m.AsBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"greeting": "hello"}`; string(decompressed) != expected {
+		t.Fatalf("expected %s, got %s", expected, decompressed)
+	}
+}
+
+func TestMessageDicts(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe: "python3",
+		Script: `
+kind = content().decode()
+if kind == "full":
+    root = {"content": {"n": 1}, "meta": {"source": "test"}, "key": b"k1"}
+elif kind == "content":
+    root = {"content": "hello"}
+else:
+    root = {"content": "not", "other": "a message dict"}
+`,
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+		MessageDicts: true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	batch := service.MessageBatch{
+		service.NewMessage([]byte("full")),
+		service.NewMessage([]byte("content")),
+		service.NewMessage([]byte("other")),
+	}
+	batches, err := proc.ProcessBatch(context.Background(), batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		payload, source, key string
+	}{
+		{`{"n": 1}`, "test", "k1"},
+		{"hello", "", ""},
+		{`{"content": "not", "other": "a message dict"}`, "", ""},
+	}
+	for idx, m := range batches[0] {
+		if err = m.GetError(); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := m.AsBytes()
+		source, _ := m.MetaGet("source")
+		key, _ := m.MetaGet(python.KeyMetaKey)
+		if string(data) != expected[idx].payload || source != expected[idx].source || key != expected[idx].key {
+			t.Errorf("expected %+v, got {%s %s %s}", expected[idx], data, source, key)
+		}
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe: "python3",
+		Script: `
+n = int(content())
+if n % 2:
+    root = rpcn.Route("odd", {"n": n})
+else:
+    root = {"n": n}
+`,
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+		RouteMeta:    "sink",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	batch := service.MessageBatch{
+		service.NewMessage([]byte("1")),
+		service.NewMessage([]byte("2")),
+	}
+	batches, err := proc.ProcessBatch(context.Background(), batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		payload, sink string
+	}{
+		{`{"n": 1}`, "odd"},
+		{`{"n": 2}`, ""},
+	}
+	for idx, m := range batches[0] {
+		if err = m.GetError(); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := m.AsBytes()
+		sink, _ := m.MetaGet("sink")
+		if string(data) != expected[idx].payload || sink != expected[idx].sink {
+			t.Errorf("expected %+v, got {%s %s}", expected[idx], data, sink)
+		}
+	}
+}
+
+func TestSyncResponse(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe: "python3",
+		Script: `
+msg.respond({"accepted": True}, status=202, headers={"x-request": "r1"})
+root = content()
+`,
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	m, store := service.NewMessage([]byte("hello")).WithSyncResponseStore()
+	batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = batches[0][0].GetError(); err != nil {
+		t.Fatal(err)
+	}
+
+	responses := store.Read()
+	if len(responses) != 1 || len(responses[0]) != 1 {
+		t.Fatalf("expected a single response, got %v", responses)
+	}
+	res := responses[0][0]
+	data, _ := res.AsBytes()
+	if expected := `{"accepted": true}`; string(data) != expected {
+		t.Errorf("expected %s, got %s", expected, data)
+	}
+	if status, _ := res.MetaGet(StatusCodeMetaKey); status != "202" {
+		t.Errorf("expected status 202, got %s", status)
+	}
+	if header, _ := res.MetaGet("x-request"); header != "r1" {
+		t.Errorf("expected header r1, got %s", header)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Script:       `root = f"{identity.stream}/{identity.label}/{identity.pipeline}"`,
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+		Identity:     python.Identity{Stream: "orders", Label: "enrich", Pipeline: "prod-1"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage(nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := batches[0][0].AsBytes()
+	if expected := "orders/enrich/prod-1"; string(data) != expected {
+		t.Errorf("expected %s, got %s", expected, data)
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe:  "python3",
+		Init: "calls = 0",
+		Script: `
+global calls
+calls += 1
+meta["calls"] = str(calls)
+root = None if content() == b"drop" else content().decode().upper()
+`,
+		Interpreters:    1,
+		Mode:            python.Global,
+		Serializer:      python.Bloblang,
+		ResultCacheSize: 2,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	process := func(payloads ...string) []string {
+		batch := service.MessageBatch{}
+		for _, payload := range payloads {
+			batch = append(batch, service.NewMessage([]byte(payload)))
+		}
+		batches, err := proc.ProcessBatch(context.Background(), batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var results []string
+		for _, b := range batches {
+			for _, m := range b {
+				data, _ := m.AsBytes()
+				calls, _ := m.MetaGet("calls")
+				results = append(results, string(data)+":"+calls)
+			}
+		}
+		return results
+	}
+
+	if results := process("a", "drop"); !slices.Equal(results, []string{"A:1"}) {
+		t.Fatalf("unexpected results %v", results)
+	}
+	// Both are cached, so Python isn't called.
+	if results := process("drop", "a"); !slices.Equal(results, []string{"A:1"}) {
+		t.Fatalf("unexpected cached results %v", results)
+	}
+	// Evicts "drop", the least recently used.
+	if results := process("b", "a"); !slices.Equal(results, []string{"B:3", "A:1"}) {
+		t.Fatalf("unexpected results %v", results)
+	}
+	if results := process("drop"); len(results) != 0 {
+		t.Fatalf("unexpected results %v", results)
+	}
+	if results := process("a"); !slices.Equal(results, []string{"A:5"}) {
+		t.Fatalf("expected a to be evicted, got %v", results)
+	}
+}
+
+func TestGeneratorResults(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe: "python3",
+		Script: `
+def chunks(data):
+    for line in data.splitlines():
+        if line == b"boom":
+            raise rpcn.FatalError("bad line")
+        if line:
+            yield {"line": line.decode()}
+root = chunks(content())
+`,
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	batch := service.MessageBatch{
+		service.NewMessage([]byte("a\n\nb")),
+		service.NewMessage([]byte("c\nboom\nd")),
+	}
+	batches, err := proc.ProcessBatch(context.Background(), batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{`{"line": "a"}`, `{"line": "b"}`, `{"line": "c"}`, "c\nboom\nd"}
+	if len(batches[0]) != len(expected) {
+		t.Fatalf("expected %d messages, got %d", len(expected), len(batches[0]))
+	}
+	for idx, m := range batches[0] {
+		data, _ := m.AsBytes()
+		if string(data) != expected[idx] {
+			t.Errorf("expected %s, got %s", expected[idx], data)
+		}
+	}
+	if !errors.Is(batches[0][3].GetError(), ErrFatal) {
+		t.Errorf("expected a fatal error, got %v", batches[0][3].GetError())
+	}
+}
+
+func TestScriptDir(t *testing.T) {
+	// A package, with relative imports and a data file.
+	pkg := filepath.Join(t.TempDir(), "shouty")
+	files := map[string]string{
+		"__init__.py": "",
+		"helpers.py":  "def shout(s):\n    return s.upper()\n",
+		"main.py": `import os
+from .helpers import shout
+with open(os.path.join(os.path.dirname(__file__), "suffix.txt")) as f:
+    SUFFIX = f.read().strip()
+def handle(s):
+    return shout(s) + SUFFIX
+`,
+		"suffix.txt": "!\n",
+	}
+	if err := os.Mkdir(pkg, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(pkg, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A plain directory of modules, with another entry module.
+	plain := t.TempDir()
+	if err := os.WriteFile(filepath.Join(plain, "app.py"), []byte("def handle(s):\n    return s[::-1]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dir, entry, expected string
+	}{
+		{pkg, "", "HELLO!"},
+		{plain, "app", "olleh"},
+	}
+	for _, test := range tests {
+		proc, err := NewPythonProcessor(Config{
+			Exe:          "python3",
+			Script:       `root = handle(content().decode())`,
+			ScriptDir:    test.dir,
+			EntryModule:  test.entry,
+			Interpreters: 1,
+			Mode:         python.Isolated,
+			Serializer:   python.Bloblang,
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage([]byte("hello"))})
+		_ = proc.Close(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := batches[0][0].AsBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != test.expected {
+			t.Errorf("expected '%s', got '%s'", test.expected, data)
+		}
+	}
+}
+
+func TestInterpreterPoolSize(t *testing.T) {
+	if _, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Script:       `root = content()`,
+		Interpreters: 0,
+		Mode:         python.Isolated,
+		Serializer:   python.Bloblang,
+	}, nil); err == nil {
+		t.Fatal("expected 0 interpreters to be rejected")
+	}
+
+	proc, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Script:       `root = content()`,
+		Interpreters: 3,
+		Mode:         python.Isolated,
+		Serializer:   python.Bloblang,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	// Processing starts the runtime.
+	ctx := context.Background()
+	if _, err = proc.ProcessBatch(ctx, service.MessageBatch{service.NewMessage([]byte("hello"))}); err != nil {
+		t.Fatal(err)
+	}
+
+	// We can hold as many interpreters as we asked for, but no more.
+	r := proc.(*PythonProcessor).runtime
+	var tickets []*python.InterpreterTicket
+	defer func() {
+		for _, ticket := range tickets {
+			_ = r.Release(ticket)
+		}
+	}()
+	for range 3 {
+		ticket, err := r.Acquire(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tickets = append(tickets, ticket)
+	}
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if ticket, err := r.Acquire(timeout); err == nil {
+		tickets = append(tickets, ticket)
+		t.Fatal("expected no fourth interpreter")
+	}
+}
+
+func TestCloseStopsRuntimeWithInterpreters(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Script:       `root = content()`,
+		Interpreters: 2,
+		Mode:         python.Isolated,
+		Serializer:   python.Bloblang,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if _, err = proc.ProcessBatch(ctx, service.MessageBatch{service.NewMessage([]byte("hello"))}); err != nil {
+		t.Fatal(err)
+	}
+	if err = proc.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stopping a runtime that's already stopped fails.
+	if err = proc.(*PythonProcessor).runtime.Stop(ctx); err == nil || err.Error() != "not started" {
+		t.Fatalf("expected the runtime to be stopped, got %v", err)
+	}
+}
+
+func TestPathImportableInEveryInterpreter(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "helpers.py"), []byte("def shout(s):\n    return s.upper()\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	proc, err := NewPythonProcessor(Config{
+		Exe: "python3",
+		Script: `
+import sys
+import helpers
+root = f"{helpers.shout(content().decode())} {sys.path.count(args_dir)}"
+`,
+		Init:         "args_dir = " + strconv.Quote(dir),
+		Interpreters: 2,
+		Mode:         python.Isolated,
+		Serializer:   python.Bloblang,
+		Path:         []string{dir, dir},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	// Process concurrently so both interpreters are used.
+	results := make(chan string, 4)
+	for range 4 {
+		go func() {
+			batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage([]byte("hi"))})
+			if err != nil {
+				results <- err.Error()
+				return
+			}
+			data, _ := batches[0][0].AsBytes()
+			results <- string(data)
+		}()
+	}
+	for range 4 {
+		// The directory is importable, and only added once.
+		if result := <-results; result != "HI 1" {
+			t.Fatalf("expected 'HI 1', got '%s'", result)
+		}
+	}
+}
+
+func TestEnvironmentSetInEveryInterpreter(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Script:       `import os; root = os.environ.get("RPCN_TEST_GREETING", "unset")`,
+		Interpreters: 2,
+		Mode:         python.Isolated,
+		Serializer:   python.Bloblang,
+		Environment:  map[string]string{"RPCN_TEST_GREETING": "hello"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	results := make(chan string, 4)
+	for range 4 {
+		go func() {
+			batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage(nil)})
+			if err != nil {
+				results <- err.Error()
+				return
+			}
+			data, _ := batches[0][0].AsBytes()
+			results <- string(data)
+		}()
+	}
+	for range 4 {
+		if result := <-results; result != "hello" {
+			t.Fatalf("expected 'hello', got '%s'", result)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package processor
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+)
+
+// resultCache remembers the results of a pure script, keyed by a hash of the
+// payload and interpolated args it was given, evicting the least recently
+// used once full.
+type resultCache struct {
+	size    int
+	ttl     time.Duration // Results don't expire if 0.
+	hits    *service.MetricCounter
+	misses  *service.MetricCounter
+	mtx     sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // Most recently used first.
+}
+
+// cachedResult describes what the script made of a message, relative to it.
+type cachedResult struct {
+	key     string
+	drop    bool // Whether the script dropped the message.
+	payload []byte
+	set     map[string]any // Metadata the script set or changed.
+	deleted []string       // Metadata the script deleted.
+	expires time.Time
+}
+
+func newResultCache(size int, ttl time.Duration, metrics *service.Metrics) *resultCache {
+	return &resultCache{
+		size:    size,
+		ttl:     ttl,
+		hits:    metrics.NewCounter("python_result_cache_hits"),
+		misses:  metrics.NewCounter("python_result_cache_misses"),
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// key hashes the payload of a message and the args resolved against it.
+func (c *resultCache) key(m *service.Message, args map[string]*service.InterpolatedString) (string, error) {
+	data, err := m.AsBytes()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write(data)
+	names := make([]string, 0, len(args))
+	for name := range args {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		val, err := args[name].TryString(m)
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte{0})
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+		h.Write([]byte(val))
+	}
+	return string(h.Sum(nil)), nil
+}
+
+// lookup finds the cached results of a batch, returning the key of each
+// message, empty if it can't be cached, and its result, nil if there's none.
+// all reports whether every message has a result.
+func (c *resultCache) lookup(batch service.MessageBatch, args map[string]*service.InterpolatedString) (keys []string, hits []*cachedResult, all bool) {
+	keys = make([]string, len(batch))
+	hits = make([]*cachedResult, len(batch))
+	all = true
+	now := time.Now()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for idx, m := range batch {
+		key, err := c.key(m, args)
+		if err != nil {
+			// Let the script deal with it.
+			all = false
+			continue
+		}
+		keys[idx] = key
+		elem, ok := c.entries[key]
+		if ok && c.ttl > 0 && now.After(elem.Value.(*cachedResult).expires) {
+			c.order.Remove(elem)
+			delete(c.entries, key)
+			ok = false
+		}
+		if !ok {
+			c.misses.Incr(1)
+			all = false
+			continue
+		}
+		c.order.MoveToFront(elem)
+		hits[idx] = elem.Value.(*cachedResult)
+		c.hits.Incr(1)
+	}
+	return keys, hits, all
+}
+
+// remember caches what the script made of a message: the result, or nil if
+// it was dropped. Results that failed aren't cached.
+func (c *resultCache) remember(key string, m, result *service.Message) {
+	if key == "" || (result != nil && result.GetError() != nil) {
+		return
+	}
+	entry := &cachedResult{key: key, drop: result == nil}
+	if result != nil {
+		payload, err := result.AsBytes()
+		if err != nil {
+			return
+		}
+		entry.payload = payload
+		before, after := metadataOf(m), metadataOf(result)
+		entry.set = make(map[string]any)
+		for k, v := range after {
+			if old, ok := before[k]; !ok || !reflect.DeepEqual(old, v) {
+				entry.set[k] = v
+			}
+		}
+		for k := range before {
+			if _, ok := after[k]; !ok {
+				entry.deleted = append(entry.deleted, k)
+			}
+		}
+	}
+	if c.ttl > 0 {
+		entry.expires = time.Now().Add(c.ttl)
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResult).key)
+	}
+}
+
+// apply makes the cached result of a message, or nil if it's dropped.
+func (r *cachedResult) apply(m *service.Message) *service.Message {
+	if r.drop {
+		return nil
+	}
+	result := m.Copy()
+	result.SetBytes(r.payload)
+	for k, v := range r.set {
+		result.MetaSetMut(k, v)
+	}
+	for _, k := range r.deleted {
+		result.MetaDelete(k)
+	}
+	return result
+}
+
+// metadataOf collects the metadata of a message.
+func metadataOf(m *service.Message) map[string]any {
+	meta := make(map[string]any)
+	_ = m.MetaWalkMut(func(k string, v any) error {
+		meta[k] = v
+		return nil
+	})
+	return meta
+}
@@ -0,0 +1,79 @@
+package processor
+
+import (
+	_ "embed"
+	"errors"
+	"time"
+
+	py "github.com/voutilad/gogopython"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+)
+
+// Python helper for tracing memory allocations.
+//
+//go:embed tracemalloc.py
+var tracemallocSrc string
+
+// memoryTracer wraps Python's tracemalloc module.
+type memoryTracer struct {
+	top      py.PyObjectPtr
+	lastDump time.Time
+}
+
+// newMemoryTracer starts tracemalloc in the current interpreter.
+//
+// The caller must manage the interpreter state for this to succeed.
+func newMemoryTracer() (*memoryTracer, error) {
+	code, err := python.Compile(tracemallocSrc, "__tracemalloc__.py")
+	if err != nil {
+		return nil, errors.New("failed to compile tracemalloc source")
+	}
+	module := py.PyImport_ExecCodeModule("__tracemalloc__", code)
+	if module == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return nil, errors.New("failed to import tracemalloc module")
+	}
+	defer py.Py_DecRef(module)
+
+	start := py.PyObject_GetAttrString(module, "start")
+	if start == py.NullPyObjectPtr {
+		return nil, errors.New("failed to find start in tracemalloc module")
+	}
+	defer py.Py_DecRef(start)
+	result := py.PyObject_CallNoArgs(start)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return nil, errors.New("failed to start tracemalloc")
+	}
+	py.Py_DecRef(result)
+
+	top := py.PyObject_GetAttrString(module, "top")
+	if top == py.NullPyObjectPtr {
+		return nil, errors.New("failed to find top in tracemalloc module")
+	}
+
+	return &memoryTracer{top: top, lastDump: time.Now()}, nil
+}
+
+// DumpIfDue summarizes the top allocation sites if at least interval has
+// elapsed since the previous dump, returning the summary and whether a dump
+// occurred.
+func (t *memoryTracer) DumpIfDue(interval time.Duration) (string, bool, error) {
+	if time.Since(t.lastDump) < interval {
+		return "", false, nil
+	}
+	t.lastDump = time.Now()
+
+	result := py.PyObject_CallNoArgs(t.top)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return "", false, errors.New("failed to take tracemalloc snapshot")
+	}
+	defer py.Py_DecRef(result)
+
+	summary, err := py.UnicodeToString(result)
+	if err != nil {
+		return "", false, err
+	}
+	return summary, true, nil
+}
@@ -0,0 +1,28 @@
+"""
+Memory diagnostics helper using tracemalloc.
+"""
+import tracemalloc
+
+
+def start(frames=1):
+    """
+    Start tracing allocations if not already tracing.
+    :param frames: number of frames to store per allocation traceback
+    :return: None
+    """
+    if not tracemalloc.is_tracing():
+        tracemalloc.start(frames)
+
+
+def top(limit=10):
+    """
+    Summarize current memory use and the top allocation sites.
+    :param limit: number of allocation sites to report
+    :return: a summary string suitable for logging
+    """
+    snapshot = tracemalloc.take_snapshot()
+    current, peak = tracemalloc.get_traced_memory()
+    lines = [f"current={current / 1024:.1f} KiB peak={peak / 1024:.1f} KiB"]
+    for stat in snapshot.statistics("lineno")[:limit]:
+        lines.append(str(stat))
+    return "\n".join(lines)
@@ -0,0 +1,152 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+	py "github.com/voutilad/gogopython"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// scriptSpan is a span recorded by a script via rpcn.span().
+type scriptSpan struct {
+	Name       string         `json:"name"`
+	Parent     int            `json:"parent"` // Index of the parent span, or -1 for the message's span.
+	Start      int64          `json:"start"`  // Nanoseconds since the Unix epoch.
+	End        int64          `json:"end"`
+	Attributes map[string]any `json:"attributes"`
+	Error      string         `json:"error"`
+}
+
+// evaluation is the span around a script's evaluation of a message.
+type evaluation struct {
+	ctx  context.Context
+	span trace.Span
+}
+
+// beginEvaluation starts a span around evaluating m as a child of its span,
+// making it the script's trace context. Untraced messages cost nothing and
+// have no evaluation.
+//
+// The caller must manage the interpreter state for this to succeed.
+func (p *PythonProcessor) beginEvaluation(m *service.Message, i *interpreter) (*evaluation, error) {
+	parent := trace.SpanFromContext(m.Context())
+	if !parent.SpanContext().IsValid() {
+		return nil, nil
+	}
+	ctx, span := parent.TracerProvider().Tracer(python.TracerName).
+		Start(m.Context(), "python.process", trace.WithAttributes(p.spanAttributes...))
+
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	str := py.PyUnicode_FromString(carrier["traceparent"])
+	if str == py.NullPyObjectPtr {
+		span.End()
+		return nil, errors.New("failed to create python string")
+	}
+	defer py.Py_DecRef(str)
+
+	result := py.PyObject_CallOneArg(i.traceBegin, str)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		span.End()
+		return nil, errors.New("failed to set trace context of python script")
+	}
+	py.Py_DecRef(result)
+	return &evaluation{ctx: ctx, span: span}, nil
+}
+
+// end restores the script's trace context, records the spans it created as
+// children of the evaluation, and ends the evaluation. The exception and err
+// describe how the script failed, if it did.
+//
+// The caller must manage the interpreter state for this to succeed.
+func (e *evaluation) end(i *interpreter, exception string, err error) error {
+	defer python.EndSpan(e.span, exception, err)
+
+	result := py.PyObject_CallNoArgs(i.traceEnd)
+	if result == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return errors.New("failed to reset trace context of python script")
+	}
+	defer py.Py_DecRef(result)
+	if py.BaseType(result) == py.None {
+		return nil
+	}
+
+	data, err := py.UnicodeToString(result)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewBufferString(data))
+	decoder.UseNumber()
+	var spans []scriptSpan
+	if err = decoder.Decode(&spans); err != nil {
+		return err
+	}
+	recordSpans(e.ctx, e.span.TracerProvider(), spans)
+	return nil
+}
+
+// recordSpans re-creates spans recorded by a script as descendants of the
+// span of ctx.
+func recordSpans(ctx context.Context, provider trace.TracerProvider, spans []scriptSpan) {
+	tracer := provider.Tracer(python.TracerName)
+
+	// Spans are recorded as they're entered, so parents precede children.
+	contexts := make([]context.Context, len(spans))
+	for idx, s := range spans {
+		parent := ctx
+		if s.Parent >= 0 && s.Parent < idx {
+			parent = contexts[s.Parent]
+		}
+
+		spanCtx, span := tracer.Start(parent, s.Name,
+			trace.WithTimestamp(time.Unix(0, s.Start)),
+			trace.WithAttributes(attributes(s.Attributes)...))
+		contexts[idx] = spanCtx
+
+		if s.Error != "" {
+			span.SetStatus(codes.Error, s.Error)
+		}
+		// Spans left open by the script end with it.
+		end := time.Now()
+		if s.End > 0 {
+			end = time.Unix(0, s.End)
+		}
+		span.End(trace.WithTimestamp(end))
+	}
+}
+
+// attributes converts the attributes of a script span.
+func attributes(values map[string]any) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(values))
+	for key, value := range values {
+		switch v := value.(type) {
+		case string:
+			kvs = append(kvs, attribute.String(key, v))
+		case bool:
+			kvs = append(kvs, attribute.Bool(key, v))
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				kvs = append(kvs, attribute.Int64(key, n))
+			} else if f, err := v.Float64(); err == nil {
+				kvs = append(kvs, attribute.Float64(key, f))
+			}
+		default:
+			data, err := json.Marshal(v)
+			if err == nil {
+				kvs = append(kvs, attribute.String(key, string(data)))
+			}
+		}
+	}
+	return kvs
+}
@@ -0,0 +1,171 @@
+package processor
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/embedded"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// recordingProvider records the spans ended by its tracers.
+type recordingProvider struct {
+	embedded.TracerProvider
+	mtx     sync.Mutex
+	started byte
+	ended   []*recordingSpan
+}
+
+func (p *recordingProvider) Tracer(string, ...trace.TracerOption) trace.Tracer {
+	return &recordingTracer{provider: p}
+}
+
+type recordingTracer struct {
+	embedded.Tracer
+	provider *recordingProvider
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, _ ...trace.SpanStartOption) (context.Context, trace.Span) {
+	t.provider.mtx.Lock()
+	t.provider.started++
+	id := trace.SpanID{t.provider.started + 1}
+	t.provider.mtx.Unlock()
+
+	parent := trace.SpanContextFromContext(ctx)
+	span := &recordingSpan{
+		provider: t.provider,
+		name:     name,
+		parent:   parent.SpanID(),
+		ctx: trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    parent.TraceID(),
+			SpanID:     id,
+			TraceFlags: trace.FlagsSampled,
+		}),
+	}
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+type recordingSpan struct {
+	noop.Span
+	provider *recordingProvider
+	name     string
+	parent   trace.SpanID
+	ctx      trace.SpanContext
+}
+
+func (s *recordingSpan) SpanContext() trace.SpanContext       { return s.ctx }
+func (s *recordingSpan) TracerProvider() trace.TracerProvider { return s.provider }
+func (s *recordingSpan) End(...trace.SpanEndOption) {
+	s.provider.mtx.Lock()
+	defer s.provider.mtx.Unlock()
+	s.provider.ended = append(s.provider.ended, s)
+}
+
+func TestEvaluationSpans(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+		Script: `
+if content() == b"boom":
+    raise ValueError("boom")
+root = content()
+`,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	provider := &recordingProvider{}
+	var batch service.MessageBatch
+	for _, content := range []string{"ok", "boom"} {
+		ctx := trace.ContextWithSpan(context.Background(), &recordingSpan{
+			provider: provider,
+			ctx: trace.NewSpanContext(trace.SpanContextConfig{
+				TraceID:    trace.TraceID{1},
+				SpanID:     trace.SpanID{1},
+				TraceFlags: trace.FlagsSampled,
+			}),
+		})
+		batch = append(batch, service.NewMessage([]byte(content)).WithContext(ctx))
+	}
+
+	// Unclassified exceptions fail the batch.
+	_, err = proc.ProcessBatch(context.Background(), batch)
+	if err == nil {
+		t.Fatal("expected the batch to fail")
+	}
+
+	if len(provider.ended) != 2 {
+		t.Fatalf("expected a span per evaluation, got %d", len(provider.ended))
+	}
+	for _, span := range provider.ended {
+		if span.name != "python.process" || span.parent != (trace.SpanID{1}) {
+			t.Errorf("expected evaluation span as a child of the message's span, got '%s' with parent %s", span.name, span.parent)
+		}
+	}
+}
+
+func TestTraceFlowsThroughScript(t *testing.T) {
+	proc, err := NewPythonProcessor(Config{
+		Exe:          "python3",
+		Interpreters: 1,
+		Mode:         python.Global,
+		Serializer:   python.Bloblang,
+		Script: `
+with rpcn.span("outer", model="test"):
+    with rpcn.span("inner"):
+        root = rpcn.traceparent()
+`,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proc.Close(context.Background()) }()
+
+	provider := &recordingProvider{}
+	traceId := trace.TraceID{0x4b, 0xf9, 0x2f, 0x35}
+	ctx := trace.ContextWithSpan(context.Background(), &recordingSpan{
+		provider: provider,
+		ctx: trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    traceId,
+			SpanID:     trace.SpanID{1},
+			TraceFlags: trace.FlagsSampled,
+		}),
+	})
+	msg := service.NewMessage(nil).WithContext(ctx)
+
+	batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{msg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := batches[0][0].AsBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Scripts see the span of their evaluation.
+	expected := "00-4bf92f35000000000000000000000000-0200000000000000-01"
+	if string(data) != expected {
+		t.Fatalf("expected traceparent '%s', got '%s'", expected, data)
+	}
+
+	if len(provider.ended) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(provider.ended))
+	}
+	outer, inner, eval := provider.ended[0], provider.ended[1], provider.ended[2]
+	if eval.name != "python.process" || eval.parent != (trace.SpanID{1}) {
+		t.Errorf("expected evaluation span to be a child of the message's span, got '%s' with parent %s", eval.name, eval.parent)
+	}
+	if outer.name != "outer" || outer.parent != eval.ctx.SpanID() {
+		t.Errorf("expected outer span to be a child of the evaluation, got '%s' with parent %s", outer.name, outer.parent)
+	}
+	if inner.name != "inner" || inner.parent != outer.ctx.SpanID() {
+		t.Errorf("expected inner span to be a child of outer, got '%s' with parent %s", inner.name, inner.parent)
+	}
+}
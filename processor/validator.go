@@ -0,0 +1,91 @@
+package processor
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+	py "github.com/voutilad/gogopython"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+)
+
+// Python helper for building payload validation functions.
+//
+//go:embed validator.py
+var validatorSrc string
+
+// newValidator builds a Python validation function from either a pydantic
+// model location or a JSON schema document.
+//
+// The caller must manage the interpreter state for this to succeed.
+func newValidator(model, schema string) (py.PyObjectPtr, error) {
+	code, err := python.Compile(validatorSrc, "__validator__.py")
+	if err != nil {
+		return py.NullPyObjectPtr, errors.New("failed to compile validator source")
+	}
+	module := py.PyImport_ExecCodeModule("__validator__", code)
+	if module == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return py.NullPyObjectPtr, errors.New("failed to import validator module")
+	}
+	defer py.Py_DecRef(module)
+
+	factoryName, arg := "pydantic_validator", model
+	if model == "" {
+		factoryName, arg = "json_schema_validator", schema
+	}
+	factory := py.PyObject_GetAttrString(module, factoryName)
+	if factory == py.NullPyObjectPtr {
+		return py.NullPyObjectPtr, fmt.Errorf("failed to find %s in validator module", factoryName)
+	}
+	defer py.Py_DecRef(factory)
+
+	str := py.PyUnicode_FromString(arg)
+	if str == py.NullPyObjectPtr {
+		py.PyErr_Clear()
+		return py.NullPyObjectPtr, errors.New("failed to convert validator argument to a python string")
+	}
+	defer py.Py_DecRef(str)
+
+	validate := py.PyObject_CallOneArg(factory, str)
+	if validate == py.NullPyObjectPtr {
+		py.PyErr_Print()
+		return py.NullPyObjectPtr, errors.New("failed to create validator")
+	}
+	return validate, nil
+}
+
+// validateMessage runs the interpreter's validation function over the raw
+// bytes of the message, returning the validation details as an error.
+func validateMessage(m *service.Message, i *interpreter) error {
+	data, err := m.AsBytes()
+	if err != nil {
+		return err
+	}
+	bytes := py.PyBytes_FromStringAndSize(unsafe.SliceData(data), int64(len(data)))
+	if bytes == py.NullPyObjectPtr {
+		panic("failed to create Python bytes")
+	}
+	defer py.Py_DecRef(bytes)
+
+	result := py.PyObject_CallOneArg(i.validate, bytes)
+	if result == py.NullPyObjectPtr {
+		python.StashException()
+		if _, exc := classifyError(i); exc != nil {
+			return fmt.Errorf("validator raised an exception: %w", exc)
+		}
+		return errors.New("validator raised an exception")
+	}
+	defer py.Py_DecRef(result)
+
+	if py.BaseType(result) == py.None {
+		return nil
+	}
+	details, err := py.UnicodeToString(result)
+	if err != nil {
+		return errors.New("unable to decode validation details")
+	}
+	return fmt.Errorf("validation failed: %s", details)
+}
@@ -0,0 +1,53 @@
+"""
+Validation helpers for checking message payloads before they reach a script.
+"""
+import importlib
+import json
+
+
+def pydantic_validator(target):
+    """
+    Build a validation function from a pydantic model.
+    :param target: model location in the form "module:Model"
+    :return: function taking payload bytes, returning an error string or None
+    """
+    module_name, _, name = target.partition(":")
+    if not name:
+        raise ValueError(f"model '{target}' must be in the form 'module:Model'")
+    model = getattr(importlib.import_module(module_name), name)
+
+    def validate(data):
+        try:
+            model.model_validate_json(data)
+        except Exception as e:
+            return str(e)
+        return None
+
+    return validate
+
+
+def json_schema_validator(schema):
+    """
+    Build a validation function from a JSON schema using `jsonschema`.
+    :param schema: JSON schema document as a string
+    :return: function taking payload bytes, returning an error string or None
+    """
+    import jsonschema
+    document = json.loads(schema)
+    cls = jsonschema.validators.validator_for(document)
+    cls.check_schema(document)
+    validator = cls(document)
+
+    def validate(data):
+        try:
+            obj = json.loads(data)
+        except ValueError as e:
+            return f"payload is not valid json: {e}"
+        errors = sorted(validator.iter_errors(obj), key=lambda e: list(e.path))
+        if not errors:
+            return None
+        return "; ".join(
+            f"{'/'.join(map(str, e.path)) or '<root>'}: {e.message}" for e in errors
+        )
+
+    return validate
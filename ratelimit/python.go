@@ -0,0 +1,270 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+	py "github.com/voutilad/gogopython"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+)
+
+var configSpec = service.NewConfigSpec().
+	Summary("Rate limit with Python.").
+	Description("Calls a Python function, defined by the script, each time a component wants access to the rate limited resource, so custom quota logic like per-tenant token buckets from a Python SDK can gate inputs and outputs. The function may be `async def`.").
+	Field(service.NewStringField("script").
+		Description("Python code defining the access function.")).
+	Fields(python.RuntimeFields()...).
+	Field(python.SharedRuntimeField()).
+	Field(service.NewIntField("interpreters").
+		Description("Number of interpreters to call the access function from concurrently. Each runs the script, so each keeps its own quota state. Most useful with the isolated modes.").
+		Default(1)).
+	Field(service.NewStringField("access_function").
+		Description("Name of a Python function called with no arguments, returning `0` or `None` if the resource may be accessed, or otherwise how many seconds to wait before asking again.").
+		Default("access")).
+	LintRule(`root = python_syntax_error("script", this.script | "", this.exe | "python3")`)
+
+type pythonRateLimit struct {
+	logger          *service.Logger
+	runtime         python.Runtime
+	script          string
+	path            []string
+	environment     map[string]string
+	preload         []string
+	requires        []string
+	accessFn        string
+	shutdownTimeout time.Duration
+	interpreters    map[int64]*interpreter
+}
+
+// interpreter holds our function in a particular interpreter.
+type interpreter struct {
+	access  py.PyObjectPtr
+	resolve py.PyObjectPtr
+}
+
+func init() {
+	err := service.RegisterRateLimit("python", configSpec,
+		func(conf *service.ParsedConfig, mgr *service.Resources) (service.RateLimit, error) {
+			// Extract our configuration.
+			runtimeConf, err := python.ParseRuntimeConfig(conf, mgr.Logger())
+			if err != nil {
+				return nil, err
+			}
+			runtimeName, err := conf.FieldString("runtime")
+			if err != nil {
+				return nil, err
+			}
+			script, err := conf.FieldString("script")
+			if err != nil {
+				return nil, err
+			}
+			if err = python.AuditScript(mgr.Logger(), "script", script, runtimeConf.ScriptChecksums); err != nil {
+				return nil, err
+			}
+			accessFn, err := conf.FieldString("access_function")
+			if err != nil {
+				return nil, err
+			}
+			interpreters, err := conf.FieldInt("interpreters")
+			if err != nil {
+				return nil, err
+			}
+			if interpreters < 1 {
+				return nil, errors.New("interpreters must be at least 1")
+			}
+
+			r, err := newPythonRateLimit(runtimeConf.Exe, runtimeConf.Mode, runtimeName, interpreters, mgr.Metrics(), mgr.Logger())
+			if err != nil {
+				return nil, err
+			}
+			r.script = script
+			r.path = runtimeConf.Path
+			r.environment = runtimeConf.Environment
+			r.preload = runtimeConf.Preload
+			r.requires = runtimeConf.Requires
+			r.accessFn = accessFn
+			r.shutdownTimeout = runtimeConf.ShutdownTimeout
+
+			// Start now, as rate limits are used without connecting.
+			if err = r.start(context.Background()); err != nil {
+				return nil, err
+			}
+			return r, nil
+		})
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+// newPythonRateLimit creates a python rate limit using up to cnt interpreters,
+// each with its own quota state.
+func newPythonRateLimit(exe string, mode python.Mode, runtimeName string, cnt int, metrics *service.Metrics, logger *service.Logger) (*pythonRateLimit, error) {
+	var err error
+	var r python.Runtime
+
+	switch mode {
+	case python.IsolatedLegacy:
+		r, err = python.NewMultiInterpreterRuntime(exe, cnt, true, logger)
+	case python.Global:
+		r, err = python.NewSingleInterpreterRuntime(exe, cnt, logger)
+	case python.Isolated:
+		r, err = python.NewMultiInterpreterRuntime(exe, cnt, false, logger)
+	case python.FreeThreaded:
+		r, err = python.NewFreeThreadedRuntime(exe, cnt, logger)
+	default:
+		return nil, errors.New("invalid mode")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if runtimeName != "" {
+		r, err = python.ShareRuntime(runtimeName, exe, mode, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r = python.NewMeteredRuntime(r, metrics)
+
+	return &pythonRateLimit{
+		logger:          logger,
+		runtime:         r,
+		shutdownTimeout: 10 * time.Second,
+		interpreters:    make(map[int64]*interpreter),
+	}, nil
+}
+
+// start starts our runtime and runs our script in every interpreter to define
+// our function.
+func (r *pythonRateLimit) start(ctx context.Context) error {
+	err := r.runtime.Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = r.runtime.Map(ctx, func(ticket *python.InterpreterTicket) error {
+		code, err := python.Compile(r.script, "__rp_connect_python_rate_limit__.py")
+		if err != nil {
+			return err
+		}
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+
+		// Provide our rpcn helper module, which we also need for running
+		// async functions.
+		rpcn, err := python.LoadRpcnModule()
+		if err != nil {
+			return err
+		}
+		py.PyDict_SetItemString(globals, "rpcn", rpcn)
+		resolve := py.PyObject_GetAttrString(rpcn, "_resolve")
+		if resolve == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find _resolve function in rpcn module")
+		}
+		i := &interpreter{resolve: resolve}
+
+		// Send print() and friends to our logger.
+		if err = python.CaptureOutput(r.logger); err != nil {
+			return err
+		}
+
+		// Apply environment variables before running anything of the user's.
+		if err = python.SetEnvironment(r.environment); err != nil {
+			return err
+		}
+
+		// Make any local helper modules importable.
+		if err = python.ExtendSysPath(r.path); err != nil {
+			return err
+		}
+
+		// Fail fast, saying where we looked, if a dependency is missing.
+		if err = python.RequireModules(r.requires); err != nil {
+			return err
+		}
+
+		// Pay for slow imports now rather than on the first access.
+		if err = python.PreloadModules(r.preload); err != nil {
+			return err
+		}
+
+		// Execute the script to define our function.
+		result := py.PyEval_EvalCode(code, globals, py.NullPyObjectPtr)
+		if result == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to evaluate rate limit script")
+		}
+		py.Py_DecRef(result)
+
+		access := py.PyDict_GetItemString(globals, r.accessFn)
+		if access == py.NullPyObjectPtr {
+			return fmt.Errorf("failed to find python function '%s'", r.accessFn)
+		}
+		if py.BaseType(access) != py.Function {
+			return fmt.Errorf("python object '%s' is not a function", r.accessFn)
+		}
+		i.access = access
+
+		r.interpreters[ticket.Id()] = i
+		return nil
+	})
+	if err != nil {
+		// Try cleaning up if we had an issue.
+		_ = r.runtime.Stop(ctx)
+		return err
+	}
+	return nil
+}
+
+func (r *pythonRateLimit) Access(ctx context.Context) (time.Duration, error) {
+	ticket, err := r.runtime.Acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = r.runtime.Release(ticket) }()
+
+	i, ok := r.interpreters[ticket.Id()]
+	if !ok {
+		return 0, errors.New("python rate limit is closed")
+	}
+
+	var wait time.Duration
+	err = r.runtime.Apply(ticket, ctx, func() error {
+		result := py.PyObject_CallNoArgs(i.access)
+		if result != py.NullPyObjectPtr {
+			defer py.Py_DecRef(result)
+			result = py.PyObject_CallOneArg(i.resolve, result)
+		}
+		if result == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return fmt.Errorf("python function '%s' failed", r.accessFn)
+		}
+		defer py.Py_DecRef(result)
+
+		var seconds float64
+		switch t := py.BaseType(result); t {
+		case py.None:
+		case py.Long:
+			seconds = float64(py.PyLong_AsLong(result))
+		case py.Float:
+			seconds = py.PyFloat_AsDouble(result)
+		default:
+			return fmt.Errorf("python function '%s' returned %s instead of a number of seconds", r.accessFn, t)
+		}
+		if seconds > 0 {
+			wait = time.Duration(seconds * float64(time.Second))
+		}
+		return nil
+	})
+	return wait, err
+}
+
+func (r *pythonRateLimit) Close(ctx context.Context) error {
+	return python.StopWithDeadline(ctx, r.runtime, r.shutdownTimeout, r.logger)
+}
@@ -0,0 +1,41 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+	"golang.org/x/net/context"
+)
+
+func TestAccessWaitsAsToldByPython(t *testing.T) {
+	r, err := newPythonRateLimit("python3", python.Isolated, "", 1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.script = `
+tokens = 2
+def access():
+    global tokens
+    if tokens > 0:
+        tokens -= 1
+        return None
+    return 1.5
+`
+	r.accessFn = "access"
+	ctx := context.Background()
+	if err = r.start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Close(ctx) }()
+
+	for _, expected := range []time.Duration{0, 0, 1500 * time.Millisecond} {
+		wait, err := r.Access(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait != expected {
+			t.Fatalf("expected to wait %s, got %s", expected, wait)
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/ebitengine/purego"
+	"github.com/redpanda-data/benthos/v4/public/service"
+	py "github.com/voutilad/gogopython"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+)
+
+var configSpec = service.NewConfigSpec().
+	Summary("Split a stream of bytes into messages with Python.").
+	Description("Hands the stream read by an input like `file`, `aws_s3`, or `sftp` to a Python function, defined by the script, as a buffered binary file object, and turns each item it yields into a message. Enables custom binary framing, stitching multi-line log records, and other formats the built-in scanners don't support.").
+	Field(service.NewStringField("script").
+		Description("Python code defining the scan function.")).
+	Fields(python.RuntimeFields()...).
+	Field(service.NewStringField("function").
+		Description("Name of the Python function, defined by the script, called with each stream and returning an iterable of records, typically by being a generator. Each record becomes a message: `bytes` and `str` as is and anything else as JSON, while `None` is skipped.").
+		Default("scan")).
+	Field(service.NewStringEnumField("json_library", python.JSONLibraryAuto, python.JSONLibraryJSON, python.JSONLibraryOrjson, python.JSONLibraryUjson).
+		Description("Library encoding records as JSON. `orjson` is several times faster than the standard `json` module and also handles datetimes and numpy arrays, while `auto` uses `orjson` or `ujson` if installed, falling back to `json`.").
+		Advanced().
+		Default(python.JSONLibraryJSON)).
+	LintRule(`root = python_syntax_error("script", this.script | "", this.exe | "python3")`)
+
+// Go readers being scanned, identified to Python by an id.
+var (
+	readersMtx sync.Mutex
+	readers    = map[int64]*reader{}
+	nextReader int64
+)
+
+// Python function reading from a Go reader, shared by all scanners as purego
+// can only create a limited number of callbacks.
+var (
+	readDefOnce sync.Once
+	readDef     py.PyMethodDef
+	readName    = []byte("__read\x00")
+)
+
+// reader is a Go reader being scanned, remembering the first error reading
+// from it so it can be reported to the input.
+type reader struct {
+	r   io.Reader
+	err error
+}
+
+// addReader registers r, returning its id.
+func addReader(r io.Reader) int64 {
+	readersMtx.Lock()
+	defer readersMtx.Unlock()
+
+	id := nextReader
+	nextReader++
+	readers[id] = &reader{r: r}
+	return id
+}
+
+// removeReader forgets the reader with id, returning the first error reading
+// from it, if any.
+func removeReader(id int64) error {
+	readersMtx.Lock()
+	defer readersMtx.Unlock()
+
+	rd, ok := readers[id]
+	if !ok {
+		return nil
+	}
+	delete(readers, id)
+	return rd.err
+}
+
+// readCallback is called from Python to read from a Go reader. It has a
+// Python function definition like:
+//
+// def __read(reader: int, size: int) -> Optional[bytes]
+//
+// returning up to size bytes, empty bytes at the end of the stream, or None
+// if reading failed.
+func readCallback(_, tuple py.PyObjectPtr) py.PyObjectPtr {
+	if py.BaseType(tuple) != py.Tuple {
+		panic("argument should be a Python tuple")
+	}
+
+	id := py.PyLong_AsLong(py.PyTuple_GetItem(tuple, 0))
+	size := py.PyLong_AsLong(py.PyTuple_GetItem(tuple, 1))
+
+	readersMtx.Lock()
+	rd, ok := readers[id]
+	readersMtx.Unlock()
+	if !ok {
+		return python.NewNone()
+	}
+
+	buf := make([]byte, max(size, 0))
+	n, err := io.ReadAtLeast(rd.r, buf, min(len(buf), 1))
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		readersMtx.Lock()
+		rd.err = err
+		readersMtx.Unlock()
+		return python.NewNone()
+	}
+	return py.PyBytes_FromStringAndSize(unsafe.SliceData(buf), int64(n))
+}
+
+type pythonScannerCreator struct {
+	logger          *service.Logger
+	runtime         python.Runtime
+	script          string
+	path            []string
+	environment     map[string]string
+	preload         []string
+	requires        []string
+	functionName    string
+	shutdownTimeout time.Duration
+	jsonLibrary     string
+
+	// Python state, only used with our single interpreter's ticket.
+	function   py.PyObjectPtr
+	scan       py.PyObjectPtr
+	read       py.PyObjectPtr
+	serializer *python.Serializer
+}
+
+func init() {
+	err := service.RegisterBatchScannerCreator("python", configSpec,
+		func(conf *service.ParsedConfig, mgr *service.Resources) (service.BatchScannerCreator, error) {
+			// Extract our configuration.
+			runtimeConf, err := python.ParseRuntimeConfig(conf, mgr.Logger())
+			if err != nil {
+				return nil, err
+			}
+			script, err := conf.FieldString("script")
+			if err != nil {
+				return nil, err
+			}
+			if err = python.AuditScript(mgr.Logger(), "script", script, runtimeConf.ScriptChecksums); err != nil {
+				return nil, err
+			}
+
+			c, err := newPythonScannerCreator(runtimeConf.Exe, runtimeConf.Mode, mgr.Metrics(), mgr.Logger())
+			if err != nil {
+				return nil, err
+			}
+			c.script = script
+			c.path = runtimeConf.Path
+			c.environment = runtimeConf.Environment
+			c.preload = runtimeConf.Preload
+			c.requires = runtimeConf.Requires
+			c.shutdownTimeout = runtimeConf.ShutdownTimeout
+			if c.functionName, err = conf.FieldString("function"); err != nil {
+				return nil, err
+			}
+			if c.jsonLibrary, err = conf.FieldString("json_library"); err != nil {
+				return nil, err
+			}
+
+			if err = c.start(context.Background()); err != nil {
+				return nil, err
+			}
+			return c, nil
+		})
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+// newPythonScannerCreator creates a python scanner creator. It uses a single
+// interpreter of its own, shared by the scanners it creates.
+func newPythonScannerCreator(exe string, mode python.Mode, metrics *service.Metrics, logger *service.Logger) (*pythonScannerCreator, error) {
+	var err error
+	var r python.Runtime
+
+	switch mode {
+	case python.IsolatedLegacy:
+		r, err = python.NewMultiInterpreterRuntime(exe, 1, true, logger)
+	case python.Global:
+		r, err = python.NewSingleInterpreterRuntime(exe, 1, logger)
+	case python.Isolated:
+		r, err = python.NewMultiInterpreterRuntime(exe, 1, false, logger)
+	case python.FreeThreaded:
+		r, err = python.NewFreeThreadedRuntime(exe, 1, logger)
+	default:
+		return nil, errors.New("invalid mode")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &pythonScannerCreator{
+		logger:          logger,
+		runtime:         python.NewMeteredRuntime(r, metrics),
+		shutdownTimeout: 10 * time.Second,
+	}, nil
+}
+
+// start starts our runtime and runs our script to find our scan function.
+func (c *pythonScannerCreator) start(ctx context.Context) error {
+	err := c.runtime.Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = c.runtime.Map(ctx, func(ticket *python.InterpreterTicket) error {
+		code, err := python.Compile(c.script, "__rp_connect_python_scanner__.py")
+		if err != nil {
+			return err
+		}
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+
+		// Provide our rpcn helper module, which also wraps Go readers as
+		// Python streams.
+		rpcn, err := python.LoadRpcnModule()
+		if err != nil {
+			return err
+		}
+		py.PyDict_SetItemString(globals, "rpcn", rpcn)
+		c.scan = py.PyObject_GetAttrString(rpcn, "_scan")
+		if c.scan == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find _scan function in rpcn module")
+		}
+
+		readDefOnce.Do(func() {
+			readDef = py.PyMethodDef{
+				Name:   unsafe.SliceData(readName),
+				Flags:  py.MethodVarArgs,
+				Method: purego.NewCallback(readCallback),
+			}
+		})
+		c.read = py.PyCFunction_NewEx(&readDef, py.NullPyObjectPtr, py.NullPyObjectPtr)
+		if c.read == py.NullPyObjectPtr {
+			return errors.New("failed to create python function")
+		}
+
+		// Send print() and friends to our logger.
+		if err = python.CaptureOutput(c.logger); err != nil {
+			return err
+		}
+
+		// Apply environment variables before running anything of the user's.
+		if err = python.SetEnvironment(c.environment); err != nil {
+			return err
+		}
+
+		// Make any local helper modules importable.
+		if err = python.ExtendSysPath(c.path); err != nil {
+			return err
+		}
+
+		// Fail fast, saying where we looked, if a dependency is missing.
+		if err = python.RequireModules(c.requires); err != nil {
+			return err
+		}
+
+		// Pay for slow imports now rather than on the first stream.
+		if err = python.PreloadModules(c.preload); err != nil {
+			return err
+		}
+
+		// Execute the script to define our scan function.
+		result := py.PyEval_EvalCode(code, globals, py.NullPyObjectPtr)
+		if result == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to evaluate scanner script")
+		}
+		py.Py_DecRef(result)
+
+		c.function = py.PyDict_GetItemString(globals, c.functionName)
+		if c.function == py.NullPyObjectPtr {
+			return fmt.Errorf("failed to find python function '%s'", c.functionName)
+		}
+
+		c.serializer, err = python.NewSerializer()
+		if err != nil || c.jsonLibrary == "" {
+			return err
+		}
+		library, err := c.serializer.SetJSONLibrary(c.jsonLibrary)
+		if err != nil {
+			return err
+		}
+		c.logger.Debugf("Encoding JSON with %s.", library)
+		return nil
+	})
+	if err != nil {
+		// Try cleaning up if we had an issue.
+		_ = c.runtime.Stop(ctx)
+	}
+	return err
+}
+
+// apply calls f with our interpreter's state managed.
+func (c *pythonScannerCreator) apply(ctx context.Context, f func() error) error {
+	ticket, err := c.runtime.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.runtime.Release(ticket) }()
+	return c.runtime.Apply(ticket, ctx, f)
+}
+
+func (c *pythonScannerCreator) Create(rdr io.ReadCloser, aFn service.AckFunc, _ *service.ScannerSourceDetails) (service.BatchScanner, error) {
+	s := &pythonScanner{
+		creator: c,
+		rdr:     rdr,
+		id:      addReader(rdr),
+	}
+
+	err := c.apply(context.Background(), func() error {
+		args := py.PyTuple_New(3)
+		if args == py.NullPyObjectPtr {
+			return errors.New("failed to create python tuple")
+		}
+		defer py.Py_DecRef(args)
+		// Tuples steal our references.
+		py.Py_IncRef(c.function)
+		py.PyTuple_SetItem(args, 0, c.function)
+		py.Py_IncRef(c.read)
+		py.PyTuple_SetItem(args, 1, c.read)
+		py.PyTuple_SetItem(args, 2, py.PyLong_FromLong(s.id))
+
+		s.iter = py.PyObject_Call(c.scan, args, py.NullPyObjectPtr)
+		if s.iter == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return fmt.Errorf("python function '%s' failed", c.functionName)
+		}
+		return nil
+	})
+	if err != nil {
+		_ = removeReader(s.id)
+		_ = rdr.Close()
+		return nil, err
+	}
+	return service.AutoAggregateBatchScannerAcks(s, aFn), nil
+}
+
+func (c *pythonScannerCreator) Close(ctx context.Context) error {
+	return python.StopWithDeadline(ctx, c.runtime, c.shutdownTimeout, c.logger)
+}
+
+// pythonScanner yields a message per record from a Python iterator over a
+// stream.
+type pythonScanner struct {
+	creator *pythonScannerCreator
+	rdr     io.ReadCloser
+	id      int64
+	iter    py.PyObjectPtr
+}
+
+func (s *pythonScanner) NextBatch(ctx context.Context) (service.MessageBatch, error) {
+	var m *service.Message
+	err := s.creator.apply(ctx, func() error {
+		for m == nil {
+			next := py.PyIter_Next(s.iter)
+			if next == py.NullPyObjectPtr {
+				if python.ErrOccurred() {
+					py.PyErr_Print()
+					return fmt.Errorf("python function '%s' failed", s.creator.functionName)
+				}
+				return io.EOF
+			}
+
+			var err error
+			m, err = s.toMessage(next)
+			py.Py_DecRef(next)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		// Prefer the underlying error if reading is what failed.
+		readersMtx.Lock()
+		if rd := readers[s.id]; rd != nil && rd.err != nil {
+			err = rd.err
+		}
+		readersMtx.Unlock()
+		return nil, err
+	}
+	return service.MessageBatch{m}, nil
+}
+
+// toMessage converts a record into a message, or nil if it's None.
+//
+// The caller must manage the interpreter state for this to succeed.
+func (s *pythonScanner) toMessage(obj py.PyObjectPtr) (*service.Message, error) {
+	switch py.BaseType(obj) {
+	case py.None:
+		return nil, nil
+	case py.Bytes:
+		// Copy out of memory managed by Python.
+		data := make([]byte, py.PyBytes_Size(obj))
+		copy(data, unsafe.Slice(py.PyBytes_AsString(obj), len(data)))
+		return service.NewMessage(data), nil
+	case py.String:
+		data, err := python.UnicodeToBytes(obj)
+		if err != nil {
+			return nil, err
+		}
+		return service.NewMessage(data), nil
+	default:
+		data, err := s.creator.serializer.JsonBytes(obj)
+		if err != nil {
+			return nil, err
+		}
+		return service.NewMessage(data), nil
+	}
+}
+
+func (s *pythonScanner) Close(ctx context.Context) error {
+	// Drop our iterator, letting Python clean up a generator.
+	_ = s.creator.apply(ctx, func() error {
+		py.Py_DecRef(s.iter)
+		return nil
+	})
+	readErr := removeReader(s.id)
+	return errors.Join(s.rdr.Close(), readErr)
+}
@@ -0,0 +1,77 @@
+package scanner
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+	"golang.org/x/net/context"
+)
+
+func TestScanStitchesRecords(t *testing.T) {
+	c, err := newPythonScannerCreator("python3", python.Global, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.script = `
+def scan(stream):
+    record = []
+    for line in stream:
+        if not line.startswith(b" ") and record:
+            yield b"".join(record).rstrip()
+            record = []
+        record.append(line)
+    if record:
+        yield b"".join(record).rstrip()
+`
+	c.functionName = "scan"
+	ctx := context.Background()
+	if err = c.start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close(ctx) }()
+
+	acked := make(chan error, 1)
+	rdr := io.NopCloser(strings.NewReader("first\n  more\nsecond\nthird\n  more\n"))
+	s, err := c.Create(rdr, func(ctx context.Context, err error) error {
+		acked <- err
+		return nil
+	}, service.NewScannerSourceDetails())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"first\n  more", "second", "third\n  more"}
+	for _, want := range expected {
+		batch, ack, err := s.NextBatch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(batch) != 1 {
+			t.Fatalf("expected 1 message, got %d", len(batch))
+		}
+		got, err := batch[0].AsBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+		if err = ack(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err = s.NextBatch(ctx); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	if err = s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-acked; err != nil {
+		t.Fatalf("expected source to be acknowledged, got %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+module github.com/voutilad/gogopython
+
+go 1.22.5
+
+require (
+	github.com/ebitengine/purego v0.8.0-alpha.4
+	github.com/jupiterrider/ffi v0.1.0-beta.10
+)
+
+require golang.org/x/sys v0.24.0
@@ -0,0 +1,540 @@
+package tracer
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+	py "github.com/voutilad/gogopython"
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/embedded"
+)
+
+var configSpec = service.NewConfigSpec().
+	Summary("Export traces with Python.").
+	Description("Records spans and periodically hands those that ended to a Python function, defined by the script, so they can be sent to tracing backends that only have a Python SDK. Each call receives a list of `dict`s, one per span, with the keys `name`, `scope`, `kind`, `trace_id`, `span_id`, `parent_span_id`, `start_time` and `end_time` in nanoseconds since the Unix epoch, `attributes`, `events`, `links`, and `status`.").
+	Field(service.NewStringField("script").
+		Description("Python code defining the export function.")).
+	Fields(python.RuntimeFields()...).
+	Field(service.NewStringField("function").
+		Description("Name of the Python function, defined by the script, called with each list of spans. May be `async def`.").
+		Default("export")).
+	Field(service.NewDurationField("flush_interval").
+		Description("How often to call the function with the spans that ended since the last call. Spans are flushed once more when shutting down.").
+		Default("5s")).
+	Field(service.NewIntField("max_queue_size").
+		Description("Most spans to hold on to between calls. Spans ending while the queue is full are dropped, with a warning written to stderr.").
+		Advanced().
+		Default(2048)).
+	LintRule(`root = python_syntax_error("script", this.script | "", this.exe | "python3")`)
+
+type pythonTracer struct {
+	embedded.TracerProvider
+
+	runtime         python.Runtime
+	script          string
+	path            []string
+	environment     map[string]string
+	preload         []string
+	requires        []string
+	functionName    string
+	flushInterval   time.Duration
+	maxQueueSize    int
+	shutdownTimeout time.Duration
+
+	// Python state, only used with our single interpreter's ticket.
+	function py.PyObjectPtr
+	export   py.PyObjectPtr
+
+	mtx     sync.Mutex
+	queue   []map[string]any // Ended spans awaiting a flush.
+	dropped int              // Spans dropped since the last flush.
+
+	stop         chan struct{}
+	done         chan struct{}
+	shutdownOnce sync.Once
+}
+
+func init() {
+	err := service.RegisterOtelTracerProvider("python", configSpec,
+		func(conf *service.ParsedConfig) (trace.TracerProvider, error) {
+			// Extract our configuration.
+			runtimeConf, err := python.ParseRuntimeConfig(conf, nil)
+			if err != nil {
+				return nil, err
+			}
+			script, err := conf.FieldString("script")
+			if err != nil {
+				return nil, err
+			}
+			if err = python.AuditScript(nil, "script", script, runtimeConf.ScriptChecksums); err != nil {
+				return nil, err
+			}
+
+			t, err := newPythonTracer(runtimeConf.Exe, runtimeConf.Mode)
+			if err != nil {
+				return nil, err
+			}
+			t.script = script
+			t.path = runtimeConf.Path
+			t.environment = runtimeConf.Environment
+			t.preload = runtimeConf.Preload
+			t.requires = runtimeConf.Requires
+			t.shutdownTimeout = runtimeConf.ShutdownTimeout
+			if t.functionName, err = conf.FieldString("function"); err != nil {
+				return nil, err
+			}
+			if t.flushInterval, err = conf.FieldDuration("flush_interval"); err != nil {
+				return nil, err
+			}
+			if t.flushInterval <= 0 {
+				return nil, errors.New("flush_interval must be positive")
+			}
+			if t.maxQueueSize, err = conf.FieldInt("max_queue_size"); err != nil {
+				return nil, err
+			}
+			if t.maxQueueSize <= 0 {
+				return nil, errors.New("max_queue_size must be positive")
+			}
+
+			if err = t.start(context.Background()); err != nil {
+				return nil, err
+			}
+			return t, nil
+		})
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+// newPythonTracer creates a python tracer provider. It uses a single
+// interpreter of its own. Tracer providers aren't given a logger, so neither
+// is the runtime.
+func newPythonTracer(exe string, mode python.Mode) (*pythonTracer, error) {
+	var err error
+	var r python.Runtime
+
+	switch mode {
+	case python.IsolatedLegacy:
+		r, err = python.NewMultiInterpreterRuntime(exe, 1, true, nil)
+	case python.Global:
+		r, err = python.NewSingleInterpreterRuntime(exe, 1, nil)
+	case python.Isolated:
+		r, err = python.NewMultiInterpreterRuntime(exe, 1, false, nil)
+	case python.FreeThreaded:
+		r, err = python.NewFreeThreadedRuntime(exe, 1, nil)
+	default:
+		return nil, errors.New("invalid mode")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &pythonTracer{
+		runtime:         r,
+		flushInterval:   5 * time.Second,
+		maxQueueSize:    2048,
+		shutdownTimeout: 10 * time.Second,
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}, nil
+}
+
+// start starts our runtime, runs our script to find our export function, and
+// starts flushing periodically.
+func (t *pythonTracer) start(ctx context.Context) error {
+	err := t.runtime.Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = t.runtime.Map(ctx, func(ticket *python.InterpreterTicket) error {
+		code, err := python.Compile(t.script, "__rp_connect_python_tracer__.py")
+		if err != nil {
+			return err
+		}
+		globals, err := ticket.Globals()
+		if err != nil {
+			return err
+		}
+
+		// Provide our rpcn helper module, which we also need for decoding
+		// spans and running async functions.
+		rpcn, err := python.LoadRpcnModule()
+		if err != nil {
+			return err
+		}
+		py.PyDict_SetItemString(globals, "rpcn", rpcn)
+		t.export = py.PyObject_GetAttrString(rpcn, "_export_spans")
+		if t.export == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to find _export_spans function in rpcn module")
+		}
+
+		// Apply environment variables before running anything of the user's.
+		if err = python.SetEnvironment(t.environment); err != nil {
+			return err
+		}
+
+		// Make any local helper modules importable.
+		if err = python.ExtendSysPath(t.path); err != nil {
+			return err
+		}
+
+		// Fail fast, saying where we looked, if a dependency is missing.
+		if err = python.RequireModules(t.requires); err != nil {
+			return err
+		}
+
+		// Pay for slow imports now rather than on the first flush.
+		if err = python.PreloadModules(t.preload); err != nil {
+			return err
+		}
+
+		// Execute the script to define our export function.
+		result := py.PyEval_EvalCode(code, globals, py.NullPyObjectPtr)
+		if result == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return errors.New("failed to evaluate tracer script")
+		}
+		py.Py_DecRef(result)
+
+		t.function = py.PyDict_GetItemString(globals, t.functionName)
+		if t.function == py.NullPyObjectPtr {
+			return fmt.Errorf("failed to find python function '%s'", t.functionName)
+		}
+		return nil
+	})
+	if err != nil {
+		// Try cleaning up if we had an issue.
+		_ = t.runtime.Stop(ctx)
+		return err
+	}
+
+	go t.flushPeriodically()
+	return nil
+}
+
+// flushPeriodically flushes every flushInterval until we're shut down.
+func (t *pythonTracer) flushPeriodically() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = t.flush(context.Background())
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// flush hands the spans that ended since the last flush to our function.
+func (t *pythonTracer) flush(ctx context.Context) error {
+	t.mtx.Lock()
+	spans := t.queue
+	t.queue = nil
+	dropped := t.dropped
+	t.dropped = 0
+	t.mtx.Unlock()
+	if len(spans) == 0 && dropped == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(spans)
+	if err != nil {
+		return err
+	}
+
+	ticket, err := t.runtime.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = t.runtime.Release(ticket) }()
+
+	return t.runtime.Apply(ticket, ctx, func() error {
+		arg := py.PyUnicode_FromString(string(data))
+		if arg == py.NullPyObjectPtr {
+			return errors.New("failed to create python string")
+		}
+
+		args := py.PyTuple_New(3)
+		if args == py.NullPyObjectPtr {
+			py.Py_DecRef(arg)
+			return errors.New("failed to create python tuple")
+		}
+		defer py.Py_DecRef(args)
+		// Tuples steal our references.
+		py.Py_IncRef(t.function)
+		py.PyTuple_SetItem(args, 0, t.function)
+		py.PyTuple_SetItem(args, 1, arg)
+		py.PyTuple_SetItem(args, 2, py.PyLong_FromLong(int64(dropped)))
+
+		result := py.PyObject_Call(t.export, args, py.NullPyObjectPtr)
+		if result == py.NullPyObjectPtr {
+			py.PyErr_Print()
+			return fmt.Errorf("python function '%s' failed", t.functionName)
+		}
+		py.Py_DecRef(result)
+		return nil
+	})
+}
+
+// enqueue queues an ended span for the next flush, unless the queue is full.
+func (t *pythonTracer) enqueue(span map[string]any) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if len(t.queue) >= t.maxQueueSize {
+		t.dropped++
+		return
+	}
+	t.queue = append(t.queue, span)
+}
+
+func (t *pythonTracer) Tracer(name string, _ ...trace.TracerOption) trace.Tracer {
+	return &tracer{provider: t, name: name}
+}
+
+// Shutdown flushes any remaining spans and stops our runtime. Called by
+// Redpanda Connect when it exits.
+func (t *pythonTracer) Shutdown(ctx context.Context) error {
+	var err error
+	t.shutdownOnce.Do(func() {
+		close(t.stop)
+		<-t.done
+
+		// Don't lose spans that ended since the last flush.
+		_ = t.flush(ctx)
+
+		err = python.StopWithDeadline(ctx, t.runtime, t.shutdownTimeout, nil)
+	})
+	return err
+}
+
+// tracer creates spans recorded by its provider.
+type tracer struct {
+	embedded.Tracer
+
+	provider *pythonTracer
+	name     string
+}
+
+func (t *tracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	config := trace.NewSpanStartConfig(opts...)
+
+	s := &span{
+		tracer:    t,
+		name:      name,
+		kind:      config.SpanKind(),
+		start:     config.Timestamp(),
+		links:     config.Links(),
+		recording: true,
+	}
+	if s.start.IsZero() {
+		s.start = time.Now()
+	}
+	s.attributes = append(s.attributes, config.Attributes()...)
+
+	var traceId trace.TraceID
+	var state trace.TraceState
+	if parent := trace.SpanContextFromContext(ctx); parent.IsValid() && !config.NewRoot() {
+		traceId = parent.TraceID()
+		state = parent.TraceState()
+		s.parent = parent.SpanID()
+	} else {
+		binary.BigEndian.PutUint64(traceId[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(traceId[8:], rand.Uint64())
+	}
+	var spanId trace.SpanID
+	binary.BigEndian.PutUint64(spanId[:], rand.Uint64())
+
+	s.context = trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceId,
+		SpanID:     spanId,
+		TraceFlags: trace.FlagsSampled,
+		TraceState: state,
+	})
+	return trace.ContextWithSpan(ctx, s), s
+}
+
+// event is something that happened during a span.
+type event struct {
+	name       string
+	time       time.Time
+	attributes []attribute.KeyValue
+}
+
+// span records its details until it ends, when they're queued for export.
+type span struct {
+	embedded.Span
+
+	tracer  *tracer
+	context trace.SpanContext
+	parent  trace.SpanID
+	kind    trace.SpanKind
+	start   time.Time
+
+	mtx         sync.Mutex
+	name        string
+	attributes  []attribute.KeyValue
+	events      []event
+	links       []trace.Link
+	status      codes.Code
+	description string
+	recording   bool // Whether the span hasn't ended yet.
+}
+
+func (s *span) End(options ...trace.SpanEndOption) {
+	config := trace.NewSpanEndConfig(options...)
+	end := config.Timestamp()
+	if end.IsZero() {
+		end = time.Now()
+	}
+
+	s.mtx.Lock()
+	if !s.recording {
+		s.mtx.Unlock()
+		return
+	}
+	s.recording = false
+
+	var parent any
+	if s.parent.IsValid() {
+		parent = s.parent.String()
+	}
+	events := make([]map[string]any, 0, len(s.events))
+	for _, e := range s.events {
+		events = append(events, map[string]any{
+			"name":       e.name,
+			"time":       e.time.UnixNano(),
+			"attributes": attributes(e.attributes),
+		})
+	}
+	links := make([]map[string]any, 0, len(s.links))
+	for _, l := range s.links {
+		links = append(links, map[string]any{
+			"trace_id":   l.SpanContext.TraceID().String(),
+			"span_id":    l.SpanContext.SpanID().String(),
+			"attributes": attributes(l.Attributes),
+		})
+	}
+	exported := map[string]any{
+		"name":           s.name,
+		"scope":          s.tracer.name,
+		"kind":           s.kind.String(),
+		"trace_id":       s.context.TraceID().String(),
+		"span_id":        s.context.SpanID().String(),
+		"parent_span_id": parent,
+		"start_time":     s.start.UnixNano(),
+		"end_time":       end.UnixNano(),
+		"attributes":     attributes(s.attributes),
+		"events":         events,
+		"links":          links,
+		"status":         map[string]any{"code": s.status.String(), "description": s.description},
+	}
+	s.mtx.Unlock()
+
+	s.tracer.provider.enqueue(exported)
+}
+
+func (s *span) AddEvent(name string, options ...trace.EventOption) {
+	config := trace.NewEventConfig(options...)
+	e := event{name: name, time: config.Timestamp(), attributes: config.Attributes()}
+	if e.time.IsZero() {
+		e.time = time.Now()
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.recording {
+		s.events = append(s.events, e)
+	}
+}
+
+func (s *span) AddLink(link trace.Link) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.recording {
+		s.links = append(s.links, link)
+	}
+}
+
+func (s *span) IsRecording() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.recording
+}
+
+func (s *span) RecordError(err error, options ...trace.EventOption) {
+	if err == nil {
+		return
+	}
+	options = append(options, trace.WithAttributes(
+		attribute.String("exception.type", fmt.Sprintf("%T", err)),
+		attribute.String("exception.message", err.Error()),
+	))
+	s.AddEvent("exception", options...)
+}
+
+func (s *span) SpanContext() trace.SpanContext {
+	return s.context
+}
+
+func (s *span) SetStatus(code codes.Code, description string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// Like OpenTelemetry's SDK, Ok is final and descriptions are only for
+	// errors.
+	if !s.recording || s.status == codes.Ok || code < s.status {
+		return
+	}
+	s.status = code
+	s.description = ""
+	if code == codes.Error {
+		s.description = description
+	}
+}
+
+func (s *span) SetName(name string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.recording {
+		s.name = name
+	}
+}
+
+func (s *span) SetAttributes(kv ...attribute.KeyValue) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.recording {
+		s.attributes = append(s.attributes, kv...)
+	}
+}
+
+func (s *span) TracerProvider() trace.TracerProvider {
+	return s.tracer.provider
+}
+
+// attributes converts kvs into a map, with later values of a key replacing
+// earlier ones.
+func attributes(kvs []attribute.KeyValue) map[string]any {
+	m := make(map[string]any, len(kvs))
+	for _, kv := range kvs {
+		m[string(kv.Key)] = kv.Value.AsInterface()
+	}
+	return m
+}
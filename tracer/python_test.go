@@ -0,0 +1,83 @@
+package tracer
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/voutilad/rp-connect-python/internal/impl/python"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+func TestExportsSpansOnShutdown(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "spans.json")
+
+	p, err := newPythonTracer("python3", python.Global)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.environment = map[string]string{"SPANS_OUT": out}
+	p.script = `
+import json, os
+
+def export(spans):
+    with open(os.environ["SPANS_OUT"], "w") as f:
+        json.dump(spans, f)
+`
+	p.functionName = "export"
+	ctx := context.Background()
+	if err = p.start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tracer := p.Tracer("test")
+	ctx, parent := tracer.Start(ctx, "parent", trace.WithAttributes(attribute.Int("size", 3)))
+	_, child := tracer.Start(ctx, "child")
+	child.RecordError(errors.New("boom"))
+	child.SetStatus(codes.Error, "failed")
+	child.End()
+	parent.End()
+
+	if err = p.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spans []map[string]any
+	if err = json.Unmarshal(data, &spans); err != nil {
+		t.Fatal(err)
+	}
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+
+	c, pa := spans[0], spans[1]
+	if c["name"] != "child" || pa["name"] != "parent" {
+		t.Fatalf("expected child then parent, got %v and %v", c["name"], pa["name"])
+	}
+	if c["trace_id"] != pa["trace_id"] || c["parent_span_id"] != pa["span_id"] {
+		t.Fatalf("expected child of parent, got %v", c)
+	}
+	if pa["parent_span_id"] != nil {
+		t.Fatalf("expected root span, got parent %v", pa["parent_span_id"])
+	}
+	if size := pa["attributes"].(map[string]any)["size"]; size != 3.0 {
+		t.Fatalf("expected size attribute of 3, got %v", size)
+	}
+	status := c["status"].(map[string]any)
+	if status["code"] != "Error" || status["description"] != "failed" {
+		t.Fatalf("expected error status, got %v", status)
+	}
+	events := c["events"].([]any)
+	if len(events) != 1 || events[0].(map[string]any)["name"] != "exception" {
+		t.Fatalf("expected exception event, got %v", events)
+	}
+}